@@ -0,0 +1,299 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client 通过unix socket访问daemon的http客户端
+type Client struct {
+	httpClient *http.Client
+}
+
+// Error daemon返回的错误
+type Error struct {
+	StatusCode int
+	Message    string
+	// Kind daemon返回的错误类型
+	Kind string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("daemon error(%d): %s", e.StatusCode, e.Message)
+}
+
+// Is 按照错误类型还原为本地的错误，调用方可以与本地执行一样通过errors.Is(err, container.ErrNoSuchContainer)判断
+func (e *Error) Is(target error) bool {
+	switch e.Kind {
+	case ErrorKind_NoSuchContainer:
+		return target == container.ErrNoSuchContainer
+	case ErrorKind_NoSuchSecret:
+		return target == container.ErrNoSuchSecret
+	}
+	return false
+}
+
+// decodeError 解析daemon返回的错误响应，响应不是ErrorResponse时以响应内容作为错误信息
+func decodeError(statusCode int, content []byte) *Error {
+	errResponse := &ErrorResponse{}
+	if sonic.Unmarshal(content, errResponse) != nil || errResponse.Message == "" {
+		errResponse.Message = strings.TrimSpace(string(content))
+	}
+	return &Error{StatusCode: statusCode, Message: errResponse.Message, Kind: errResponse.Kind}
+}
+
+// NewClient host格式为 unix:///path/to/ghndocker.sock 或者socket路径
+func NewClient(host string) (*Client, error) {
+	socketPath, err := ParseHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}, nil
+}
+
+// ParseHost 解析--host，返回unix socket路径
+func ParseHost(host string) (string, error) {
+	if host == "" {
+		return DefaultSocketPath, nil
+	}
+	if strings.HasPrefix(host, "unix://") {
+		host = strings.TrimPrefix(host, "unix://")
+	} else if strings.Contains(host, "://") {
+		return "", fmt.Errorf("invalid host:%s, only unix socket is supported", host)
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid host, missing socket path")
+	}
+	return host, nil
+}
+
+func (client *Client) Ping() error {
+	return client.do(http.MethodGet, "/_ping", nil, nil, nil)
+}
+
+func (client *Client) ContainerCreate(config *ContainerConfig) (string, error) {
+	response := &CreateResponse{}
+	if err := client.do(http.MethodPost, "/containers/create", nil, config, response); err != nil {
+		return "", err
+	}
+	return response.Id, nil
+}
+
+func (client *Client) ContainerStart(containerRef string) error {
+	return client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/start", nil, nil, nil)
+}
+
+func (client *Client) ContainerStop(containerRef string) error {
+	return client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/stop", nil, nil, nil)
+}
+
+func (client *Client) ContainerPause(containerRef string) error {
+	return client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/pause", nil, nil, nil)
+}
+
+func (client *Client) ContainerUnpause(containerRef string) error {
+	return client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/unpause", nil, nil, nil)
+}
+
+func (client *Client) ContainerRemove(containerRef string, force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+	return client.do(http.MethodDelete, "/containers/"+url.PathEscape(containerRef), query, nil, nil)
+}
+
+func (client *Client) ContainerList(options *container.ListOptions) ([]*container.ContainerInfo, error) {
+	query := url.Values{}
+	if options.All {
+		query.Set("all", "1")
+	}
+	if len(options.Filters) > 0 {
+		filters, err := sonic.MarshalString(options.Filters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", filters)
+	}
+
+	containers := make([]*container.ContainerInfo, 0)
+	if err := client.do(http.MethodGet, "/containers/json", query, nil, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func (client *Client) ContainerInspect(containerRef string) (*container.ContainerInspect, error) {
+	inspect := &container.ContainerInspect{}
+	if err := client.do(http.MethodGet, "/containers/"+url.PathEscape(containerRef)+"/json", nil, nil, inspect); err != nil {
+		return nil, err
+	}
+	return inspect, nil
+}
+
+// ContainerLogs 将容器日志写入w
+func (client *Client) ContainerLogs(containerRef string, w io.Writer) error {
+	return client.do(http.MethodGet, "/containers/"+url.PathEscape(containerRef)+"/logs", nil, nil, w)
+}
+
+// ContainerExec 在容器内执行命令，返回退出码以及输出
+func (client *Client) ContainerExec(containerRef string, cmd []string) (*ExecResponse, error) {
+	response := &ExecResponse{}
+	if err := client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/exec", nil, &ExecRequest{Cmd: cmd}, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// ContainerTop 列出容器内的进程
+func (client *Client) ContainerTop(containerRef string) ([]*container.ProcessInfo, error) {
+	processes := make([]*container.ProcessInfo, 0)
+	if err := client.do(http.MethodGet, "/containers/"+url.PathEscape(containerRef)+"/top", nil, nil, &processes); err != nil {
+		return nil, err
+	}
+	return processes, nil
+}
+
+func (client *Client) ContainerRename(containerRef string, name string) error {
+	return client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/rename", url.Values{"name": {name}}, nil, nil)
+}
+
+// ContainerUpdate 在线修改容器的资源限制，update中为空的字段保持不变
+func (client *Client) ContainerUpdate(containerRef string, update *subsystem.SubSystemConfig) error {
+	return client.do(http.MethodPost, "/containers/"+url.PathEscape(containerRef)+"/update", nil, update, nil)
+}
+
+func (client *Client) NetworkList() ([]*NetworkSummary, error) {
+	networks := make([]*NetworkSummary, 0)
+	if err := client.do(http.MethodGet, "/networks", nil, nil, &networks); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+func (client *Client) NetworkCreate(request *NetworkCreateRequest) error {
+	return client.do(http.MethodPost, "/networks/create", nil, request, nil)
+}
+
+func (client *Client) NetworkRemove(name string) error {
+	return client.do(http.MethodDelete, "/networks/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// NetworkConnect 将容器接入网络，运行中的容器立即接入
+func (client *Client) NetworkConnect(name string, containerRef string, aliases []string) error {
+	return client.do(http.MethodPost, "/networks/"+url.PathEscape(name)+"/connect", nil, &NetworkConnectRequest{Container: containerRef, Aliases: aliases}, nil)
+}
+
+func (client *Client) NetworkDisconnect(name string, containerRef string) error {
+	return client.do(http.MethodPost, "/networks/"+url.PathEscape(name)+"/disconnect", nil, &NetworkConnectRequest{Container: containerRef}, nil)
+}
+
+func (client *Client) ImageList() ([]*container.ImageInfo, error) {
+	images := make([]*container.ImageInfo, 0)
+	if err := client.do(http.MethodGet, "/images/json", nil, nil, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (client *Client) ImageCommit(containerRef string, image string) error {
+	return client.do(http.MethodPost, "/commit", nil, &CommitRequest{Container: containerRef, Image: image}, nil)
+}
+
+// ImageImport 以r中的tar流创建镜像
+func (client *Client) ImageImport(image string, r io.Reader) error {
+	return client.do(http.MethodPost, "/images/import", url.Values{"name": {image}}, r, nil)
+}
+
+func (client *Client) SecretList() ([]*container.SecretInfo, error) {
+	secrets := make([]*container.SecretInfo, 0)
+	if err := client.do(http.MethodGet, "/secrets", nil, nil, &secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// SecretCreate 以r中的内容创建secret，内容由daemon加密保存
+func (client *Client) SecretCreate(name string, r io.Reader) error {
+	return client.do(http.MethodPost, "/secrets/create", url.Values{"name": {name}}, r, nil)
+}
+
+func (client *Client) SecretRemove(name string) error {
+	return client.do(http.MethodDelete, "/secrets/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// do 发送请求: body为io.Reader时作为原始请求体，否则序列化为json；
+// out为io.Writer时原样写入响应体，否则按照json反序列化
+func (client *Client) do(method string, path string, query url.Values, body interface{}, out interface{}) error {
+	var reader io.Reader
+	isJson := false
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		content, err := sonic.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+		isJson = true
+	}
+
+	// host对unix socket没有意义，仅用于构造合法的url
+	requestUrl := "http://ghndocker" + path
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, requestUrl, reader)
+	if err != nil {
+		return err
+	}
+	if isJson {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("cannot connect to the ghndocker daemon, err:%s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		content, _ := io.ReadAll(response.Body)
+		return decodeError(response.StatusCode, content)
+	}
+
+	switch o := out.(type) {
+	case nil:
+		return nil
+	case io.Writer:
+		_, err = io.Copy(o, response.Body)
+		return err
+	default:
+		content, err := io.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		return sonic.Unmarshal(content, o)
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestError_Is(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		wantCode int
+		// wantIs 还原之后errors.Is应当匹配的错误，nil表示不匹配任何已知错误
+		wantIs error
+	}{
+		{name: "no such container", err: fmt.Errorf("resolve failed, err:%w", container.ErrNoSuchContainer), wantCode: http.StatusNotFound, wantIs: container.ErrNoSuchContainer},
+		{name: "no such secret", err: container.ErrNoSuchSecret, wantCode: http.StatusNotFound, wantIs: container.ErrNoSuchSecret},
+		{name: "route not found", err: &statusError{code: http.StatusNotFound, err: errors.New("page not found")}, wantCode: http.StatusNotFound},
+		{name: "internal", err: errors.New("boom"), wantCode: http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			writeError(recorder, c.err)
+			assert.Equal(t, c.wantCode, recorder.Code)
+
+			err := decodeError(recorder.Code, recorder.Body.Bytes())
+			assert.Equal(t, c.err.Error(), err.Message)
+			for _, known := range []error{container.ErrNoSuchContainer, container.ErrNoSuchSecret} {
+				assert.Equal(t, known == c.wantIs, errors.Is(err, known), known.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Server 将Docker Engine风格的http请求转发给Backend
+//
+//	GET    /_ping
+//	GET    /containers/json?all=1&filters={"status":["running"]}
+//	POST   /containers/create
+//	GET    /containers/{id}/json
+//	GET    /containers/{id}/logs
+//	GET    /containers/{id}/top
+//	POST   /containers/{id}/start|stop|pause|unpause|exec
+//	POST   /containers/{id}/rename?name=xxx
+//	POST   /containers/{id}/update   请求体为需要修改的资源限制
+//	DELETE /containers/{id}?force=1
+//	GET    /networks
+//	POST   /networks/create
+//	DELETE /networks/{name}
+//	GET    /images/json
+//	POST   /images/import?name=xxx   请求体为镜像tar包
+//	POST   /commit
+//	GET    /secrets
+//	POST   /secrets/create?name=xxx  请求体为secret内容
+//	DELETE /secrets/{name}
+type Server struct {
+	backend Backend
+	routes  []*route
+}
+
+type route struct {
+	method string
+	// pattern 以/分隔的路径，{}表示路径参数
+	pattern []string
+	handler func(w http.ResponseWriter, r *http.Request, params map[string]string) error
+}
+
+// statusError 需要以指定http状态码返回的错误
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return &statusError{code: http.StatusBadRequest, err: err}
+}
+
+func NewServer(backend Backend) *Server {
+	server := &Server{backend: backend}
+	server.handle(http.MethodGet, "/_ping", server.ping)
+	server.handle(http.MethodGet, "/containers/json", server.listContainers)
+	server.handle(http.MethodPost, "/containers/create", server.createContainer)
+	server.handle(http.MethodGet, "/containers/{id}/json", server.inspectContainer)
+	server.handle(http.MethodGet, "/containers/{id}/logs", server.containerLogs)
+	server.handle(http.MethodPost, "/containers/{id}/start", server.containerAction(backend.Start))
+	server.handle(http.MethodPost, "/containers/{id}/stop", server.containerAction(backend.Stop))
+	server.handle(http.MethodPost, "/containers/{id}/pause", server.containerAction(backend.Pause))
+	server.handle(http.MethodPost, "/containers/{id}/unpause", server.containerAction(backend.Unpause))
+	server.handle(http.MethodPost, "/containers/{id}/exec", server.execContainer)
+	server.handle(http.MethodGet, "/containers/{id}/top", server.topContainer)
+	server.handle(http.MethodPost, "/containers/{id}/rename", server.renameContainer)
+	server.handle(http.MethodPost, "/containers/{id}/update", server.updateContainer)
+	server.handle(http.MethodDelete, "/containers/{id}", server.removeContainer)
+	server.handle(http.MethodGet, "/networks", server.listNetworks)
+	server.handle(http.MethodPost, "/networks/create", server.createNetwork)
+	server.handle(http.MethodDelete, "/networks/{name}", server.removeNetwork)
+	server.handle(http.MethodPost, "/networks/{name}/connect", server.connectNetwork)
+	server.handle(http.MethodPost, "/networks/{name}/disconnect", server.disconnectNetwork)
+	server.handle(http.MethodGet, "/images/json", server.listImages)
+	server.handle(http.MethodPost, "/images/import", server.importImage)
+	server.handle(http.MethodPost, "/commit", server.commitImage)
+	server.handle(http.MethodGet, "/secrets", server.listSecrets)
+	server.handle(http.MethodPost, "/secrets/create", server.createSecret)
+	server.handle(http.MethodDelete, "/secrets/{name}", server.removeSecret)
+	return server
+}
+
+func (server *Server) handle(method string, pattern string, handler func(w http.ResponseWriter, r *http.Request, params map[string]string) error) {
+	server.routes = append(server.routes, &route{
+		method:  method,
+		pattern: strings.Split(strings.Trim(pattern, "/"), "/"),
+		handler: handler,
+	})
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	pathMatched := false
+	for _, route := range server.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if route.method != r.Method {
+			continue
+		}
+
+		if err := route.handler(w, r, params); err != nil {
+			logrus.Errorf("[api] %s %s failed, err:%s", r.Method, r.URL.Path, err)
+			writeError(w, err)
+		}
+		return
+	}
+
+	if pathMatched {
+		writeError(w, &statusError{code: http.StatusMethodNotAllowed, err: fmt.Errorf("method %s not allowed", r.Method)})
+		return
+	}
+	writeError(w, &statusError{code: http.StatusNotFound, err: fmt.Errorf("page not found: %s", r.URL.Path)})
+}
+
+func (route *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(route.pattern) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, part := range route.pattern {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			params[strings.Trim(part, "{}")] = segments[i]
+			continue
+		}
+		if part != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (server *Server) ping(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	_, err := io.WriteString(w, "OK")
+	return err
+}
+
+func (server *Server) listContainers(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	options := &container.ListOptions{All: isTrue(r.URL.Query().Get("all"))}
+	if filters := r.URL.Query().Get("filters"); filters != "" {
+		if err := sonic.UnmarshalString(filters, &options.Filters); err != nil {
+			return badRequest(fmt.Errorf("invalid filters:%s, err:%s", filters, err))
+		}
+	}
+
+	containers, err := server.backend.List(options)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, containers)
+}
+
+func (server *Server) createContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	config := &ContainerConfig{}
+	if err := readJson(r, config); err != nil {
+		return err
+	}
+
+	containerId, err := server.backend.Create(config)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusCreated, &CreateResponse{Id: containerId})
+}
+
+func (server *Server) inspectContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	inspect, err := server.backend.Inspect(params["id"])
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, inspect)
+}
+
+func (server *Server) containerLogs(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	// 先写入缓冲区，日志读取失败时仍然可以返回错误状态码
+	var logs bytes.Buffer
+	if err := server.backend.Logs(params["id"], &logs); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := logs.WriteTo(w)
+	return err
+}
+
+func (server *Server) containerAction(action func(containerRef string) error) func(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+		if err := action(params["id"]); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func (server *Server) execContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	request := &ExecRequest{}
+	if err := readJson(r, request); err != nil {
+		return err
+	}
+	if len(request.Cmd) == 0 {
+		return badRequest(errors.New("missing exec command"))
+	}
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := server.backend.Exec(params["id"], request.Cmd, nil, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, &ExecResponse{ExitCode: exitCode, Stdout: stdout.String(), Stderr: stderr.String()})
+}
+
+func (server *Server) topContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	processes, err := server.backend.Top(params["id"])
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, processes)
+}
+
+func (server *Server) renameContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return badRequest(errors.New("missing new container name"))
+	}
+	if err := server.backend.Rename(params["id"], name); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) updateContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	update := &subsystem.SubSystemConfig{}
+	if err := readJson(r, update); err != nil {
+		return err
+	}
+	if err := server.backend.Update(params["id"], update); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) removeContainer(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	if err := server.backend.Remove(params["id"], isTrue(r.URL.Query().Get("force"))); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) listNetworks(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	networks, err := server.backend.NetworkList()
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, networks)
+}
+
+func (server *Server) createNetwork(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	request := &NetworkCreateRequest{}
+	if err := readJson(r, request); err != nil {
+		return err
+	}
+	if err := server.backend.NetworkCreate(request); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (server *Server) removeNetwork(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	if err := server.backend.NetworkRemove(params["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) connectNetwork(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	request := &NetworkConnectRequest{}
+	if err := readJson(r, request); err != nil {
+		return err
+	}
+	if err := server.backend.NetworkConnect(params["name"], request.Container, request.Aliases); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) disconnectNetwork(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	request := &NetworkConnectRequest{}
+	if err := readJson(r, request); err != nil {
+		return err
+	}
+	if err := server.backend.NetworkDisconnect(params["name"], request.Container); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (server *Server) listImages(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	images, err := server.backend.ImageList()
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, images)
+}
+
+func (server *Server) importImage(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return badRequest(errors.New("missing image name"))
+	}
+	if err := server.backend.ImageImport(name, r.Body); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (server *Server) commitImage(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	request := &CommitRequest{}
+	if err := readJson(r, request); err != nil {
+		return err
+	}
+	if err := server.backend.ImageCommit(request.Container, request.Image); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (server *Server) listSecrets(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	secrets, err := server.backend.SecretList()
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, secrets)
+}
+
+func (server *Server) createSecret(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return badRequest(errors.New("missing secret name"))
+	}
+	if err := server.backend.SecretCreate(name, r.Body); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (server *Server) removeSecret(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	if err := server.backend.SecretRemove(params["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func readJson(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err = sonic.Unmarshal(body, v); err != nil {
+		return badRequest(fmt.Errorf("invalid request body, err:%s", err))
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) error {
+	body, err := sonic.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(body)
+	return err
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code, kind := http.StatusInternalServerError, ""
+	var statusErr *statusError
+	switch {
+	case errors.As(err, &statusErr):
+		code = statusErr.code
+	case errors.Is(err, container.ErrNoSuchContainer):
+		code, kind = http.StatusNotFound, ErrorKind_NoSuchContainer
+	case errors.Is(err, container.ErrNoSuchSecret):
+		code, kind = http.StatusNotFound, ErrorKind_NoSuchSecret
+	}
+	writeJson(w, code, &ErrorResponse{Message: err.Error(), Kind: kind})
+}
+
+func isTrue(value string) bool {
+	return value == "1" || value == "true"
+}
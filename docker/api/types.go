@@ -0,0 +1,128 @@
+package api
+
+import (
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"io"
+)
+
+const (
+	// DefaultSocketPath daemon默认监听的unix socket
+	DefaultSocketPath = "/home/guohaonan/ghndocker/ghndocker.sock"
+	// HostEnv 未指定--host时读取的环境变量
+	HostEnv = "GHNDOCKER_HOST"
+)
+
+// ContainerConfig 创建容器的配置
+type ContainerConfig struct {
+	Name  string   `json:"name"`
+	Image string   `json:"image"`
+	Cmd   []string `json:"cmd"`
+	Env   []string `json:"env"`
+	// Volume 宿主机路径:容器内路径[:rprivate|rshared|rslave]
+	Volume string `json:"volume"`
+	// Networks 接入的网络名称，依次对应容器内的eth0、eth1...，为空时不接入网络
+	Networks []string `json:"networks"`
+	// NetworkAliases 容器在接入的每个网络中的别名
+	NetworkAliases []string `json:"network_aliases"`
+	// PortMapping 宿主机端口:容器端口，多个以逗号分隔，只作用于第一个网络
+	PortMapping  string                     `json:"port_mapping"`
+	TinyInit     bool                       `json:"tiny_init"`
+	Resources    *subsystem.SubSystemConfig `json:"resources"`
+	HealthConfig *container.HealthConfig    `json:"health_config"`
+	Labels       map[string]string          `json:"labels"`
+	// RestartPolicy 容器进程退出之后的重启策略，为空时不重启
+	RestartPolicy *container.RestartPolicy `json:"restart_policy"`
+	// Storage 存储驱动以及容器可写层的容量限制，为空时自动选择存储驱动且不限制容量
+	Storage *container.StorageConfig `json:"storage"`
+	// ReadOnly 以只读方式挂载容器根文件系统
+	ReadOnly bool `json:"read_only"`
+	// Ulimits 容器内进程的资源限制
+	Ulimits []*container.Ulimit `json:"ulimits"`
+	// Sysctls 容器namespace内的内核参数，只允许net.*以及ipc namespace的参数
+	Sysctls map[string]string `json:"sysctls"`
+	// Secrets 挂载到容器内/run/secrets的secret
+	Secrets []*container.SecretReference `json:"secrets"`
+}
+
+type CreateResponse struct {
+	Id string `json:"id"`
+}
+
+type ExecRequest struct {
+	Cmd []string `json:"cmd"`
+}
+
+type ExecResponse struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+type NetworkCreateRequest struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+	Subnet string `json:"subnet"`
+}
+
+// NetworkConnectRequest 将容器接入网络或者从网络断开，断开时不使用Aliases
+type NetworkConnectRequest struct {
+	Container string   `json:"container"`
+	Aliases   []string `json:"aliases"`
+}
+
+// NetworkSummary 网络列表中的一项
+type NetworkSummary struct {
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	IPRange string `json:"ip_range"`
+}
+
+type CommitRequest struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+}
+
+const (
+	// ErrorKind_NoSuchContainer 容器不存在，客户端还原为container.ErrNoSuchContainer
+	ErrorKind_NoSuchContainer = "no_such_container"
+	// ErrorKind_NoSuchSecret secret不存在，客户端还原为container.ErrNoSuchSecret
+	ErrorKind_NoSuchSecret = "no_such_secret"
+)
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+	// Kind 可以识别的错误类型，为空表示其他错误
+	Kind string `json:"kind,omitempty"`
+}
+
+// Backend daemon执行请求的后端，由ghndocker.Client以本地模式实现
+type Backend interface {
+	Create(config *ContainerConfig) (string, error)
+	Start(containerRef string) error
+	Stop(containerRef string) error
+	Remove(containerRef string, force bool) error
+	Pause(containerRef string) error
+	Unpause(containerRef string) error
+	List(options *container.ListOptions) ([]*container.ContainerInfo, error)
+	Inspect(containerRef string) (*container.ContainerInspect, error)
+	Logs(containerRef string, w io.Writer) error
+	Exec(containerRef string, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error)
+	Rename(containerRef string, name string) error
+	Update(containerRef string, update *subsystem.SubSystemConfig) error
+	Top(containerRef string) ([]*container.ProcessInfo, error)
+
+	NetworkList() ([]*NetworkSummary, error)
+	NetworkCreate(request *NetworkCreateRequest) error
+	NetworkRemove(name string) error
+	NetworkConnect(name string, containerRef string, aliases []string) error
+	NetworkDisconnect(name string, containerRef string) error
+
+	ImageList() ([]*container.ImageInfo, error)
+	ImageCommit(containerRef string, image string) error
+	ImageImport(image string, r io.Reader) error
+
+	SecretList() ([]*container.SecretInfo, error)
+	SecretCreate(name string, r io.Reader) error
+	SecretRemove(name string) error
+}
@@ -1,8 +1,13 @@
 package cgroup
 
 import (
+	"fmt"
 	"github.com/common-tools-haonan/docker/cgroup/subsystem"
 	"github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
 )
 
 type CgroupManager struct {
@@ -69,6 +74,80 @@ func (manager *CgroupManager) Remove() error {
 	return nil
 }
 
+// Paths 返回各个子系统下容器cgroup的绝对路径，不存在的子系统跳过
+func (manager *CgroupManager) Paths() map[string]string {
+	paths := make(map[string]string)
+	for _, subIns := range subsystem.SubSystemFactory {
+		if root, err := subsystem.GetCgroupPath(subIns.Name(), manager.Namespace); err == nil {
+			paths[subIns.Name()] = root
+		}
+	}
+	return paths
+}
+
+// Pids 返回容器cgroup内的所有进程
+func (manager *CgroupManager) Pids() ([]int, error) {
+	return subsystem.ReadCgroupProcs(subsystem.SubsystemName_Pids, manager.Namespace)
+}
+
+// Freeze 通过freezer子系统冻结容器内的所有进程
+func (manager *CgroupManager) Freeze() error {
+	return subsystem.NewFreezerConfig().Freeze(manager.Namespace)
+}
+
+// Thaw 通过freezer子系统解冻容器内的所有进程
+func (manager *CgroupManager) Thaw() error {
+	return subsystem.NewFreezerConfig().Thaw(manager.Namespace)
+}
+
+// ListChildren 返回各个子系统中parent下的子cgroup名称(去重)
+func ListChildren(parent string) []string {
+	names, seen := make([]string, 0), make(map[string]bool)
+	for _, subIns := range subsystem.SubSystemFactory {
+		root, err := subsystem.GetCgroupPath(subIns.Name(), parent)
+		if err != nil {
+			continue
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RemoveTree 自底向上删除各个子系统中namespace对应的cgroup目录，cgroup内仍有进程时删除失败
+func RemoveTree(namespace string) error {
+	for _, subIns := range subsystem.SubSystemFactory {
+		root, err := subsystem.GetCgroupPath(subIns.Name(), namespace)
+		if err != nil {
+			// 不存在或者v2下已经被其他子系统删除
+			continue
+		}
+
+		dirs := make([]string, 0)
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err = subsystem.RemoveCgroupDir(dirs[i]); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("remove cgroup %s failed, err:%s", dirs[i], err)
+			}
+		}
+	}
+	return nil
+}
+
 //func RunContainerWithConfig(isStd bool, cmd string, namespace string, conf *subsystem.SubSystemConfig) {
 //	parent, _ := fork(isStd, cmd)
 //	if err := parent.Start(); err != nil {
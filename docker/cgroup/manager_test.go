@@ -0,0 +1,153 @@
+package cgroup
+
+import (
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+// useCgroupDir 将cgroup文件系统替换为临时目录，测试结束后恢复
+func useCgroupDir(t *testing.T, v2 bool) string {
+	root := t.TempDir()
+	origin := subsystem.DefaultCgroupFileSystem
+	subsystem.DefaultCgroupFileSystem = &subsystem.DirCgroupFileSystem{Root: root, V2: v2}
+	t.Cleanup(func() {
+		subsystem.DefaultCgroupFileSystem = origin
+	})
+	return root
+}
+
+func readFile(t *testing.T, file string) string {
+	content, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	return string(content)
+}
+
+func TestCgroupManager(t *testing.T) {
+	const namespace = "ghndocker/123"
+	conf := &subsystem.SubSystemConfig{MemoryLimits: "104857600", CpuShare: "1024", CpuSet: "0-1", Cpus: "0.5", PidsLimit: "100"}
+
+	cases := []struct {
+		name string
+		v2   bool
+		// files 应用配置以及加入进程之后，相对于cgroup根目录的文件内容
+		files map[string]string
+		// procs 加入进程时写入的文件
+		procs []string
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/ghndocker/123/memory.limit_in_bytes": "104857600",
+				"cpu/ghndocker/123/cpu.shares":               "1024",
+				"cpu/ghndocker/123/cpu.cfs_quota_us":         "50000",
+				"cpuset/ghndocker/123/cpuset.cpus":           "0-1",
+				"pids/ghndocker/123/pids.max":                "100",
+			},
+			procs: []string{"memory/ghndocker/123/tasks", "cpu/ghndocker/123/tasks", "cpuset/ghndocker/123/tasks", "pids/ghndocker/123/tasks", "freezer/ghndocker/123/tasks"},
+		},
+		{
+			name: "v2",
+			v2:   true,
+			files: map[string]string{
+				"ghndocker/123/memory.max":  "104857600",
+				"ghndocker/123/cpu.weight":  "39",
+				"ghndocker/123/cpu.max":     "50000 100000",
+				"ghndocker/123/cpuset.cpus": "0-1",
+				"ghndocker/123/pids.max":    "100",
+			},
+			procs: []string{"ghndocker/123/cgroup.procs"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := useCgroupDir(t, c.v2)
+			manager := NewCgroupManager(namespace, conf)
+			assert.Nil(t, manager.ApplySubsystem())
+			for file, content := range c.files {
+				assert.Equal(t, content, readFile(t, path.Join(root, file)), file)
+			}
+
+			manager.ProcessId = "4242"
+			assert.Nil(t, manager.SetPidIntoGroup())
+			for _, file := range c.procs {
+				assert.Equal(t, "4242", readFile(t, path.Join(root, file)), file)
+			}
+			assert.Len(t, manager.Paths(), len(subsystem.SubSystemFactory))
+
+			// cgroup内仍有进程时不能删除
+			assert.NotNil(t, manager.Remove())
+			for _, file := range c.procs {
+				assert.Nil(t, os.Truncate(path.Join(root, file), 0))
+			}
+			assert.Nil(t, manager.Remove())
+			assert.Empty(t, manager.Paths())
+		})
+	}
+}
+
+func TestCgroupManager_UnlimitedMemory(t *testing.T) {
+	conf := &subsystem.SubSystemConfig{MemoryLimits: "max", MemoryReservation: "64m", MemorySwap: "-1"}
+
+	cases := []struct {
+		name  string
+		v2    bool
+		files map[string]string
+	}{
+		{
+			name: "v1",
+			files: map[string]string{
+				"memory/ghndocker/123/memory.limit_in_bytes":       "-1",
+				"memory/ghndocker/123/memory.soft_limit_in_bytes":  "67108864",
+				"memory/ghndocker/123/memory.memsw.limit_in_bytes": "-1",
+			},
+		},
+		{
+			name: "v2",
+			v2:   true,
+			files: map[string]string{
+				"ghndocker/123/memory.max":      "max",
+				"ghndocker/123/memory.low":      "67108864",
+				"ghndocker/123/memory.swap.max": "max",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := useCgroupDir(t, c.v2)
+			assert.Nil(t, NewCgroupManager("ghndocker/123", conf).ApplySubsystem())
+			for file, content := range c.files {
+				assert.Equal(t, content, readFile(t, path.Join(root, file)), file)
+			}
+		})
+	}
+}
+
+func TestCgroupManager_Freeze(t *testing.T) {
+	root := useCgroupDir(t, false)
+	manager := NewCgroupManager("ghndocker/123", &subsystem.SubSystemConfig{})
+	assert.Nil(t, manager.ApplySubsystem())
+
+	state := path.Join(root, "freezer/ghndocker/123/freezer.state")
+	assert.Nil(t, manager.Freeze())
+	assert.Equal(t, subsystem.FreezerState_Frozen, readFile(t, state))
+	assert.Nil(t, manager.Thaw())
+	assert.Equal(t, subsystem.FreezerState_Thawed, readFile(t, state))
+}
+
+func TestRemoveTree(t *testing.T) {
+	root := useCgroupDir(t, true)
+	for _, namespace := range []string{"ghndocker/a/cgroup", "ghndocker/b/cgroup"} {
+		assert.Nil(t, NewCgroupManager(namespace, &subsystem.SubSystemConfig{PidsLimit: "10"}).ApplySubsystem())
+	}
+	assert.Equal(t, []string{"a", "b"}, ListChildren("ghndocker"))
+
+	assert.Nil(t, RemoveTree("ghndocker/a"))
+	assert.Equal(t, []string{"b"}, ListChildren("ghndocker"))
+	_, err := os.Stat(path.Join(root, "ghndocker/a"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -5,15 +5,29 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+const (
+	// CgroupV2UnifiedMountPoint cgroup v2 所有控制器共用的挂载点
+	CgroupV2UnifiedMountPoint = "/sys/fs/cgroup"
+)
+
 var (
 	SubSystemFactory = []ContainerSubsystem{
 		&MemoryConfig{},
 		&CpuShareConfig{},
 		&CpuSetConfig{},
+		&PidsConfig{},
+		&FreezerConfig{},
 	}
+
+	cpuSetFormat = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+
+	// v2Controllers cgroup v2下容器使用的控制器，freezer在v2中由cgroup.freeze提供，不需要开启
+	v2Controllers = []string{"memory", "cpu", "cpuset", "pids"}
 )
 
 type ContainerSubsystem interface {
@@ -28,9 +42,104 @@ type ContainerSubsystem interface {
 }
 
 type SubSystemConfig struct {
-	MemoryLimits string
-	CpuShare     string
-	CpuSet       string
+	MemoryLimits string `json:"memory_limits"`
+	CpuShare     string `json:"cpu_share"`
+	CpuSet       string `json:"cpu_set"`
+	// Cpus 可使用的cpu核数，例如1.5，对应cfs quota
+	Cpus      string `json:"cpus"`
+	PidsLimit string `json:"pids_limit"`
+	// MemorySwap 内存+swap的总上限，-1表示不限制swap
+	MemorySwap string `json:"memory_swap"`
+	// MemoryReservation 内存软限制
+	MemoryReservation string `json:"memory_reservation"`
+	// OomKillDisable 内存超限时不kill进程，仅cgroup v1支持
+	OomKillDisable bool `json:"oom_kill_disable"`
+}
+
+// Validate 校验各项资源配置的格式，空值表示不限制
+func (conf *SubSystemConfig) Validate() error {
+	if conf.MemoryLimits != "" {
+		if _, err := ParseMemory(conf.MemoryLimits); err != nil {
+			return err
+		}
+	}
+
+	if conf.MemoryReservation != "" {
+		if _, err := ParseMemory(conf.MemoryReservation); err != nil {
+			return err
+		}
+	}
+
+	if conf.MemorySwap != "" {
+		swap, err := ParseMemory(conf.MemorySwap)
+		if err != nil {
+			return err
+		}
+		if conf.MemoryLimits == "" {
+			return fmt.Errorf("memory swap:%s requires memory limit to be set", conf.MemorySwap)
+		}
+		if limit, _ := ParseMemory(conf.MemoryLimits); swap != -1 && limit != -1 && swap < limit {
+			return fmt.Errorf("memory swap:%s should be larger than memory limit:%s", conf.MemorySwap, conf.MemoryLimits)
+		}
+	}
+
+	if conf.CpuShare != "" {
+		if shares, err := strconv.ParseUint(conf.CpuShare, 10, 64); err != nil || shares < 2 {
+			return fmt.Errorf("invalid cpushare:%s, must be an integer not less than 2", conf.CpuShare)
+		}
+	}
+
+	if conf.CpuSet != "" && !cpuSetFormat.MatchString(conf.CpuSet) {
+		return fmt.Errorf("invalid cpuset:%s, example: 0-2,4", conf.CpuSet)
+	}
+
+	if conf.Cpus != "" {
+		cpus, err := strconv.ParseFloat(conf.Cpus, 64)
+		if err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid cpus:%s, must be a positive number", conf.Cpus)
+		}
+		if cpus*cpuCfsPeriod < cpuCfsMinQuota {
+			return fmt.Errorf("invalid cpus:%s, must be at least %.2f", conf.Cpus, float64(cpuCfsMinQuota)/cpuCfsPeriod)
+		}
+	}
+
+	if conf.PidsLimit != "" && conf.PidsLimit != "max" {
+		if limit, err := strconv.ParseInt(conf.PidsLimit, 10, 64); err != nil || limit <= 0 {
+			return fmt.Errorf("invalid pids limit:%s, must be a positive integer or max", conf.PidsLimit)
+		}
+	}
+	return nil
+}
+
+// Merge 用update中非空的配置项覆盖当前配置，返回新的配置
+func (conf *SubSystemConfig) Merge(update *SubSystemConfig) *SubSystemConfig {
+	merged := &SubSystemConfig{}
+	if conf != nil {
+		*merged = *conf
+	}
+
+	if update.MemoryLimits != "" {
+		merged.MemoryLimits = update.MemoryLimits
+	}
+	if update.CpuShare != "" {
+		merged.CpuShare = update.CpuShare
+	}
+	if update.CpuSet != "" {
+		merged.CpuSet = update.CpuSet
+	}
+	if update.Cpus != "" {
+		merged.Cpus = update.Cpus
+	}
+	if update.PidsLimit != "" {
+		merged.PidsLimit = update.PidsLimit
+	}
+	if update.MemorySwap != "" {
+		merged.MemorySwap = update.MemorySwap
+	}
+	if update.MemoryReservation != "" {
+		merged.MemoryReservation = update.MemoryReservation
+	}
+	return merged
 }
 
 func findRootPathBySubsystem(subsystem string) (string, error) {
@@ -60,17 +169,138 @@ func findRootPathBySubsystem(subsystem string) (string, error) {
 	return "", nil
 }
 
+// procsFileName 进程加入cgroup时写入的文件，v1为tasks，v2为cgroup.procs
+func procsFileName() string {
+	if IsCgroupV2() {
+		return "cgroup.procs"
+	}
+	return "tasks"
+}
+
+// writeCgroupFile 写入cgroup配置文件，value为空表示未配置，直接跳过
+func writeCgroupFile(root string, fileName string, value string) error {
+	if value == "" {
+		return nil
+	}
+	if err := DefaultCgroupFileSystem.WriteFile(root, fileName, value); err != nil {
+		return fmt.Errorf("write %s failed, err:%s", fileName, err)
+	}
+	return nil
+}
+
+// removeCgroup 删除cgroup目录; v2下所有子系统共用同一个目录，已经被删除时直接跳过
+func removeCgroup(subsystem string, namespace string) error {
+	root, err := getCgroupPathWithCreateOption(subsystem, namespace, false)
+	if err != nil {
+		if IsCgroupV2() {
+			return nil
+		}
+		return err
+	}
+	return RemoveCgroupDir(root)
+}
+
+// GetCgroupPath 返回子系统下已经存在的cgroup绝对路径
+func GetCgroupPath(subsystem string, namespace string) (string, error) {
+	return getCgroupPathWithCreateOption(subsystem, namespace, false)
+}
+
+// ReadCgroupProcs 读取cgroup内所有进程的pid
+func ReadCgroupProcs(subsystem string, namespace string) ([]int, error) {
+	root, err := getCgroupPathWithCreateOption(subsystem, namespace, false)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path.Join(root, "cgroup.procs"))
+	if err != nil {
+		return nil, fmt.Errorf("read cgroup.procs failed, err:%s", err)
+	}
+
+	pids := make([]int, 0)
+	for _, line := range strings.Fields(string(content)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// IsCgroupV2 判断宿主机是否挂载的是cgroup v2(unified hierarchy)
+func IsCgroupV2() bool {
+	return DefaultCgroupFileSystem.IsV2()
+}
+
+// RemoveCgroupDir 删除一个cgroup目录，cgroup内仍有进程时删除失败
+func RemoveCgroupDir(dir string) error {
+	return DefaultCgroupFileSystem.RemoveDir(dir)
+}
+
 func getCgroupPathWithCreateOption(subsystem string, namespace string, autoCreate bool) (string, error) {
-	root, _ := findRootPathBySubsystem(subsystem)
-	if _, err := os.Stat(path.Join(root, namespace)); err == nil || (autoCreate && os.IsNotExist(err)) {
-		if os.IsNotExist(err) {
-			if err := os.Mkdir(path.Join(root, namespace), 0755); err == nil {
-			} else {
-				return "", fmt.Errorf("error create cgroup %v", err)
+	root, _ := DefaultCgroupFileSystem.MountPoint(subsystem)
+	cgroupPath := path.Join(root, namespace)
+	_, err := os.Stat(cgroupPath)
+	if err == nil {
+		return cgroupPath, nil
+	}
+	if !autoCreate || !os.IsNotExist(err) {
+		return "", fmt.Errorf("cgroup path error %v", err)
+	}
+
+	if IsCgroupV2() {
+		if err = createCgroupV2Path(root, namespace); err != nil {
+			return "", err
+		}
+		return cgroupPath, nil
+	}
+	if err = os.MkdirAll(cgroupPath, 0755); err != nil {
+		return "", fmt.Errorf("error create cgroup %v", err)
+	}
+	return cgroupPath, nil
+}
+
+// createCgroupV2Path 逐级创建v2的cgroup目录，v2下子cgroup只能使用父cgroup在cgroup.subtree_control中开启的控制器，
+// 因此创建每一级目录之前先在父cgroup中开启容器使用的控制器
+func createCgroupV2Path(root string, namespace string) error {
+	parent := root
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+namespace), "/"), "/") {
+		if err := enableV2Controllers(parent); err != nil {
+			return err
+		}
+		parent = path.Join(parent, name)
+		if err := os.Mkdir(parent, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("error create cgroup %v", err)
+		}
+	}
+	return nil
+}
+
+// enableV2Controllers 在cgroup.subtree_control中开启cgroup.controllers里可用的容器控制器，读取不到cgroup.controllers时全部开启
+func enableV2Controllers(dir string) error {
+	available := v2Controllers
+	if content, err := os.ReadFile(path.Join(dir, "cgroup.controllers")); err == nil {
+		available = make([]string, 0, len(v2Controllers))
+		for _, controller := range v2Controllers {
+			for _, field := range strings.Fields(string(content)) {
+				if field == controller {
+					available = append(available, controller)
+					break
+				}
 			}
 		}
-		return path.Join(root, namespace), nil
-	} else {
-		return "", fmt.Errorf("cgroup path error %v", err)
 	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	tokens := make([]string, 0, len(available))
+	for _, controller := range available {
+		tokens = append(tokens, "+"+controller)
+	}
+	if err := os.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(tokens, " ")), 0644); err != nil {
+		return fmt.Errorf("enable controllers in %s failed, err:%s", dir, err)
+	}
+	return nil
 }
@@ -0,0 +1,144 @@
+package subsystem
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	t.Run("suffix", func(t *testing.T) {
+		limit, err := ParseMemory("100m")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(100<<20), limit)
+
+		limit, err = ParseMemory("2G")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2<<30), limit)
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		limit, err := ParseMemory("max")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(-1), limit)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseMemory("abc")
+		assert.NotNil(t, err)
+		_, err = ParseMemory("0")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSubSystemConfig_Validate(t *testing.T) {
+	cases := []struct {
+		name  string
+		conf  *SubSystemConfig
+		valid bool
+	}{
+		{"empty", &SubSystemConfig{}, true},
+		{"all", &SubSystemConfig{MemoryLimits: "512m", CpuShare: "512", CpuSet: "0-2,4", Cpus: "1.5", PidsLimit: "100"}, true},
+		{"cpuset", &SubSystemConfig{CpuSet: "0-"}, false},
+		{"cpus", &SubSystemConfig{Cpus: "-1"}, false},
+		{"cpus below min quota", &SubSystemConfig{Cpus: "0.005"}, false},
+		{"cpus min quota", &SubSystemConfig{Cpus: "0.01"}, true},
+		{"unlimited memory", &SubSystemConfig{MemoryLimits: "max", MemorySwap: "-1"}, true},
+		{"pids", &SubSystemConfig{PidsLimit: "0"}, false},
+		{"cpushare", &SubSystemConfig{CpuShare: "1"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.valid, c.conf.Validate() == nil)
+		})
+	}
+}
+
+func TestSubSystemConfig_Merge(t *testing.T) {
+	current := &SubSystemConfig{MemoryLimits: "100m", CpuSet: "0"}
+	merged := current.Merge(&SubSystemConfig{MemoryLimits: "200m", PidsLimit: "10"})
+
+	assert.Equal(t, &SubSystemConfig{MemoryLimits: "200m", CpuSet: "0", PidsLimit: "10"}, merged)
+	assert.Equal(t, "100m", current.MemoryLimits)
+
+	var empty *SubSystemConfig
+	assert.Equal(t, &SubSystemConfig{Cpus: "1"}, empty.Merge(&SubSystemConfig{Cpus: "1"}))
+}
+
+func TestGetCgroupPathWithCreateOption_V2(t *testing.T) {
+	cases := []struct {
+		name        string
+		controllers string
+		want        string
+	}{
+		{name: "all available", controllers: "cpuset cpu io memory hugetlb pids", want: "+memory +cpu +cpuset +pids"},
+		{name: "cpuset unavailable", controllers: "cpu io memory pids", want: "+memory +cpu +pids"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := t.TempDir()
+			origin := DefaultCgroupFileSystem
+			DefaultCgroupFileSystem = &DirCgroupFileSystem{Root: root, V2: true}
+			defer func() {
+				DefaultCgroupFileSystem = origin
+			}()
+			assert.Nil(t, os.WriteFile(path.Join(root, "cgroup.controllers"), []byte(c.controllers), 0644))
+
+			cgroupPath, err := getCgroupPathWithCreateOption("memory", "ghndocker/123", true)
+			assert.Nil(t, err)
+			assert.Equal(t, path.Join(root, "ghndocker/123"), cgroupPath)
+
+			content, err := os.ReadFile(path.Join(root, "cgroup.subtree_control"))
+			assert.Nil(t, err)
+			assert.Equal(t, c.want, string(content))
+
+			// 中间一级没有cgroup.controllers，开启全部控制器
+			content, err = os.ReadFile(path.Join(root, "ghndocker", "cgroup.subtree_control"))
+			assert.Nil(t, err)
+			assert.Equal(t, "+memory +cpu +cpuset +pids", string(content))
+
+			// 容器所在的叶子cgroup中有进程，不能开启子树控制器
+			_, err = os.Stat(path.Join(cgroupPath, "cgroup.subtree_control"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestMemoryConfig_Apply_V1(t *testing.T) {
+	cases := []struct {
+		name  string
+		conf  *SubSystemConfig
+		limit string
+		memsw string
+	}{
+		{name: "raise both", conf: &SubSystemConfig{MemoryLimits: "300m", MemorySwap: "400m"}, limit: "314572800", memsw: "419430400"},
+		{name: "lower both", conf: &SubSystemConfig{MemoryLimits: "50m", MemorySwap: "60m"}, limit: "52428800", memsw: "62914560"},
+		{name: "unlimited swap", conf: &SubSystemConfig{MemoryLimits: "300m", MemorySwap: "-1"}, limit: "314572800", memsw: "-1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := t.TempDir()
+			origin := DefaultCgroupFileSystem
+			DefaultCgroupFileSystem = &DirCgroupFileSystem{Root: root}
+			defer func() {
+				DefaultCgroupFileSystem = origin
+			}()
+
+			memory := NewMemoryConfig()
+			assert.Nil(t, memory.Apply("ghndocker/123", &SubSystemConfig{MemoryLimits: "100m", MemorySwap: "200m"}))
+			assert.Nil(t, memory.Apply("ghndocker/123", c.conf))
+
+			cgroupPath := path.Join(root, "memory", "ghndocker/123")
+			content, err := os.ReadFile(path.Join(cgroupPath, "memory.limit_in_bytes"))
+			assert.Nil(t, err)
+			assert.Equal(t, c.limit, string(content))
+			content, err = os.ReadFile(path.Join(cgroupPath, "memory.memsw.limit_in_bytes"))
+			assert.Nil(t, err)
+			assert.Equal(t, c.memsw, string(content))
+		})
+	}
+}
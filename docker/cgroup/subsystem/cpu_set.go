@@ -7,7 +7,7 @@ import (
 )
 
 const (
-	SubsystemName_CpuSet = "CpuSet"
+	SubsystemName_CpuSet = "cpuset"
 )
 
 type CpuSetConfig struct {
@@ -27,7 +27,7 @@ func (cpuSet *CpuSetConfig) SetPid(namespace string, pid string) error {
 		return err
 	}
 	// 将进程pid放入group底下的tasks文件
-	err = os.WriteFile(path.Join(root, "tasks"), []byte(pid), 0644)
+	err = os.WriteFile(path.Join(root, procsFileName()), []byte(pid), 0644)
 	if err != nil {
 		return fmt.Errorf("[CpuSetConfig] write files failed, err:%s", err)
 	}
@@ -39,18 +39,13 @@ func (cpuSet *CpuSetConfig) Apply(namespace string, conf *SubSystemConfig) error
 	if err != nil {
 		return err
 	}
-	// 将内存配置放入group底下的cpuset.cpus文件
-	err = os.WriteFile(path.Join(root, "cpu.shares"), []byte(conf.CpuSet), 0644)
-	if err != nil {
-		return fmt.Errorf("[CpuSetConfig] write files failed, err:%s", err)
+	// 将cpu核配置放入group底下的cpuset.cpus文件
+	if err = writeCgroupFile(root, "cpuset.cpus", conf.CpuSet); err != nil {
+		return fmt.Errorf("[CpuSetConfig] %s", err)
 	}
 	return nil
 }
 
 func (cpuSet *CpuSetConfig) Remove(namespace string) error {
-	root, err := getCgroupPathWithCreateOption(cpuSet.Name(), namespace, false)
-	if err != nil {
-		return err
-	}
-	return os.Remove(root)
+	return removeCgroup(cpuSet.Name(), namespace)
 }
@@ -4,12 +4,19 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 )
 
 const (
-	SubsystemName_CpuShare = "CpuShare"
+	SubsystemName_CpuShare = "cpu"
+
+	// cpuCfsPeriod cfs调度周期(微秒)，--cpus按该周期换算为quota
+	cpuCfsPeriod = 100000
+	// cpuCfsMinQuota 内核允许的最小cfs quota(微秒)，--cpus换算后不能低于该值
+	cpuCfsMinQuota = 1000
 )
 
+// CpuShareConfig 对应cpu子系统，负责cpu权重(cpu.shares)以及cpu核数上限(cfs quota)
 type CpuShareConfig struct {
 }
 
@@ -27,7 +34,7 @@ func (cpuShare *CpuShareConfig) SetPid(namespace string, pid string) error {
 		return err
 	}
 	// 将进程pid放入group底下的tasks文件
-	err = os.WriteFile(path.Join(root, "tasks"), []byte(pid), 0644)
+	err = os.WriteFile(path.Join(root, procsFileName()), []byte(pid), 0644)
 	if err != nil {
 		return fmt.Errorf("[CpuShareConfig] write files failed, err:%s", err)
 	}
@@ -39,18 +46,39 @@ func (cpuShare *CpuShareConfig) Apply(namespace string, conf *SubSystemConfig) e
 	if err != nil {
 		return err
 	}
-	// 将内存配置放入group底下的cpuset.cpus文件
-	err = os.WriteFile(path.Join(root, "cpuset.cpus"), []byte(conf.CpuShare), 0644)
+
+	shareFile, share := "cpu.shares", conf.CpuShare
+	if IsCgroupV2() && share != "" {
+		// v2使用cpu.weight(1-10000)替代cpu.shares(2-262144)
+		shares, _ := strconv.ParseUint(share, 10, 64)
+		shareFile, share = "cpu.weight", strconv.FormatUint(1+((shares-2)*9999)/262142, 10)
+	}
+	// 将cpu权重放入group底下的cpu.shares文件
+	if err = writeCgroupFile(root, shareFile, share); err != nil {
+		return fmt.Errorf("[CpuShareConfig] %s", err)
+	}
+
+	if conf.Cpus == "" {
+		return nil
+	}
+
+	cpus, err := strconv.ParseFloat(conf.Cpus, 64)
 	if err != nil {
-		return fmt.Errorf("[CpuShareConfig] write files failed, err:%s", err)
+		return fmt.Errorf("[CpuShareConfig] parse cpus:%s failed, err:%s", conf.Cpus, err)
+	}
+	quota := strconv.Itoa(int(cpus * cpuCfsPeriod))
+
+	if IsCgroupV2() {
+		err = writeCgroupFile(root, "cpu.max", fmt.Sprintf("%s %d", quota, cpuCfsPeriod))
+	} else if err = writeCgroupFile(root, "cpu.cfs_period_us", strconv.Itoa(cpuCfsPeriod)); err == nil {
+		err = writeCgroupFile(root, "cpu.cfs_quota_us", quota)
+	}
+	if err != nil {
+		return fmt.Errorf("[CpuShareConfig] %s", err)
 	}
 	return nil
 }
 
 func (cpuShare *CpuShareConfig) Remove(namespace string) error {
-	root, err := getCgroupPathWithCreateOption(cpuShare.Name(), namespace, false)
-	if err != nil {
-		return err
-	}
-	return os.Remove(root)
+	return removeCgroup(cpuShare.Name(), namespace)
 }
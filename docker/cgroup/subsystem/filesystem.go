@@ -0,0 +1,122 @@
+package subsystem
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CgroupFileSystem cgroup文件系统的挂载位置以及目录操作，默认使用宿主机的cgroup挂载点，测试时可以指向普通目录
+type CgroupFileSystem interface {
+	// IsV2 是否为cgroup v2(unified hierarchy)
+	IsV2() bool
+	// MountPoint 子系统的挂载点，v2下所有子系统共用同一个挂载点
+	MountPoint(subsystem string) (string, error)
+	// RemoveDir 删除cgroup目录
+	RemoveDir(dir string) error
+	// WriteFile 写入cgroup目录下的控制文件
+	WriteFile(dir string, fileName string, value string) error
+}
+
+// DefaultCgroupFileSystem 各个子系统以及CgroupManager使用的cgroup文件系统
+var DefaultCgroupFileSystem CgroupFileSystem = &hostCgroupFileSystem{}
+
+type hostCgroupFileSystem struct{}
+
+func (fs *hostCgroupFileSystem) IsV2() bool {
+	_, err := os.Stat(path.Join(CgroupV2UnifiedMountPoint, "cgroup.controllers"))
+	return err == nil
+}
+
+// MountPoint v1下从/proc/self/mountinfo中查找子系统的挂载点
+func (fs *hostCgroupFileSystem) MountPoint(subsystem string) (string, error) {
+	if fs.IsV2() {
+		return CgroupV2UnifiedMountPoint, nil
+	}
+	return findRootPathBySubsystem(subsystem)
+}
+
+// RemoveDir cgroup目录中的控制文件由内核维护，rmdir即可删除整个cgroup
+func (fs *hostCgroupFileSystem) RemoveDir(dir string) error {
+	return os.Remove(dir)
+}
+
+func (fs *hostCgroupFileSystem) WriteFile(dir string, fileName string, value string) error {
+	return os.WriteFile(path.Join(dir, fileName), []byte(value), 0644)
+}
+
+// DirCgroupFileSystem 以普通目录模拟的cgroup文件系统: v2下所有子系统位于Root，v1下各个子系统位于Root/<子系统>。
+// 控制文件都是普通文件，写入的值原样保留，用于在没有root权限的环境中检查写入的cgroup配置
+type DirCgroupFileSystem struct {
+	Root string
+	V2   bool
+}
+
+func (fs *DirCgroupFileSystem) IsV2() bool {
+	return fs.V2
+}
+
+func (fs *DirCgroupFileSystem) MountPoint(subsystem string) (string, error) {
+	if fs.V2 {
+		return fs.Root, nil
+	}
+	return path.Join(fs.Root, subsystem), nil
+}
+
+// RemoveDir 普通目录中的控制文件需要一起删除，目录中仍有进程(cgroup.procs非空)时与cgroup一样返回EBUSY
+func (fs *DirCgroupFileSystem) RemoveDir(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	for _, procsFile := range []string{"cgroup.procs", "tasks"} {
+		if content, err := os.ReadFile(path.Join(dir, procsFile)); err == nil && len(content) > 0 {
+			return &os.PathError{Op: "rmdir", Path: dir, Err: syscall.EBUSY}
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return &os.PathError{Op: "rmdir", Path: dir, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// WriteFile 与v1的memory子系统一样，memory.limit_in_bytes大于memory.memsw.limit_in_bytes时返回EINVAL
+func (fs *DirCgroupFileSystem) WriteFile(dir string, fileName string, value string) error {
+	if !fs.V2 {
+		limit, memsw := readLimitFile(dir, "memory.limit_in_bytes"), readLimitFile(dir, "memory.memsw.limit_in_bytes")
+		switch fileName {
+		case "memory.limit_in_bytes":
+			limit = parseLimitValue(value)
+		case "memory.memsw.limit_in_bytes":
+			memsw = parseLimitValue(value)
+		}
+		if memsw != -1 && (limit == -1 || limit > memsw) {
+			return &os.PathError{Op: "write", Path: path.Join(dir, fileName), Err: syscall.EINVAL}
+		}
+	}
+	return os.WriteFile(path.Join(dir, fileName), []byte(value), 0644)
+}
+
+// readLimitFile 读取内存上限文件，文件不存在时与新建的cgroup一样视为不限制(-1)
+func readLimitFile(dir string, fileName string) int64 {
+	content, err := os.ReadFile(path.Join(dir, fileName))
+	if err != nil {
+		return -1
+	}
+	return parseLimitValue(string(content))
+}
+
+func parseLimitValue(value string) int64 {
+	limit, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return limit
+}
@@ -2,12 +2,15 @@ package subsystem
 
 import (
 	"fmt"
+	"github.com/sirupsen/logrus"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 )
 
 const (
-	SubsystemName_Memory = "Memory"
+	SubsystemName_Memory = "memory"
 )
 
 type MemoryConfig struct {
@@ -27,7 +30,7 @@ func (memory *MemoryConfig) SetPid(namespace string, pid string) error {
 		return err
 	}
 	// 将进程pid放入group底下的tasks文件
-	err = os.WriteFile(path.Join(root, "tasks"), []byte(pid), 0644)
+	err = os.WriteFile(path.Join(root, procsFileName()), []byte(pid), 0644)
 	if err != nil {
 		return fmt.Errorf("[MemoryConfig] write files failed, err:%s", err)
 	}
@@ -39,18 +42,155 @@ func (memory *MemoryConfig) Apply(namespace string, conf *SubSystemConfig) error
 	if err != nil {
 		return err
 	}
-	// 将内存配置放入group底下的memory.limit_in_bytes文件
-	err = os.WriteFile(path.Join(root, "memory.limit_in_bytes"), []byte(conf.MemoryLimits), 0644)
+
+	if IsCgroupV2() {
+		// 将内存配置放入group底下的memory.max文件
+		if err = writeCgroupFile(root, "memory.max", memoryLimitValue(conf.MemoryLimits)); err != nil {
+			return fmt.Errorf("[MemoryConfig] %s", err)
+		}
+		return memory.applyV2(root, conf)
+	}
+	return memory.applyV1(root, conf)
+}
+
+func (memory *MemoryConfig) applyV1(root string, conf *SubSystemConfig) error {
+	// memsw为内存+swap的总上限，内核要求limit_in_bytes不大于memsw: 调大memsw时先写memsw，否则先写limit_in_bytes
+	files := []string{"memory.limit_in_bytes", "memory.memsw.limit_in_bytes"}
+	values := []string{memoryLimitValue(conf.MemoryLimits), memoryLimitValue(conf.MemorySwap)}
+	if memswRaised(root, conf.MemorySwap) {
+		files[0], files[1] = files[1], files[0]
+		values[0], values[1] = values[1], values[0]
+	}
+	for i := range files {
+		if err := writeCgroupFile(root, files[i], values[i]); err != nil {
+			return fmt.Errorf("[MemoryConfig] %s", err)
+		}
+	}
+
+	// 软限制，内存紧张时优先回收超过reservation的部分
+	if err := writeCgroupFile(root, "memory.soft_limit_in_bytes", memoryLimitValue(conf.MemoryReservation)); err != nil {
+		return fmt.Errorf("[MemoryConfig] %s", err)
+	}
+	if conf.OomKillDisable {
+		if err := writeCgroupFile(root, "memory.oom_control", "1"); err != nil {
+			return fmt.Errorf("[MemoryConfig] %s", err)
+		}
+	}
+	return nil
+}
+
+// memswRaised 新的memsw上限是否大于cgroup当前的memsw上限，当前值读取失败时按未调大处理
+func memswRaised(root string, memorySwap string) bool {
+	if memorySwap == "" {
+		return false
+	}
+	next, err := ParseMemory(memorySwap)
 	if err != nil {
-		return fmt.Errorf("[MemoryConfig] write files failed, err:%s", err)
+		return false
+	}
+	content, err := os.ReadFile(path.Join(root, "memory.memsw.limit_in_bytes"))
+	if err != nil {
+		return false
+	}
+	current, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return false
+	}
+	if next == -1 {
+		return current != -1
+	}
+	return current != -1 && next > current
+}
+
+func (memory *MemoryConfig) applyV2(root string, conf *SubSystemConfig) error {
+	if err := writeCgroupFile(root, "memory.low", memoryLimitValue(conf.MemoryReservation)); err != nil {
+		return fmt.Errorf("[MemoryConfig] %s", err)
+	}
+
+	// v2的memory.swap.max只限制swap本身，需要用总上限减去内存上限
+	if conf.MemorySwap != "" {
+		swapMax := "max"
+		total, _ := ParseMemory(conf.MemorySwap)
+		limit, _ := ParseMemory(conf.MemoryLimits)
+		if total != -1 && limit != -1 {
+			swapMax = strconv.FormatInt(total-limit, 10)
+		}
+		if err := writeCgroupFile(root, "memory.swap.max", swapMax); err != nil {
+			return fmt.Errorf("[MemoryConfig] %s", err)
+		}
+	}
+
+	if conf.OomKillDisable {
+		logrus.Warnf("[MemoryConfig] oom kill disable is not supported by cgroup v2, skip")
 	}
 	return nil
 }
 
 func (memory *MemoryConfig) Remove(namespace string) error {
+	return removeCgroup(memory.Name(), namespace)
+}
+
+// Usage 读取cgroup当前的内存使用量(字节)
+func (memory *MemoryConfig) Usage(namespace string) (int64, error) {
 	root, err := getCgroupPathWithCreateOption(memory.Name(), namespace, false)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	usageFile := "memory.usage_in_bytes"
+	if IsCgroupV2() {
+		usageFile = "memory.current"
+	}
+
+	content, err := os.ReadFile(path.Join(root, usageFile))
+	if err != nil {
+		return 0, fmt.Errorf("[MemoryConfig] read %s failed, err:%s", usageFile, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// memoryLimitValue 将内存配置转换为cgroup文件中的值: 不限制时v1写入-1，v2写入max，其余换算为字节数
+func memoryLimitValue(limit string) string {
+	if limit == "" {
+		return ""
+	}
+	bytes, err := ParseMemory(limit)
+	if err != nil {
+		// 配置已经校验过，解析失败时原样写入，由内核拒绝
+		return limit
+	}
+	if bytes == -1 {
+		if IsCgroupV2() {
+			return "max"
+		}
+		return "-1"
+	}
+	return strconv.FormatInt(bytes, 10)
+}
+
+// ParseMemory 将内存配置解析为字节数，支持k/m/g后缀，-1或max表示不限制并返回-1
+func ParseMemory(limit string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(limit))
+	if value == "-1" || value == "max" {
+		return -1, nil
+	}
+
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(value, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(value, "g"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		value = value[:len(value)-1]
+	}
+
+	num, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("invalid memory limit:%s, example: 100m", limit)
 	}
-	return os.Remove(root)
+	return num * unit, nil
 }
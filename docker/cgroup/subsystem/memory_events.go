@@ -0,0 +1,177 @@
+package subsystem
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	MemoryEvent_OOM      = "oom"
+	MemoryEvent_Pressure = "pressure"
+)
+
+// MemoryEvent cgroup内存事件
+type MemoryEvent struct {
+	// Type oom: 发生oom; pressure: 内存使用触及上限/内存压力达到critical
+	Type string
+	// Count 本次新增的事件次数
+	Count int64
+}
+
+// NotifyMemoryEvents 监听cgroup的oom以及内存压力事件
+// v1: 通过eventfd注册memory.oom_control/memory.pressure_level; v2: 通过inotify监听memory.events的计数变化
+// cgroup被删除或者监听出错时关闭返回的channel
+func (memory *MemoryConfig) NotifyMemoryEvents(namespace string) (<-chan MemoryEvent, error) {
+	root, err := getCgroupPathWithCreateOption(memory.Name(), namespace, false)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan MemoryEvent, 16)
+	if IsCgroupV2() {
+		if err = watchMemoryEventsV2(root, events); err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+
+	oomFd, err := registerMemoryEventfd(root, "memory.oom_control", "")
+	if err != nil {
+		return nil, err
+	}
+	pressureFd, err := registerMemoryEventfd(root, "memory.pressure_level", "critical")
+	if err != nil {
+		unix.Close(oomFd)
+		return nil, err
+	}
+
+	done := make(chan struct{}, 2)
+	go readEventfd(root, oomFd, MemoryEvent_OOM, events, done)
+	go readEventfd(root, pressureFd, MemoryEvent_Pressure, events, done)
+	go func() {
+		<-done
+		<-done
+		close(events)
+	}()
+	return events, nil
+}
+
+// registerMemoryEventfd 向cgroup.event_control写入"<eventfd> <fd> [args]"，注册v1的内存事件通知
+func registerMemoryEventfd(root string, controlFile string, args string) (int, error) {
+	controlFd, err := unix.Open(path.Join(root, controlFile), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("[MemoryConfig] open %s failed, err:%s", controlFile, err)
+	}
+	defer unix.Close(controlFd)
+
+	eventFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("[MemoryConfig] create eventfd failed, err:%s", err)
+	}
+
+	register := strings.TrimSpace(fmt.Sprintf("%d %d %s", eventFd, controlFd, args))
+	if err = os.WriteFile(path.Join(root, "cgroup.event_control"), []byte(register), 0700); err != nil {
+		unix.Close(eventFd)
+		return -1, fmt.Errorf("[MemoryConfig] register %s event failed, err:%s", controlFile, err)
+	}
+	return eventFd, nil
+}
+
+func readEventfd(root string, eventFd int, eventType string, events chan<- MemoryEvent, done chan<- struct{}) {
+	defer func() {
+		unix.Close(eventFd)
+		done <- struct{}{}
+	}()
+
+	buf := make([]byte, 8)
+	for {
+		if _, err := unix.Read(eventFd, buf); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return
+		}
+
+		// cgroup被删除时同样会触发eventfd
+		if _, err := os.Stat(root); err != nil {
+			return
+		}
+		events <- MemoryEvent{Type: eventType, Count: int64(binary.LittleEndian.Uint64(buf))}
+	}
+}
+
+func watchMemoryEventsV2(root string, events chan<- MemoryEvent) error {
+	inotifyFd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("[MemoryConfig] inotify init failed, err:%s", err)
+	}
+
+	eventsFile := path.Join(root, "memory.events")
+	if _, err = unix.InotifyAddWatch(inotifyFd, eventsFile, unix.IN_MODIFY|unix.IN_DELETE_SELF); err != nil {
+		unix.Close(inotifyFd)
+		return fmt.Errorf("[MemoryConfig] inotify watch memory.events failed, err:%s", err)
+	}
+
+	last, err := readMemoryEventsV2(eventsFile)
+	if err != nil {
+		unix.Close(inotifyFd)
+		return err
+	}
+
+	go func() {
+		defer func() {
+			unix.Close(inotifyFd)
+			close(events)
+		}()
+
+		buf := make([]byte, unix.SizeofInotifyEvent+unix.NAME_MAX+1)
+		for {
+			if _, err := unix.Read(inotifyFd, buf); err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				return
+			}
+
+			current, err := readMemoryEventsV2(eventsFile)
+			if err != nil {
+				// cgroup已经被删除
+				return
+			}
+
+			// max: 内存使用触及memory.max的次数
+			if delta := current["max"] - last["max"]; delta > 0 {
+				events <- MemoryEvent{Type: MemoryEvent_Pressure, Count: delta}
+			}
+			if delta := current["oom_kill"] - last["oom_kill"]; delta > 0 {
+				events <- MemoryEvent{Type: MemoryEvent_OOM, Count: delta}
+			}
+			last = current
+		}
+	}()
+	return nil
+}
+
+// readMemoryEventsV2 解析memory.events，格式为每行"<key> <count>"
+func readMemoryEventsV2(eventsFile string) (map[string]int64, error) {
+	content, err := os.ReadFile(eventsFile)
+	if err != nil {
+		return nil, fmt.Errorf("[MemoryConfig] read memory.events failed, err:%s", err)
+	}
+
+	counters := make(map[string]int64)
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		count, _ := strconv.ParseInt(fields[1], 10, 64)
+		counters[fields[0]] = count
+	}
+	return counters, nil
+}
@@ -0,0 +1,51 @@
+package subsystem
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+const (
+	SubsystemName_Pids = "pids"
+)
+
+type PidsConfig struct {
+}
+
+func NewPidsConfig() *PidsConfig {
+	return &PidsConfig{}
+}
+
+func (pids *PidsConfig) Name() string {
+	return SubsystemName_Pids
+}
+
+func (pids *PidsConfig) SetPid(namespace string, pid string) error {
+	root, err := getCgroupPathWithCreateOption(pids.Name(), namespace, false)
+	if err != nil {
+		return err
+	}
+	// 将进程pid放入group底下的tasks文件
+	err = os.WriteFile(path.Join(root, procsFileName()), []byte(pid), 0644)
+	if err != nil {
+		return fmt.Errorf("[PidsConfig] write files failed, err:%s", err)
+	}
+	return nil
+}
+
+func (pids *PidsConfig) Apply(namespace string, conf *SubSystemConfig) error {
+	root, err := getCgroupPathWithCreateOption(pids.Name(), namespace, true)
+	if err != nil {
+		return err
+	}
+	// 将进程数上限放入group底下的pids.max文件
+	if err = writeCgroupFile(root, "pids.max", conf.PidsLimit); err != nil {
+		return fmt.Errorf("[PidsConfig] %s", err)
+	}
+	return nil
+}
+
+func (pids *PidsConfig) Remove(namespace string) error {
+	return removeCgroup(pids.Name(), namespace)
+}
@@ -0,0 +1,424 @@
+package container
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// whiteoutPrefix tar中以.wh.为前缀的空文件表示删除同名文件，与docker镜像层的格式一致
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque 表示删除所在目录中原有的全部内容
+	whiteoutOpaque = ".wh..wh..opq"
+
+	overlayXattrPrefix = "trusted.overlay."
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+	paxXattrPrefix     = "SCHILY.xattr."
+)
+
+// inodeKey 用于识别硬链接: 同一文件系统上inode相同的文件
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// tarWriter 记录已经写入的inode，第二次遇到同一个inode时写入硬链接
+type tarWriter struct {
+	tw    *tar.Writer
+	links map[inodeKey]string
+}
+
+// writeTarFile 将root以gzip压缩的tar格式写入path，先写入同目录下的临时文件，成功之后再重命名，失败时不留下不完整的文件
+func writeTarFile(path string, root string, excludes ...string) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	gw := gzip.NewWriter(tmp)
+	if err = writeTar(gw, root, excludes...); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeTar 将root目录下的所有内容以相对路径写入tar流，excludes中的路径(绝对路径)及其子目录会被跳过
+// 硬链接写为链接项，扩展属性写入PAX记录，overlay的whiteout以及opaque目录转换为.wh.格式
+func writeTar(w io.Writer, root string, excludes ...string) error {
+	writer := &tarWriter{tw: tar.NewWriter(w), links: make(map[inodeKey]string)}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		for _, exclude := range excludes {
+			if path != exclude {
+				continue
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		return writer.writeEntry(path, filepath.ToSlash(rel), info)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.tw.Close()
+}
+
+func (writer *tarWriter) writeEntry(path string, name string, info os.FileInfo) error {
+	if isWhiteout(info) {
+		return writer.writeWhiteout(filepath.Dir(name), whiteoutPrefix+filepath.Base(name), info)
+	}
+	if info.Mode()&os.ModeSocket != 0 {
+		logrus.Warnf("[writeTar] skip socket:%s", path)
+		return nil
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("build tar header of %s failed, err:%s", path, err)
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok {
+		header.Uid, header.Gid = int(stat.Uid), int(stat.Gid)
+
+		if info.Mode().IsRegular() && stat.Nlink > 1 {
+			key := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+			if first, ok := writer.links[key]; ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeLink, first, 0
+			} else {
+				writer.links[key] = name
+			}
+		}
+	}
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return fmt.Errorf("read xattrs of %s failed, err:%s", path, err)
+	}
+	opaque := false
+	for key, value := range xattrs {
+		if key == overlayOpaqueXattr {
+			opaque = value == "y"
+			continue
+		}
+		if strings.HasPrefix(key, overlayXattrPrefix) {
+			continue
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[paxXattrPrefix+key] = value
+	}
+	if len(header.PAXRecords) > 0 {
+		header.Format = tar.FormatPAX
+	}
+
+	if err = writer.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("write tar header of %s failed, err:%s", path, err)
+	}
+	if opaque {
+		if err = writer.writeWhiteout(name, whiteoutOpaque, info); err != nil {
+			return err
+		}
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(writer.tw, file); err != nil {
+		return fmt.Errorf("write content of %s failed, err:%s", path, err)
+	}
+	return nil
+}
+
+func (writer *tarWriter) writeWhiteout(dir string, base string, info os.FileInfo) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(filepath.Join(dir, base)),
+		Mode:     0600,
+		ModTime:  info.ModTime(),
+	}
+	if err := writer.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("write whiteout %s failed, err:%s", header.Name, err)
+	}
+	return nil
+}
+
+// readXattrs 读取文件自身(不跟随符号链接)的扩展属性，文件系统不支持扩展属性时返回空
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, key := range bytes.Split(buf[:size], []byte{0}) {
+		if len(key) == 0 {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(path, string(key), nil)
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get xattr %s failed, err:%s", key, err)
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(path, string(key), value); err != nil {
+			return nil, fmt.Errorf("get xattr %s failed, err:%s", key, err)
+		}
+		xattrs[string(key)] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+// extractTarFile 将tar文件解压到dest目录，自动识别gzip压缩
+func extractTarFile(path string, dest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return extractTar(file, dest)
+}
+
+// extractTar 将tar流(可以是gzip压缩的)解压到dest目录，拒绝解压到dest之外的路径，
+// 包括通过之前解压出的符号链接逃逸。.wh.格式的whiteout删除dest中的同名文件
+func extractTar(r io.Reader, dest string) error {
+	br := bufio.NewReader(r)
+	var stream io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("read gzip failed, err:%s", err)
+		}
+		defer gr.Close()
+		stream = gr
+	}
+
+	// 目录的修改时间会随着子项的创建改变，全部解压之后再设置
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+	dirs := make([]dirTime, 0)
+
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar failed, err:%s", err)
+		}
+
+		name := filepath.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		parent, err := resolveInRootfs(dest, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("resolve parent of %s failed, err:%s", header.Name, err)
+		}
+		target := filepath.Join(parent, filepath.Base(name))
+		if !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid tar entry:%s, outside of %s", header.Name, dest)
+		}
+
+		if base := filepath.Base(name); strings.HasPrefix(base, whiteoutPrefix) {
+			if err = applyWhiteout(parent, base); err != nil {
+				return fmt.Errorf("apply whiteout %s failed, err:%s", header.Name, err)
+			}
+			continue
+		}
+
+		if err = extractTarEntry(tr, header, dest, target); err != nil {
+			return fmt.Errorf("extract %s failed, err:%s", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{path: target, modTime: header.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return fmt.Errorf("set times of %s failed, err:%s", dirs[i].path, err)
+		}
+	}
+
+	// 读完tar结束标记之后的填充，保证通过TeeReader保存的tar包完整
+	_, err := io.Copy(io.Discard, br)
+	return err
+}
+
+// applyWhiteout opaque删除目录下原有的全部内容，否则删除.wh.之后的同名文件
+func applyWhiteout(dir string, base string) error {
+	if base == whiteoutOpaque {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+}
+
+func extractTarEntry(tr *tar.Reader, header *tar.Header, dest string, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// 已经存在的同名文件(例如镜像中被替换的文件)先删除，同为目录时保留目录及其内容
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+		if err = os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// 链接源按照dest为根解析，中间的符号链接不能把源指向dest之外，且只允许链接普通文件
+		source, err := resolveInRootfs(dest, header.Linkname)
+		if err != nil {
+			return fmt.Errorf("resolve hardlink:%s failed, err:%s", header.Linkname, err)
+		}
+		if !strings.HasPrefix(source, dest+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid hardlink:%s, outside of %s", header.Linkname, dest)
+		}
+		info, err := os.Lstat(source)
+		if err != nil {
+			return fmt.Errorf("stat hardlink:%s failed, err:%s", header.Linkname, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("invalid hardlink:%s, not a regular file", header.Linkname)
+		}
+		// 硬链接与源文件共享inode，属性已经随源文件设置
+		return os.Link(source, target)
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[header.Typeflag]
+		device := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		if err := unix.Mknod(target, fileType|uint32(mode.Perm()), int(device)); err != nil {
+			return fmt.Errorf("mknod %d:%d failed, err:%s", header.Devmajor, header.Devminor, err)
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		logrus.Warnf("[extractTar] skip unsupported entry:%s, type:%c", header.Name, header.Typeflag)
+		return nil
+	}
+
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		xattr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, xattr, []byte(value), 0); err != nil {
+			if err == unix.ENOTSUP || err == unix.EPERM {
+				logrus.Warnf("[extractTar] skip xattr %s of %s, err:%s", xattr, header.Name, err)
+				continue
+			}
+			return fmt.Errorf("set xattr %s failed, err:%s", xattr, err)
+		}
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		atime := unix.NsecToTimeval(header.ModTime.UnixNano())
+		return unix.Lutimes(target, []unix.Timeval{atime, atime})
+	}
+	// chown会清除setuid/setgid，需要在chown之后设置权限
+	return os.Chmod(target, mode)
+}
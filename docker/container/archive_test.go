@@ -0,0 +1,92 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildTar 按顺序写入header，普通文件的内容为content
+func buildTar(t *testing.T, headers []*tar.Header, content string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		assert.Nil(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(content))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, tw.Close())
+	return buf
+}
+
+func TestExtractTarHardlink(t *testing.T) {
+	host := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(host, "shadow"), []byte("secret"), 0600))
+
+	cases := []struct {
+		name    string
+		headers []*tar.Header
+		wantErr bool
+	}{
+		{
+			name: "link inside rootfs",
+			headers: []*tar.Header{
+				{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755},
+				{Name: "bin/ash", Typeflag: tar.TypeLink, Linkname: "bin/sh"},
+			},
+		},
+		{
+			name: "link through symlink to host",
+			headers: []*tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: host},
+				{Name: "bin/ash", Typeflag: tar.TypeLink, Linkname: "etc/shadow"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "link outside rootfs",
+			headers: []*tar.Header{
+				{Name: "bin/ash", Typeflag: tar.TypeLink, Linkname: "../../" + host + "/shadow"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "link to directory",
+			headers: []*tar.Header{
+				{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "sbin", Typeflag: tar.TypeLink, Linkname: "bin"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dest := t.TempDir()
+			err := extractTar(buildTar(t, c.headers, "#!/bin/sh"), dest)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+
+			source, err := os.Stat(filepath.Join(dest, "bin/sh"))
+			assert.Nil(t, err)
+			link, err := os.Stat(filepath.Join(dest, "bin/ash"))
+			assert.Nil(t, err)
+			assert.True(t, os.SameFile(source, link))
+		})
+	}
+
+	content, err := os.ReadFile(filepath.Join(host, "shadow"))
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(content))
+}
@@ -3,22 +3,20 @@ package container
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"os"
-	"os/exec"
 )
 
 func CommitToMakeAImage(containerId string, image string) error {
-	containerFileUrl := fmt.Sprintf(GhnDockerMountPoint, containerId)
-	imageName := image + ".tar"
-	imageUrl := fmt.Sprintf(GhnDockerImageDir, imageName)
-	_, err := os.Stat(imageUrl)
-	if err != nil && !os.IsNotExist(err) {
+	containerFileUrl, err := mountedRootfs(containerId)
+	if err != nil {
 		return err
 	}
+	imageName := image + ".tar"
+	imageUrl := fmt.Sprintf(GhnDockerImageDir, imageName)
 
-	if output, err := exec.Command("tar", "-czf", imageUrl, "-C", containerFileUrl, ".").CombinedOutput(); err != nil {
-		logrus.Errorf("commit image failed, err:%s, output:%s", err, output)
-		return err
+	if err = writeTarFile(imageUrl, containerFileUrl); err != nil {
+		logrus.Errorf("commit image failed, err:%s", err)
+		return fmt.Errorf("commit container:%s to image:%s failed, err:%s", containerId, image, err)
 	}
+	RecordEvent(EventType_Image, EventAction_Commit, image, map[string]string{"container": containerId})
 	return nil
 }
@@ -3,27 +3,42 @@ package container
 import (
 	"fmt"
 	"github.com/bytedance/sonic"
+	"github.com/common-tools-haonan/docker/cgroup"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"syscall"
-	"text/tabwriter"
 )
 
 const (
-	CGroupPathFormat             = "/home/guohaonan/ghndocker/container/%s/cgroup"
-	GhnDockerRunningContainerDir = "/home/guohaonan/ghndocker/run/%s"
-	ConfFileName                 = "config.json"
-	LogFileName                  = "container.log"
+	CGroupPathFormat = "/home/guohaonan/ghndocker/container/%s/cgroup"
+	CGroupRootPath   = "/home/guohaonan/ghndocker/container"
+	ConfFileName     = "config.json"
+	// ConfLockFileName 容器记录的锁文件，与config.json位于同一目录
+	ConfLockFileName   = "config.lock"
+	LogFileName        = "container.log"
+	MonitorLogFileName = "monitor.log"
 )
 
 type ContainerStatus string
 
 const (
+	// ContainerStatus_Created 工作空间以及记录已经创建，容器进程尚未启动
+	ContainerStatus_Created ContainerStatus = "CREATED"
 	ContainerStatus_Running ContainerStatus = "RUNNING"
 	ContainerStatus_Stop    ContainerStatus = "STOP"
 	ContainerStatus_Exit    ContainerStatus = "EXIT"
+	ContainerStatus_Paused  ContainerStatus = "PAUSED"
+)
+
+const (
+	// Supervisor_Monitor 每个容器一个独立的监控进程
+	Supervisor_Monitor = "monitor"
+	// Supervisor_Daemon 容器进程是ghndockerd的子进程，由daemon回收并维护状态
+	Supervisor_Daemon = "daemon"
 )
 
 type ContainerInfo struct {
@@ -35,121 +50,283 @@ type ContainerInfo struct {
 	Commands      string          `json:"commands"`
 	CreateTime    string          `json:"create_time"`
 	Volume        string          `json:"volume"`
-	Network       string          `json:"network"`
-	PortMapping   string          `json:"port_mapping"`
+	// Networks 接入的网络，按照接入顺序排列，容器未运行时只记录网络名称以及别名
+	Networks    []*EndpointSettings `json:"networks"`
+	PortMapping string              `json:"port_mapping"`
+	TinyInit    bool                `json:"tiny_init"`
+	// ResourceConfig 容器当前生效的cgroup资源限制
+	ResourceConfig *subsystem.SubSystemConfig `json:"resource_config"`
+	// OomKilled 容器内是否有进程因为oom被kill
+	OomKilled bool `json:"oom_killed"`
+	// OomCount 触发oom的次数
+	OomCount    int64  `json:"oom_count"`
+	LastOomTime string `json:"last_oom_time"`
+	// MemoryPressureCount 内存使用触及上限的次数
+	MemoryPressureCount int64 `json:"memory_pressure_count"`
+	// Env 用户指定的环境变量，重启容器时复用
+	Env          []string      `json:"env"`
+	HealthConfig *HealthConfig `json:"health_config"`
+	Health       *HealthState  `json:"health"`
+	RestartCount int           `json:"restart_count"`
+	// Labels 用户自定义的标签，用于show的过滤
+	Labels map[string]string `json:"labels"`
+	// Supervisor 容器进程的托管方: 独立的监控进程或者daemon
+	Supervisor string `json:"supervisor"`
+	// FinishedAt 容器进程最近一次退出的时间，已经记录过退出的进程不再重复记录die事件
+	FinishedAt string `json:"finished_at"`
+	// ExitCode 容器进程最近一次的退出码，-1表示未知
+	ExitCode      int            `json:"exit_code"`
+	RestartPolicy *RestartPolicy `json:"restart_policy"`
+	// Storage 容器根文件系统的存储驱动以及容量限制，为空表示overlay
+	Storage *StorageConfig `json:"storage"`
+	// ReadOnly 容器根文件系统以只读方式挂载，/dev等tmpfs以及数据卷仍然可写
+	ReadOnly bool              `json:"read_only"`
+	Ulimits  []*Ulimit         `json:"ulimits"`
+	Sysctls  map[string]string `json:"sysctls"`
+	// Secrets 容器引用的secret，只记录名称以及挂载位置，内容在启动时解密后传给init进程
+	Secrets []*SecretReference `json:"secrets"`
 }
 
-func deleteContainerInfo(path string) error {
-	if err := os.RemoveAll(path); err != nil {
-		logrus.Errorf("delete container Info failed, err:%s", err)
-		return err
-	}
-	return nil
+// EndpointSettings 容器在一个网络中的接入信息，断开之后只保留网络名称以及别名
+type EndpointSettings struct {
+	NetworkName string   `json:"network_name"`
+	Aliases     []string `json:"aliases"`
+	EndpointId  string   `json:"endpoint_id"`
+	// Interface 容器内的网卡名称，例如eth0
+	Interface  string `json:"interface"`
+	IPAddress  string `json:"ip_address"`
+	MacAddress string `json:"mac_address"`
 }
 
-// ListAllContainers 将当前host内所有的容器信息输出到标准输出流
-func ListAllContainers() {
+// Connected 是否已经接入网络并分配了ip
+func (settings *EndpointSettings) Connected() bool {
+	return settings.EndpointId != ""
+}
 
-	files, err := ioutil.ReadDir("/home/guohaonan/ghndocker/run/")
-	if err != nil {
-		logrus.Errorf("[ListAllContainers] Read Dir failed, err:%s", err)
-		return
+// NetworkSettings 容器在指定网络中的接入信息，没有接入该网络时返回nil
+func (container *ContainerInfo) NetworkSettings(networkName string) *EndpointSettings {
+	for _, settings := range container.Networks {
+		if settings.NetworkName == networkName {
+			return settings
+		}
 	}
+	return nil
+}
 
-	containers := make([]*ContainerInfo, 0)
-	for _, file := range files {
-
-		var (
-			container *ContainerInfo
-			tmpErr    error
-		)
+// NetworkNames 容器接入的网络名称
+func (container *ContainerInfo) NetworkNames() []string {
+	names := make([]string, 0, len(container.Networks))
+	for _, settings := range container.Networks {
+		names = append(names, settings.NetworkName)
+	}
+	return names
+}
 
-		container, tmpErr = handleContainerDir(file.Name())
-		if tmpErr != nil {
-			logrus.Errorf("container:%s handle failed, err:%s", file.Name(), tmpErr)
-			continue
+// IPAddresses 容器在所有已接入网络中的ip
+func (container *ContainerInfo) IPAddresses() []string {
+	ips := make([]string, 0, len(container.Networks))
+	for _, settings := range container.Networks {
+		if settings.IPAddress != "" {
+			ips = append(ips, settings.IPAddress)
 		}
-		containers = append(containers, container)
 	}
+	return ips
+}
 
-	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	fmt.Fprint(w, "ID\tNAME\tIMAGE\tPID\tSTATUS\tCREATE_TIME\tCMDS\n")
+// legacyNetworkRecord 只支持接入一个网络的旧版本容器记录中的网络字段
+type legacyNetworkRecord struct {
+	Network    string `json:"network"`
+	EndpointId string `json:"endpoint_id"`
+	IPAddress  string `json:"ip_address"`
+	MacAddress string `json:"mac_address"`
+}
 
-	for _, container := range containers {
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
-			container.Id,
-			container.ContainerName,
-			container.Image,
-			container.Pid,
-			container.Status,
-			container.CreateTime,
-			container.Commands)
+// decodeContainerInfo 反序列化容器记录，旧版本记录中的网络字段迁移到Networks
+func decodeContainerInfo(record []byte) (*ContainerInfo, error) {
+	container := &ContainerInfo{}
+	if err := sonic.Unmarshal(record, container); err != nil {
+		return nil, err
+	}
+	if container.Networks != nil {
+		return container, nil
 	}
 
-	if err := w.Flush(); err != nil {
-		logrus.Fatalf("[ListAllContainers] Flush to buffered zone failed, err:%s", err)
+	legacy := &legacyNetworkRecord{}
+	if err := sonic.Unmarshal(record, legacy); err != nil {
+		return nil, err
+	}
+	container.Networks = make([]*EndpointSettings, 0)
+	if legacy.Network != "" {
+		container.Networks = append(container.Networks, &EndpointSettings{
+			NetworkName: legacy.Network,
+			EndpointId:  legacy.EndpointId,
+			Interface:   "eth0",
+			IPAddress:   legacy.IPAddress,
+			MacAddress:  legacy.MacAddress,
+		})
 	}
-	return
+	return container, nil
 }
 
-func handleContainerDir(dir string) (*ContainerInfo, error) {
-	path := fmt.Sprintf(GhnDockerRunningContainerDir, dir) + "/" + ConfFileName
-	record, err := ioutil.ReadFile(path)
+// loadContainerInfo 根据容器id读取持久化的容器记录
+func loadContainerInfo(containerId string) (*ContainerInfo, error) {
+	path := fmt.Sprintf(GhnDockerRunningContainerDir, containerId) + "/" + ConfFileName
+	recordFile, err := ioutil.ReadFile(path)
 	if err != nil {
+		logrus.Errorf("[loadContainerInfo] read record file failed, err:%s", err)
 		return nil, err
 	}
 
-	container := &ContainerInfo{}
-	if err = sonic.Unmarshal(record, container); err != nil {
-		return nil, err
-	}
-	return container, nil
+	return decodeContainerInfo(recordFile)
+}
 
+// lockContainer 对容器记录加文件锁，返回解锁函数。监控进程、stop、update等命令在不同进程中修改config.json，
+// 读取-修改-写入需要在锁内完成，避免覆盖彼此的修改。flock不可重入，持有锁时不能再次加锁
+func lockContainer(containerId string) (func(), error) {
+	path := fmt.Sprintf(GhnDockerRunningContainerDir, containerId) + "/" + ConfLockFileName
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock of container:%s failed, err:%s", containerId, err)
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("lock container:%s failed, err:%s", containerId, err)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
 }
 
-// FindContainerLog 根据容器id寻找对应的日志文件，并输出到标准输出流
-func FindContainerLog(containerId string) {
-	path := fmt.Sprintf(GhnDockerRunningContainerDir, containerId) + "/" + LogFileName
-	logFile, err := ioutil.ReadFile(path)
+// modifyContainerInfo 在锁内重新读取容器记录并交给modify修改，modify返回true时写回，返回修改之后的记录
+func modifyContainerInfo(containerId string, modify func(container *ContainerInfo) (bool, error)) (*ContainerInfo, error) {
+	unlock, err := lockContainer(containerId)
 	if err != nil {
-		logrus.Fatalf("read log from file failed, err:%s", err)
+		return nil, err
+	}
+	defer unlock()
+
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Fprint(os.Stdout, string(logFile))
+	changed, err := modify(container)
+	if err != nil || !changed {
+		return container, err
+	}
+	return container, dumpContainerInfo(container)
 }
 
-// StopContainer 根据容器id kill对应的进程，并修改持久化存储文件
-func StopContainer(containerId string) error {
-	path := fmt.Sprintf(GhnDockerRunningContainerDir, containerId) + "/" + ConfFileName
-	recordFile, err := ioutil.ReadFile(path)
+// dumpContainerInfo 覆盖写入容器记录: 先写入同目录下的临时文件再重命名，读取方不会读到写了一半的记录
+func dumpContainerInfo(container *ContainerInfo) error {
+	dir := fmt.Sprintf(GhnDockerRunningContainerDir, container.Id)
+	bytes, err := sonic.Marshal(container)
 	if err != nil {
-		logrus.Errorf("[StopContainer] read record file failed, err:%s", err)
 		return err
 	}
 
-	container := &ContainerInfo{}
-	if err = sonic.Unmarshal(recordFile, container); err != nil {
-		return err
+	file, err := os.CreateTemp(dir, ConfFileName+".*")
+	if err != nil {
+		return fmt.Errorf("create temp record of container:%s failed, err:%s", container.Id, err)
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(bytes); err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write record of container:%s failed, err:%s", container.Id, err)
+	}
+	if err = os.Rename(file.Name(), dir+"/"+ConfFileName); err != nil {
+		return fmt.Errorf("rename record of container:%s failed, err:%s", container.Id, err)
 	}
+	return nil
+}
 
-	pid, _ := strconv.Atoi(container.Pid)
-	// 杀死容器进程
-	if err = syscall.Kill(pid, syscall.SIGTERM); err != nil {
-		logrus.Errorf("[StopContainer] kill proc failed, err:%s", err)
+func deleteContainerInfo(path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		logrus.Errorf("delete container Info failed, err:%s", err)
 		return err
 	}
+	return nil
+}
 
-	// 更新容器记录
-	container.Status = ContainerStatus_Stop
-	container.Pid = " "
+// statusSummary show命令中展示的状态，配置了健康检查时附带健康状态，例如 RUNNING(healthy)
+func statusSummary(container *ContainerInfo) string {
+	if container.Health == nil || container.Status != ContainerStatus_Running {
+		return string(container.Status)
+	}
+	return fmt.Sprintf("%s(%s)", container.Status, container.Health.Status)
+}
 
-	bytes, err := sonic.Marshal(container)
+// oomSummary show命令中展示的oom信息，例如 killed(2)
+func oomSummary(container *ContainerInfo) string {
+	if container.OomCount == 0 {
+		return "-"
+	}
+	if container.OomKilled {
+		return fmt.Sprintf("killed(%d)", container.OomCount)
+	}
+	return fmt.Sprintf("oom(%d)", container.OomCount)
+}
+
+func handleContainerDir(dir string) (*ContainerInfo, error) {
+	path := fmt.Sprintf(GhnDockerRunningContainerDir, dir) + "/" + ConfFileName
+	record, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return decodeContainerInfo(record)
+}
+
+// FindContainerLog 根据容器id寻找对应的日志文件，并输出到w
+func FindContainerLog(containerId string, w io.Writer) error {
+	path := fmt.Sprintf(GhnDockerRunningContainerDir, containerId) + "/" + LogFileName
+	logFile, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("read log from file failed, err:%s", err)
 	}
+	defer logFile.Close()
+
+	_, err = io.Copy(w, logFile)
+	return err
+}
+
+// StopContainer 根据容器id kill对应的进程，并修改持久化存储文件
+func StopContainer(containerId string) error {
+	container, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		if container.Status != ContainerStatus_Running && container.Status != ContainerStatus_Paused {
+			return false, fmt.Errorf("container:%s is not running, status:%s", containerId, container.Status)
+		}
+
+		pid, _ := strconv.Atoi(container.Pid)
+		// 杀死容器进程
+		if err := DefaultLauncher.Signal(pid, syscall.SIGTERM); err != nil {
+			logrus.Errorf("[StopContainer] kill proc failed, err:%s", err)
+			return false, err
+		}
+		recordContainerEvent(container, EventAction_Kill, map[string]string{"signal": "SIGTERM"})
+
+		// 被冻结的进程收不到信号，需要解冻之后SIGTERM才会被处理
+		if container.Status == ContainerStatus_Paused {
+			if err := newContainerCgroupManager(containerId).Thaw(); err != nil {
+				logrus.Errorf("[StopContainer] thaw paused container failed, err:%s", err)
+				return false, err
+			}
+		}
 
-	if err = ioutil.WriteFile(path, bytes, 0622); err != nil {
+		// 更新容器记录
+		container.Status = ContainerStatus_Stop
+		container.Pid = " "
+		return true, nil
+	})
+	if err != nil {
 		return err
 	}
+	recordContainerEvent(container, EventAction_Stop, nil)
 	return nil
 }
 
@@ -162,54 +339,92 @@ func RemoveContainer(containerId string, isForce bool) error {
 		return err
 	}
 
-	container := &ContainerInfo{}
-	if err = sonic.Unmarshal(recordFile, container); err != nil {
+	container, err := decodeContainerInfo(recordFile)
+	if err != nil {
 		return err
 	}
 
-	if !isForce && container.Status != ContainerStatus_Stop {
-		logrus.Infof("[RemoveContainer] unforcibly remove only apply for container which has been stop")
+	if !isForce && container.Status != ContainerStatus_Stop && container.Status != ContainerStatus_Exit && container.Status != ContainerStatus_Created {
+		logrus.Infof("[RemoveContainer] unforcibly remove only apply for container which has been stop, exited or not started")
 		return nil
 	}
 
-	// 卸除挂载点
-	if err = RemoveMountVolume(containerId); err != nil {
-		logrus.Infof("[RemoveContainer] RemoveMountVolume failed, err:%s", err)
-		return err
+	// 强制删除暂停中的容器: 先kill再解冻，否则进程会一直处于冻结状态无法退出
+	if container.Status == ContainerStatus_Paused {
+		pid, _ := strconv.Atoi(container.Pid)
+		if err = DefaultLauncher.Signal(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			logrus.Errorf("[RemoveContainer] kill paused container failed, err:%s", err)
+			return err
+		}
+		recordContainerEvent(container, EventAction_Kill, map[string]string{"signal": "SIGKILL"})
+		if err = newContainerCgroupManager(containerId).Thaw(); err != nil {
+			logrus.Errorf("[RemoveContainer] thaw paused container failed, err:%s", err)
+			return err
+		}
 	}
 
-	// 移除容器记录+容器日志
-	if err = deleteContainerInfo(path); err != nil {
+	// 卸除挂载点，通过存储驱动删除容器可写层
+	if err = RemoveWorkSpace(containerId, container.Volume, container.Storage); err != nil {
+		logrus.Infof("[RemoveContainer] RemoveWorkSpace failed, err:%s", err)
 		return err
 	}
 
-	// 删除容器可写层以及work层
-	if err = deleteContainerInfo(fmt.Sprintf(GhnDockerContainerDir, containerId)); err != nil {
+	if err = RemoveSnapshots(containerId); err != nil {
+		logrus.Errorf("[RemoveContainer] remove snapshots failed, err:%s", err)
 		return err
 	}
 
-	if err = deleteContainerInfo(fmt.Sprintf(GhnDockerWorkDir, containerId)); err != nil {
+	// 移除容器记录+容器日志
+	if err = deleteContainerInfo(path); err != nil {
 		return err
 	}
 
-	if err = RemoveMountPoints(containerId); err != nil {
-		logrus.Infof("[RemoveContainer] RemoveMountPoints failed, err:%s", err)
-		return err
+	// 容器cgroup在容器停止之后保留到删除时，cgroup内仍有进程时删除失败，交由doctor清理
+	if err = cgroup.RemoveTree(CGroupRootPath + "/" + containerId); err != nil {
+		logrus.Warnf("[RemoveContainer] remove cgroup failed, err:%s", err)
 	}
+	recordContainerEvent(container, EventAction_Remove, nil)
 	return nil
 }
 
-func GetSpecificContainers(containerId string) (*ContainerInfo, error) {
+// GetSpecificContainers 根据容器id、唯一id前缀或者容器名称读取容器记录
+func GetSpecificContainers(containerRef string) (*ContainerInfo, error) {
+	return ResolveContainer(containerRef)
+}
 
-	containerFile, err := os.ReadFile("/home/guohaonan/ghndocker/run/" + containerId)
-	if err != nil {
-		logrus.Errorf("[getSpecificContainers] Read file failed, err:%s", err)
-		return nil, err
-	}
+// MarkContainerStarted 容器进程启动之后将CREATED状态的记录修改为运行态，返回修改之后的记录
+func MarkContainerStarted(containerId string, pid string, supervisor string) (*ContainerInfo, error) {
+	return modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		if container.Status != ContainerStatus_Created {
+			return false, fmt.Errorf("container:%s cannot be started, status:%s", containerId, container.Status)
+		}
+		container.Pid = pid
+		container.Status = ContainerStatus_Running
+		container.Supervisor = supervisor
+		if container.HealthConfig != nil {
+			container.Health = &HealthState{Status: HealthStatus_Starting}
+		}
+		return true, nil
+	})
+}
 
-	container := &ContainerInfo{}
-	if err = sonic.Unmarshal(containerFile, container); err != nil {
-		return nil, err
-	}
-	return container, nil
+// MarkContainerCreated 启动失败时撤销MarkContainerStarted，记录恢复为CREATED
+func MarkContainerCreated(containerId string) error {
+	_, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		container.Pid = ""
+		container.Status = ContainerStatus_Created
+		container.Health = nil
+		return true, nil
+	})
+	return err
+}
+
+// UpdateContainerNetworks 只更新容器记录中的网络接入信息，其余字段以锁内重新读取的记录为准，
+// 避免网络操作期间监控进程或者stop命令的修改被覆盖
+func UpdateContainerNetworks(container *ContainerInfo) error {
+	_, err := modifyContainerInfo(container.Id, func(current *ContainerInfo) (bool, error) {
+		current.Networks = container.Networks
+		return true, nil
+	})
+	return err
 }
@@ -0,0 +1,191 @@
+package container
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+const testPid = 4242
+
+// newTestContainer 创建工作空间、cgroup以及指定状态的容器记录
+func newTestContainer(t *testing.T, status ContainerStatus) *ContainerInfo {
+	newTestImage(t)
+	storage := &StorageConfig{Driver: StorageDriver_Vfs}
+	assert.Nil(t, NewWorkSpace(testImage, testContainerId, "", storage))
+	assert.Nil(t, cgroup.NewCgroupManager(fmt.Sprintf(CGroupPathFormat, testContainerId), &subsystem.SubSystemConfig{}).ApplySubsystem())
+
+	container := &ContainerInfo{Id: testContainerId, Image: testImage, Status: status, Storage: storage}
+	if status == ContainerStatus_Running || status == ContainerStatus_Paused {
+		container.Pid = strconv.Itoa(testPid)
+	}
+	assert.Nil(t, os.MkdirAll(fmt.Sprintf(GhnDockerRunningContainerDir, testContainerId), 0755))
+	assert.Nil(t, dumpContainerInfo(container))
+	return container
+}
+
+// freezerState v1 freezer子系统中容器cgroup的冻结状态
+func freezerState(t *testing.T, root string) string {
+	content, _ := os.ReadFile(filepath.Join(root, "cgroup/freezer", fmt.Sprintf(CGroupPathFormat, testContainerId), "freezer.state"))
+	return string(content)
+}
+
+func TestStopContainer(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      ContainerStatus
+		alive       bool
+		wantErr     bool
+		wantSignals []syscall.Signal
+		wantState   string
+	}{
+		{name: "running", status: ContainerStatus_Running, alive: true, wantSignals: []syscall.Signal{syscall.SIGTERM}},
+		{name: "paused", status: ContainerStatus_Paused, alive: true, wantSignals: []syscall.Signal{syscall.SIGTERM}, wantState: subsystem.FreezerState_Thawed},
+		{name: "process gone", status: ContainerStatus_Running, wantErr: true},
+		{name: "exited", status: ContainerStatus_Exit, alive: true, wantErr: true},
+		{name: "created", status: ContainerStatus_Created, alive: true, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, _, launcher := useFakeHost(t)
+			newTestContainer(t, c.status)
+			if c.alive {
+				launcher.alive[testPid] = true
+			}
+
+			err := StopContainer(testContainerId)
+			record, loadErr := loadContainerInfo(testContainerId)
+			assert.Nil(t, loadErr)
+			assert.Equal(t, c.wantSignals, launcher.signals[testPid])
+			if c.wantErr {
+				assert.NotNil(t, err)
+				assert.Equal(t, c.status, record.Status)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, ContainerStatus_Stop, record.Status)
+			assert.Equal(t, c.wantState, freezerState(t, root))
+		})
+	}
+}
+
+func TestModifyContainerInfo(t *testing.T) {
+	useFakeHost(t)
+	newTestContainer(t, ContainerStatus_Running)
+
+	// 并发的读取-修改-写入在锁内串行执行，不会丢失修改
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := modifyContainerInfo(testContainerId, func(container *ContainerInfo) (bool, error) {
+				container.OomCount++
+				return true, nil
+			})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	container, err := loadContainerInfo(testContainerId)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), container.OomCount)
+
+	// 记录通过临时文件重命名写入，不会留下临时文件，其他用户不可写
+	recordFile := filepath.Join(fmt.Sprintf(GhnDockerRunningContainerDir, testContainerId), ConfFileName)
+	stat, err := os.Stat(recordFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), stat.Mode().Perm())
+	temps, _ := filepath.Glob(recordFile + ".*")
+	assert.Empty(t, temps)
+
+	// 只更新网络时保留其他命令的修改
+	stale := &ContainerInfo{Id: testContainerId, Status: ContainerStatus_Running, Networks: []*EndpointSettings{{NetworkName: "bridge0"}}}
+	assert.Nil(t, UpdateContainerNetworks(stale))
+	container, err = loadContainerInfo(testContainerId)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), container.OomCount)
+	assert.Equal(t, "bridge0", container.Networks[0].NetworkName)
+}
+
+func TestRemoveContainer(t *testing.T) {
+	cases := []struct {
+		name        string
+		status      ContainerStatus
+		force       bool
+		wantRemoved bool
+		wantSignals []syscall.Signal
+	}{
+		{name: "stopped", status: ContainerStatus_Stop, wantRemoved: true},
+		{name: "created", status: ContainerStatus_Created, wantRemoved: true},
+		{name: "running without force", status: ContainerStatus_Running},
+		{name: "paused with force", status: ContainerStatus_Paused, force: true, wantRemoved: true, wantSignals: []syscall.Signal{syscall.SIGKILL}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, mounter, launcher := useFakeHost(t, testPid)
+			newTestContainer(t, c.status)
+			assert.Nil(t, os.MkdirAll(filepath.Join(fmt.Sprintf(GhnDockerSnapshotDir, testContainerId), "v1"), 0755))
+
+			assert.Nil(t, RemoveContainer(testContainerId, c.force))
+			assert.Equal(t, c.wantSignals, launcher.signals[testPid])
+
+			paths := []string{
+				fmt.Sprintf(GhnDockerRunningContainerDir, testContainerId),
+				fmt.Sprintf(GhnDockerContainerDir, testContainerId),
+				fmt.Sprintf(GhnDockerMountPoint, testContainerId),
+				fmt.Sprintf(GhnDockerSnapshotDir, testContainerId),
+				filepath.Join(root, "cgroup/memory", CGroupRootPath, testContainerId),
+			}
+			for _, path := range paths {
+				exist, _ := PathExist(path)
+				assert.Equal(t, !c.wantRemoved, exist, path)
+			}
+			assert.Equal(t, !c.wantRemoved, len(mounter.mounts) > 0)
+		})
+	}
+}
+
+func TestDecodeContainerInfo(t *testing.T) {
+	cases := []struct {
+		name   string
+		record string
+		want   []*EndpointSettings
+	}{
+		{name: "no network", record: `{"id":"1234567890","network":""}`, want: []*EndpointSettings{}},
+		{
+			name:   "legacy network",
+			record: `{"id":"1234567890","network":"br0","endpoint_id":"1234567890-br0","ip_address":"192.168.10.2","mac_address":"02:42:ac:11:00:02"}`,
+			want: []*EndpointSettings{{
+				NetworkName: "br0", EndpointId: "1234567890-br0", Interface: "eth0", IPAddress: "192.168.10.2", MacAddress: "02:42:ac:11:00:02",
+			}},
+		},
+		{
+			name:   "multiple networks",
+			record: `{"id":"1234567890","networks":[{"network_name":"br0","aliases":["web"]},{"network_name":"br1","endpoint_id":"1234567890-br1","interface":"eth0","ip_address":"192.168.20.2"}]}`,
+			want: []*EndpointSettings{
+				{NetworkName: "br0", Aliases: []string{"web"}},
+				{NetworkName: "br1", EndpointId: "1234567890-br1", Interface: "eth0", IPAddress: "192.168.20.2"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			container, err := decodeContainerInfo([]byte(c.record))
+			assert.Nil(t, err)
+			assert.Equal(t, c.want, container.Networks)
+		})
+	}
+}
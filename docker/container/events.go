@@ -0,0 +1,352 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	EventType_Container = "container"
+	EventType_Network   = "network"
+	EventType_Image     = "image"
+
+	EventAction_Create     = "create"
+	EventAction_Start      = "start"
+	EventAction_Die        = "die"
+	EventAction_Oom        = "oom"
+	EventAction_Stop       = "stop"
+	EventAction_Kill       = "kill"
+	EventAction_Pause      = "pause"
+	EventAction_Unpause    = "unpause"
+	EventAction_Remove     = "remove"
+	EventAction_Connect    = "connect"
+	EventAction_Disconnect = "disconnect"
+	EventAction_Commit     = "commit"
+	EventAction_Snapshot   = "snapshot"
+	EventAction_Restore    = "restore"
+
+	// eventsPollInterval follow模式下检查日志新增内容的周期
+	eventsPollInterval = 200 * time.Millisecond
+)
+
+// Event 一次生命周期变化
+type Event struct {
+	Time     string `json:"time"`
+	TimeNano int64  `json:"time_nano"`
+	Type     string `json:"type"`
+	Action   string `json:"action"`
+	// Id 容器id、网络名称或者镜像名称
+	Id         string            `json:"id"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// EventOptions events命令的过滤以及输出选项
+type EventOptions struct {
+	Since time.Time
+	Until time.Time
+	// Filters 过滤条件，同一个key的多个值之间为或关系，不同key之间为与关系
+	Filters map[string][]string
+	// Follow 输出已有事件之后继续等待新的事件，直到until或者stop被关闭
+	Follow bool
+	// Format 为json时原样输出每行事件
+	Format string
+}
+
+// RecordEvent 追加写入一条事件，写入失败只记录日志，不影响生命周期操作本身
+func RecordEvent(eventType string, action string, id string, attributes map[string]string) {
+	now := time.Now()
+	event := &Event{
+		Time:       now.Format(time.RFC3339Nano),
+		TimeNano:   now.UnixNano(),
+		Type:       eventType,
+		Action:     action,
+		Id:         id,
+		Attributes: attributes,
+	}
+
+	if err := appendEvent(event); err != nil {
+		logrus.Warnf("[RecordEvent] record %s %s event of %s failed, err:%s", eventType, action, id, err)
+	}
+}
+
+// recordContainerEvent 记录容器事件，附带容器名称以及镜像
+func recordContainerEvent(container *ContainerInfo, action string, attributes map[string]string) {
+	RecordEvent(EventType_Container, action, container.Id, ContainerEventAttributes(container, attributes))
+}
+
+// ContainerEventAttributes 容器事件的公共属性(name/image)与extra合并
+func ContainerEventAttributes(container *ContainerInfo, extra map[string]string) map[string]string {
+	attributes := map[string]string{
+		"name":  container.ContainerName,
+		"image": container.Image,
+	}
+	for key, value := range extra {
+		attributes[key] = value
+	}
+	return attributes
+}
+
+func appendEvent(event *Event) error {
+	line, err := sonic.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(GhnDockerEventsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 多个进程(命令行、监控进程)同时写入，加锁保证每行完整
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// ParseEventFilters 解析 key=value 形式的过滤条件，支持 type/event/container/image/network
+func ParseEventFilters(filters []string) (map[string][]string, error) {
+	parsed := make(map[string][]string)
+	for _, filter := range filters {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid filter:%s, format: key=value", filter)
+		}
+
+		switch kv[0] {
+		case "type", "event", "container", "image", "network":
+			parsed[kv[0]] = append(parsed[kv[0]], kv[1])
+		default:
+			return nil, fmt.Errorf("invalid filter key:%s, supported: type, event, container, image, network", kv[0])
+		}
+	}
+	return parsed, nil
+}
+
+// ParseEventTime 解析--since/--until: RFC3339时间、unix时间戳(秒)或者相对当前时间的时长(例如10m表示10分钟之前)
+func ParseEventTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time:%s, supported: RFC3339, unix timestamp or duration such as 10m", value)
+}
+
+// StreamEvents 按照options将事件日志中的事件输出到w，follow模式下持续输出新的事件直到until或者stop被关闭
+func StreamEvents(options *EventOptions, w io.Writer, stop <-chan struct{}) error {
+	file, err := openEventsFile(options.Follow, stop)
+	if err != nil || file == nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	pending := make([]byte, 0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		pending = append(pending, line...)
+
+		if err == nil {
+			event := &Event{}
+			if unmarshalErr := sonic.Unmarshal(bytes.TrimSpace(pending), event); unmarshalErr != nil {
+				logrus.Warnf("[StreamEvents] skip broken event:%s", string(pending))
+			} else if !options.Until.IsZero() && event.TimeNano > options.Until.UnixNano() {
+				return nil
+			} else if matchEvent(event, options) {
+				if err = writeEvent(w, event, pending, options.Format); err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+
+		// 已有的事件输出完毕
+		if !options.Follow || (!options.Until.IsZero() && time.Now().After(options.Until)) {
+			return nil
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(eventsPollInterval):
+		}
+	}
+}
+
+// openEventsFile 打开事件日志，follow模式下等待日志被创建
+func openEventsFile(follow bool, stop <-chan struct{}) (*os.File, error) {
+	for {
+		file, err := os.Open(GhnDockerEventsFile)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !follow {
+			return nil, nil
+		}
+
+		select {
+		case <-stop:
+			return nil, nil
+		case <-time.After(eventsPollInterval):
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event *Event, line []byte, format string) error {
+	if format == ListFormat_Json {
+		_, err := w.Write(append(bytes.TrimSpace(line), '\n'))
+		return err
+	}
+
+	attributes := make([]string, 0, len(event.Attributes))
+	for key, value := range event.Attributes {
+		attributes = append(attributes, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(attributes)
+	_, err := fmt.Fprintf(w, "%s %s %s %s (%s)\n", event.Time, event.Type, event.Action, event.Id, strings.Join(attributes, ", "))
+	return err
+}
+
+func matchEvent(event *Event, options *EventOptions) bool {
+	if !options.Since.IsZero() && event.TimeNano < options.Since.UnixNano() {
+		return false
+	}
+
+	for key, values := range options.Filters {
+		matched := false
+		for _, value := range values {
+			switch key {
+			case "type":
+				matched = event.Type == value
+			case "event":
+				matched = event.Action == value
+			case "container":
+				matched = event.Type == EventType_Container && (strings.HasPrefix(event.Id, value) || event.Attributes["name"] == value) ||
+					event.Type == EventType_Network && event.Attributes["container"] == value
+			case "image":
+				matched = event.Attributes["image"] == value || event.Type == EventType_Image && event.Id == value
+			case "network":
+				matched = event.Type == EventType_Network && event.Id == value
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// EventCounters 根据事件日志累计的生命周期计数，删除容器之后仍然保留
+type EventCounters struct {
+	// Runs 容器进程启动的次数，包括重启
+	Runs int64
+	// Failures 容器进程以非0退出码退出的次数
+	Failures int64
+	// Restarts 重启策略或者健康检查触发的重启次数
+	Restarts int64
+	// Ooms 容器内进程触发oom的次数
+	Ooms int64
+}
+
+// EventCounter 增量读取事件日志并累计计数，每次Update只解析上次之后追加的事件
+type EventCounter struct {
+	offset   int64
+	counters EventCounters
+}
+
+// Update 读取新增的事件并返回累计计数，日志被截断时从头重新计数
+func (counter *EventCounter) Update() (*EventCounters, error) {
+	file, err := os.Open(GhnDockerEventsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			counter.offset, counter.counters = 0, EventCounters{}
+			return &EventCounters{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < counter.offset {
+		counter.offset, counter.counters = 0, EventCounters{}
+	}
+	if _, err = file.Seek(counter.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		// 只处理完整的行，正在写入的最后一行留到下次
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		counter.offset += int64(len(line))
+
+		event := &Event{}
+		if err = sonic.Unmarshal(bytes.TrimSpace(line), event); err != nil || event.Type != EventType_Container {
+			continue
+		}
+		counter.count(event)
+	}
+
+	counters := counter.counters
+	return &counters, nil
+}
+
+func (counter *EventCounter) count(event *Event) {
+	switch event.Action {
+	case EventAction_Start:
+		counter.counters.Runs++
+		if _, ok := event.Attributes["restart_count"]; ok {
+			counter.counters.Restarts++
+		}
+	case EventAction_Die:
+		if exitCode, ok := event.Attributes["exit_code"]; ok && exitCode != "0" {
+			counter.counters.Failures++
+		}
+	case EventAction_Oom:
+		count, err := strconv.ParseInt(event.Attributes["count"], 10, 64)
+		if err != nil || count <= 0 {
+			count = 1
+		}
+		counter.counters.Ooms += count
+	}
+}
@@ -9,49 +9,61 @@ package container
 #include <stdlib.h>
 #include <string.h>
 #include <fcntl.h>
+#include <sys/wait.h>
 
+// 诊断信息统一输出到stderr，保证stdout只包含命令本身的输出
 __attribute__((constructor)) void enter_namespace(void) {
 	char *ghndocker_pid;
 	ghndocker_pid = getenv("ghndocker_pid");
 	if (ghndocker_pid) {
-		fprintf(stdout, "got ghndocker_pid=%s\n", ghndocker_pid);
+		fprintf(stderr, "got ghndocker_pid=%s\n", ghndocker_pid);
 	} else {
-		fprintf(stdout, "missing ghndocker_pid env skip nsenter");
+		// 非exec调用(run/show等)同样会执行到这里，直接跳过
 		return;
 	}
 	char *ghndocker_cmd;
 	ghndocker_cmd = getenv("ghndocker_cmd");
 	if (ghndocker_cmd) {
-		fprintf(stdout, "got ghndocker_cmd=%s\n", ghndocker_cmd);
+		fprintf(stderr, "got ghndocker_cmd=%s\n", ghndocker_cmd);
 	} else {
-		fprintf(stdout, "missing ghndocker_cmd env skip nsenter");
+		fprintf(stderr, "missing ghndocker_cmd env skip nsenter\n");
 		return;
 	}
 	int i;
 	char nspath[1024];
-	char *namespaces[] = { "ipc", "uts", "net", "pid", "mnt" };
+	char *namespaces[] = { "ipc", "uts", "net", "pid", "cgroup", "mnt" };
 
-	for (i=0; i<5; i++) {
+	for (i=0; i<6; i++) {
 		sprintf(nspath, "/proc/%s/ns/%s", ghndocker_pid, namespaces[i]);
 		int fd = open(nspath, O_RDONLY);
 
 		if (setns(fd, 0) == -1) {
 			fprintf(stderr, "setns on %s namespace failed: %s\n", namespaces[i], strerror(errno));
 		} else {
-			fprintf(stdout, "setns on %s namespace succeeded\n", namespaces[i]);
+			fprintf(stderr, "setns on %s namespace succeeded\n", namespaces[i]);
 		}
 		close(fd);
 	}
+	// 以命令的退出码退出，调用方(例如健康检查)依赖该退出码判断执行结果
 	int res = system(ghndocker_cmd);
-	exit(0);
+	if (res == -1) {
+		exit(127);
+	}
+	if (WIFEXITED(res)) {
+		exit(WEXITSTATUS(res));
+	}
+	exit(128 + WTERMSIG(res));
 	return;
 }
 */
 import "C"
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/bytedance/sonic"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -63,36 +75,63 @@ const (
 	ENV_EXEC_CMD = "ghndocker_cmd"
 )
 
+// ExecContainer 使用当前进程的标准输入输出在容器内执行命令，命令退出码非0时返回错误
 func ExecContainer(containerId string, cmds []string) error {
+	exitCode, err := ExecContainerWithIO(containerId, cmds, os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exec in container:%s exit with code:%d", containerId, exitCode)
+	}
+	return nil
+}
+
+// ExecContainerWithIO 在容器内执行命令，使用指定的标准输入输出，返回命令的退出码
+func ExecContainerWithIO(containerId string, cmds []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
 	recordUrl := fmt.Sprintf(GhnDockerRunningContainerDir, containerId) + "/" + ConfFileName
 	recordFile, err := ioutil.ReadFile(recordUrl)
 	if err != nil {
-		logrus.Errorf("[RemoveContainer] read record file failed, err:%s", err)
-		return err
+		logrus.Errorf("[ExecContainer] read record file failed, err:%s", err)
+		return -1, err
 	}
 
 	container := &ContainerInfo{}
 	if err = sonic.Unmarshal(recordFile, container); err != nil {
-		return err
+		return -1, err
 	}
 
-	pid := container.Pid
-	cmd := strings.Join(cmds, " ")
-
-	os.Setenv(ENV_EXEC_CMD, cmd)
-	os.Setenv(ENV_EXEC_PID, pid)
+	switch container.Status {
+	case ContainerStatus_Running:
+	case ContainerStatus_Paused:
+		return -1, fmt.Errorf("container:%s is paused, unpause it first", containerId)
+	default:
+		return -1, fmt.Errorf("container:%s is not running, status:%s", containerId, container.Status)
+	}
 
-	execCmd := exec.Command("/proc/self/exe", "exec")
-	execCmd.Env = append(os.Environ(), getEnvsByPid(pid)...)
-	execCmd.Stdout = os.Stdout
-	execCmd.Stderr = os.Stderr
-	execCmd.Stdin = os.Stdin
+	execCmd := newExecCommand(context.Background(), container.Pid, cmds)
+	execCmd.Stdout = stdout
+	execCmd.Stderr = stderr
+	execCmd.Stdin = stdin
 
-	if err = execCmd.Run(); err != nil {
+	err = execCmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
 		logrus.Errorf("/proc/self/exe -exec failed, err:%s", err)
-		return err
+		return -1, err
 	}
-	return nil
+	return 0, nil
+}
+
+// newExecCommand 构造进入容器namespace执行命令的进程: /proc/self/exe exec 启动时由C构造函数完成setns并执行命令
+func newExecCommand(ctx context.Context, pid string, cmds []string) *exec.Cmd {
+	execCmd := exec.CommandContext(ctx, "/proc/self/exe", "exec")
+	execCmd.Env = append(os.Environ(), getEnvsByPid(pid)...)
+	execCmd.Env = append(execCmd.Env, ENV_EXEC_CMD+"="+strings.Join(cmds, " "), ENV_EXEC_PID+"="+pid)
+	return execCmd
 }
 
 func getEnvsByPid(pid string) []string {
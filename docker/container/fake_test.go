@@ -0,0 +1,103 @@
+package container
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fakeMount 内存中的一个挂载点
+type fakeMount struct {
+	Source string
+	FsType string
+	Flags  uintptr
+	Data   string
+}
+
+// fakeMounter 只记录挂载关系，不修改文件系统
+type fakeMounter struct {
+	mounts map[string]*fakeMount
+	// failOn 挂载点 -> 挂载该目标时返回的错误
+	failOn map[string]error
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{mounts: make(map[string]*fakeMount), failOn: make(map[string]error)}
+}
+
+func (mounter *fakeMounter) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if err := mounter.failOn[target]; err != nil {
+		return err
+	}
+	// 修改传播方式只改变已有挂载点的属性
+	if flags&(syscall.MS_SHARED|syscall.MS_SLAVE|syscall.MS_PRIVATE) != 0 {
+		if _, ok := mounter.mounts[target]; !ok {
+			return fmt.Errorf("%s is not a mount point", target)
+		}
+		mounter.mounts[target].Flags |= flags
+		return nil
+	}
+	mounter.mounts[target] = &fakeMount{Source: source, FsType: fstype, Flags: flags, Data: data}
+	return nil
+}
+
+func (mounter *fakeMounter) Unmount(target string) error {
+	delete(mounter.mounts, target)
+	return nil
+}
+
+func (mounter *fakeMounter) LoopMount(image string, target string, fstype string) error {
+	return mounter.Mount(image, target, fstype, 0, "")
+}
+
+// fakeLauncher 记录发送的信号，alive中的进程视为存在
+type fakeLauncher struct {
+	signals map[int][]syscall.Signal
+	alive   map[int]bool
+}
+
+func newFakeLauncher(pids ...int) *fakeLauncher {
+	launcher := &fakeLauncher{signals: make(map[int][]syscall.Signal), alive: make(map[int]bool)}
+	for _, pid := range pids {
+		launcher.alive[pid] = true
+	}
+	return launcher
+}
+
+func (launcher *fakeLauncher) Start(cmd *exec.Cmd) error {
+	return fmt.Errorf("fake launcher does not start processes")
+}
+
+func (launcher *fakeLauncher) Signal(pid int, sig syscall.Signal) error {
+	if !launcher.alive[pid] {
+		return syscall.ESRCH
+	}
+	if sig != 0 {
+		launcher.signals[pid] = append(launcher.signals[pid], sig)
+	}
+	if sig == syscall.SIGKILL {
+		delete(launcher.alive, pid)
+	}
+	return nil
+}
+
+// useFakeHost 将状态目录、挂载点以及cgroup替换为临时目录，挂载以及进程操作替换为内存实现，测试结束后恢复
+func useFakeHost(t *testing.T, pids ...int) (string, *fakeMounter, *fakeLauncher) {
+	root := t.TempDir()
+	mounter, launcher := newFakeMounter(), newFakeLauncher(pids...)
+
+	originMounter, originLauncher, originMountPoint, originCgroup := DefaultMounter, DefaultLauncher, GhnDockerMountPoint, subsystem.DefaultCgroupFileSystem
+	t.Cleanup(func() {
+		DefaultMounter, DefaultLauncher, GhnDockerMountPoint, subsystem.DefaultCgroupFileSystem = originMounter, originLauncher, originMountPoint, originCgroup
+		SetRootDir(DefaultRootDir)
+	})
+
+	SetRootDir(root)
+	DefaultMounter, DefaultLauncher = mounter, launcher
+	GhnDockerMountPoint = filepath.Join(root, "mnt") + "/%s"
+	subsystem.DefaultCgroupFileSystem = &subsystem.DirCgroupFileSystem{Root: filepath.Join(root, "cgroup")}
+	return root, mounter, launcher
+}
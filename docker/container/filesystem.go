@@ -0,0 +1,368 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	ChangeKind_Added   = "A"
+	ChangeKind_Changed = "C"
+	ChangeKind_Deleted = "D"
+
+	// maxSymlinkDepth 解析容器内路径时允许跟随的符号链接层数
+	maxSymlinkDepth = 255
+)
+
+// FileChange 容器可写层相对于镜像的文件变更
+type FileChange struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// CopyFromContainer 将容器内的文件/目录拷贝到宿主机，保留权限、属主以及修改时间
+func CopyFromContainer(containerId string, containerPath string, hostPath string) error {
+	rootfs, err := mountedRootfs(containerId)
+	if err != nil {
+		return err
+	}
+
+	src, err := resolveInRootfs(rootfs, containerPath)
+	if err != nil {
+		return err
+	}
+	return copyPath(src, copyDestination(src, hostPath))
+}
+
+// CopyToContainer 将宿主机的文件/目录拷贝到容器内，保留权限、属主以及修改时间
+func CopyToContainer(containerId string, hostPath string, containerPath string) error {
+	rootfs, err := mountedRootfs(containerId)
+	if err != nil {
+		return err
+	}
+
+	return copyIntoRootfs(rootfs, hostPath, containerPath)
+}
+
+// copyIntoRootfs 将宿主机的文件/目录拷贝到rootfs内的containerPath。递归拷贝时每一项目标路径都按照rootfs重新解析，
+// 容器内已经存在的同名符号链接不能把后续写入引到rootfs之外
+func copyIntoRootfs(rootfs string, hostPath string, containerPath string) error {
+	dst, err := resolveInRootfs(rootfs, containerPath)
+	if err != nil {
+		return err
+	}
+
+	copier := &pathCopier{
+		resolve: func(dst string, isDir bool) (string, error) {
+			containerPath := strings.TrimPrefix(dst, rootfs)
+			// 目录跟随容器内的符号链接写入链接指向的目录，解析结果仍在rootfs之内
+			if isDir {
+				return resolveInRootfs(rootfs, containerPath)
+			}
+			parent, err := resolveInRootfs(rootfs, filepath.Dir(containerPath))
+			if err != nil {
+				return "", err
+			}
+			target := filepath.Join(parent, filepath.Base(containerPath))
+			// 其他文件替换同名的符号链接本身，不跟随写入
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if err = os.Remove(target); err != nil {
+					return "", err
+				}
+			}
+			return target, nil
+		},
+	}
+	return copier.copy(hostPath, copyDestination(hostPath, dst))
+}
+
+// DiffContainer 通过容器的存储驱动列出可写层相对于镜像新增/修改/删除的文件
+func DiffContainer(containerId string) ([]*FileChange, error) {
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := getStorageDriver(container.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return driver.Diff(containerId, container.Image)
+}
+
+// ExportContainer 将容器合并之后的根文件系统以tar格式写入w，不包括数据卷
+func ExportContainer(containerId string, w io.Writer) error {
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return err
+	}
+
+	rootfs, err := mountedRootfs(containerId)
+	if err != nil {
+		return err
+	}
+
+	excludes := make([]string, 0)
+	if volume, _ := ParseVolume(container.Volume); volume != nil {
+		excludes = append(excludes, filepath.Join(rootfs, volume.ContainerPath))
+	}
+	return writeTar(w, rootfs, excludes...)
+}
+
+// ImportImage 读取tar流创建镜像，同时保存一份镜像tar包
+func ImportImage(image string, r io.Reader) (err error) {
+	imageUrl := fmt.Sprintf(GhnDockerImageDir, image)
+	imageTarUrl := imageUrl + ".tar"
+
+	for _, url := range []string{imageUrl, imageTarUrl} {
+		isExist, statErr := PathExist(url)
+		if statErr != nil {
+			return statErr
+		}
+		if isExist {
+			return fmt.Errorf("image:%s already existed", image)
+		}
+	}
+
+	if err = os.MkdirAll(imageUrl, 0777); err != nil {
+		return err
+	}
+	tarFile, err := os.Create(imageTarUrl)
+	if err != nil {
+		os.RemoveAll(imageUrl)
+		return err
+	}
+
+	defer func() {
+		tarFile.Close()
+		if err != nil {
+			os.RemoveAll(imageUrl)
+			os.Remove(imageTarUrl)
+		}
+	}()
+
+	return extractTar(io.TeeReader(r, tarFile), imageUrl)
+}
+
+// mountedRootfs 返回容器根文件系统在宿主机上的挂载点，容器未挂载时报错
+func mountedRootfs(containerId string) (string, error) {
+	rootfs := fmt.Sprintf(GhnDockerMountPoint, containerId)
+	mounted, err := HostMountPoints()
+	if err != nil {
+		return "", err
+	}
+	if !mounted[rootfs] {
+		return "", fmt.Errorf("rootfs of container:%s is not mounted", containerId)
+	}
+	return rootfs, nil
+}
+
+// resolveInRootfs 将容器内路径解析为宿主机路径，容器内的符号链接按照容器根目录解析，避免逃逸到宿主机
+func resolveInRootfs(rootfs string, containerPath string) (string, error) {
+	components := strings.Split(filepath.Clean("/"+containerPath), "/")
+	resolved, links := "/", 0
+
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinkDepth {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", containerPath)
+		}
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		components = append(strings.Split(target, "/"), components...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
+
+// copyDestination 目标为已存在的目录时拷贝到目录下的同名文件
+func copyDestination(src string, dst string) string {
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		return filepath.Join(dst, filepath.Base(src))
+	}
+	return dst
+}
+
+// pathCopier 递归拷贝文件，resolve非空时在写入之前将每一项目标路径解析为实际写入的路径
+type pathCopier struct {
+	resolve func(dst string, isDir bool) (string, error)
+	// links 已经拷贝的多链接文件的目标路径，再次遇到同一个inode时创建硬链接
+	links map[inodeKey]string
+}
+
+// copyPath 递归拷贝文件/目录/符号链接/设备文件，保留权限、属主、扩展属性、硬链接以及修改时间，socket跳过
+func copyPath(src string, dst string) error {
+	return (&pathCopier{}).copy(src, dst)
+}
+
+func (copier *pathCopier) copy(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if copier.resolve != nil {
+		if dst, err = copier.resolve(dst, info.IsDir()); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		if err = os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case info.IsDir():
+		if err = os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = copier.copy(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && stat.Nlink > 1 {
+			key := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+			if first, ok := copier.links[key]; ok {
+				// 硬链接与第一次拷贝的文件共享inode，属性已经随之设置
+				os.Remove(dst)
+				return os.Link(first, dst)
+			}
+			if copier.links == nil {
+				copier.links = make(map[inodeKey]string)
+			}
+			copier.links[key] = dst
+		}
+		if err = copyFile(src, dst, info.Mode()); err != nil {
+			return err
+		}
+	case info.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0:
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unsupported file type of %s", src)
+		}
+		os.Remove(dst)
+		if err = unix.Mknod(dst, stat.Mode, int(stat.Rdev)); err != nil {
+			return err
+		}
+	case info.Mode()&os.ModeSocket != 0:
+		// socket由监听的进程创建，拷贝没有意义
+		logrus.Warnf("[copyPath] skip socket:%s", src)
+		return nil
+	default:
+		return fmt.Errorf("unsupported file type of %s", src)
+	}
+
+	return copyMetadata(src, dst, info)
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func copyMetadata(src string, dst string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+
+	// 扩展属性需要在chown之后设置，chown会清除security.capability。
+	// overlay的upper目录通过trusted.overlay.*记录opaque目录，快照需要保留
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	if err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyXattrs 拷贝扩展属性，目标文件系统不支持或者没有权限设置时忽略
+func copyXattrs(src string, dst string) error {
+	xattrs, err := readXattrs(src)
+	if err != nil {
+		return err
+	}
+	for key, value := range xattrs {
+		if err = unix.Lsetxattr(dst, key, []byte(value), 0); err != nil && err != unix.ENOTSUP && err != unix.EPERM {
+			return fmt.Errorf("set xattr %s of %s failed, err:%s", key, dst, err)
+		}
+	}
+	return nil
+}
+
+// isWhiteout overlay的whiteout文件为主次设备号均为0的字符设备
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && unix.Major(stat.Rdev) == 0 && unix.Minor(stat.Rdev) == 0
+}
+
+// isOpaqueDir overlay通过trusted.overlay.opaque=y标记upper中完全替换镜像同名目录的opaque目录
+func isOpaqueDir(path string) bool {
+	value := make([]byte, 1)
+	size, err := unix.Lgetxattr(path, overlayOpaqueXattr, value)
+	return err == nil && size == 1 && value[0] == 'y'
+}
@@ -0,0 +1,85 @@
+package container
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyIntoRootfs(t *testing.T) {
+	host := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(host, "passwd"), []byte("root"), 0644))
+
+	src := filepath.Join(t.TempDir(), "pkg")
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "etc"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "etc/passwd"), []byte("hacked"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "passwd"), []byte("hacked"), 0644))
+
+	cases := []struct {
+		name string
+		// links 容器内已经存在的符号链接，key为相对于rootfs的路径
+		links map[string]string
+		// want 拷贝之后rootfs内的文件内容
+		want map[string]string
+	}{
+		{
+			name: "plain",
+			want: map[string]string{"pkg/etc/passwd": "hacked", "pkg/passwd": "hacked"},
+		},
+		{
+			name:  "nested directory symlink",
+			links: map[string]string{"pkg/etc": host},
+			want:  map[string]string{filepath.Join(host, "passwd"): "hacked"},
+		},
+		{
+			name:  "nested file symlink",
+			links: map[string]string{"pkg/passwd": filepath.Join(host, "passwd")},
+			want:  map[string]string{"pkg/passwd": "hacked"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			for path, target := range c.links {
+				assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(rootfs, path)), 0755))
+				assert.Nil(t, os.Symlink(target, filepath.Join(rootfs, path)))
+			}
+
+			assert.Nil(t, copyIntoRootfs(rootfs, src, "/"))
+			for path, content := range c.want {
+				got, err := os.ReadFile(filepath.Join(rootfs, path))
+				assert.Nil(t, err, path)
+				assert.Equal(t, content, string(got), path)
+			}
+
+			got, err := os.ReadFile(filepath.Join(host, "passwd"))
+			assert.Nil(t, err)
+			assert.Equal(t, "root", string(got))
+		})
+	}
+}
+
+func TestCopyPath(t *testing.T) {
+	src := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "a"), []byte("data"), 0644))
+	assert.Nil(t, os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")))
+	listener, err := net.Listen("unix", filepath.Join(src, "sock"))
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	dst := filepath.Join(t.TempDir(), "layer")
+	assert.Nil(t, copyPath(src, dst))
+
+	// 硬链接保持共享inode，不会被拷贝成两个文件
+	a, err := os.Stat(filepath.Join(dst, "a"))
+	assert.Nil(t, err)
+	b, err := os.Stat(filepath.Join(dst, "b"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(a, b))
+
+	_, err = os.Lstat(filepath.Join(dst, "sock"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,131 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type HealthStatus string
+
+const (
+	HealthStatus_Starting  HealthStatus = "starting"
+	HealthStatus_Healthy   HealthStatus = "healthy"
+	HealthStatus_Unhealthy HealthStatus = "unhealthy"
+
+	// healthLogSize 容器记录中保留的最近探测结果数量
+	healthLogSize = 5
+	// healthOutputLimit 单次探测保留的输出长度
+	healthOutputLimit = 4096
+)
+
+// HealthConfig 健康检查配置
+type HealthConfig struct {
+	// Cmd 在容器内执行的探测命令，退出码为0表示健康
+	Cmd         string        `json:"cmd"`
+	Interval    time.Duration `json:"interval"`
+	Timeout     time.Duration `json:"timeout"`
+	Retries     int           `json:"retries"`
+	StartPeriod time.Duration `json:"start_period"`
+	// RestartOnUnhealthy 变为unhealthy之后由监控进程重启容器
+	RestartOnUnhealthy bool `json:"restart_on_unhealthy"`
+}
+
+// HealthState 健康检查状态
+type HealthState struct {
+	Status HealthStatus `json:"status"`
+	// FailingStreak 连续失败次数
+	FailingStreak int            `json:"failing_streak"`
+	Log           []*HealthProbe `json:"log"`
+}
+
+// HealthProbe 单次探测结果
+type HealthProbe struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+}
+
+// runHealthProbe 通过exec机制在容器内执行一次探测命令
+// 探测命令是exec包装进程的子进程，包装进程放入独立的进程组，超时之后kill整个进程组，避免命令残留在容器内
+func runHealthProbe(pid string, config *HealthConfig) *HealthProbe {
+	probe := &HealthProbe{Start: time.Now().Format(time.RFC3339)}
+
+	var output bytes.Buffer
+	execCmd := newExecCommand(context.Background(), pid, strings.Split(config.Cmd, " "))
+	execCmd.Stdout = &output
+	execCmd.Stderr = nil
+	execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := execCmd.Start()
+	timeout := false
+	if err == nil {
+		done := make(chan error, 1)
+		go func() {
+			done <- execCmd.Wait()
+		}()
+
+		timer := time.NewTimer(config.Timeout)
+		select {
+		case err = <-done:
+		case <-timer.C:
+			timeout = true
+			if killErr := syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL); killErr != nil && killErr != syscall.ESRCH {
+				logrus.Warnf("[runHealthProbe] kill probe process group:%d failed, err:%s", execCmd.Process.Pid, killErr)
+			}
+			err = <-done
+		}
+		timer.Stop()
+	}
+	probe.End = time.Now().Format(time.RFC3339)
+
+	var exitErr *exec.ExitError
+	switch {
+	case timeout:
+		probe.ExitCode = -1
+		output.WriteString("health check timeout after " + config.Timeout.String())
+	case errors.As(err, &exitErr):
+		probe.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		probe.ExitCode = -1
+		output.WriteString(err.Error())
+	}
+
+	probe.Output = output.String()
+	if len(probe.Output) > healthOutputLimit {
+		probe.Output = probe.Output[:healthOutputLimit]
+	}
+	return probe
+}
+
+// update 根据探测结果更新健康状态，返回是否由非unhealthy变为unhealthy
+// 启动期(startPeriod)内的失败不计入重试次数
+func (state *HealthState) update(probe *HealthProbe, config *HealthConfig, inStartPeriod bool) bool {
+	state.Log = append(state.Log, probe)
+	if len(state.Log) > healthLogSize {
+		state.Log = state.Log[len(state.Log)-healthLogSize:]
+	}
+
+	if probe.ExitCode == 0 {
+		state.Status = HealthStatus_Healthy
+		state.FailingStreak = 0
+		return false
+	}
+
+	if inStartPeriod && state.Status == HealthStatus_Starting {
+		return false
+	}
+
+	state.FailingStreak++
+	if state.FailingStreak >= config.Retries && state.Status != HealthStatus_Unhealthy {
+		state.Status = HealthStatus_Unhealthy
+		return true
+	}
+	return false
+}
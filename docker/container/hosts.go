@@ -0,0 +1,44 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HostsEntry /etc/hosts中的一行: ip以及对应的名称
+type HostsEntry struct {
+	IP    string
+	Names []string
+}
+
+// WriteHostsFile 重写容器根文件系统内的/etc/hosts，内容为localhost以及entries，根文件系统未挂载(没有/etc目录)时跳过。
+// 宿主机上的挂载点与容器内是同一个文件系统，写入之后容器内立即可见
+func WriteHostsFile(container *ContainerInfo, entries []*HostsEntry) error {
+	rootfs := fmt.Sprintf(GhnDockerMountPoint, container.Id)
+	// 镜像中的/etc或者/etc/hosts可能是符号链接，按照容器根目录解析，避免写到宿主机上
+	etc, err := resolveInRootfs(rootfs, "/etc")
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(etc); err != nil || !info.IsDir() {
+		return nil
+	}
+	hosts, err := resolveInRootfs(rootfs, "/etc/hosts")
+	if err != nil {
+		return err
+	}
+
+	var content strings.Builder
+	content.WriteString("127.0.0.1\tlocalhost\n")
+	content.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	for _, entry := range entries {
+		content.WriteString(fmt.Sprintf("%s\t%s\n", entry.IP, strings.Join(entry.Names, " ")))
+	}
+
+	// 原地写入而不是重命名，保证已经打开该文件的进程以及绑定挂载看到的是同一个文件
+	if err = os.WriteFile(hosts, []byte(content.String()), 0644); err != nil {
+		return fmt.Errorf("write /etc/hosts of container:%s failed, err:%s", container.Id, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ImageInfo 本地镜像: 镜像tar包以及解压之后的镜像目录
+type ImageInfo struct {
+	Name string `json:"name"`
+	// Size 镜像tar包的大小，没有tar包时为0
+	Size int64 `json:"size"`
+	// Extracted 镜像目录是否已经解压
+	Extracted  bool   `json:"extracted"`
+	CreateTime string `json:"create_time"`
+}
+
+// ListImages 列出本地所有镜像，按照名称排序
+func ListImages() ([]*ImageInfo, error) {
+	entries, err := ioutil.ReadDir(GhnDockerImageRootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]*ImageInfo, 0), nil
+		}
+		return nil, fmt.Errorf("read image dir failed, err:%s", err)
+	}
+
+	images := make(map[string]*ImageInfo)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".tar")
+		if !entry.IsDir() && name == entry.Name() {
+			continue
+		}
+
+		image, ok := images[name]
+		if !ok {
+			image = &ImageInfo{Name: name, CreateTime: entry.ModTime().Format("2006-01-02 15:04:05")}
+			images[name] = image
+		}
+		if entry.IsDir() {
+			image.Extracted = true
+		} else {
+			image.Size = entry.Size()
+			image.CreateTime = entry.ModTime().Format("2006-01-02 15:04:05")
+		}
+	}
+
+	result := make([]*ImageInfo, 0, len(images))
+	for _, image := range images {
+		result = append(result, image)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
@@ -1,18 +1,48 @@
 package container
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"strings"
 	"syscall"
 )
 
+// InitOptions 容器init进程的参数，由fork通过init命令的参数传入
+type InitOptions struct {
+	// TinyInit 为true时不直接exec用户命令，而是由init进程作为1号进程托管用户命令
+	TinyInit bool
+	// ReadOnly 以只读方式重新挂载容器根文件系统
+	ReadOnly bool
+	// Volume 容器的数据卷，用于在容器的mount namespace中设置数据卷的传播方式
+	Volume string
+	// Ulimits exec用户命令之前设置的资源限制
+	Ulimits []*Ulimit
+	// Sysctls 容器namespace内的内核参数
+	Sysctls map[string]string
+	// Secrets 为true时从fd 4读取secret并挂载到/run/secrets
+	Secrets bool
+}
+
 // 创建子进程是否，命令行输入是/proc/self/exe init;即先执行父进程的所有可执行内容，然后执行init
-func RunContainerInitProcess() error {
+func RunContainerInitProcess(options *InitOptions) error {
+	// cgroup namespace属于线程，unshare、挂载cgroup以及exec需要在同一个线程中执行
+	runtime.LockOSThread()
+
+	// 父进程先写入secret再写入用户命令，需要按照相同的顺序读取
+	var secrets []*SecretPayload
+	if options.Secrets {
+		var err error
+		if secrets, err = readSecrets(); err != nil {
+			return fmt.Errorf("read secrets failed, err:%s", err)
+		}
+	}
 
 	// read pipe，无内容阻塞后面处理逻辑
 	cmds := readUserCommand()
@@ -21,10 +51,28 @@ func RunContainerInitProcess() error {
 	}
 	logrus.Infof("command %s", cmds)
 
-	if err := setupMount(); err != nil {
+	// clone时创建的cgroup namespace以父进程的cgroup为根，父进程写入命令之前已经将init进程加入容器cgroup，
+	// 此时再创建一次，容器内看到的cgroup根目录即为容器自身的cgroup
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		logrus.Errorf("[RunContainerInitProcess] unshare cgroup namespace failed, err:%s", err)
+		return err
+	}
+
+	if err := setupMount(options, secrets); err != nil {
+		logrus.Errorf("[RunContainerInitProcess] setup mount failed, err:%s", err)
 		os.Exit(-1)
 	}
 
+	// 此时已经处于容器的network/ipc namespace并且挂载了/proc，网络也已经由父进程接入
+	if err := writeSysctls(options.Sysctls); err != nil {
+		logrus.Errorf("[RunContainerInitProcess] write sysctls failed, err:%s", err)
+		return err
+	}
+	if err := setRlimits(options.Ulimits); err != nil {
+		logrus.Errorf("[RunContainerInitProcess] set ulimits failed, err:%s", err)
+		return err
+	}
+
 	// 寻找命令行工具的可执行文件
 	execPath, err := exec.LookPath(cmds[0])
 	if err != nil {
@@ -32,6 +80,10 @@ func RunContainerInitProcess() error {
 		return err
 	}
 
+	if options.TinyInit {
+		return runTinyInit(execPath, cmds)
+	}
+
 	if err := syscall.Exec(execPath, cmds[0:], os.Environ()); err != nil {
 		logrus.Errorf(err.Error())
 	}
@@ -50,15 +102,34 @@ func readUserCommand() []string {
 	return strings.Split(msgStr, " ")
 }
 
-func setupMount() error {
+func setupMount(options *InitOptions, secrets []*SecretPayload) error {
 	wd, err := os.Getwd()
 	if err != nil {
 		logrus.Errorf("[setupMount] get current work directory failed, err:%s", err)
 		return fmt.Errorf("when container is initing, get current work directory failed, err:%s", err)
 	}
 
+	volume, err := ParseVolume(options.Volume)
+	if err != nil {
+		return err
+	}
+
+	// 先设置整个挂载树的传播方式，默认rprivate，避免容器内的挂载传播到宿主机。
+	// 数据卷需要rshared/rslave时整个挂载树使用相同的方式，否则数据卷的副本会先被改为私有，无法再与宿主机建立传播关系
+	rootPropagation := Propagation_RPrivate
+	if volume != nil {
+		rootPropagation = volume.Propagation
+	}
+	if err = mount("", "/", "", propagationFlags[rootPropagation]|unix.MS_REC, ""); err != nil {
+		return err
+	}
+	// pivot_root要求新根目录的父挂载点不是共享的
+	if err = mount("", wd, "", unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
 	logrus.Infof("current location:%s", wd)
-	err = pivotRoot(wd)
+	err = pivotRoot(wd, volume)
 	if err != nil {
 		return fmt.Errorf("[setupMount] pivot root failed, err:%s", err)
 	}
@@ -69,10 +140,70 @@ func setupMount() error {
 
 	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
 
+	// 容器内的工具(例如JVM)通过/sys/fs/cgroup读取容器自身的资源限制
+	if err = mount("sysfs", "/sys", "sysfs", uintptr(defaultMountFlags|syscall.MS_RDONLY), ""); err != nil {
+		logrus.Warnf("[setupMount] mount sysfs failed, err:%s", err)
+	} else if err = mountCgroups(); err != nil {
+		logrus.Warnf("[setupMount] mount cgroup failed, err:%s", err)
+	}
+
+	// secret的挂载点可能位于根文件系统中，需要在只读挂载之前创建
+	if err = mountSecrets(secrets); err != nil {
+		return fmt.Errorf("mount secrets failed, err:%s", err)
+	}
+
+	// 只重新挂载根目录这一个挂载点，/dev等tmpfs以及数据卷是独立的挂载点，仍然可写
+	if options.ReadOnly {
+		if err = mount("", "/", "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func pivotRoot(root string) error {
+// mountCgroups 以只读方式挂载容器cgroup namespace内的cgroup文件系统，根目录即为容器自身的cgroup
+func mountCgroups() error {
+	flags := uintptr(unix.MS_NOEXEC | unix.MS_NOSUID | unix.MS_NODEV | unix.MS_RDONLY)
+
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 每行为 hierarchy-id:controllers:path，cgroup v2只有一行 0::path
+	hierarchies := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			return mount("cgroup2", "/sys/fs/cgroup", "cgroup2", flags, "")
+		}
+		hierarchies = append(hierarchies, fields[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	if err = mount("tmpfs", "/sys/fs/cgroup", "tmpfs", uintptr(unix.MS_NOEXEC|unix.MS_NOSUID|unix.MS_NODEV), "mode=755"); err != nil {
+		return err
+	}
+	for _, controllers := range hierarchies {
+		dir := "/sys/fs/cgroup/" + strings.TrimPrefix(controllers, "name=")
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err = mount("cgroup", dir, "cgroup", flags, controllers); err != nil {
+			return err
+		}
+	}
+	return mount("", "/sys/fs/cgroup", "", unix.MS_REMOUNT|unix.MS_BIND|flags, "")
+}
+
+func pivotRoot(root string, volume *VolumeMount) error {
 	// 这块解释一下，为啥出现mount -b挂载源和目标相同
 	// 原因主要是因为pivot_root这个系统调用，新的root必须是mount挂载点，来自该系统调用的约束
 	if err := syscall.Mount(root, root, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
@@ -80,6 +211,13 @@ func pivotRoot(root string) error {
 		return fmt.Errorf("pivot_root failed, err:%s", err)
 	}
 
+	if volume != nil {
+		if err := mount("", path.Join(root, volume.ContainerPath), "", propagationFlags[volume.Propagation]|unix.MS_REC, ""); err != nil {
+			logrus.Errorf("[pivotRoot] set volume propagation failed, err:%s", err)
+			return err
+		}
+	}
+
 	// 创建pivot_root系统调用的另一个目录，put_old
 	putOld := path.Join(root, ".pivot_root")
 	if err := os.Mkdir(putOld, 0777); err != nil {
@@ -100,6 +238,11 @@ func pivotRoot(root string) error {
 	}
 
 	putOld = path.Join("/", ".pivot_root")
+	// 旧的根目录可能与宿主机共享传播，先改为slave，避免卸载传播到宿主机
+	if err := mount("", putOld, "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		logrus.Errorf("[pivotRoot] make old root slave failed, err:%s", err)
+		return fmt.Errorf("pivot_root failed, err:%s", err)
+	}
 	if err := syscall.Unmount(putOld, syscall.MNT_DETACH); err != nil {
 		logrus.Errorf("[pivotRoot] unmount failed, err:%s", err)
 		return fmt.Errorf("pivot_root failed, err:%s", err)
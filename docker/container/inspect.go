@@ -0,0 +1,196 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ContainerInspect inspect命令输出: 容器记录 + 实时状态
+type ContainerInspect struct {
+	*ContainerInfo
+	State  *ContainerLiveState `json:"state"`
+	Mounts []*MountPoint       `json:"mounts"`
+	Ports  []*PortBinding      `json:"ports"`
+}
+
+// ContainerLiveState 从宿主机实时读取的容器状态
+type ContainerLiveState struct {
+	PidAlive bool `json:"pid_alive"`
+	// CgroupPaths 子系统 -> 容器cgroup的绝对路径
+	CgroupPaths map[string]string `json:"cgroup_paths"`
+	// Processes 容器cgroup内的进程数
+	Processes int `json:"processes"`
+}
+
+// MountPoint 容器的挂载信息
+type MountPoint struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only"`
+	Propagation string `json:"propagation,omitempty"`
+	// Mounted 挂载点当前是否存在于宿主机的mountinfo中
+	Mounted bool `json:"mounted"`
+}
+
+// PortBinding 宿主机端口到容器端口的映射
+type PortBinding struct {
+	HostPort      string `json:"host_port"`
+	ContainerIP   string `json:"container_ip"`
+	ContainerPort string `json:"container_port"`
+	// Active 对应的DNAT规则是否存在
+	Active bool `json:"active"`
+}
+
+// ProcessInfo top命令输出的容器内进程信息
+type ProcessInfo struct {
+	Uid   string `json:"uid"`
+	Pid   int    `json:"pid"`
+	PPid  int    `json:"ppid"`
+	State string `json:"state"`
+	Cmd   string `json:"cmd"`
+}
+
+// InspectContainer 读取容器记录，并合并进程存活、cgroup、挂载点等实时状态
+func InspectContainer(containerRef string) (*ContainerInspect, error) {
+	container, err := GetSpecificContainers(containerRef)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := newContainerCgroupManager(container.Id)
+	pid, _ := strconv.Atoi(strings.TrimSpace(container.Pid))
+
+	inspect := &ContainerInspect{
+		ContainerInfo: container,
+		State: &ContainerLiveState{
+			PidAlive:    IsProcessAlive(pid),
+			CgroupPaths: manager.Paths(),
+		},
+		Mounts: make([]*MountPoint, 0),
+		Ports:  make([]*PortBinding, 0),
+	}
+
+	if pids, err := manager.Pids(); err == nil {
+		inspect.State.Processes = len(pids)
+	}
+
+	mounted, err := HostMountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := getStorageDriver(container.Storage)
+	if err != nil {
+		return nil, err
+	}
+	rootfs := fmt.Sprintf(GhnDockerMountPoint, container.Id)
+	inspect.Mounts = append(inspect.Mounts, &MountPoint{
+		Type:        driver.Name(),
+		Source:      driver.Source(container.Id, container.Image),
+		Destination: rootfs,
+		ReadOnly:    container.ReadOnly,
+		Propagation: Propagation_RPrivate,
+		Mounted:     mounted[rootfs],
+	})
+
+	if volume, _ := ParseVolume(container.Volume); volume != nil {
+		inspect.Mounts = append(inspect.Mounts, &MountPoint{
+			Type:        "bind",
+			Source:      volume.HostPath,
+			Destination: volume.ContainerPath,
+			Propagation: volume.Propagation,
+			Mounted:     mounted[rootfs+volume.ContainerPath],
+		})
+	}
+	return inspect, nil
+}
+
+// TopContainer 通过容器cgroup内的进程列表以及/proc读取容器内的进程信息
+func TopContainer(containerRef string) ([]*ProcessInfo, error) {
+	container, err := GetSpecificContainers(containerRef)
+	if err != nil {
+		return nil, err
+	}
+
+	if container.Status != ContainerStatus_Running && container.Status != ContainerStatus_Paused {
+		return nil, fmt.Errorf("container:%s is not running, status:%s", container.Id, container.Status)
+	}
+
+	pids, err := newContainerCgroupManager(container.Id).Pids()
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]*ProcessInfo, 0, len(pids))
+	for _, pid := range pids {
+		process, err := readProcessInfo(pid)
+		if err != nil {
+			// 读取过程中进程已经退出
+			continue
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+func readProcessInfo(pid int) (*ProcessInfo, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// /proc/<pid>/stat: pid (comm) state ppid ...，comm中可能包含空格和括号，从最后一个')'开始解析
+	content := string(stat)
+	commEnd := strings.LastIndex(content, ")")
+	if commEnd < 0 {
+		return nil, fmt.Errorf("invalid stat of process:%d", pid)
+	}
+	fields := strings.Fields(content[commEnd+1:])
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid stat of process:%d", pid)
+	}
+
+	process := &ProcessInfo{Pid: pid, State: fields[0]}
+	process.PPid, _ = strconv.Atoi(fields[1])
+	process.Cmd = content[strings.Index(content, "(")+1 : commEnd]
+
+	// 内核线程没有cmdline，使用comm
+	if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+		process.Cmd = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+
+	if status, err := os.Open(fmt.Sprintf("/proc/%d/status", pid)); err == nil {
+		scanner := bufio.NewScanner(status)
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "Uid:" {
+				process.Uid = fields[1]
+				break
+			}
+		}
+		status.Close()
+	}
+	return process, nil
+}
+
+// HostMountPoints 读取宿主机当前所有的挂载点
+func HostMountPoints() (map[string]bool, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mountPoints := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 第5列为挂载点
+		if fields := strings.Fields(scanner.Text()); len(fields) > 4 {
+			mountPoints[fields[4]] = true
+		}
+	}
+	return mountPoints, scanner.Err()
+}
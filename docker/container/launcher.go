@@ -0,0 +1,27 @@
+package container
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ProcessLauncher 容器进程的启动以及信号，默认直接调用系统调用，测试时可以替换为内存中的实现
+type ProcessLauncher interface {
+	// Start 启动容器的init进程，新建的namespace由cmd.SysProcAttr.Cloneflags指定
+	Start(cmd *exec.Cmd) error
+	// Signal 向进程发送信号，sig为0时只检查进程是否存在
+	Signal(pid int, sig syscall.Signal) error
+}
+
+// DefaultLauncher 启动、停止、删除以及重启容器时使用的ProcessLauncher
+var DefaultLauncher ProcessLauncher = &hostLauncher{}
+
+type hostLauncher struct{}
+
+func (launcher *hostLauncher) Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+func (launcher *hostLauncher) Signal(pid int, sig syscall.Signal) error {
+	return syscall.Kill(pid, sig)
+}
@@ -0,0 +1,202 @@
+package container
+
+import (
+	"fmt"
+	"github.com/bytedance/sonic"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+const (
+	ListFormat_Json = "json"
+
+	// listCommandsWidth 默认输出中命令列的最大宽度
+	listCommandsWidth = 20
+)
+
+// ListOptions show命令的过滤以及输出选项
+type ListOptions struct {
+	// All 为false时只输出运行中(包括暂停)的容器
+	All bool
+	// Filters 过滤条件，同一个key的多个值之间为或关系，不同key之间为与关系
+	Filters map[string][]string
+	// Format 为json时输出json数组，否则作为go template逐个容器渲染
+	Format  string
+	Quiet   bool
+	NoTrunc bool
+}
+
+// ParseListFilters 解析 key=value 形式的过滤条件，支持 status/name/label/network/ancestor
+func ParseListFilters(filters []string) (map[string][]string, error) {
+	parsed := make(map[string][]string)
+	for _, filter := range filters {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid filter:%s, format: key=value", filter)
+		}
+
+		switch kv[0] {
+		case "status", "name", "label", "network", "ancestor":
+			parsed[kv[0]] = append(parsed[kv[0]], kv[1])
+		default:
+			return nil, fmt.Errorf("invalid filter key:%s, supported: status, name, label, network, ancestor", kv[0])
+		}
+	}
+	return parsed, nil
+}
+
+// ListContainers 读取当前host内的容器记录并按照options过滤，无法解析的记录输出告警到stderr
+func ListContainers(options *ListOptions) ([]*ContainerInfo, error) {
+	files, err := ioutil.ReadDir(GhnDockerRunningRootDir)
+	if os.IsNotExist(err) {
+		return make([]*ContainerInfo, 0), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read container records failed, err:%s", err)
+	}
+
+	containers := make([]*ContainerInfo, 0)
+	for _, file := range files {
+		container, err := handleContainerDir(file.Name())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skip broken container record:%s, err:%s\n", file.Name(), err)
+			continue
+		}
+
+		if !options.All && container.Status != ContainerStatus_Running && container.Status != ContainerStatus_Paused {
+			continue
+		}
+		if !matchFilters(container, options.Filters) {
+			continue
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// ListAllContainers 将当前host内的容器信息按照options输出到w
+func ListAllContainers(options *ListOptions, w io.Writer) error {
+	containers, err := ListContainers(options)
+	if err != nil {
+		return err
+	}
+	return RenderContainers(containers, options, w)
+}
+
+// RenderContainers 按照options中的输出选项将容器列表输出到w
+func RenderContainers(containers []*ContainerInfo, options *ListOptions, w io.Writer) error {
+	switch {
+	case options.Quiet:
+		for _, container := range containers {
+			fmt.Fprintln(w, container.Id)
+		}
+		return nil
+	case options.Format == ListFormat_Json:
+		bytes, err := sonic.Marshal(containers)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(bytes))
+		return err
+	case options.Format != "":
+		return renderTemplate(w, options.Format, containers)
+	}
+
+	tw := tabwriter.NewWriter(w, 12, 1, 3, ' ', 0)
+	fmt.Fprint(tw, "ID\tNAME\tIMAGE\tPID\tSTATUS\tOOM\tCREATE_TIME\tCMDS\n")
+
+	for _, container := range containers {
+		commands := container.Commands
+		if !options.NoTrunc && len(commands) > listCommandsWidth {
+			commands = commands[:listCommandsWidth-3] + "..."
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			container.Id,
+			container.ContainerName,
+			container.Image,
+			container.Pid,
+			statusSummary(container),
+			oomSummary(container),
+			container.CreateTime,
+			commands)
+	}
+	return tw.Flush()
+}
+
+func renderTemplate(w io.Writer, format string, containers []*ContainerInfo) error {
+	tmpl, err := template.New("show").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			return sonic.MarshalString(v)
+		},
+	}).Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid format template, err:%s", err)
+	}
+
+	for _, container := range containers {
+		if err = tmpl.Execute(w, container); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func matchFilters(container *ContainerInfo, filters map[string][]string) bool {
+	for key, values := range filters {
+		matched := false
+		for _, value := range values {
+			if matchFilter(container, key, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchFilter(container *ContainerInfo, key string, value string) bool {
+	switch key {
+	case "status":
+		return strings.EqualFold(string(container.Status), value)
+	case "name":
+		return strings.Contains(container.ContainerName, value)
+	case "network":
+		return container.NetworkSettings(value) != nil
+	case "ancestor":
+		return container.Image == value
+	case "label":
+		// label=key 只要求存在，label=key=value 要求值相等
+		kv := strings.SplitN(value, "=", 2)
+		labelValue, exist := container.Labels[kv[0]]
+		if len(kv) == 1 {
+			return exist
+		}
+		return exist && labelValue == kv[1]
+	}
+	return false
+}
+
+// ParseLabels 解析 run --label k=v
+func ParseLabels(labels []string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, label := range labels {
+		kv := strings.SplitN(label, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid label:%s, format: key=value", label)
+		}
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		parsed[kv[0]] = kv[1]
+	}
+	return parsed, nil
+}
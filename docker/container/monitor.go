@@ -0,0 +1,310 @@
+package container
+
+import (
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// monitorInterval 监控进程检查容器进程存活的周期
+	monitorInterval = time.Second
+)
+
+// RestartFunc 在原有工作空间上重新拉起容器进程，需要将新的进程pid写入container.Pid
+type RestartFunc func(container *ContainerInfo) error
+
+// ProcessExit 监控方作为父进程回收到的容器进程退出状态
+type ProcessExit struct {
+	Pid      int
+	ExitCode int
+}
+
+// MonitorContainer 容器监控进程的主循环
+// 1. 监听cgroup的oom以及内存压力事件，并写入容器记录
+// 2. 配置了健康检查时周期性探测，unhealthy时按配置通过restart重启容器
+// 3. 容器进程退出之后更新容器状态，按照重启策略重新拉起，不需要重启时结束监控
+// 监控方是容器进程(包括restart拉起的进程)的父进程时，通过exits获得退出码，否则周期性检查进程是否存活，退出码未知
+func MonitorContainer(containerId string, restart RestartFunc, exits <-chan *ProcessExit) error {
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return err
+	}
+
+	pid, _ := strconv.Atoi(container.Pid)
+	namespace := newContainerCgroupManager(containerId).Namespace
+
+	events, err := subsystem.NewMemoryConfig().NotifyMemoryEvents(namespace)
+	if err != nil {
+		// 无法监听内存事件时仍然需要继续维护容器状态
+		logrus.Warnf("[MonitorContainer] watch memory events of container:%s failed, err:%s", containerId, err)
+	}
+
+	var aliveTicker <-chan time.Time
+	if exits == nil {
+		ticker := time.NewTicker(monitorInterval)
+		defer ticker.Stop()
+		aliveTicker = ticker.C
+	}
+
+	var (
+		healthTicker <-chan time.Time
+		// 探测在独立的协程中执行，不阻塞退出检测以及内存事件的处理，同一时间只有一个探测
+		healthResults = make(chan healthResult, 1)
+		probing       bool
+		startAt       = time.Now()
+	)
+	if container.HealthConfig != nil {
+		healthTick := time.NewTicker(container.HealthConfig.Interval)
+		defer healthTick.Stop()
+		healthTicker = healthTick.C
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			logrus.Infof("[MonitorContainer] container:%s memory event:%s count:%d", containerId, event.Type, event.Count)
+			if err = recordMemoryEvent(containerId, event); err != nil {
+				logrus.Errorf("[MonitorContainer] record memory event failed, err:%s", err)
+			}
+		case <-healthTicker:
+			if probing {
+				continue
+			}
+			probing = true
+			go func(pid int, inStartPeriod bool) {
+				unhealthy, err := checkHealth(containerId, container.HealthConfig, inStartPeriod)
+				healthResults <- healthResult{pid: pid, unhealthy: unhealthy, err: err}
+			}(pid, time.Since(startAt) < container.HealthConfig.StartPeriod)
+		case result := <-healthResults:
+			probing = false
+			if result.err != nil {
+				logrus.Errorf("[MonitorContainer] health check failed, err:%s", result.err)
+				continue
+			}
+			// 探测期间容器已经按照重启策略重新拉起时，结果不再适用
+			if !result.unhealthy || result.pid != pid || !container.HealthConfig.RestartOnUnhealthy || restart == nil {
+				continue
+			}
+
+			logrus.Infof("[MonitorContainer] container:%s is unhealthy, restart it", containerId)
+			newPid, err := restartContainer(containerId, restart)
+			if err != nil {
+				logrus.Errorf("[MonitorContainer] restart unhealthy container failed, err:%s", err)
+				continue
+			}
+			pid, startAt = newPid, time.Now()
+		case exit := <-exits:
+			// 健康检查重启时kill的旧进程
+			if exit.Pid != pid {
+				continue
+			}
+			logrus.Infof("[MonitorContainer] container:%s process:%d exited, exit code:%d", containerId, pid, exit.ExitCode)
+			newPid, err := containerExited(containerId, exit.ExitCode, restart)
+			if err != nil || newPid == 0 {
+				return err
+			}
+			pid, startAt = newPid, time.Now()
+		case <-aliveTicker:
+			if IsProcessAlive(pid) {
+				continue
+			}
+			logrus.Infof("[MonitorContainer] container:%s process:%d exited", containerId, pid)
+			// 不是容器进程的父进程，无法获得退出码(daemon托管时由回收协程记录)
+			newPid, err := containerExited(containerId, -1, restart)
+			if err != nil || newPid == 0 {
+				return err
+			}
+			pid, startAt = newPid, time.Now()
+		}
+	}
+}
+
+// containerExited 记录容器进程退出，按照重启策略重新拉起时返回新的进程pid，不需要重启时返回0
+func containerExited(containerId string, exitCode int, restart RestartFunc) (int, error) {
+	if err := MarkContainerExited(containerId, exitCode); err != nil {
+		return 0, err
+	}
+
+	exited, err := loadContainerInfo(containerId)
+	if err != nil || !shouldRestart(exited) || restart == nil {
+		return 0, err
+	}
+	logrus.Infof("[MonitorContainer] restart container:%s by policy:%s", containerId, exited.RestartPolicy)
+	newPid, err := restartContainer(containerId, restart)
+	if err != nil {
+		logrus.Errorf("[MonitorContainer] restart exited container failed, err:%s", err)
+		return 0, err
+	}
+	return newPid, nil
+}
+
+// healthResult 一次健康检查的结果
+type healthResult struct {
+	// pid 发起探测时的容器进程pid
+	pid int
+	// unhealthy 容器是否刚刚变为unhealthy
+	unhealthy bool
+	err       error
+}
+
+// checkHealth 执行一次健康检查并写入容器记录，返回容器是否刚刚变为unhealthy
+func checkHealth(containerId string, config *HealthConfig, inStartPeriod bool) (bool, error) {
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return false, err
+	}
+
+	// 暂停/停止的容器不做探测
+	if container.Status != ContainerStatus_Running {
+		return false, nil
+	}
+
+	probe := runHealthProbe(container.Pid, config)
+
+	// 探测可能耗时较长，期间容器可能已经被stop或者重启，在锁内重新读取记录，仍是同一个运行中的进程时才更新
+	unhealthy := false
+	_, err = modifyContainerInfo(containerId, func(current *ContainerInfo) (bool, error) {
+		if current.Status != ContainerStatus_Running || current.Pid != container.Pid {
+			return false, nil
+		}
+		if current.Health == nil {
+			current.Health = &HealthState{Status: HealthStatus_Starting}
+		}
+		unhealthy = current.Health.update(probe, config, inStartPeriod)
+		return true, nil
+	})
+	return unhealthy, err
+}
+
+// restartContainer kill掉当前的容器进程(已经退出的容器跳过)，并通过restart重新拉起，返回新的进程pid
+func restartContainer(containerId string, restart RestartFunc) (int, error) {
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return 0, err
+	}
+
+	// kill容器内的1号进程，pid namespace内的其他进程会随之退出
+	// 已经退出的容器pid为空，kill(0)会发给整个进程组，必须跳过
+	oldPid, _ := strconv.Atoi(container.Pid)
+	if container.Status == ContainerStatus_Running && oldPid > 0 {
+		if err = DefaultLauncher.Signal(oldPid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return 0, err
+		}
+		recordContainerEvent(container, EventAction_Kill, map[string]string{"signal": "SIGKILL"})
+		for i := 0; i < 50 && IsProcessAlive(oldPid); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if err = restart(container); err != nil {
+		return 0, err
+	}
+
+	// restart更新了进程pid以及网络，其余字段以锁内重新读取的记录为准
+	container, err = modifyContainerInfo(containerId, func(current *ContainerInfo) (bool, error) {
+		current.Pid = container.Pid
+		current.Networks = container.Networks
+		current.Status = ContainerStatus_Running
+		current.Health = &HealthState{Status: HealthStatus_Starting}
+		current.FinishedAt = ""
+		current.RestartCount++
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	recordContainerEvent(container, EventAction_Start, map[string]string{"restart_count": strconv.Itoa(container.RestartCount)})
+
+	newPid, _ := strconv.Atoi(container.Pid)
+	return newPid, nil
+}
+
+// recordMemoryEvent 将内存事件累加到容器记录，在锁内重新读取记录，避免覆盖其他命令的修改
+func recordMemoryEvent(containerId string, event subsystem.MemoryEvent) error {
+	container, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		switch event.Type {
+		case subsystem.MemoryEvent_OOM:
+			container.OomCount += event.Count
+			container.LastOomTime = time.Now().Format("2006-01-02 15:04:05")
+			// 关闭了oom kill时进程只会被挂起，不会被kill
+			if container.ResourceConfig == nil || !container.ResourceConfig.OomKillDisable {
+				container.OomKilled = true
+			}
+		case subsystem.MemoryEvent_Pressure:
+			container.MemoryPressureCount += event.Count
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if event.Type == subsystem.MemoryEvent_OOM {
+		recordContainerEvent(container, EventAction_Oom, map[string]string{"count": strconv.FormatInt(event.Count, 10)})
+	}
+	return nil
+}
+
+// MarkContainerExited 容器进程退出，但记录仍处于运行态时修改为EXIT并记录die事件(stop命令已经修改过的记录保持不变)
+// exitCode为-1表示退出码未知
+func MarkContainerExited(containerId string, exitCode int) error {
+	died := false
+	container, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		// daemon托管的容器同时由回收子进程的协程以及监控协程感知退出，只记录一次，监控协程先记录时补充退出码
+		if container.FinishedAt != "" {
+			if container.ExitCode < 0 && exitCode >= 0 {
+				container.ExitCode = exitCode
+				return true, nil
+			}
+			return false, nil
+		}
+		switch container.Status {
+		case ContainerStatus_Running, ContainerStatus_Paused:
+			container.Status = ContainerStatus_Exit
+			container.Pid = " "
+		case ContainerStatus_Stop:
+			// stop命令发送信号之后进程才退出
+		default:
+			return false, nil
+		}
+		container.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+		container.ExitCode = exitCode
+		died = true
+		return true, nil
+	})
+	if err != nil || !died {
+		return err
+	}
+
+	attributes := make(map[string]string)
+	if exitCode >= 0 {
+		attributes["exit_code"] = strconv.Itoa(exitCode)
+	}
+	recordContainerEvent(container, EventAction_Die, attributes)
+	return nil
+}
+
+// ExitCodeOf 进程的退出码，被信号杀死时与shell一样为128+信号值
+func ExitCodeOf(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// IsProcessAlive 通过0信号判断进程是否存在，没有权限(EPERM)同样表示进程存在
+func IsProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := DefaultLauncher.Signal(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestMonitorContainer_Exits(t *testing.T) {
+	cases := []struct {
+		name        string
+		exitCode    int
+		wantRestart bool
+	}{
+		{name: "success", exitCode: 0},
+		{name: "failure", exitCode: 3, wantRestart: true},
+		{name: "killed by signal", exitCode: 137, wantRestart: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useFakeHost(t, testPid)
+			container := newTestContainer(t, ContainerStatus_Running)
+			container.RestartPolicy = &RestartPolicy{Name: RestartPolicy_OnFailure, MaximumRetryCount: 1}
+			assert.Nil(t, dumpContainerInfo(container))
+
+			// 监控方是容器进程的父进程，退出码通过exits传入，重启之后的进程正常退出
+			exits := make(chan *ProcessExit, 2)
+			restarted := false
+			restart := func(container *ContainerInfo) error {
+				restarted = true
+				container.Pid = strconv.Itoa(testPid + 1)
+				exits <- &ProcessExit{Pid: testPid + 1, ExitCode: 0}
+				return nil
+			}
+			exits <- &ProcessExit{Pid: testPid, ExitCode: c.exitCode}
+			assert.Nil(t, MonitorContainer(testContainerId, restart, exits))
+			assert.Equal(t, c.wantRestart, restarted)
+
+			record, err := loadContainerInfo(testContainerId)
+			assert.Nil(t, err)
+			assert.Equal(t, ContainerStatus_Exit, record.Status)
+
+			out := &bytes.Buffer{}
+			options := &EventOptions{Format: "json", Filters: map[string][]string{"event": {EventAction_Die}}}
+			assert.Nil(t, StreamEvents(options, out, nil))
+			assert.Contains(t, out.String(), fmt.Sprintf(`"exit_code":"%d"`, c.exitCode))
+		})
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   string
+		status   ContainerStatus
+		exitCode int
+		want     bool
+	}{
+		{name: "always", policy: "always", status: ContainerStatus_Exit, want: true},
+		{name: "always stopped", policy: "always", status: ContainerStatus_Stop},
+		{name: "on-failure success", policy: "on-failure", status: ContainerStatus_Exit},
+		{name: "on-failure failure", policy: "on-failure", status: ContainerStatus_Exit, exitCode: 1, want: true},
+		{name: "on-failure unknown exit code", policy: "on-failure", status: ContainerStatus_Exit, exitCode: -1},
+		{name: "no", policy: "no", status: ContainerStatus_Exit, exitCode: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := ParseRestartPolicy(c.policy)
+			assert.Nil(t, err)
+			container := &ContainerInfo{Status: c.status, ExitCode: c.exitCode, RestartPolicy: policy}
+			assert.Equal(t, c.want, shouldRestart(container))
+		})
+	}
+
+	_, err := ParseRestartPolicy("unless-stopped")
+	assert.NotNil(t, err)
+}
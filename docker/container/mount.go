@@ -0,0 +1,133 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+	"unsafe"
+)
+
+const (
+	// unmountRetries 挂载点忙(EBUSY)时重试普通卸载的次数，仍然失败时使用MNT_DETACH延迟卸载
+	unmountRetries       = 5
+	unmountRetryInterval = 100 * time.Millisecond
+
+	loopControlDevice = "/dev/loop-control"
+	loopDeviceFormat  = "/dev/loop%d"
+)
+
+// Mounter 容器文件系统的挂载操作，默认直接调用系统调用，测试时可以替换为内存中的实现
+type Mounter interface {
+	// Mount 挂载文件系统，参数与mount(2)一致
+	Mount(source string, target string, fstype string, flags uintptr, data string) error
+	// Unmount 卸载target，target不是挂载点时视为已经卸载
+	Unmount(target string) error
+	// LoopMount 将文件系统镜像关联到空闲的loop设备并挂载到target
+	LoopMount(image string, target string, fstype string) error
+}
+
+// DefaultMounter 存储驱动、数据卷以及容器init进程使用的Mounter
+var DefaultMounter Mounter = &hostMounter{}
+
+// mount 封装DefaultMounter.Mount
+func mount(source string, target string, fstype string, flags uintptr, data string) error {
+	return DefaultMounter.Mount(source, target, fstype, flags, data)
+}
+
+// bindMount 将source以bind mount的方式挂载到target
+func bindMount(source string, target string) error {
+	return mount(source, target, "", unix.MS_BIND, "")
+}
+
+// unmount 卸载target，target不是挂载点时视为已经卸载
+func unmount(target string) error {
+	return DefaultMounter.Unmount(target)
+}
+
+// loopMount 将文件系统镜像以loop设备挂载到target
+func loopMount(image string, target string, fstype string) error {
+	return DefaultMounter.LoopMount(image, target, fstype)
+}
+
+type hostMounter struct{}
+
+// Mount 错误中包含挂载源、挂载点、文件系统类型以及挂载选项
+func (mounter *hostMounter) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if err := unix.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("mount %s on %s (type:%q, flags:%#x, options:%q) failed, err:%s", source, target, fstype, flags, data, err)
+	}
+	return nil
+}
+
+// Unmount 挂载点忙时重试，重试之后仍然忙则使用MNT_DETACH从挂载树中摘除，由内核在最后一个使用者退出之后完成卸载
+func (mounter *hostMounter) Unmount(target string) error {
+	var err error
+	for i := 0; i < unmountRetries; i++ {
+		if err = unix.Unmount(target, 0); err == nil || err == unix.EINVAL || err == unix.ENOENT {
+			return nil
+		}
+		if err != unix.EBUSY {
+			return fmt.Errorf("umount %s failed, err:%s", target, err)
+		}
+		time.Sleep(unmountRetryInterval)
+	}
+
+	logrus.Warnf("[unmount] %s is busy, detach it lazily", target)
+	if err = unix.Unmount(target, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("umount %s with MNT_DETACH failed, err:%s", target, err)
+	}
+	return nil
+}
+
+// LoopMount loop设备设置了自动清除，卸载之后自动释放
+func (mounter *hostMounter) LoopMount(image string, target string, fstype string) error {
+	control, err := os.OpenFile(loopControlDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("open %s failed, err:%s", loopControlDevice, err)
+	}
+	defer control.Close()
+
+	backing, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer backing.Close()
+
+	// 获取空闲设备与关联之间可能被其他进程抢占，抢占时重新获取
+	for i := 0; i < unmountRetries; i++ {
+		index, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return fmt.Errorf("get free loop device failed, err:%s", err)
+		}
+
+		device := fmt.Sprintf(loopDeviceFormat, index)
+		loop, err := os.OpenFile(device, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("open %s failed, err:%s", device, err)
+		}
+
+		if err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+			loop.Close()
+			if err == unix.EBUSY {
+				continue
+			}
+			return fmt.Errorf("attach %s to %s failed, err:%s", image, device, err)
+		}
+
+		info := &unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR}
+		copy(info.File_name[:], image)
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, loop.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(info))); errno != 0 {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return fmt.Errorf("set status of %s failed, err:%s", device, errno)
+		}
+
+		err = mounter.Mount(device, target, fstype, 0, "")
+		// 挂载之后文件系统持有loop设备，关闭之后由自动清除标志在卸载时释放，挂载失败时关闭即释放
+		loop.Close()
+		return err
+	}
+	return fmt.Errorf("attach %s to loop device failed, all free devices were taken", image)
+}
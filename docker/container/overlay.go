@@ -0,0 +1,154 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// OverlayDriver 以镜像目录为lower层、容器可写层为upper层挂载overlay
+type OverlayDriver struct{}
+
+func (driver *OverlayDriver) Name() string {
+	return StorageDriver_Overlay
+}
+
+// layerDirs 容器的upper以及work目录，两者需要位于同一个文件系统:
+// 限制容量时都位于挂载了ext4镜像的可写层目录下，否则分别为可写层目录以及work目录
+func (driver *OverlayDriver) layerDirs(containerId string) (string, string) {
+	containerUrl := fmt.Sprintf(GhnDockerContainerDir, containerId)
+	if hasQuota(containerId) {
+		return containerUrl + "/upper", containerUrl + "/work"
+	}
+	return containerUrl, fmt.Sprintf(GhnDockerWorkDir, containerId)
+}
+
+func (driver *OverlayDriver) CreateLayer(containerId string, image string, size int64) error {
+	if size > 0 {
+		if err := createQuota(containerId, fmt.Sprintf(GhnDockerContainerDir, containerId), size); err != nil {
+			logrus.Errorf("[OverlayDriver.CreateLayer] create quota failed, err:%s", err)
+			return err
+		}
+	}
+
+	upper, work := driver.layerDirs(containerId)
+	if err := os.MkdirAll(upper, 0777); err != nil {
+		logrus.Errorf("[OverlayDriver.CreateLayer] mk container dir failed, err:%s", err)
+		return err
+	}
+
+	if err := os.MkdirAll(work, 0777); err != nil {
+		logrus.Errorf("[OverlayDriver.CreateLayer] mk tmp work dir failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (driver *OverlayDriver) Mount(containerId string, image string) error {
+	mountUrl := fmt.Sprintf(GhnDockerMountPoint, containerId)
+	if err := os.MkdirAll(mountUrl, 0777); err != nil {
+		logrus.Errorf("[OverlayDriver.Mount] mk mnt dir failed, err:%s", err)
+		return err
+	}
+
+	dirs := driver.Source(containerId, image)
+	logrus.Infof("overlay dirs:%s", dirs)
+	// mount -t overlay -o lowerdir=./lower,upperdir=./upper,workdir=./work ./merged
+	if err := mount("overlay", mountUrl, "overlay", 0, dirs); err != nil {
+		logrus.Errorf("[OverlayDriver.Mount] mount failed, err:%s", err)
+		// 挂载失败时挂载点只是一个空目录，直接删除
+		os.RemoveAll(mountUrl)
+		return err
+	}
+	return nil
+}
+
+func (driver *OverlayDriver) Unmount(containerId string) error {
+	return RemoveMountPoints(containerId)
+}
+
+// Diff 遍历upper目录，upper中的文件在镜像中存在时为修改，whiteout以及被opaque目录遮住的镜像文件为删除
+func (driver *OverlayDriver) Diff(containerId string, image string) ([]*FileChange, error) {
+	upper, _ := driver.layerDirs(containerId)
+	lower := fmt.Sprintf(GhnDockerImageDir, image)
+
+	changes := make([]*FileChange, 0)
+	err := filepath.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = "/" + rel
+
+		// overlay使用0/0的字符设备表示删除(whiteout)
+		if isWhiteout(info) {
+			changes = append(changes, &FileChange{Kind: ChangeKind_Deleted, Path: rel})
+			return nil
+		}
+
+		kind := ChangeKind_Added
+		if _, statErr := os.Lstat(filepath.Join(lower, rel)); statErr == nil {
+			kind = ChangeKind_Changed
+		}
+		changes = append(changes, &FileChange{Kind: kind, Path: rel})
+
+		// opaque目录遮住了镜像中该目录下原有的全部内容，upper中没有的都是删除
+		if info.IsDir() && isOpaqueDir(path) {
+			entries, readErr := os.ReadDir(filepath.Join(lower, rel))
+			if readErr != nil && !os.IsNotExist(readErr) {
+				return readErr
+			}
+			for _, entry := range entries {
+				if _, statErr := os.Lstat(filepath.Join(path, entry.Name())); os.IsNotExist(statErr) {
+					changes = append(changes, &FileChange{Kind: ChangeKind_Deleted, Path: filepath.Join(rel, entry.Name())})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func (driver *OverlayDriver) Remove(containerId string) error {
+	containerUrl := fmt.Sprintf(GhnDockerContainerDir, containerId)
+	if err := RemoveQuota(containerId, containerUrl); err != nil {
+		logrus.Errorf("[OverlayDriver.Remove] remove quota failed, err:%s", err)
+		return err
+	}
+
+	if err := os.RemoveAll(containerUrl); err != nil {
+		logrus.Errorf("[OverlayDriver.Remove] rm container dir failed, err:%s", err)
+		return err
+	}
+
+	tmpWorkUrl := fmt.Sprintf(GhnDockerWorkDir, containerId)
+	if err := os.RemoveAll(tmpWorkUrl); err != nil {
+		logrus.Errorf("[OverlayDriver.Remove] rm tmp work dir failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (driver *OverlayDriver) Source(containerId string, image string) string {
+	upper, work := driver.layerDirs(containerId)
+	return fmt.Sprintf(FileSystem_OverlayFormat, fmt.Sprintf(GhnDockerImageDir, image), upper, work)
+}
+
+// Layer overlay的upper目录，包含whiteout以及opaque目录的xattr
+func (driver *OverlayDriver) Layer(containerId string) string {
+	upper, _ := driver.layerDirs(containerId)
+	return upper
+}
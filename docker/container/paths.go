@@ -0,0 +1,66 @@
+package container
+
+// DefaultRootDir ghndocker在宿主机上保存镜像、容器可写层以及各类记录的根目录
+const DefaultRootDir = "/home/guohaonan/ghndocker"
+
+// 以下目录均位于根目录之下，由SetRootDir统一设置
+var (
+	GhnDockerImageDir     string
+	GhnDockerContainerDir string
+	GhnDockerWorkDir      string
+
+	GhnDockerImageRootDir     string
+	GhnDockerContainerRootDir string
+	GhnDockerWorkRootDir      string
+
+	GhnDockerRunningRootDir      string
+	GhnDockerRunningContainerDir string
+
+	// GhnDockerQuotaImage 限制容量的容器可写层使用的ext4镜像文件，以loop设备挂载到容器可写层目录
+	GhnDockerQuotaImage   string
+	GhnDockerQuotaRootDir string
+
+	// GhnDockerSnapshotDir 容器可写层的快照，每个容器一个目录，其下每个tag一个目录
+	GhnDockerSnapshotDir     string
+	GhnDockerSnapshotRootDir string
+
+	GhnDockerSecretDir string
+	// GhnDockerSecretKey 加密secret的AES-256密钥，首次创建secret时生成，只有root可读
+	GhnDockerSecretKey string
+
+	// GhnDockerEventsFile 生命周期事件日志，每行一个json格式的事件，只追加写入
+	GhnDockerEventsFile string
+)
+
+// GhnDockerMountPoint 容器根文件系统的挂载点，不在根目录之下
+var GhnDockerMountPoint = "/mnt/%s"
+
+func init() {
+	SetRootDir(DefaultRootDir)
+}
+
+// SetRootDir 将镜像、容器可写层、容器记录、快照、secret以及事件日志的目录切换到root之下，
+// 需要在任何容器操作之前调用，例如单元测试中指向临时目录
+func SetRootDir(root string) {
+	GhnDockerImageDir = root + "/image/%s"
+	GhnDockerContainerDir = root + "/container/%s"
+	GhnDockerWorkDir = root + "/work/%s"
+
+	GhnDockerImageRootDir = root + "/image/"
+	GhnDockerContainerRootDir = root + "/container/"
+	GhnDockerWorkRootDir = root + "/work/"
+
+	GhnDockerRunningRootDir = root + "/run/"
+	GhnDockerRunningContainerDir = root + "/run/%s"
+
+	GhnDockerQuotaImage = root + "/quota/%s.img"
+	GhnDockerQuotaRootDir = root + "/quota/"
+
+	GhnDockerSnapshotDir = root + "/snapshot/%s"
+	GhnDockerSnapshotRootDir = root + "/snapshot/"
+
+	GhnDockerSecretDir = root + "/secrets/"
+	GhnDockerSecretKey = root + "/secret.key"
+
+	GhnDockerEventsFile = root + "/events.log"
+}
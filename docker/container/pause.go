@@ -0,0 +1,55 @@
+package container
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup"
+	"github.com/sirupsen/logrus"
+)
+
+func newContainerCgroupManager(containerId string) *cgroup.CgroupManager {
+	return cgroup.NewCgroupManager(fmt.Sprintf(CGroupPathFormat, containerId), nil)
+}
+
+// PauseContainer 通过freezer子系统冻结容器内所有进程，并更新容器记录为PAUSED
+func PauseContainer(containerId string) error {
+	container, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		if container.Status != ContainerStatus_Running {
+			return false, fmt.Errorf("container:%s is not running, status:%s", containerId, container.Status)
+		}
+
+		if err := newContainerCgroupManager(containerId).Freeze(); err != nil {
+			logrus.Errorf("[PauseContainer] freeze container failed, err:%s", err)
+			return false, err
+		}
+
+		container.Status = ContainerStatus_Paused
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	recordContainerEvent(container, EventAction_Pause, nil)
+	return nil
+}
+
+// UnpauseContainer 解冻容器内所有进程，并更新容器记录为RUNNING
+func UnpauseContainer(containerId string) error {
+	container, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		if container.Status != ContainerStatus_Paused {
+			return false, fmt.Errorf("container:%s is not paused, status:%s", containerId, container.Status)
+		}
+
+		if err := newContainerCgroupManager(containerId).Thaw(); err != nil {
+			logrus.Errorf("[UnpauseContainer] thaw container failed, err:%s", err)
+			return false, err
+		}
+
+		container.Status = ContainerStatus_Running
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	recordContainerEvent(container, EventAction_Unpause, nil)
+	return nil
+}
@@ -0,0 +1,127 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNoSuchContainer 容器不存在，调用方可以通过errors.Is判断
+	ErrNoSuchContainer = errors.New("no such container")
+
+	containerNameFormat = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// ResolveContainer 根据完整id、唯一的id前缀或者容器名称查找容器记录
+// 优先级: 完整id > 容器名称 > id前缀，前缀匹配到多个容器时报错
+func ResolveContainer(containerRef string) (*ContainerInfo, error) {
+	if containerRef == "" {
+		return nil, fmt.Errorf("missing container id or name")
+	}
+
+	if isExist, _ := PathExist(fmt.Sprintf(GhnDockerRunningContainerDir, containerRef) + "/" + ConfFileName); isExist {
+		return loadContainerInfo(containerRef)
+	}
+
+	containers, err := listContainerRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range containers {
+		if container.ContainerName == containerRef {
+			return container, nil
+		}
+	}
+
+	matched := make([]*ContainerInfo, 0)
+	for _, container := range containers {
+		if strings.HasPrefix(container.Id, containerRef) {
+			matched = append(matched, container)
+		}
+	}
+
+	switch len(matched) {
+	case 0:
+		return nil, fmt.Errorf("%w:%s", ErrNoSuchContainer, containerRef)
+	case 1:
+		return matched[0], nil
+	default:
+		ids := make([]string, 0, len(matched))
+		for _, container := range matched {
+			ids = append(ids, container.Id)
+		}
+		sort.Strings(ids)
+		return nil, fmt.Errorf("container id prefix:%s is ambiguous, matches:%s", containerRef, strings.Join(ids, ","))
+	}
+}
+
+// ValidateContainerName 校验容器名称的格式以及唯一性
+func ValidateContainerName(name string) error {
+	if !containerNameFormat.MatchString(name) {
+		return fmt.Errorf("invalid container name:%s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	containers, err := listContainerRecords()
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		// 名称同样不能和已有容器的id冲突，否则按id查找时会被遮蔽
+		if container.ContainerName == name || container.Id == name {
+			return fmt.Errorf("container name:%s is already in use by container:%s", name, container.Id)
+		}
+	}
+	return nil
+}
+
+// RenameContainer 修改容器名称
+func RenameContainer(containerRef string, newName string) error {
+	container, err := ResolveContainer(containerRef)
+	if err != nil {
+		return err
+	}
+
+	if container.ContainerName == newName {
+		return nil
+	}
+
+	if err = ValidateContainerName(newName); err != nil {
+		return err
+	}
+
+	_, err = modifyContainerInfo(container.Id, func(container *ContainerInfo) (bool, error) {
+		container.ContainerName = newName
+		return true, nil
+	})
+	return err
+}
+
+// listContainerRecords 读取当前host内所有可以解析的容器记录
+func listContainerRecords() ([]*ContainerInfo, error) {
+	files, err := ioutil.ReadDir(GhnDockerRunningRootDir)
+	// 还没有创建过容器
+	if os.IsNotExist(err) {
+		return make([]*ContainerInfo, 0), nil
+	}
+	if err != nil {
+		logrus.Errorf("[listContainerRecords] Read Dir failed, err:%s", err)
+		return nil, err
+	}
+
+	containers := make([]*ContainerInfo, 0, len(files))
+	for _, file := range files {
+		container, err := handleContainerDir(file.Name())
+		if err != nil {
+			continue
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
@@ -0,0 +1,18 @@
+package container
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestResolveContainer_NoRecords(t *testing.T) {
+	// 新安装的host上还没有run目录
+	SetRootDir(t.TempDir())
+	defer SetRootDir(DefaultRootDir)
+
+	_, err := ResolveContainer("web")
+	assert.True(t, errors.Is(err, ErrNoSuchContainer))
+	assert.Nil(t, ValidateContainerName("web"))
+	assert.NotNil(t, ValidateContainerName("-web"))
+}
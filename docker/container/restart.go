@@ -0,0 +1,80 @@
+package container
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type RestartPolicyName string
+
+const (
+	RestartPolicy_No        RestartPolicyName = "no"
+	RestartPolicy_Always    RestartPolicyName = "always"
+	RestartPolicy_OnFailure RestartPolicyName = "on-failure"
+)
+
+// RestartPolicy 容器进程退出之后由监控方按策略重新拉起
+type RestartPolicy struct {
+	Name RestartPolicyName `json:"name"`
+	// MaximumRetryCount on-failure最多重启的次数，0表示不限制
+	MaximumRetryCount int `json:"maximum_retry_count"`
+}
+
+// ParseRestartPolicy 解析 no、always、on-failure[:max-retries]。
+// 不支持unless-stopped: 没有在daemon重启时拉起已停止容器的逻辑，与always没有区别，通过stop停止的容器都不会被重启
+func ParseRestartPolicy(value string) (*RestartPolicy, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	name, retries, hasRetries := strings.Cut(value, ":")
+	policy := &RestartPolicy{Name: RestartPolicyName(name)}
+	switch policy.Name {
+	case RestartPolicy_No, RestartPolicy_Always:
+		if hasRetries {
+			return nil, fmt.Errorf("restart policy:%s does not support max retries", name)
+		}
+	case RestartPolicy_OnFailure:
+		if hasRetries {
+			count, err := strconv.Atoi(retries)
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("invalid max retries:%s of restart policy", retries)
+			}
+			policy.MaximumRetryCount = count
+		}
+	default:
+		return nil, fmt.Errorf("invalid restart policy:%s, supported: no, always, on-failure[:max-retries]", value)
+	}
+	return policy, nil
+}
+
+func (policy *RestartPolicy) String() string {
+	if policy == nil {
+		return string(RestartPolicy_No)
+	}
+	if policy.Name == RestartPolicy_OnFailure && policy.MaximumRetryCount > 0 {
+		return fmt.Sprintf("%s:%d", policy.Name, policy.MaximumRetryCount)
+	}
+	return string(policy.Name)
+}
+
+// shouldRestart 已经记录退出的容器是否需要重启，通过stop停止的容器不重启。
+// 退出码未知(-1，监控方不是容器进程的父进程)时无法区分是否失败，on-failure不重启
+func shouldRestart(container *ContainerInfo) bool {
+	policy := container.RestartPolicy
+	if policy == nil || container.Status != ContainerStatus_Exit {
+		return false
+	}
+
+	switch policy.Name {
+	case RestartPolicy_Always:
+		return true
+	case RestartPolicy_OnFailure:
+		if container.ExitCode <= 0 {
+			return false
+		}
+		return policy.MaximumRetryCount == 0 || container.RestartCount < policy.MaximumRetryCount
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package container
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Rollback 补偿操作栈: 每完成一步压入对应的撤销操作，失败时按照与执行相反的顺序依次撤销
+type Rollback struct {
+	steps []*rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+// Push 压入一步撤销操作，name用于撤销失败时的日志
+func (rollback *Rollback) Push(name string, undo func() error) {
+	rollback.steps = append(rollback.steps, &rollbackStep{name: name, undo: undo})
+}
+
+// Undo 倒序执行所有撤销操作，单步撤销失败只记录日志，继续撤销其余步骤
+func (rollback *Rollback) Undo() {
+	for i := len(rollback.steps) - 1; i >= 0; i-- {
+		step := rollback.steps[i]
+		if err := step.undo(); err != nil {
+			logrus.Errorf("[Rollback] undo %s failed, err:%s", step.name, err)
+		}
+	}
+	rollback.steps = nil
+}
@@ -0,0 +1,386 @@
+package container
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SecretMountDir 容器内存放secret的私有tmpfs
+	SecretMountDir = "/run/secrets"
+
+	// MaxSecretSize secret通过管道传给init进程并保存在内存中，限制大小
+	MaxSecretSize = 500 << 10
+
+	secretKeySize = 32
+	// secretPipeFd init进程读取secret的管道，fd 3为用户命令
+	secretPipeFd = 4
+)
+
+var ErrNoSuchSecret = errors.New("no such secret")
+
+// SecretInfo secret的元数据，列表中不包含内容
+type SecretInfo struct {
+	Name       string `json:"name"`
+	CreateTime string `json:"create_time"`
+	Size       int    `json:"size"`
+}
+
+// secretFile 持久化的secret，Data为nonce+AES-GCM密文，以secret名称作为附加数据防止密文被挪用
+type secretFile struct {
+	SecretInfo
+	Data []byte `json:"data"`
+}
+
+// SecretReference 容器引用的secret，容器记录中只保存引用，不保存内容
+type SecretReference struct {
+	Name   string      `json:"name"`
+	Target string      `json:"target"`
+	Mode   os.FileMode `json:"mode"`
+}
+
+// SecretPayload 启动容器时通过管道传给init进程的secret内容
+type SecretPayload struct {
+	Name   string      `json:"name"`
+	Target string      `json:"target"`
+	Mode   os.FileMode `json:"mode"`
+	Data   []byte      `json:"data"`
+}
+
+// ParseSecretReference 解析 name[,target=/run/secrets/x,mode=0400]，target默认为/run/secrets/<name>，mode默认为0444。
+// target必须位于/run/secrets下，secret只写入该目录的tmpfs，不会在容器根文件系统中创建文件
+func ParseSecretReference(value string) (*SecretReference, error) {
+	fields := strings.Split(value, ",")
+	ref := &SecretReference{Name: fields[0], Mode: 0444}
+	if err := validateSecretName(ref.Name); err != nil {
+		return nil, err
+	}
+	ref.Target = path.Join(SecretMountDir, ref.Name)
+
+	for _, field := range fields[1:] {
+		key, setting, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid secret option:%s, expected key=value", field)
+		}
+		switch key {
+		case "target":
+			// 相对路径相对于/run/secrets
+			if !path.IsAbs(setting) {
+				setting = path.Join(SecretMountDir, setting)
+			}
+			ref.Target = path.Clean(setting)
+			if err := validateSecretTarget(ref.Target); err != nil {
+				return nil, err
+			}
+		case "mode":
+			mode, err := strconv.ParseUint(setting, 8, 32)
+			if err != nil || mode > 0777 {
+				return nil, fmt.Errorf("invalid secret mode:%s, example: mode=0400", setting)
+			}
+			ref.Mode = os.FileMode(mode)
+		default:
+			return nil, fmt.Errorf("unknown secret option:%s", key)
+		}
+	}
+	return ref, nil
+}
+
+// validateSecretTarget target必须是/run/secrets下的路径
+func validateSecretTarget(target string) error {
+	if !strings.HasPrefix(target, SecretMountDir+"/") {
+		return fmt.Errorf("invalid secret target:%s, must be under %s", target, SecretMountDir)
+	}
+	return nil
+}
+
+func validateSecretName(name string) error {
+	if len(name) > 64 || !containerNameFormat.MatchString(name) {
+		return fmt.Errorf("invalid secret name:%s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed and at most 64 characters", name)
+	}
+	return nil
+}
+
+// CreateSecret 加密保存secret，同名secret已经存在时报错
+func CreateSecret(name string, data []byte) error {
+	if err := validateSecretName(name); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("secret:%s is empty", name)
+	}
+	if len(data) > MaxSecretSize {
+		return fmt.Errorf("secret:%s is too large, maximum is 500KB", name)
+	}
+
+	gcm, err := secretCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	content, err := sonic.Marshal(&secretFile{
+		SecretInfo: SecretInfo{Name: name, CreateTime: time.Now().Format("2006-01-02 15:04:05"), Size: len(data)},
+		Data:       gcm.Seal(nonce, nonce, data, []byte(name)),
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(secretPath(name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("secret:%s already exists", name)
+		}
+		return err
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		os.Remove(secretPath(name))
+		return err
+	}
+	return file.Close()
+}
+
+// ListSecrets 按名称排序列出所有secret
+func ListSecrets() ([]*SecretInfo, error) {
+	files, err := ioutil.ReadDir(GhnDockerSecretDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]*SecretInfo, 0), nil
+		}
+		return nil, err
+	}
+
+	secrets := make([]*SecretInfo, 0, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || name == file.Name() {
+			continue
+		}
+		secret, err := loadSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, &secret.SecretInfo)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+// RemoveSecret 删除secret，仍被容器引用时拒绝删除
+func RemoveSecret(name string) error {
+	if err := validateSecretName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(secretPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNoSuchSecret, name)
+		}
+		return err
+	}
+
+	containers, err := listContainerRecords()
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		for _, ref := range container.Secrets {
+			if ref.Name == name {
+				return fmt.Errorf("secret:%s is in use by container:%s", name, container.Id)
+			}
+		}
+	}
+	return os.Remove(secretPath(name))
+}
+
+// LoadSecretPayloads 解密容器引用的secret
+func LoadSecretPayloads(refs []*SecretReference) ([]*SecretPayload, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	gcm, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([]*SecretPayload, 0, len(refs))
+	for _, ref := range refs {
+		secret, err := loadSecret(ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret.Data) < gcm.NonceSize() {
+			return nil, fmt.Errorf("secret:%s is corrupted", ref.Name)
+		}
+		nonce, ciphertext := secret.Data[:gcm.NonceSize()], secret.Data[gcm.NonceSize():]
+		data, err := gcm.Open(nil, nonce, ciphertext, []byte(ref.Name))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt secret:%s failed, err:%s", ref.Name, err)
+		}
+		payloads = append(payloads, &SecretPayload{Name: ref.Name, Target: ref.Target, Mode: ref.Mode, Data: data})
+	}
+	return payloads, nil
+}
+
+// SendSecrets 将secret写入init进程的管道并关闭，init进程读取secret之后再读取用户命令
+func SendSecrets(w *os.File, payloads []*SecretPayload) error {
+	defer w.Close()
+	content, err := sonic.Marshal(payloads)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func readSecrets() ([]*SecretPayload, error) {
+	pipe := os.NewFile(uintptr(secretPipeFd), "secrets")
+	defer pipe.Close()
+	content, err := ioutil.ReadAll(pipe)
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([]*SecretPayload, 0)
+	if err = sonic.Unmarshal(content, &payloads); err != nil {
+		return nil, err
+	}
+	return payloads, nil
+}
+
+// mountSecrets 在容器内的/run/secrets挂载私有tmpfs并写入secret，写入之后tmpfs重新挂载为只读。
+// secret只存在于容器的内存文件系统中，不会写入容器可写层
+func mountSecrets(payloads []*SecretPayload) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+	// 旧版本记录的target可能不在/run/secrets下，挂载之前再次校验
+	for _, payload := range payloads {
+		if err := validateSecretTarget(path.Clean(payload.Target)); err != nil {
+			return err
+		}
+	}
+
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	if err := os.MkdirAll(SecretMountDir, 0755); err != nil {
+		return err
+	}
+	if err := mount("tmpfs", SecretMountDir, "tmpfs", flags, "mode=755"); err != nil {
+		return err
+	}
+	if err := mount("", SecretMountDir, "", unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
+	for _, payload := range payloads {
+		file := path.Clean(payload.Target)
+		if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, payload.Data, payload.Mode); err != nil {
+			return fmt.Errorf("write secret:%s failed, err:%s", payload.Name, err)
+		}
+		// WriteFile创建文件时的权限受umask影响
+		if err := os.Chmod(file, payload.Mode); err != nil {
+			return err
+		}
+	}
+	return mount("", SecretMountDir, "", unix.MS_REMOUNT|unix.MS_RDONLY|flags, "")
+}
+
+func secretPath(name string) string {
+	return GhnDockerSecretDir + name + ".json"
+}
+
+func loadSecret(name string) (*secretFile, error) {
+	content, err := ioutil.ReadFile(secretPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchSecret, name)
+		}
+		return nil, err
+	}
+
+	secret := &secretFile{}
+	if err = sonic.Unmarshal(content, secret); err != nil {
+		return nil, fmt.Errorf("parse secret:%s failed, err:%s", name, err)
+	}
+	return secret, nil
+}
+
+// secretCipher 读取密钥，不存在时生成
+func secretCipher() (cipher.AEAD, error) {
+	if err := os.MkdirAll(GhnDockerSecretDir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ioutil.ReadFile(GhnDockerSecretKey)
+	if os.IsNotExist(err) {
+		key, err = createSecretKey()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read secret key failed, err:%s", err)
+	}
+	if len(key) != secretKeySize {
+		return nil, fmt.Errorf("invalid secret key:%s, expected %d bytes", GhnDockerSecretKey, secretKeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// createSecretKey 生成密钥并写入同目录下的临时文件，写完之后通过硬链接放到密钥路径。
+// 链接在目标已经存在时失败，其他进程不会读到写了一半的密钥；并发创建时使用先链接成功的密钥
+func createSecretKey() ([]byte, error) {
+	key := make([]byte, secretKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(path.Dir(GhnDockerSecretKey), ".secret.key-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(key)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Link(tmp.Name(), GhnDockerSecretKey); err != nil {
+		if os.IsExist(err) {
+			return ioutil.ReadFile(GhnDockerSecretKey)
+		}
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,67 @@
+package container
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSecretCipher(t *testing.T) {
+	root, _, _ := useFakeHost(t)
+
+	// 并发首次创建时所有调用都使用同一个完整的密钥
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := secretCipher()
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	key, err := os.ReadFile(GhnDockerSecretKey)
+	assert.Nil(t, err)
+	assert.Len(t, key, secretKeySize)
+
+	// 临时文件不会残留
+	tmpFiles, err := filepath.Glob(filepath.Join(root, ".secret.key-*"))
+	assert.Nil(t, err)
+	assert.Empty(t, tmpFiles)
+
+	_, err = secretCipher()
+	assert.Nil(t, err)
+	again, err := os.ReadFile(GhnDockerSecretKey)
+	assert.Nil(t, err)
+	assert.Equal(t, key, again)
+}
+
+func TestParseSecretReference_Target(t *testing.T) {
+	cases := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "db", want: "/run/secrets/db"},
+		{value: "db,target=pass", want: "/run/secrets/pass"},
+		{value: "db,target=/run/secrets/app/pass", want: "/run/secrets/app/pass"},
+		{value: "db,target=/run/secrets", wantErr: true},
+		{value: "db,target=/etc/passwd", wantErr: true},
+		{value: "db,target=../../etc/passwd", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			ref, err := ParseSecretReference(c.value)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.want, ref.Target)
+		})
+	}
+}
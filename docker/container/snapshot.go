@@ -0,0 +1,304 @@
+package container
+
+import (
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	snapshotLayerDir  = "layer"
+	snapshotInfoFile  = "snapshot.json"
+	snapshotTmpSuffix = ".tmp"
+)
+
+// SnapshotInfo 容器可写层的快照，创建之后不再修改
+type SnapshotInfo struct {
+	ContainerId string `json:"container_id"`
+	Tag         string `json:"tag"`
+	Image       string `json:"image"`
+	// Driver 创建快照时容器的存储驱动，只能恢复到相同存储驱动的可写层
+	Driver     string `json:"driver"`
+	CreateTime string `json:"create_time"`
+	// Size 快照中文件的总大小(字节)
+	Size int64 `json:"size"`
+}
+
+// CreateSnapshot 将容器可写层拷贝为快照，运行中的容器在拷贝期间通过freezer冻结，保证快照中的文件处于一致的状态。
+// 整个过程持有容器记录锁，拷贝期间容器不会被启动、暂停或者停止
+func CreateSnapshot(containerId string, tag string) (err error) {
+	if err = validateSnapshotTag(tag); err != nil {
+		return err
+	}
+	unlock, err := lockContainer(containerId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// 持有锁之后再读取记录，按照最新的状态决定是否冻结
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return err
+	}
+	driver, err := getStorageDriver(container.Storage)
+	if err != nil {
+		return err
+	}
+
+	dir := snapshotPath(containerId, tag)
+	if exist, _ := PathExist(dir); exist {
+		return fmt.Errorf("snapshot:%s of container:%s already exists", tag, containerId)
+	}
+
+	// 先拷贝到临时目录，完成之后再重命名，失败时不会留下不完整的快照
+	tmpDir := dir + snapshotTmpSuffix
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	// 已经暂停的容器保持暂停，不需要再冻结
+	if container.Status == ContainerStatus_Running {
+		manager := newContainerCgroupManager(containerId)
+		if err = manager.Freeze(); err != nil {
+			logrus.Errorf("[CreateSnapshot] freeze container failed, err:%s", err)
+			return err
+		}
+		defer func() {
+			if thawErr := manager.Thaw(); thawErr != nil {
+				logrus.Errorf("[CreateSnapshot] thaw container failed, err:%s", thawErr)
+				if err == nil {
+					err = thawErr
+				}
+			}
+		}()
+	}
+
+	if err = copyPath(driver.Layer(containerId), filepath.Join(tmpDir, snapshotLayerDir)); err != nil {
+		logrus.Errorf("[CreateSnapshot] copy writable layer failed, err:%s", err)
+		return fmt.Errorf("copy writable layer of container:%s failed, err:%s", containerId, err)
+	}
+
+	snapshot := &SnapshotInfo{
+		ContainerId: containerId,
+		Tag:         tag,
+		Image:       container.Image,
+		Driver:      driver.Name(),
+		CreateTime:  time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if snapshot.Size, err = dirSize(filepath.Join(tmpDir, snapshotLayerDir)); err != nil {
+		return err
+	}
+	content, err := sonic.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, snapshotInfoFile), content, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+
+	recordContainerEvent(container, EventAction_Snapshot, map[string]string{"tag": tag})
+	return nil
+}
+
+// ListSnapshots 列出容器的快照，containerId为空时列出所有容器的快照，按照容器以及创建时间排序
+func ListSnapshots(containerId string) ([]*SnapshotInfo, error) {
+	containerIds := []string{containerId}
+	if containerId == "" {
+		dirs, err := ioutil.ReadDir(GhnDockerSnapshotRootDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		containerIds = containerIds[:0]
+		for _, dir := range dirs {
+			if dir.IsDir() {
+				containerIds = append(containerIds, dir.Name())
+			}
+		}
+	}
+
+	snapshots := make([]*SnapshotInfo, 0)
+	for _, id := range containerIds {
+		dirs, err := ioutil.ReadDir(fmt.Sprintf(GhnDockerSnapshotDir, id))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, dir := range dirs {
+			// 未完成的快照
+			if !dir.IsDir() || filepath.Ext(dir.Name()) == snapshotTmpSuffix {
+				continue
+			}
+			snapshot, err := loadSnapshot(id, dir.Name())
+			if err != nil {
+				logrus.Warnf("[ListSnapshots] load snapshot:%s of container:%s failed, err:%s", dir.Name(), id, err)
+				continue
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if snapshots[i].ContainerId != snapshots[j].ContainerId {
+			return snapshots[i].ContainerId < snapshots[j].ContainerId
+		}
+		return snapshots[i].CreateTime < snapshots[j].CreateTime
+	})
+	return snapshots, nil
+}
+
+// RestoreSnapshot 将已经停止的容器的可写层恢复为快照时的内容，快照之后的修改全部丢弃。
+// 整个过程持有容器记录锁，并在锁内检查状态，恢复期间容器不会被启动
+func RestoreSnapshot(containerId string, tag string) error {
+	unlock, err := lockContainer(containerId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	container, err := loadContainerInfo(containerId)
+	if err != nil {
+		return err
+	}
+	if container.Status != ContainerStatus_Stop && container.Status != ContainerStatus_Exit && container.Status != ContainerStatus_Created {
+		return fmt.Errorf("container:%s should be stopped before restoring a snapshot, status:%s", containerId, container.Status)
+	}
+
+	snapshot, err := loadSnapshot(containerId, tag)
+	if err != nil {
+		return err
+	}
+	driver, err := getStorageDriver(container.Storage)
+	if err != nil {
+		return err
+	}
+	if snapshot.Driver != driver.Name() {
+		return fmt.Errorf("snapshot:%s was taken with storage driver:%s, container uses:%s", tag, snapshot.Driver, driver.Name())
+	}
+
+	// 修改overlay的upper层需要先卸载根文件系统，卸载之前先卸载其中的数据卷
+	if err = UnmountVolume(containerId, container.Volume); err != nil {
+		return err
+	}
+	if err = driver.Unmount(containerId); err != nil {
+		return err
+	}
+
+	layer := driver.Layer(containerId)
+	if err = clearDir(layer); err != nil {
+		logrus.Errorf("[RestoreSnapshot] clear writable layer failed, err:%s", err)
+		return fmt.Errorf("clear writable layer of container:%s failed, err:%s", containerId, err)
+	}
+	if err = copyPath(filepath.Join(snapshotPath(containerId, tag), snapshotLayerDir), layer); err != nil {
+		logrus.Errorf("[RestoreSnapshot] copy snapshot failed, err:%s", err)
+		return fmt.Errorf("copy snapshot:%s to container:%s failed, err:%s", tag, containerId, err)
+	}
+
+	if err = driver.Mount(containerId, container.Image); err != nil {
+		return err
+	}
+	if err = MountVolume(containerId, container.Volume); err != nil {
+		return err
+	}
+
+	recordContainerEvent(container, EventAction_Restore, map[string]string{"tag": tag})
+	return nil
+}
+
+// RemoveSnapshot 删除容器的一个快照
+func RemoveSnapshot(containerId string, tag string) error {
+	if _, err := loadSnapshot(containerId, tag); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(snapshotPath(containerId, tag)); err != nil {
+		return err
+	}
+
+	// 最后一个快照删除之后删除容器的快照目录
+	os.Remove(fmt.Sprintf(GhnDockerSnapshotDir, containerId))
+	return nil
+}
+
+// RemoveSnapshots 删除容器的所有快照，删除容器时调用
+func RemoveSnapshots(containerId string) error {
+	return os.RemoveAll(fmt.Sprintf(GhnDockerSnapshotDir, containerId))
+}
+
+func validateSnapshotTag(tag string) error {
+	if len(tag) > 64 || !containerNameFormat.MatchString(tag) {
+		return fmt.Errorf("invalid snapshot tag:%s, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed and at most 64 characters", tag)
+	}
+	if filepath.Ext(tag) == snapshotTmpSuffix {
+		return fmt.Errorf("invalid snapshot tag:%s, suffix %s is reserved", tag, snapshotTmpSuffix)
+	}
+	return nil
+}
+
+func snapshotPath(containerId string, tag string) string {
+	return filepath.Join(fmt.Sprintf(GhnDockerSnapshotDir, containerId), tag)
+}
+
+func loadSnapshot(containerId string, tag string) (*SnapshotInfo, error) {
+	if err := validateSnapshotTag(tag); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(snapshotPath(containerId, tag), snapshotInfoFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such snapshot:%s of container:%s", tag, containerId)
+		}
+		return nil, err
+	}
+
+	snapshot := &SnapshotInfo{}
+	if err = sonic.Unmarshal(content, snapshot); err != nil {
+		return nil, fmt.Errorf("parse snapshot:%s of container:%s failed, err:%s", tag, containerId, err)
+	}
+	return snapshot, nil
+}
+
+// clearDir 删除目录下的所有内容，保留目录本身: 限制容量的可写层目录是ext4镜像的挂载点
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
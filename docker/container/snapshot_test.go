@@ -0,0 +1,34 @@
+package container
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot_StatusUnderLock(t *testing.T) {
+	useFakeHost(t, testPid)
+	container := newTestContainer(t, ContainerStatus_Running)
+	driver, err := getStorageDriver(container.Storage)
+	assert.Nil(t, err)
+	file := filepath.Join(driver.Layer(testContainerId), "data")
+	assert.Nil(t, os.WriteFile(file, []byte("v1"), 0644))
+
+	assert.Nil(t, CreateSnapshot(testContainerId, "v1"))
+	assert.Nil(t, os.WriteFile(file, []byte("v2"), 0644))
+	// 运行中的容器不能恢复快照，检查失败之后锁被释放，其他修改不会被阻塞
+	assert.NotNil(t, RestoreSnapshot(testContainerId, "v1"))
+	assert.Nil(t, PauseContainer(testContainerId))
+
+	_, err = modifyContainerInfo(testContainerId, func(container *ContainerInfo) (bool, error) {
+		container.Status = ContainerStatus_Stop
+		return true, nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, RestoreSnapshot(testContainerId, "v1"))
+
+	content, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(content))
+}
@@ -0,0 +1,202 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	StorageDriver_Overlay = "overlay"
+	StorageDriver_Vfs     = "vfs"
+
+	StorageOpt_Size = "size"
+
+	// minQuotaSize ext4文件系统自身需要占用一部分空间，过小的容量没有意义
+	minQuotaSize = 16 << 20
+)
+
+// StorageDriver 容器根文件系统的存储驱动: 在镜像层之上为每个容器提供独立的可写层
+type StorageDriver interface {
+	// Name 存储驱动名称
+	Name() string
+	// CreateLayer 为容器创建可写层，size大于0时限制可写层的容量(字节)
+	CreateLayer(containerId string, image string, size int64) error
+	// Mount 将镜像层与容器可写层组合之后挂载到容器的根文件系统挂载点
+	Mount(containerId string, image string) error
+	// Unmount 卸载容器的根文件系统并删除挂载点
+	Unmount(containerId string) error
+	// Diff 容器可写层相对于镜像新增/修改/删除的文件
+	Diff(containerId string, image string) ([]*FileChange, error)
+	// Remove 删除容器可写层
+	Remove(containerId string) error
+	// Source inspect中展示的根文件系统挂载源
+	Source(containerId string, image string) string
+	// Layer 容器可写层目录，快照以及恢复快照的对象
+	Layer(containerId string) string
+}
+
+var StorageDrivers = map[string]StorageDriver{
+	StorageDriver_Overlay: &OverlayDriver{},
+	StorageDriver_Vfs:     &VfsDriver{},
+}
+
+// StorageConfig 容器根文件系统使用的存储驱动以及选项
+type StorageConfig struct {
+	// Driver 存储驱动名称，为空时根据宿主机是否支持overlay自动选择
+	Driver string `json:"driver"`
+	// Size 容器可写层的容量上限(字节)，0表示不限制
+	Size int64 `json:"size"`
+}
+
+// ParseStorageConfig 解析存储驱动名称以及 --storage-opt key=value，目前只支持size
+func ParseStorageConfig(driver string, opts []string) (*StorageConfig, error) {
+	if driver == "" && len(opts) == 0 {
+		return nil, nil
+	}
+	if _, ok := StorageDrivers[driver]; driver != "" && !ok {
+		return nil, fmt.Errorf("unknown storage driver:%s, supported: %s, %s", driver, StorageDriver_Overlay, StorageDriver_Vfs)
+	}
+
+	storage := &StorageConfig{Driver: driver}
+	for _, opt := range opts {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid storage option:%s, expected key=value", opt)
+		}
+
+		switch key {
+		case StorageOpt_Size:
+			size, err := subsystem.ParseMemory(value)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid storage size:%s, example: size=2G", value)
+			}
+			if size < minQuotaSize {
+				return nil, fmt.Errorf("storage size:%s is too small, minimum is 16M", value)
+			}
+			storage.Size = size
+		default:
+			return nil, fmt.Errorf("unknown storage option:%s", key)
+		}
+	}
+	return storage, nil
+}
+
+// DefaultStorageDriver 内核支持overlay且容器可写层所在的文件系统可以作为overlay的upper层时使用overlay，否则使用vfs
+func DefaultStorageDriver() string {
+	if err := overlaySupported(); err != nil {
+		logrus.Infof("[DefaultStorageDriver] overlay is not supported, fall back to vfs, reason:%s", err)
+		return StorageDriver_Vfs
+	}
+	return StorageDriver_Overlay
+}
+
+// getStorageDriver 容器记录中的存储驱动，没有记录存储驱动的容器都是overlay创建的
+func getStorageDriver(storage *StorageConfig) (StorageDriver, error) {
+	if storage == nil || storage.Driver == "" {
+		return StorageDrivers[StorageDriver_Overlay], nil
+	}
+	driver, ok := StorageDrivers[storage.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver:%s", storage.Driver)
+	}
+	return driver, nil
+}
+
+func overlaySupported() error {
+	file, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("overlay is not listed in /proc/filesystems")
+	}
+
+	// overlay的upper层不能位于另一个overlay上，例如运行在容器内的CI
+	if err = os.MkdirAll(GhnDockerContainerRootDir, 0777); err != nil {
+		return err
+	}
+	stat := &unix.Statfs_t{}
+	if err = unix.Statfs(GhnDockerContainerRootDir, stat); err != nil {
+		return err
+	}
+	if stat.Type == unix.OVERLAYFS_SUPER_MAGIC {
+		return fmt.Errorf("%s is on an overlay filesystem", GhnDockerContainerRootDir)
+	}
+	return nil
+}
+
+// hasQuota 容器可写层是否限制了容量
+func hasQuota(containerId string) bool {
+	isExist, _ := PathExist(fmt.Sprintf(GhnDockerQuotaImage, containerId))
+	return isExist
+}
+
+// createQuota 创建指定容量的ext4镜像文件并以loop设备挂载到dir，dir内的写入受镜像容量限制
+func createQuota(containerId string, dir string, size int64) (err error) {
+	if err = os.MkdirAll(GhnDockerQuotaRootDir, 0777); err != nil {
+		return err
+	}
+
+	image := fmt.Sprintf(GhnDockerQuotaImage, containerId)
+	file, err := os.OpenFile(image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(image)
+		}
+	}()
+
+	// 稀疏文件，实际占用的磁盘空间随写入增长。宿主机上没有可以替代mkfs.ext4的系统调用，限制容量时需要e2fsprogs
+	err = file.Truncate(size)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("mkfs.ext4", "-q", "-F", image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mkfs.ext4 failed, err:%s, output:%s", err, strings.TrimSpace(string(output)))
+	}
+
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	if err = loopMount(image, dir, "ext4"); err != nil {
+		return err
+	}
+	// mkfs创建的lost+found不属于容器文件系统
+	os.RemoveAll(dir + "/lost+found")
+	return nil
+}
+
+// RemoveQuota 卸载并删除容器可写层的ext4镜像文件，dir为镜像的挂载目录
+func RemoveQuota(containerId string, dir string) error {
+	if !hasQuota(containerId) {
+		return nil
+	}
+
+	if err := unmount(dir); err != nil {
+		logrus.Errorf("[RemoveQuota] umount quota dir failed, err:%s", err)
+		return err
+	}
+	return os.Remove(fmt.Sprintf(GhnDockerQuotaImage, containerId))
+}
@@ -0,0 +1,74 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// namespacedSysctlPrefixes 只允许属于容器自身namespace的内核参数: net.*属于network namespace，
+// kernel.shm*、kernel.msg*、kernel.sem以及fs.mqueue.*属于ipc namespace，其余参数作用于整个宿主机
+var namespacedSysctlPrefixes = []string{"net.", "kernel.shm", "kernel.msg", "kernel.sem", "fs.mqueue."}
+
+// ValidateSysctl 校验内核参数是否可以在容器内设置
+func ValidateSysctl(key string) error {
+	if strings.ContainsAny(key, "/ ") || strings.Contains(key, "..") {
+		return fmt.Errorf("invalid sysctl:%s", key)
+	}
+	for _, prefix := range namespacedSysctlPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("sysctl:%s is not namespaced and would change the host, only net.*, kernel.shm*, kernel.msg*, kernel.sem and fs.mqueue.* are allowed", key)
+}
+
+// ParseSysctls 解析多个 key=value 格式的内核参数
+func ParseSysctls(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	sysctls := make(map[string]string, len(values))
+	for _, value := range values {
+		key, setting, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid sysctl:%s, expected key=value", value)
+		}
+		if err := ValidateSysctl(key); err != nil {
+			return nil, err
+		}
+		sysctls[key] = setting
+	}
+	return sysctls, nil
+}
+
+// FormatSysctls 按照key排序输出 key=value，用于传给init进程
+func FormatSysctls(sysctls map[string]string) []string {
+	values := make([]string, 0, len(sysctls))
+	for key, value := range sysctls {
+		values = append(values, key+"="+value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// writeSysctls 写入/proc/sys，由init进程在挂载/proc之后调用，此时/proc/sys/net对应容器自身的network namespace
+func writeSysctls(sysctls map[string]string) error {
+	for _, value := range FormatSysctls(sysctls) {
+		key, setting, _ := strings.Cut(value, "=")
+		if err := ValidateSysctl(key); err != nil {
+			return err
+		}
+
+		path := "/proc/sys/" + strings.ReplaceAll(key, ".", "/")
+		if err := os.WriteFile(path, []byte(setting), 0644); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("sysctl:%s does not exist in the container namespace", key)
+			}
+			return fmt.Errorf("write sysctl %s=%s failed, err:%s", key, setting, err)
+		}
+	}
+	return nil
+}
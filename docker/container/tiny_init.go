@@ -0,0 +1,102 @@
+package container
+
+import (
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// runTinyInit 极简init模式: 自身保持容器内1号进程身份，以子进程方式启动用户命令
+// 1. 回收容器内所有的僵尸进程(孤儿进程会被过继给1号进程)
+// 2. 将收到的信号转发给用户命令所在的进程组，避免没有注册信号处理的程序忽略SIGTERM
+// 3. 用户命令退出后，以其退出码退出
+func runTinyInit(execPath string, cmds []string) error {
+	// 先注册信号，避免子进程启动之后立刻退出导致SIGCHLD丢失
+	signals := make(chan os.Signal, 64)
+	signal.Notify(signals)
+
+	child := exec.Command(execPath, cmds[1:]...)
+	child.Args[0] = cmds[0]
+	child.Env = os.Environ()
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// 交互模式下需要把用户命令的进程组放到终端前台，否则读取stdin时会收到SIGTTIN
+	if isTerminal(os.Stdin) {
+		child.SysProcAttr.Foreground = true
+		child.SysProcAttr.Ctty = 0
+	}
+
+	if err := child.Start(); err != nil {
+		logrus.Errorf("[runTinyInit] start user command failed, err:%s", err)
+		return err
+	}
+	childPid := child.Process.Pid
+
+	for sig := range signals {
+		sysSig, ok := sig.(syscall.Signal)
+		if !ok {
+			continue
+		}
+
+		switch sysSig {
+		case syscall.SIGCHLD:
+			if exited, code := reapZombies(childPid); exited {
+				os.Exit(code)
+			}
+		case syscall.SIGURG, syscall.SIGTTIN, syscall.SIGTTOU:
+			// SIGURG是go runtime用于抢占调度的信号，不需要转发
+			continue
+		default:
+			// 转发给用户命令所在的进程组
+			if err := syscall.Kill(-childPid, sysSig); err != nil && err != syscall.ESRCH {
+				logrus.Errorf("[runTinyInit] forward signal:%s failed, err:%s", sysSig, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reapZombies 回收所有已经退出的子进程，若用户命令本身退出则返回其退出码
+func reapZombies(childPid int) (bool, int) {
+	var (
+		exited   bool
+		exitCode int
+	)
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			break
+		}
+
+		if pid != childPid {
+			continue
+		}
+
+		exited = true
+		switch {
+		case status.Exited():
+			exitCode = status.ExitStatus()
+		case status.Signaled():
+			exitCode = 128 + int(status.Signal())
+		}
+	}
+	return exited, exitCode
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
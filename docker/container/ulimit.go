@@ -0,0 +1,123 @@
+package container
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// RlimitInfinity 不限制，对应 unlimited 或者 -1
+const RlimitInfinity = ^uint64(0)
+
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// Ulimit 容器init进程的资源限制，exec用户命令之后由容器内的进程继承
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+// ParseUlimit 解析 name=soft[:hard]，省略hard时与soft相同，unlimited或者-1表示不限制
+func ParseUlimit(value string) (*Ulimit, error) {
+	name, limits, ok := strings.Cut(value, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid ulimit:%s, expected name=soft[:hard]", value)
+	}
+	if _, ok = rlimitResources[name]; !ok {
+		return nil, fmt.Errorf("invalid ulimit name:%s", name)
+	}
+
+	soft, hard, hasHard := strings.Cut(limits, ":")
+	ulimit := &Ulimit{Name: name}
+	var err error
+	if ulimit.Soft, err = parseRlimit(soft); err != nil {
+		return nil, fmt.Errorf("invalid soft limit of ulimit:%s, err:%s", value, err)
+	}
+	ulimit.Hard = ulimit.Soft
+	if hasHard {
+		if ulimit.Hard, err = parseRlimit(hard); err != nil {
+			return nil, fmt.Errorf("invalid hard limit of ulimit:%s, err:%s", value, err)
+		}
+	}
+	if ulimit.Soft > ulimit.Hard {
+		return nil, fmt.Errorf("invalid ulimit:%s, soft limit is greater than hard limit", value)
+	}
+	return ulimit, nil
+}
+
+// ParseUlimits 解析多个ulimit，同名的后者覆盖前者
+func ParseUlimits(values []string) ([]*Ulimit, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	byName := make(map[string]*Ulimit, len(values))
+	for _, value := range values {
+		ulimit, err := ParseUlimit(value)
+		if err != nil {
+			return nil, err
+		}
+		byName[ulimit.Name] = ulimit
+	}
+
+	ulimits := make([]*Ulimit, 0, len(byName))
+	for _, ulimit := range byName {
+		ulimits = append(ulimits, ulimit)
+	}
+	sort.Slice(ulimits, func(i, j int) bool {
+		return ulimits[i].Name < ulimits[j].Name
+	})
+	return ulimits, nil
+}
+
+func parseRlimit(value string) (uint64, error) {
+	if value == "unlimited" || value == "-1" {
+		return RlimitInfinity, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func (ulimit *Ulimit) String() string {
+	format := func(limit uint64) string {
+		if limit == RlimitInfinity {
+			return "unlimited"
+		}
+		return strconv.FormatUint(limit, 10)
+	}
+	return fmt.Sprintf("%s=%s:%s", ulimit.Name, format(ulimit.Soft), format(ulimit.Hard))
+}
+
+// setRlimits 设置当前进程的资源限制，由init进程在exec用户命令之前调用。
+// syscall.Setrlimit内部通过prlimit设置，同时告知Go运行时不要在exec时恢复启动时的nofile
+func setRlimits(ulimits []*Ulimit) error {
+	for _, ulimit := range ulimits {
+		resource, ok := rlimitResources[ulimit.Name]
+		if !ok {
+			return fmt.Errorf("invalid ulimit name:%s", ulimit.Name)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: ulimit.Soft, Max: ulimit.Hard}); err != nil {
+			return fmt.Errorf("set ulimit %s failed, err:%s", ulimit, err)
+		}
+	}
+	return nil
+}
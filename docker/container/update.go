@@ -0,0 +1,47 @@
+package container
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/sirupsen/logrus"
+)
+
+// UpdateContainerResources 在线修改运行中容器的资源限制: 校验新配置，重写cgroup文件，并同步更新容器记录
+func UpdateContainerResources(containerId string, update *subsystem.SubSystemConfig) error {
+	_, err := modifyContainerInfo(containerId, func(container *ContainerInfo) (bool, error) {
+		if container.Status != ContainerStatus_Running && container.Status != ContainerStatus_Paused {
+			return false, fmt.Errorf("container:%s is not running, status:%s", containerId, container.Status)
+		}
+
+		// 合并之后整体校验，例如只修改内存上限时仍需要满足与已有swap上限的约束
+		merged := container.ResourceConfig.Merge(update)
+		if err := merged.Validate(); err != nil {
+			return false, err
+		}
+
+		manager := newContainerCgroupManager(containerId)
+
+		// 内存上限不能低于当前的使用量，否则内核会直接触发oom
+		if update.MemoryLimits != "" {
+			limit, _ := subsystem.ParseMemory(update.MemoryLimits)
+			usage, usageErr := subsystem.NewMemoryConfig().Usage(manager.Namespace)
+			if usageErr != nil {
+				logrus.Errorf("[UpdateContainerResources] read memory usage failed, err:%s", usageErr)
+				return false, usageErr
+			}
+			if limit != -1 && limit < usage {
+				return false, fmt.Errorf("memory limit:%s is below current usage:%d bytes", update.MemoryLimits, usage)
+			}
+		}
+
+		manager.SubSystemConf = merged
+		if err := manager.ApplySubsystem(); err != nil {
+			logrus.Errorf("[UpdateContainerResources] apply subsystem failed, err:%s", err)
+			return false, err
+		}
+
+		container.ResourceConfig = manager.SubSystemConf
+		return true, nil
+	})
+	return err
+}
@@ -0,0 +1,162 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// VfsDriver 将镜像目录完整拷贝为容器可写层，再bind mount到挂载点，不依赖overlay，占用空间以及创建耗时与镜像大小成正比
+type VfsDriver struct{}
+
+func (driver *VfsDriver) Name() string {
+	return StorageDriver_Vfs
+}
+
+func (driver *VfsDriver) CreateLayer(containerId string, image string, size int64) error {
+	containerUrl := fmt.Sprintf(GhnDockerContainerDir, containerId)
+	if size > 0 {
+		if err := createQuota(containerId, containerUrl, size); err != nil {
+			logrus.Errorf("[VfsDriver.CreateLayer] create quota failed, err:%s", err)
+			return err
+		}
+	}
+
+	if err := copyPath(fmt.Sprintf(GhnDockerImageDir, image), containerUrl); err != nil {
+		logrus.Errorf("[VfsDriver.CreateLayer] copy image failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (driver *VfsDriver) Mount(containerId string, image string) error {
+	mountUrl := fmt.Sprintf(GhnDockerMountPoint, containerId)
+	if err := os.MkdirAll(mountUrl, 0777); err != nil {
+		logrus.Errorf("[VfsDriver.Mount] mk mnt dir failed, err:%s", err)
+		return err
+	}
+
+	// pivot_root要求新的根目录是一个挂载点
+	if err := bindMount(fmt.Sprintf(GhnDockerContainerDir, containerId), mountUrl); err != nil {
+		logrus.Errorf("[VfsDriver.Mount] bind mount failed, err:%s", err)
+		os.RemoveAll(mountUrl)
+		return err
+	}
+	return nil
+}
+
+func (driver *VfsDriver) Unmount(containerId string) error {
+	return RemoveMountPoints(containerId)
+}
+
+// Diff 比较可写层与镜像目录: 只在可写层中存在的为新增，类型、权限、属主、大小或者修改时间不同的为修改，
+// 只在镜像中存在的为删除，删除的目录不再列出其下的文件
+func (driver *VfsDriver) Diff(containerId string, image string) ([]*FileChange, error) {
+	layer := fmt.Sprintf(GhnDockerContainerDir, containerId)
+	lower := fmt.Sprintf(GhnDockerImageDir, image)
+
+	changes := make([]*FileChange, 0)
+	err := filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(layer, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = "/" + rel
+
+		origin, statErr := os.Lstat(filepath.Join(lower, rel))
+		if statErr != nil {
+			changes = append(changes, &FileChange{Kind: ChangeKind_Added, Path: rel})
+			return nil
+		}
+		if fileChanged(path, info, filepath.Join(lower, rel), origin) {
+			changes = append(changes, &FileChange{Kind: ChangeKind_Changed, Path: rel})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(lower, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(lower, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = "/" + rel
+
+		if _, statErr := os.Lstat(filepath.Join(layer, rel)); statErr == nil {
+			return nil
+		}
+		changes = append(changes, &FileChange{Kind: ChangeKind_Deleted, Path: rel})
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func (driver *VfsDriver) Remove(containerId string) error {
+	containerUrl := fmt.Sprintf(GhnDockerContainerDir, containerId)
+	if err := RemoveQuota(containerId, containerUrl); err != nil {
+		logrus.Errorf("[VfsDriver.Remove] remove quota failed, err:%s", err)
+		return err
+	}
+
+	if err := os.RemoveAll(containerUrl); err != nil {
+		logrus.Errorf("[VfsDriver.Remove] rm container dir failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (driver *VfsDriver) Source(containerId string, image string) string {
+	return fmt.Sprintf(GhnDockerContainerDir, containerId)
+}
+
+// Layer vfs的可写层即为完整的根文件系统
+func (driver *VfsDriver) Layer(containerId string) string {
+	return fmt.Sprintf(GhnDockerContainerDir, containerId)
+}
+
+// fileChanged 可写层中的文件相对于镜像中的同名文件是否被修改过
+func fileChanged(path string, info os.FileInfo, originPath string, origin os.FileInfo) bool {
+	if info.Mode() != origin.Mode() || (!info.IsDir() && info.Size() != origin.Size()) {
+		return true
+	}
+	// 拷贝时无法保留符号链接自身的修改时间，符号链接只比较指向
+	if info.Mode()&os.ModeSymlink == 0 && !info.ModTime().Equal(origin.ModTime()) {
+		return true
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	originStat, originOk := origin.Sys().(*syscall.Stat_t)
+	if ok && originOk && (stat.Uid != originStat.Uid || stat.Gid != originStat.Gid || stat.Rdev != originStat.Rdev) {
+		return true
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(path)
+		originTarget, _ := os.Readlink(originPath)
+		return target != originTarget
+	}
+	return false
+}
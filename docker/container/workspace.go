@@ -1,69 +1,115 @@
 package container
 
 import (
-	"errors"
 	"fmt"
 	"github.com/bytedance/sonic"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
 )
 
 const (
 	FileSystem_OverlayFormat = "lowerdir=%s,upperdir=%s,workdir=%s"
 
-	GhnDockerImageDir     = "/home/guohaonan/ghndocker/image/%s"
-	GhnDockerContainerDir = "/home/guohaonan/ghndocker/container/%s"
-	GhnDockerWorkDir      = "/home/guohaonan/ghndocker/work/%s"
-	GhnDockerMountPoint   = "/mnt/%s"
+	// 数据卷的挂载传播方式，默认rprivate: 容器内外的挂载互不可见
+	Propagation_RPrivate = "rprivate"
+	// Propagation_RShared 容器内外的挂载双向传播
+	Propagation_RShared = "rshared"
+	// Propagation_RSlave 宿主机上的挂载传播到容器内，容器内的挂载不传播到宿主机
+	Propagation_RSlave = "rslave"
 )
 
-func NewWorkSpace(image string, containerId string, volume string) error {
+var propagationFlags = map[string]uintptr{
+	Propagation_RPrivate: unix.MS_PRIVATE,
+	Propagation_RShared:  unix.MS_SHARED,
+	Propagation_RSlave:   unix.MS_SLAVE,
+}
 
-	var (
-		imageErr, containerErr, mntErr, volumeErr error
-	)
+// VolumeMount 数据卷: 宿主机路径:容器内路径[:传播方式]
+type VolumeMount struct {
+	HostPath      string `json:"host_path"`
+	ContainerPath string `json:"container_path"`
+	Propagation   string `json:"propagation"`
+}
 
-	defer func() {
-		if containerErr != nil {
-			RemoveContainerLayer(containerId)
-			return
-		}
+// ParseVolume 解析数据卷，volume为空时返回nil
+func ParseVolume(volume string) (*VolumeMount, error) {
+	if volume == "" {
+		return nil, nil
+	}
 
-		if mntErr != nil {
-			RemoveContainerLayer(containerId)
-			RemoveMountPoints(containerId)
-			return
+	parts := strings.Split(volume, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("invalid volume:%s, expected host-path:container-path[:rprivate|rshared|rslave]", volume)
+	}
+	mount := &VolumeMount{HostPath: parts[0], ContainerPath: parts[1], Propagation: Propagation_RPrivate}
+	if mount.HostPath == "" || !strings.HasPrefix(mount.ContainerPath, "/") {
+		return nil, fmt.Errorf("invalid volume:%s, container path should be absolute", volume)
+	}
+	if len(parts) == 3 {
+		if _, ok := propagationFlags[parts[2]]; !ok {
+			return nil, fmt.Errorf("invalid volume propagation:%s, supported: rprivate, rshared, rslave", parts[2])
 		}
+		mount.Propagation = parts[2]
+	}
+	return mount, nil
+}
+
+// NewWorkSpace 创建容器工作空间，任意一步失败时回滚之前已经完成的步骤
+// storage.Driver为空时按照宿主机自动选择存储驱动并回填，调用方需要将其记录到容器记录中
+func NewWorkSpace(image string, containerId string, volume string, storage *StorageConfig) (err error) {
+	if storage.Driver == "" {
+		storage.Driver = DefaultStorageDriver()
+	}
+	driver, err := getStorageDriver(storage)
+	if err != nil {
+		return err
+	}
 
-		if volumeErr != nil {
-			RemoveMountVolume(containerId)
-			RemoveContainerLayer(containerId)
-			RemoveMountPoints(containerId)
-			return
+	rollback := &Rollback{}
+	defer func() {
+		if err != nil {
+			rollback.Undo()
 		}
-		return
 	}()
 
-	if imageErr = CreateImageLayer(image); imageErr != nil {
-		return imageErr
+	if err = CreateImageLayer(image); err != nil {
+		return err
 	}
 
-	if containerErr = CreateContainerLayer(containerId); containerErr != nil {
-		return containerErr
+	rollback.Push("container layer", func() error {
+		return driver.Remove(containerId)
+	})
+	if err = driver.CreateLayer(containerId, image, storage.Size); err != nil {
+		return err
 	}
 
-	if mntErr = CreateMountPoints(image, containerId); mntErr != nil {
-		return mntErr
+	if err = driver.Mount(containerId, image); err != nil {
+		return err
 	}
+	rollback.Push("rootfs mount", func() error {
+		return driver.Unmount(containerId)
+	})
+
+	return MountVolume(containerId, volume)
+}
 
-	if volumeErr = MountVolume(containerId, volume); volumeErr != nil {
-		return volumeErr
+// RemoveWorkSpace 卸载数据卷以及容器根文件系统，并删除容器可写层，用于撤销NewWorkSpace以及删除容器
+func RemoveWorkSpace(containerId string, volume string, storage *StorageConfig) error {
+	driver, err := getStorageDriver(storage)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if err = UnmountVolume(containerId, volume); err != nil {
+		return err
+	}
+	if err = driver.Unmount(containerId); err != nil {
+		return err
+	}
+	return driver.Remove(containerId)
 }
 
 func CreateImageLayer(image string) error {
@@ -87,47 +133,12 @@ func CreateImageLayer(image string) error {
 	}
 
 	imageTarUrl := fmt.Sprintf(GhnDockerImageDir, image) + ".tar"
-	if _, err := exec.Command("tar", "xvf", imageTarUrl, "-C", imageUrl).CombinedOutput(); err != nil {
-		logrus.Errorf("tar cmd exec failed, err:%s", err)
-		return err
-	}
-	return nil
-}
-
-func CreateContainerLayer(containerId string) error {
-	containerUrl := fmt.Sprintf(GhnDockerContainerDir, containerId)
-	if err := os.MkdirAll(containerUrl, 0777); err != nil {
-		logrus.Errorf("[CreateContainerLayer] mk container dir failed, err:%s", err)
-		return err
-	}
-
-	tmpWorkUrl := fmt.Sprintf(GhnDockerWorkDir, containerId)
-	if err := os.MkdirAll(tmpWorkUrl, 0777); err != nil {
-		logrus.Errorf("[CreateContainerLayer] mk tmp work dir failed, err:%s", err)
-		return err
-	}
-	return nil
-}
-
-func CreateMountPoints(image string, containerId string) error {
-	mountUrl := fmt.Sprintf(GhnDockerMountPoint, containerId)
-	if err := os.MkdirAll(mountUrl, 0777); err != nil {
-		logrus.Errorf("[CreateMountPoints] mk mnt dir failed, err:%s", err)
-		return err
-	}
-
-	imageUrl, containerUrl := fmt.Sprintf(GhnDockerImageDir, image), fmt.Sprintf(GhnDockerContainerDir, containerId)
-	tmpWorkUrl := fmt.Sprintf(GhnDockerWorkDir, containerId)
-
-	dirs := fmt.Sprintf(FileSystem_OverlayFormat, imageUrl, containerUrl, tmpWorkUrl)
-
-	logrus.Infof("aufs dirs:%s", dirs)
-	// mount -t overlay -o lowerdir=./lower,upperdir=./upper,workdir=./work ./merged
-	if out, err := exec.Command("mount", "-t", "overlay", "-o", dirs, "overlay", mountUrl).CombinedOutput(); err != nil {
-		logrus.Errorf("mount failed, err:%s \n stdout:%s", err, string(out))
+	if err = extractTarFile(imageTarUrl, imageUrl); err != nil {
+		logrus.Errorf("[CreateImageLayer] extract image failed, err:%s", err)
+		// 解压不完整的镜像目录会被当成已存在的镜像，需要删除
+		os.RemoveAll(imageUrl)
 		return err
 	}
-
 	return nil
 }
 
@@ -137,13 +148,12 @@ func MountVolume(containerId, volume string) error {
 		return nil
 	}
 
-	volumeMapping := strings.Split(volume, ":")
-	if len(volumeMapping) != 2 {
-		logrus.Errorf("[MountVolume] Volume Mapping's length is not 2, failed")
-		return errors.New("Volume Mapping's length is not 2")
+	volumeMount, err := ParseVolume(volume)
+	if err != nil {
+		logrus.Errorf("[MountVolume] parse volume failed, err:%s", err)
+		return err
 	}
-
-	hostPath, containerPath := volumeMapping[0], volumeMapping[1]
+	hostPath, containerPath := volumeMount.HostPath, volumeMount.ContainerPath
 
 	if err := os.MkdirAll(hostPath, 0777); err != nil {
 		logrus.Errorf("[MountVolume] mk host path failed, err:%s", err)
@@ -156,11 +166,20 @@ func MountVolume(containerId, volume string) error {
 		return err
 	}
 
-	if res, err := exec.Command("mount", hostPath, containerPath, "--bind").CombinedOutput(); err != nil {
-		logrus.Errorf("[MountVolume] mount host to container failed, err:%s \n output:%s", err, string(res))
+	if err := bindMount(hostPath, containerPath); err != nil {
+		logrus.Errorf("[MountVolume] mount host to container failed, err:%s", err)
 		return err
 	}
 
+	// rshared以及rslave需要宿主机一侧的挂载点是共享的，容器mount namespace中的副本才能与其建立传播关系
+	if volumeMount.Propagation != Propagation_RPrivate {
+		if err := mount("", containerPath, "", unix.MS_SHARED|unix.MS_REC, ""); err != nil {
+			logrus.Errorf("[MountVolume] make volume shared failed, err:%s", err)
+			unmount(containerPath)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -177,26 +196,10 @@ func PathExist(url string) (bool, error) {
 	return false, err
 }
 
-func RemoveContainerLayer(containerId string) error {
-	containerUrl := fmt.Sprintf(GhnDockerContainerDir, containerId)
-	if err := os.RemoveAll(containerUrl); err != nil {
-		logrus.Errorf("[RemoveContainerLayer] rm container dir failed, err:%s", err)
-		return err
-	}
-
-	tmpWorkUrl := fmt.Sprintf(GhnDockerWorkDir, containerId)
-	if err := os.RemoveAll(tmpWorkUrl); err != nil {
-		logrus.Errorf("[RemoveContainerLayer] mk tmp work dir failed, err:%s", err)
-		return err
-	}
-	return nil
-}
-
 func RemoveMountPoints(containerId string) error {
 	mountUrl := fmt.Sprintf(GhnDockerMountPoint, containerId)
 
-	umountCmd := exec.Command("umount", mountUrl)
-	if err := umountCmd.Run(); err != nil {
+	if err := unmount(mountUrl); err != nil {
 		logrus.Errorf("[RemoveMountPoints] umount mountPoint failed, err:%s", err)
 		return err
 	}
@@ -223,22 +226,26 @@ func RemoveMountVolume(containerId string) error {
 		return err
 	}
 
-	volume := strings.Split(container.Volume, ":")
-	if len(volume) != 2 {
-		logrus.Infof("[RemoveMountVolume] no mount volume, skip")
+	return UnmountVolume(containerId, container.Volume)
+}
+
+// UnmountVolume 卸载容器的数据卷挂载点，volume为空表示没有数据卷
+func UnmountVolume(containerId string, volume string) error {
+	volumeMount, err := ParseVolume(volume)
+	if err != nil || volumeMount == nil {
+		logrus.Infof("[UnmountVolume] no mount volume, skip")
 		return nil
 	}
 
-	containerUrl := volume[1]
-	mountUrl := fmt.Sprintf(GhnDockerMountPoint, containerId) + containerUrl
+	mountUrl := fmt.Sprintf(GhnDockerMountPoint, containerId) + volumeMount.ContainerPath
 
-	if output, err := exec.Command("umount", mountUrl).CombinedOutput(); err != nil {
-		logrus.Errorf("[RemoveMountVolume] umount mountPoint failed, err:%s,\noutput:%s", err, string(output))
+	if err := unmount(mountUrl); err != nil {
+		logrus.Errorf("[UnmountVolume] umount mountPoint failed, err:%s", err)
 		return err
 	}
 
 	if err := os.Remove(mountUrl); err != nil {
-		logrus.Errorf("[RemoveMountVolume] rm mnt dir failed, err:%s", err)
+		logrus.Errorf("[UnmountVolume] rm mnt dir failed, err:%s", err)
 		return err
 	}
 
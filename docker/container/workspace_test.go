@@ -0,0 +1,101 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+const (
+	testImage       = "busybox"
+	testContainerId = "1234567890"
+)
+
+// newTestImage 创建已经解压的镜像目录
+func newTestImage(t *testing.T) {
+	image := fmt.Sprintf(GhnDockerImageDir, testImage)
+	assert.Nil(t, os.MkdirAll(filepath.Join(image, "bin"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(image, "bin/sh"), []byte("#!/bin/sh"), 0755))
+}
+
+func TestNewWorkSpace(t *testing.T) {
+	cases := []struct {
+		name    string
+		image   string
+		driver  string
+		volume  string
+		prepare func(root string, mounter *fakeMounter)
+		wantErr bool
+	}{
+		{name: "overlay", image: testImage, driver: StorageDriver_Overlay},
+		{name: "vfs with volume", image: testImage, driver: StorageDriver_Vfs, volume: "%s/data:/data"},
+		{name: "overlay with shared volume", image: testImage, driver: StorageDriver_Overlay, volume: "%s/data:/data:rshared"},
+		{
+			name: "volume mount failed", image: testImage, driver: StorageDriver_Overlay, volume: "%s/data:/data", wantErr: true,
+			prepare: func(root string, mounter *fakeMounter) {
+				mounter.failOn[fmt.Sprintf(GhnDockerMountPoint, testContainerId)+"/data"] = errors.New("permission denied")
+			},
+		},
+		{name: "unknown driver", image: testImage, driver: "zfs", wantErr: true},
+		{name: "image not found", image: "alpine", driver: StorageDriver_Vfs, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, mounter, _ := useFakeHost(t)
+			newTestImage(t)
+			if c.prepare != nil {
+				c.prepare(root, mounter)
+			}
+			volume := c.volume
+			if volume != "" {
+				volume = fmt.Sprintf(volume, root)
+			}
+			storage := &StorageConfig{Driver: c.driver}
+			rootfs := fmt.Sprintf(GhnDockerMountPoint, testContainerId)
+			layer := fmt.Sprintf(GhnDockerContainerDir, testContainerId)
+
+			err := NewWorkSpace(c.image, testContainerId, volume, storage)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				// 已经完成的步骤全部撤销: 挂载点、可写层
+				assert.Empty(t, mounter.mounts)
+				for _, dir := range []string{rootfs, layer, fmt.Sprintf(GhnDockerWorkDir, testContainerId)} {
+					exist, _ := PathExist(dir)
+					assert.False(t, exist, dir)
+				}
+				return
+			}
+
+			assert.Nil(t, err)
+			if c.driver == StorageDriver_Overlay {
+				source := StorageDrivers[c.driver].Source(testContainerId, testImage)
+				assert.Equal(t, &fakeMount{Source: "overlay", FsType: "overlay", Data: source}, mounter.mounts[rootfs])
+			} else {
+				assert.Equal(t, &fakeMount{Source: layer, Flags: syscall.MS_BIND}, mounter.mounts[rootfs])
+				// vfs的可写层是镜像的完整拷贝
+				content, readErr := os.ReadFile(filepath.Join(layer, "bin/sh"))
+				assert.Nil(t, readErr)
+				assert.Equal(t, "#!/bin/sh", string(content))
+			}
+
+			if volumeMount, _ := ParseVolume(volume); volumeMount != nil {
+				target := mounter.mounts[rootfs+volumeMount.ContainerPath]
+				assert.NotNil(t, target)
+				assert.Equal(t, volumeMount.HostPath, target.Source)
+				assert.Equal(t, volumeMount.Propagation == Propagation_RShared, target.Flags&syscall.MS_SHARED != 0)
+			}
+
+			assert.Nil(t, RemoveWorkSpace(testContainerId, volume, storage))
+			assert.Empty(t, mounter.mounts)
+			for _, dir := range []string{rootfs, layer} {
+				exist, _ := PathExist(dir)
+				assert.False(t, exist, dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+// Package ghndocker 以Go API的方式管理容器: 本地直接操作容器、网络以及镜像，或者通过unix socket交给ghndockerd执行
+package ghndocker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/common-tools-haonan/docker/api"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/network"
+	"io"
+	"os"
+	"sync"
+)
+
+// RunOptions 创建容器的参数，与daemon api的请求体一致
+type RunOptions = api.ContainerConfig
+
+// ErrNoSuchContainer 容器不存在，本地以及daemon模式下都可以通过errors.Is判断
+var ErrNoSuchContainer = container.ErrNoSuchContainer
+
+type ClientOptions struct {
+	// Host daemon的socket，例如unix:///home/guohaonan/ghndocker/ghndocker.sock，为空时在本地执行
+	Host string
+	// Binary 本地执行时用于启动容器init进程以及监控进程的ghndocker可执行文件，为空时使用当前进程的可执行文件
+	// 嵌入到其他程序中使用时需要指定
+	Binary string
+}
+
+// Client 容器的增删改查，容器引用支持完整id、唯一id前缀以及容器名称
+type Client struct {
+	// daemon 不为空时所有操作交给daemon执行
+	daemon *api.Client
+	binary string
+
+	// supervisor 以及supervise 容器进程启动之后的托管方式，默认为每个容器启动一个独立的监控进程
+	supervisor string
+	supervise  func(containerInfo *container.ContainerInfo, process *initProcess) error
+	// exits 监控进程回收到的容器进程退出状态，只在监控进程中使用
+	exits chan *container.ProcessExit
+
+	// mu 容器记录、网络以及ipam的读写都不是并发安全的，修改状态的操作串行执行
+	mu sync.Mutex
+}
+
+func NewClient(options ClientOptions) (*Client, error) {
+	client := &Client{supervisor: container.Supervisor_Monitor}
+	client.supervise = client.superviseByMonitor
+
+	if options.Host != "" {
+		daemon, err := api.NewClient(options.Host)
+		if err != nil {
+			return nil, err
+		}
+		client.daemon = daemon
+		return client, nil
+	}
+
+	client.binary = options.Binary
+	if client.binary == "" {
+		self, err := os.Readlink("/proc/self/exe")
+		if err != nil {
+			return nil, err
+		}
+		client.binary = self
+	}
+	return client, nil
+}
+
+// resolve 将容器引用解析为容器id
+func resolve(containerRef string) (string, error) {
+	containerInfo, err := container.ResolveContainer(containerRef)
+	if err != nil {
+		return "", err
+	}
+	return containerInfo.Id, nil
+}
+
+// Create 创建容器，容器状态为CREATED，返回容器id
+func (client *Client) Create(options *RunOptions) (string, error) {
+	if client.daemon != nil {
+		return client.daemon.ContainerCreate(options)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.create(options)
+}
+
+// Start 在后台启动CREATED状态的容器
+func (client *Client) Start(containerRef string) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerStart(containerRef)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	_, err = client.start(containerId, false)
+	return err
+}
+
+// Run 创建并在后台启动容器，启动失败时删除已经创建的容器
+func (client *Client) Run(options *RunOptions) (string, error) {
+	containerId, err := client.Create(options)
+	if err != nil {
+		return "", err
+	}
+
+	if err = client.Start(containerId); err != nil {
+		client.Remove(containerId, true)
+		return "", err
+	}
+	return containerId, nil
+}
+
+// RunAttached 创建容器并使用当前进程的标准输入输出运行，等待容器退出并返回退出码，只支持本地执行
+func (client *Client) RunAttached(options *RunOptions) (int, error) {
+	if client.daemon != nil {
+		return -1, fmt.Errorf("attached run is not supported by daemon, run the container detached")
+	}
+
+	containerId, err := client.Create(options)
+	if err != nil {
+		return -1, err
+	}
+
+	exitCode, err := client.start(containerId, true)
+	if err != nil {
+		client.Remove(containerId, true)
+		return -1, err
+	}
+	return exitCode, nil
+}
+
+func (client *Client) Stop(containerRef string) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerStop(containerRef)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	if err = container.StopContainer(containerId); err != nil {
+		return err
+	}
+	releaseNetwork(containerId)
+	return nil
+}
+
+// Remove 删除容器，运行中以及暂停中的容器需要force
+func (client *Client) Remove(containerRef string, force bool) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerRemove(containerRef, force)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerInfo, err := container.ResolveContainer(containerRef)
+	if err != nil {
+		return err
+	}
+	if !force && (containerInfo.Status == container.ContainerStatus_Running || containerInfo.Status == container.ContainerStatus_Paused) {
+		return fmt.Errorf("container:%s is %s, stop it first or remove forcibly", containerInfo.Id, containerInfo.Status)
+	}
+	// 容器记录删除之后无法再找到ip以及端口映射，先断开网络
+	if err = network.ReleaseContainer(containerInfo); err != nil {
+		return err
+	}
+	return container.RemoveContainer(containerInfo.Id, force)
+}
+
+func (client *Client) Pause(containerRef string) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerPause(containerRef)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	return container.PauseContainer(containerId)
+}
+
+func (client *Client) Unpause(containerRef string) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerUnpause(containerRef)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	return container.UnpauseContainer(containerId)
+}
+
+// List 按照options过滤容器记录，只使用All以及Filters
+func (client *Client) List(options *container.ListOptions) ([]*container.ContainerInfo, error) {
+	if client.daemon != nil {
+		return client.daemon.ContainerList(options)
+	}
+	return container.ListContainers(options)
+}
+
+// Inspect 容器记录以及运行时状态、端口映射
+func (client *Client) Inspect(containerRef string) (*container.ContainerInspect, error) {
+	if client.daemon != nil {
+		return client.daemon.ContainerInspect(containerRef)
+	}
+
+	inspect, err := container.InspectContainer(containerRef)
+	if err != nil {
+		return nil, err
+	}
+	inspect.Ports = network.ListPortBindings(inspect.ContainerInfo)
+	return inspect, nil
+}
+
+// Top 列出容器内的进程
+func (client *Client) Top(containerRef string) ([]*container.ProcessInfo, error) {
+	if client.daemon != nil {
+		return client.daemon.ContainerTop(containerRef)
+	}
+
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return nil, err
+	}
+	return container.TopContainer(containerId)
+}
+
+// Rename 修改容器名称，新名称不能与已有容器的名称或者id冲突
+func (client *Client) Rename(containerRef string, name string) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerRename(containerRef, name)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return container.RenameContainer(containerRef, name)
+}
+
+// Update 在线修改运行中容器的资源限制，update中为空的字段保持不变
+func (client *Client) Update(containerRef string, update *subsystem.SubSystemConfig) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerUpdate(containerRef, update)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	return container.UpdateContainerResources(containerId, update)
+}
+
+// Logs 将后台容器的日志写入w
+func (client *Client) Logs(containerRef string, w io.Writer) error {
+	if client.daemon != nil {
+		return client.daemon.ContainerLogs(containerRef, w)
+	}
+
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	return container.FindContainerLog(containerId, w)
+}
+
+// Exec 在运行中的容器内执行命令，返回命令的退出码
+// daemon模式下不支持stdin，输出在命令结束之后一次性写入stdout以及stderr
+func (client *Client) Exec(containerRef string, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(cmd) == 0 {
+		return -1, fmt.Errorf("missing exec command")
+	}
+
+	if client.daemon != nil {
+		response, err := client.daemon.ContainerExec(containerRef, cmd)
+		if err != nil {
+			return -1, err
+		}
+		if _, err = io.Copy(stdout, bytes.NewBufferString(response.Stdout)); err != nil {
+			return -1, err
+		}
+		if _, err = io.Copy(stderr, bytes.NewBufferString(response.Stderr)); err != nil {
+			return -1, err
+		}
+		return response.ExitCode, nil
+	}
+
+	// exec不修改容器状态，不需要串行执行
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return -1, err
+	}
+	return container.ExecContainerWithIO(containerId, cmd, stdin, stdout, stderr)
+}
+
+func (client *Client) NetworkList() ([]*api.NetworkSummary, error) {
+	if client.daemon != nil {
+		return client.daemon.NetworkList()
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	networks, err := network.ListAllNetwork()
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]*api.NetworkSummary, 0, len(networks))
+	for _, nw := range networks {
+		summaries = append(summaries, &api.NetworkSummary{Name: nw.NetworkName, Driver: nw.Driver, IPRange: nw.IPRange.String()})
+	}
+	return summaries, nil
+}
+
+func (client *Client) NetworkCreate(request *api.NetworkCreateRequest) error {
+	if request.Name == "" || request.Driver == "" || request.Subnet == "" {
+		return fmt.Errorf("network name, driver and subnet are required")
+	}
+	if client.daemon != nil {
+		return client.daemon.NetworkCreate(request)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return network.CreateNetwork(request.Name, request.Driver, request.Subnet)
+}
+
+func (client *Client) NetworkRemove(name string) error {
+	if client.daemon != nil {
+		return client.daemon.NetworkRemove(name)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return network.DeleteNetwork(name)
+}
+
+// NetworkConnect 将容器接入网络: 运行中(包括暂停)的容器立即接入，其他状态的容器只写入记录，启动时接入
+func (client *Client) NetworkConnect(name string, containerRef string, aliases []string) error {
+	if client.daemon != nil {
+		return client.daemon.NetworkConnect(name, containerRef, aliases)
+	}
+	if err := validateNetworks([]string{name}, aliases); err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerInfo, err := container.ResolveContainer(containerRef)
+	if err != nil {
+		return err
+	}
+	if containerInfo.NetworkSettings(name) != nil {
+		return fmt.Errorf("container:%s is already connected to network:%s", containerInfo.Id, name)
+	}
+	if !network.NetworkExists(name) {
+		return fmt.Errorf("network:%s not existed", name)
+	}
+
+	containerInfo.Networks = append(containerInfo.Networks, &container.EndpointSettings{NetworkName: name, Aliases: aliases})
+	if containerInfo.Status != container.ContainerStatus_Running && containerInfo.Status != container.ContainerStatus_Paused {
+		return container.UpdateContainerNetworks(containerInfo)
+	}
+
+	// 端口映射只作用于第一个网络
+	portMapping := ""
+	if len(containerInfo.Networks) == 1 {
+		portMapping = containerInfo.PortMapping
+	}
+	return network.Connect(name, portMapping, containerInfo)
+}
+
+// NetworkDisconnect 将容器从网络断开，并从容器记录中移除该网络
+func (client *Client) NetworkDisconnect(name string, containerRef string) error {
+	if client.daemon != nil {
+		return client.daemon.NetworkDisconnect(name, containerRef)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	containerInfo, err := container.ResolveContainer(containerRef)
+	if err != nil {
+		return err
+	}
+	settings := containerInfo.NetworkSettings(name)
+	if settings == nil {
+		return fmt.Errorf("container:%s is not connected to network:%s", containerInfo.Id, name)
+	}
+	if settings.Connected() {
+		if err = network.Disconnect(name, containerInfo); err != nil {
+			return err
+		}
+	}
+
+	networks := make([]*container.EndpointSettings, 0, len(containerInfo.Networks))
+	for _, settings := range containerInfo.Networks {
+		if settings.NetworkName != name {
+			networks = append(networks, settings)
+		}
+	}
+	containerInfo.Networks = networks
+	return container.UpdateContainerNetworks(containerInfo)
+}
+
+func (client *Client) ImageList() ([]*container.ImageInfo, error) {
+	if client.daemon != nil {
+		return client.daemon.ImageList()
+	}
+	return container.ListImages()
+}
+
+// ImageCommit 将容器当前的文件系统打包为镜像
+func (client *Client) ImageCommit(containerRef string, image string) error {
+	if image == "" {
+		return fmt.Errorf("missing image name")
+	}
+	if client.daemon != nil {
+		return client.daemon.ImageCommit(containerRef, image)
+	}
+
+	containerId, err := resolve(containerRef)
+	if err != nil {
+		return err
+	}
+	return container.CommitToMakeAImage(containerId, image)
+}
+
+// ImageImport 以r中的tar流创建镜像
+func (client *Client) ImageImport(image string, r io.Reader) error {
+	if image == "" {
+		return fmt.Errorf("missing image name")
+	}
+	if client.daemon != nil {
+		return client.daemon.ImageImport(image, r)
+	}
+	return container.ImportImage(image, r)
+}
+
+func (client *Client) SecretList() ([]*container.SecretInfo, error) {
+	if client.daemon != nil {
+		return client.daemon.SecretList()
+	}
+	return container.ListSecrets()
+}
+
+// SecretCreate 读取r中的内容加密保存为secret
+func (client *Client) SecretCreate(name string, r io.Reader) error {
+	if name == "" {
+		return fmt.Errorf("missing secret name")
+	}
+	if client.daemon != nil {
+		return client.daemon.SecretCreate(name, r)
+	}
+
+	// 多读取一个字节用于判断是否超过大小限制，由CreateSecret报错
+	data, err := io.ReadAll(io.LimitReader(r, container.MaxSecretSize+1))
+	if err != nil {
+		return fmt.Errorf("read secret:%s failed, err:%s", name, err)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return container.CreateSecret(name, data)
+}
+
+// SecretRemove 删除secret，仍被容器引用时拒绝删除
+func (client *Client) SecretRemove(name string) error {
+	if client.daemon != nil {
+		return client.daemon.SecretRemove(name)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return container.RemoveSecret(name)
+}
@@ -0,0 +1,191 @@
+package ghndocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/common-tools-haonan/docker/api"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RunDaemon ghndockerd的主流程: 接管之前由daemon托管的容器，监听unix socket，收到SIGINT/SIGTERM时退出
+// 容器进程是daemon的子进程，daemon退出之后容器进程继续运行，下次启动时重新接管
+func RunDaemon(socketPath string) error {
+	client, err := NewClient(ClientOptions{})
+	if err != nil {
+		return err
+	}
+	client.supervisor = container.Supervisor_Daemon
+	client.supervise = client.superviseByDaemon
+
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		return err
+	}
+
+	client.resumeContainers()
+
+	server := &http.Server{Handler: api.NewServer(client)}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("[daemon] received signal:%s, shutting down", sig)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logrus.Infof("[daemon] listening on unix://%s", socketPath)
+	if err = server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Monitor 独立监控进程的主流程，由run命令以 ghndocker monitor <id> 启动，文件描述符见launchByMonitor。
+// 监控进程启动容器的init进程并作为父进程回收，容器进程(包括重启之后的进程)退出时可以获得退出码
+func Monitor(containerId string) error {
+	client, err := NewClient(ClientOptions{})
+	if err != nil {
+		return err
+	}
+	containerInfo, err := container.GetSpecificContainers(containerId)
+	if err != nil {
+		return err
+	}
+
+	pidPipe, readyPipe := os.NewFile(3, "pid"), os.NewFile(4, "ready")
+	files := []*os.File{os.NewFile(5, "init")}
+	if len(containerInfo.Secrets) > 0 {
+		files = append(files, os.NewFile(6, "secret"))
+	}
+	// 继承的文件描述符只交给init进程，不能泄露给健康检查等其他子进程
+	for fd := 3; fd < 5+len(files); fd++ {
+		syscall.CloseOnExec(fd)
+	}
+
+	parent, err := client.fork(false, containerInfo, files)
+	if err == nil {
+		err = container.DefaultLauncher.Start(parent)
+	}
+	closeFiles(files)
+	if err != nil {
+		return fmt.Errorf("start container:%s process failed, err:%s", containerId, err)
+	}
+	client.exits = make(chan *container.ProcessExit, 1)
+	go client.reap(parent)
+
+	_, err = pidPipe.WriteString(strconv.Itoa(parent.Process.Pid))
+	pidPipe.Close()
+	ready, _ := io.ReadAll(readyPipe)
+	readyPipe.Close()
+	if err != nil || string(ready) != monitorReady {
+		// run命令启动失败或者异常退出，init进程读取不到用户命令，kill并回收之后退出
+		container.DefaultLauncher.Signal(parent.Process.Pid, syscall.SIGKILL)
+		<-client.exits
+		return fmt.Errorf("container:%s was not started, stop monitoring", containerId)
+	}
+
+	if err = container.MonitorContainer(containerId, client.restart, client.exits); err != nil {
+		return err
+	}
+	// 容器退出并且不再重启
+	releaseNetwork(containerId)
+	return nil
+}
+
+// reap 监控进程回收作为子进程的容器进程，退出状态交给监控主循环
+func (client *Client) reap(parent *exec.Cmd) {
+	parent.Wait()
+	client.exits <- &container.ProcessExit{Pid: parent.Process.Pid, ExitCode: container.ExitCodeOf(parent.ProcessState)}
+}
+
+// listenUnix 监听unix socket，残留的socket文件在没有daemon监听时删除
+func listenUnix(socketPath string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another daemon is listening on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale socket:%s failed, err:%s", socketPath, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s failed, err:%s", socketPath, err)
+	}
+	if err = os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// resumeContainers 重新接管daemon托管且仍在运行的容器，daemon重启之后容器进程已经不是子进程，只能通过监控协程维护状态
+func (client *Client) resumeContainers() {
+	containers, err := container.ListContainers(&container.ListOptions{})
+	if err != nil {
+		logrus.Errorf("[daemon] list containers failed, err:%s", err)
+		return
+	}
+	for _, containerInfo := range containers {
+		if containerInfo.Supervisor != container.Supervisor_Daemon {
+			continue
+		}
+		logrus.Infof("[daemon] resume supervising container:%s", containerInfo.Id)
+		go client.monitorContainer(containerInfo.Id)
+	}
+}
+
+// superviseByDaemon 容器进程是daemon的子进程: 一个协程回收进程并记录退出码，一个协程处理内存事件以及健康检查
+func (client *Client) superviseByDaemon(containerInfo *container.ContainerInfo, process *initProcess) error {
+	go client.waitContainer(containerInfo.Id, process.cmd)
+	go client.monitorContainer(containerInfo.Id)
+	return nil
+}
+
+// waitContainer 回收容器进程并记录退出码，容器已经被重启(记录中的pid不同)时忽略
+func (client *Client) waitContainer(containerId string, parent *exec.Cmd) {
+	parent.Wait()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	containerInfo, err := container.GetSpecificContainers(containerId)
+	if err != nil {
+		return
+	}
+	if containerInfo.Pid != strconv.Itoa(parent.Process.Pid) && containerInfo.Status != container.ContainerStatus_Stop {
+		return
+	}
+	if err = container.MarkContainerExited(containerId, container.ExitCodeOf(parent.ProcessState)); err != nil {
+		logrus.Errorf("[daemon] mark container:%s exited failed, err:%s", containerId, err)
+	}
+	releaseNetwork(containerId)
+}
+
+func (client *Client) monitorContainer(containerId string) {
+	restart := func(containerInfo *container.ContainerInfo) error {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.restart(containerInfo)
+	}
+	if err := container.MonitorContainer(containerId, restart, nil); err != nil {
+		logrus.Errorf("[daemon] monitor container:%s failed, err:%s", containerId, err)
+	}
+}
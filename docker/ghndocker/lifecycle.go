@@ -0,0 +1,615 @@
+package ghndocker
+
+import (
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/common-tools-haonan/docker/cgroup"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/network"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// initPipes 创建传递用户命令以及secret(容器引用了secret时)的管道，files为init进程使用的读端，
+// 调用方需要在写入用户命令之前通过SendSecrets写入secret
+func initPipes(containerInfo *container.ContainerInfo) (files []*os.File, write *os.File, secretWrite *os.File, err error) {
+	read, write, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("create pipe failed, err:%s", err)
+	}
+	files = []*os.File{read}
+
+	// secret内容只通过管道传给init进程，不出现在命令行参数以及容器记录中
+	if len(containerInfo.Secrets) > 0 {
+		var secretRead *os.File
+		if secretRead, secretWrite, err = os.Pipe(); err != nil {
+			closeFiles(append(files, write))
+			return nil, nil, nil, fmt.Errorf("create secret pipe failed, err:%s", err)
+		}
+		files = append(files, secretRead)
+	}
+	return files, write, secretWrite, nil
+}
+
+// fork 构造容器的init进程，files为initPipes返回的管道读端，isStd为true时使用当前进程的标准输入输出，否则输出写入容器日志
+func (client *Client) fork(isStd bool, containerInfo *container.ContainerInfo, files []*os.File) (*exec.Cmd, error) {
+	containerId := containerInfo.Id
+
+	cmds := exec.Command(client.binary, "init") // 子进程的启动命令：1.执行进程内的可执行文件，2.初始化
+	cmds.ExtraFiles = files
+	if len(containerInfo.Secrets) > 0 {
+		cmds.Args = append(cmds.Args, "--secrets")
+	}
+	if containerInfo.TinyInit {
+		cmds.Args = append(cmds.Args, "--init")
+	}
+	if containerInfo.ReadOnly {
+		cmds.Args = append(cmds.Args, "--read-only")
+	}
+	if containerInfo.Volume != "" {
+		cmds.Args = append(cmds.Args, "--volume", containerInfo.Volume)
+	}
+	for _, ulimit := range containerInfo.Ulimits {
+		cmds.Args = append(cmds.Args, "--ulimit", ulimit.String())
+	}
+	for _, sysctl := range container.FormatSysctls(containerInfo.Sysctls) {
+		cmds.Args = append(cmds.Args, "--sysctl", sysctl)
+	}
+	cmds.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWCGROUP,
+	}
+
+	if isStd {
+		cmds.Stdin = os.Stdin
+		cmds.Stdout = os.Stdout
+		cmds.Stderr = os.Stderr
+	} else {
+		// 创建日志文件
+		dir := fmt.Sprintf(container.GhnDockerRunningContainerDir, containerId)
+		if err := os.MkdirAll(dir, 0622); err != nil {
+			return nil, fmt.Errorf("mk container log dir failed, err:%s", err)
+		}
+		docUrl := dir + "/" + container.LogFileName
+
+		// 重启容器时复用同一个日志文件，追加写入
+		file, err := os.OpenFile(docUrl, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("create log file failed, err:%s", err)
+		}
+
+		cmds.Stdout = file
+	}
+
+	cmds.Env = append(containerInfo.Env, os.Environ()...)
+	cmds.Dir = "/mnt/" + containerId
+
+	return cmds, nil
+
+}
+
+// initProcess 已经启动的容器init进程
+type initProcess struct {
+	pid int
+	// cmd 当前进程是init进程的父进程时不为空
+	cmd *exec.Cmd
+	// ready 由监控进程启动init进程时不为空，容器启动完成之后写入monitorReady，监控进程开始托管
+	ready *os.File
+}
+
+// kill 启动失败时kill init进程；由监控进程启动时先关闭ready，监控进程回收init进程之后退出
+func (process *initProcess) kill() error {
+	closePipe(process.ready)
+	if err := container.DefaultLauncher.Signal(process.pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	if process.cmd != nil {
+		process.cmd.Wait()
+	}
+	return nil
+}
+
+// launch 启动容器的init进程。后台运行并由监控进程托管时交给监控进程启动，监控进程作为父进程可以获得退出码，
+// 其余情况由当前进程启动。files为initPipes返回的管道读端，启动之后在当前进程中关闭
+func (client *Client) launch(isStd bool, containerInfo *container.ContainerInfo, files []*os.File) (*initProcess, error) {
+	defer closeFiles(files)
+	if !isStd && client.supervisor == container.Supervisor_Monitor {
+		return client.launchByMonitor(containerInfo.Id, files)
+	}
+
+	parent, err := client.fork(isStd, containerInfo, files)
+	if err != nil {
+		return nil, err
+	}
+	if err = container.DefaultLauncher.Start(parent); err != nil {
+		return nil, err
+	}
+	return &initProcess{pid: parent.Process.Pid, cmd: parent}, nil
+}
+
+// validateContainerConfig 校验创建容器的参数
+func validateContainerConfig(config *RunOptions) error {
+	if len(config.Cmd) == 0 {
+		return fmt.Errorf("missing Container command")
+	}
+	if config.Image == "" {
+		return fmt.Errorf("missing image")
+	}
+	if config.Resources == nil {
+		config.Resources = &subsystem.SubSystemConfig{}
+	}
+	if err := config.Resources.Validate(); err != nil {
+		return err
+	}
+	if config.Name != "" {
+		if err := container.ValidateContainerName(config.Name); err != nil {
+			return err
+		}
+	}
+	if _, err := container.ParseVolume(config.Volume); err != nil {
+		return err
+	}
+	if err := validateNetworks(config.Networks, config.NetworkAliases); err != nil {
+		return err
+	}
+	for _, ulimit := range config.Ulimits {
+		if _, err := container.ParseUlimit(ulimit.String()); err != nil {
+			return err
+		}
+	}
+	for key := range config.Sysctls {
+		if err := container.ValidateSysctl(key); err != nil {
+			return err
+		}
+	}
+	if err := validateSecrets(config.Secrets); err != nil {
+		return err
+	}
+	if healthConf := config.HealthConfig; healthConf != nil {
+		if healthConf.Interval <= 0 || healthConf.Timeout <= 0 || healthConf.Retries <= 0 {
+			return fmt.Errorf("health interval, timeout and retries should be positive")
+		}
+	}
+	return nil
+}
+
+// create 创建容器的工作空间以及记录，容器状态为CREATED，由start启动
+func (client *Client) create(config *RunOptions) (containerId string, err error) {
+	if err = validateContainerConfig(config); err != nil {
+		return "", err
+	}
+
+	// id
+	containerId = randStringBytes(10)
+
+	rollback := &container.Rollback{}
+	defer func() {
+		if err != nil {
+			rollback.Undo()
+		}
+	}()
+
+	// 容器工作空间: 镜像层+容器可写层+挂载点+数据卷，未指定的存储驱动由NewWorkSpace选择
+	storage := &container.StorageConfig{}
+	if config.Storage != nil {
+		*storage = *config.Storage
+	}
+	if err = container.NewWorkSpace(config.Image, containerId, config.Volume, storage); err != nil {
+		return "", fmt.Errorf("create container workspace failed, err:%s", err)
+	}
+	rollback.Push("workspace", func() error {
+		return container.RemoveWorkSpace(containerId, config.Volume, storage)
+	})
+
+	// 持久化单host上的container信息
+	rollback.Push("container record", func() error {
+		return os.RemoveAll(fmt.Sprintf(container.GhnDockerRunningContainerDir, containerId))
+	})
+	containerInfo, err := recordContainerInfo(containerId, config, storage)
+	if err != nil {
+		return "", fmt.Errorf("record container failed, err:%s", err)
+	}
+
+	container.RecordEvent(container.EventType_Container, container.EventAction_Create, containerId, container.ContainerEventAttributes(containerInfo, nil))
+	return containerId, nil
+}
+
+// start 启动CREATED状态的容器，每一步完成之后压入对应的撤销操作，任意一步失败时按照相反的顺序撤销:
+// cgroup -> 容器进程 -> 容器记录状态 -> 网络(veth、ip、端口映射)
+func (client *Client) start(containerId string, isStd bool) (exitCode int, err error) {
+	containerInfo, err := container.GetSpecificContainers(containerId)
+	if err != nil {
+		return -1, err
+	}
+	if containerInfo.Status != container.ContainerStatus_Created {
+		return -1, fmt.Errorf("container:%s cannot be started, status:%s", containerId, containerInfo.Status)
+	}
+
+	rollback := &container.Rollback{}
+	defer func() {
+		if err != nil {
+			rollback.Undo()
+		}
+	}()
+
+	// 资源限制: 先创建cgroup，容器进程启动之后再加入
+	conf := containerInfo.ResourceConfig
+	if conf == nil {
+		conf = &subsystem.SubSystemConfig{}
+	}
+	containManager := cgroup.NewCgroupManager(fmt.Sprintf(container.CGroupPathFormat, containerId), conf)
+	rollback.Push("cgroup", func() error {
+		return cgroup.RemoveTree(container.CGroupRootPath + "/" + containerId)
+	})
+	if err = containManager.ApplySubsystem(); err != nil {
+		return -1, fmt.Errorf("apply cgroup failed, err:%s", err)
+	}
+
+	// secret在启动容器进程之前解密，secret已经被删除或者密钥不匹配时不启动
+	secrets, err := container.LoadSecretPayloads(containerInfo.Secrets)
+	if err != nil {
+		return -1, fmt.Errorf("load secrets failed, err:%s", err)
+	}
+
+	// 父进程执行内容
+	files, writePipe, secretPipe, err := initPipes(containerInfo)
+	if err != nil {
+		return -1, fmt.Errorf("fork container process failed, err:%s", err)
+	}
+	process, err := client.launch(isStd, containerInfo, files)
+	if err != nil {
+		writePipe.Close()
+		closePipe(secretPipe)
+		return -1, fmt.Errorf("start container process failed, err:%s", err)
+	}
+	rollback.Push("container process", func() error {
+		writePipe.Close()
+		closePipe(secretPipe)
+		return process.kill()
+	})
+
+	// 更新容器记录，撤销时恢复为CREATED
+	if containerInfo, err = container.MarkContainerStarted(containerId, strconv.Itoa(process.pid), client.supervisor); err != nil {
+		return -1, fmt.Errorf("record container failed, err:%s", err)
+	}
+	rollback.Push("container record", func() error {
+		return container.MarkContainerCreated(containerId)
+	})
+
+	containManager.ProcessId = containerInfo.Pid
+	if err = containManager.SetPidIntoGroup(); err != nil {
+		return -1, fmt.Errorf("set container process into cgroup failed, err:%s", err)
+	}
+
+	// 按顺序联入指定的网络，ConnectAll内部失败时已经断开接入的网络
+	if err = network.ConnectAll(containerInfo); err != nil {
+		return -1, fmt.Errorf("container connect network failed, err:%s", err)
+	}
+	rollback.Push("network", func() error {
+		return network.DisconnectAll(containerInfo)
+	})
+
+	// init进程先读取secret再读取用户命令
+	if secretPipe != nil {
+		if err = container.SendSecrets(secretPipe, secrets); err != nil {
+			return -1, fmt.Errorf("send secrets failed, err:%s", err)
+		}
+	}
+
+	// 执行指令通过管道
+	if err = sendInitCommand(strings.Split(containerInfo.Commands, " "), writePipe); err != nil {
+		return -1, fmt.Errorf("send init command failed, err:%s", err)
+	}
+
+	// 交互式容器由当前进程等待退出，不需要托管
+	if !isStd {
+		// 托管方启动失败不影响容器运行
+		if superviseErr := client.supervise(containerInfo, process); superviseErr != nil {
+			logrus.Errorf("[supervise] supervise container failed, err:%s", superviseErr)
+		}
+	}
+
+	container.RecordEvent(container.EventType_Container, container.EventAction_Start, containerId, container.ContainerEventAttributes(containerInfo, nil))
+
+	//原来parent.Wait（）主要是用于父进程等待子进程结束，这在交互式创建容器的步骤里面是没问题的，
+	//但是在这里，如果detach创建了容器，就不能再去等待，创建容器之后，父进程就已经退出了。
+	// 因此，这里只是将容器内的init进程启动起来，就已经完成工作，紧接着就可以退出，然后由操作系统进程ID为1的init进程去接管容器进程。
+	// 后台运行的容器cgroup保留到容器被删除
+	if !isStd {
+		return 0, nil
+	}
+	process.cmd.Wait()
+	// 交互式容器的父进程可以获得退出码
+	exitCode = container.ExitCodeOf(process.cmd.ProcessState)
+	if exitErr := container.MarkContainerExited(containerId, exitCode); exitErr != nil {
+		logrus.Errorf("mark container exited failed, err:%s", exitErr)
+	}
+	releaseNetwork(containerId)
+	containManager.Remove()
+	return exitCode, nil
+}
+
+// releaseNetwork 容器停止或者退出之后释放ip、veth以及端口映射，失败时只记录日志，删除容器时会再次释放
+func releaseNetwork(containerId string) {
+	containerInfo, err := container.GetSpecificContainers(containerId)
+	if err != nil {
+		return
+	}
+	if err = network.ReleaseContainer(containerInfo); err != nil {
+		logrus.Warnf("[releaseNetwork] %s", err)
+	}
+}
+
+// superviseByMonitor 通知监控进程容器已经启动完成，开始oom/内存压力事件上报、健康检查以及容器退出状态维护
+func (client *Client) superviseByMonitor(containerInfo *container.ContainerInfo, process *initProcess) error {
+	_, err := process.ready.WriteString(monitorReady)
+	if closeErr := process.ready.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// restart 在原有的工作空间上重新拉起容器进程，由监控进程在容器unhealthy或者按照重启策略调用
+func (client *Client) restart(containerInfo *container.ContainerInfo) error {
+	secrets, err := container.LoadSecretPayloads(containerInfo.Secrets)
+	if err != nil {
+		return fmt.Errorf("load secrets of container:%s failed, err:%s", containerInfo.Id, err)
+	}
+	files, writePipe, secretPipe, err := initPipes(containerInfo)
+	if err != nil {
+		return fmt.Errorf("fork container:%s process failed, err:%s", containerInfo.Id, err)
+	}
+	parent, err := client.fork(false, containerInfo, files)
+	if err == nil {
+		err = container.DefaultLauncher.Start(parent)
+	}
+	closeFiles(files)
+	if err != nil {
+		writePipe.Close()
+		closePipe(secretPipe)
+		return err
+	}
+	// 当前进程(监控进程或者daemon)是新容器进程的父进程，需要回收，否则退出后会一直以僵尸进程存在
+	switch {
+	case containerInfo.Supervisor == container.Supervisor_Daemon:
+		go client.waitContainer(containerInfo.Id, parent)
+	case client.exits != nil:
+		go client.reap(parent)
+	default:
+		go parent.Wait()
+	}
+
+	containerInfo.Pid = strconv.Itoa(parent.Process.Pid)
+
+	conf := containerInfo.ResourceConfig
+	if conf == nil {
+		conf = &subsystem.SubSystemConfig{}
+	}
+	containManager := cgroup.NewCgroupManager(fmt.Sprintf(container.CGroupPathFormat, containerInfo.Id), conf)
+	containManager.ProcessId = containerInfo.Pid
+	if err := containManager.ApplySubsystem(); err != nil {
+		return err
+	}
+	if err := containManager.SetPidIntoGroup(); err != nil {
+		return err
+	}
+
+	// 旧进程的network namespace已经销毁，释放之前的ip以及端口映射之后重新接入
+	if err := network.DisconnectAll(containerInfo); err != nil {
+		logrus.Warnf("[restart] %s", err)
+	}
+	if err := network.ConnectAll(containerInfo); err != nil {
+		return err
+	}
+
+	if secretPipe != nil {
+		if err := container.SendSecrets(secretPipe, secrets); err != nil {
+			return err
+		}
+	}
+	return sendInitCommand(strings.Split(containerInfo.Commands, " "), writePipe)
+}
+
+// monitorReady run命令完成容器启动之后写给监控进程的通知
+const monitorReady = "ready"
+
+// launchByMonitor 以独立会话启动容器的监控进程，由监控进程启动init进程并写回pid，run命令退出之后监控进程继续运行。
+// 监控进程的文件描述符: 3写回init进程的pid，4读取启动完成的通知，5以及之后为init进程的管道读端
+func (client *Client) launchByMonitor(containerId string, files []*os.File) (*initProcess, error) {
+	logFile, err := os.OpenFile(fmt.Sprintf(container.GhnDockerRunningContainerDir, containerId)+"/"+container.MonitorLogFileName,
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	pidRead, pidWrite, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer pidRead.Close()
+	readyRead, ready, err := os.Pipe()
+	if err != nil {
+		pidWrite.Close()
+		return nil, err
+	}
+
+	monitor := exec.Command(client.binary, "monitor", containerId)
+	monitor.Stdout = logFile
+	monitor.Stderr = logFile
+	monitor.ExtraFiles = append([]*os.File{pidWrite, readyRead}, files...)
+	monitor.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = monitor.Start()
+	closeFiles([]*os.File{pidWrite, readyRead})
+	if err != nil {
+		ready.Close()
+		return nil, err
+	}
+	monitor.Process.Release()
+
+	// 监控进程启动init进程失败时不写入pid直接退出
+	content, err := io.ReadAll(pidRead)
+	if err == nil {
+		var pid int
+		if pid, err = strconv.Atoi(string(content)); err == nil {
+			return &initProcess{pid: pid, ready: ready}, nil
+		}
+	}
+	ready.Close()
+	return nil, fmt.Errorf("monitor failed to start container process, see %s", logFile.Name())
+}
+
+func sendInitCommand(comArray []string, writePipe *os.File) error {
+	command := strings.Join(comArray, " ")
+	logrus.Infof("command all is %s", command)
+	if _, err := writePipe.WriteString(command); err != nil {
+		writePipe.Close()
+		return err
+	}
+	return writePipe.Close()
+}
+
+// closePipe 关闭可能不存在的管道
+func closePipe(pipe *os.File) {
+	if pipe != nil {
+		pipe.Close()
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// aliasFormat 别名写入容器的/etc/hosts，需要是合法的主机名
+var aliasFormat = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]*[a-zA-Z0-9])?$`)
+
+// validateNetworks 同一个网络只能接入一次，别名需要是合法的主机名
+func validateNetworks(networks []string, aliases []string) error {
+	seen := make(map[string]bool, len(networks))
+	for _, networkName := range networks {
+		if networkName == "" {
+			return fmt.Errorf("network name is empty")
+		}
+		if seen[networkName] {
+			return fmt.Errorf("network:%s is specified more than once", networkName)
+		}
+		seen[networkName] = true
+	}
+	for _, alias := range aliases {
+		if !aliasFormat.MatchString(alias) {
+			return fmt.Errorf("invalid network alias:%q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", alias)
+		}
+	}
+	return nil
+}
+
+// validateSecrets 校验secret引用: secret必须已经存在，不同的secret不能挂载到同一个路径
+func validateSecrets(secrets []*container.SecretReference) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	existing, err := container.ListSecrets()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(existing))
+	for _, secret := range existing {
+		names[secret.Name] = true
+	}
+
+	targets := make(map[string]bool, len(secrets))
+	for _, ref := range secrets {
+		if !names[ref.Name] {
+			return fmt.Errorf("%w: %s", container.ErrNoSuchSecret, ref.Name)
+		}
+		if targets[ref.Target] {
+			return fmt.Errorf("duplicate secret target:%s", ref.Target)
+		}
+		targets[ref.Target] = true
+	}
+	return nil
+}
+
+func randStringBytes(n int) string {
+	letterBytes := "1234567890"
+	rand.NewSource(time.Now().UnixNano())
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return string(b)
+}
+
+func recordContainerInfo(containerId string, config *RunOptions, storage *container.StorageConfig) (*container.ContainerInfo, error) {
+	name := config.Name
+	if name == "" {
+		name = containerId
+	}
+
+	containerInfo := &container.ContainerInfo{
+		Id:             containerId,
+		ContainerName:  name,
+		Image:          config.Image,
+		Commands:       strings.Join(config.Cmd, " "),
+		Status:         container.ContainerStatus_Created,
+		CreateTime:     time.Now().Format("2006-01-02 15:04:05"),
+		Volume:         config.Volume,
+		Networks:       make([]*container.EndpointSettings, 0, len(config.Networks)),
+		PortMapping:    config.PortMapping,
+		TinyInit:       config.TinyInit,
+		ResourceConfig: config.Resources,
+		Env:            config.Env,
+		HealthConfig:   config.HealthConfig,
+		Labels:         config.Labels,
+		RestartPolicy:  config.RestartPolicy,
+		Storage:        storage,
+		ReadOnly:       config.ReadOnly,
+		Ulimits:        config.Ulimits,
+		Sysctls:        config.Sysctls,
+		Secrets:        config.Secrets,
+	}
+
+	for _, networkName := range config.Networks {
+		containerInfo.Networks = append(containerInfo.Networks, &container.EndpointSettings{NetworkName: networkName, Aliases: config.NetworkAliases})
+	}
+
+	// 序列化
+	str, err := sonic.Marshal(containerInfo)
+	if err != nil {
+		logrus.Errorf("[recordContainerInfo] json marshal failed, err:%s", err)
+		return nil, err
+	}
+
+	docUrl := fmt.Sprintf(container.GhnDockerRunningContainerDir, containerId)
+	if err = os.MkdirAll(docUrl, 0777); err != nil {
+		logrus.Errorf("[recordContainerInfo] mkdir failed, err:%s", err)
+		return nil, err
+	}
+
+	docUrl = docUrl + "/" + container.ConfFileName
+
+	file, err := os.Create(docUrl)
+	defer file.Close()
+	if err != nil {
+		logrus.Errorf("[recordContainerInfo] create new file failed, err:%s", err)
+		return nil, err
+	}
+
+	if _, err = file.WriteString(string(str)); err != nil {
+		logrus.Errorf("[recordContainerInfo] write container record info failed, err:%s", err)
+		return nil, err
+	}
+
+	return containerInfo, nil
+}
@@ -0,0 +1,124 @@
+package ghndocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/metrics"
+	"github.com/common-tools-haonan/docker/network"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultMetricsAddress metrics命令默认的监听地址
+const DefaultMetricsAddress = "127.0.0.1:9323"
+
+// metricsSource 从本机的容器记录、事件日志以及容器network namespace读取指标数据
+type metricsSource struct {
+	mu     sync.Mutex
+	events container.EventCounter
+}
+
+func (source *metricsSource) Containers() ([]*metrics.Container, error) {
+	containers, err := container.ListContainers(&container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*metrics.Container, 0, len(containers))
+	for _, containerInfo := range containers {
+		target := &metrics.Container{
+			Id:         containerInfo.Id,
+			Name:       containerInfo.ContainerName,
+			Image:      containerInfo.Image,
+			State:      strings.ToLower(string(containerInfo.Status)),
+			CgroupPath: fmt.Sprintf(container.CGroupPathFormat, containerInfo.Id),
+		}
+		if containerInfo.Status == container.ContainerStatus_Running || containerInfo.Status == container.ContainerStatus_Paused {
+			target.Networks = containerNetworkStats(containerInfo)
+		}
+		result = append(result, target)
+	}
+	return result, nil
+}
+
+func (source *metricsSource) Counters() (*metrics.Counters, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	counters, err := source.events.Update()
+	if err != nil {
+		return nil, err
+	}
+	return &metrics.Counters{
+		Runs:     counters.Runs,
+		Failures: counters.Failures,
+		Restarts: counters.Restarts,
+		Ooms:     counters.Ooms,
+	}, nil
+}
+
+// containerNetworkStats 通过netlink读取容器内网络设备的统计，读取失败时不输出网络指标
+func containerNetworkStats(containerInfo *container.ContainerInfo) []*metrics.NetworkStats {
+	pid, err := strconv.Atoi(strings.TrimSpace(containerInfo.Pid))
+	if err != nil || pid <= 0 {
+		return nil
+	}
+	links, err := network.ContainerLinks(pid)
+	if err != nil {
+		logrus.Warnf("[metrics] list links of container:%s failed, err:%s", containerInfo.Id, err)
+		return nil
+	}
+
+	stats := make([]*metrics.NetworkStats, 0, len(links))
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Statistics == nil {
+			continue
+		}
+		stats = append(stats, &metrics.NetworkStats{
+			Interface: attrs.Name,
+			RxBytes:   attrs.Statistics.RxBytes,
+			TxBytes:   attrs.Statistics.TxBytes,
+			RxPackets: attrs.Statistics.RxPackets,
+			TxPackets: attrs.Statistics.TxPackets,
+			RxErrors:  attrs.Statistics.RxErrors,
+			TxErrors:  attrs.Statistics.TxErrors,
+			RxDropped: attrs.Statistics.RxDropped,
+			TxDropped: attrs.Statistics.TxDropped,
+		})
+	}
+	return stats
+}
+
+// ServeMetrics 在address上以Prometheus文本格式提供/metrics，收到SIGINT/SIGTERM时退出
+func ServeMetrics(address string) error {
+	collector := metrics.NewCollector(&metricsSource{}, subsystem.CgroupV2UnifiedMountPoint, subsystem.IsCgroupV2())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("[metrics] received signal:%s, shutting down", sig)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logrus.Infof("[metrics] listening on http://%s/metrics", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
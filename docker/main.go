@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/common-tools-haonan/docker/api"
 	"github.com/common-tools-haonan/docker/cgroup/subsystem"
 	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/ghndocker"
 	"github.com/common-tools-haonan/docker/network"
+	"github.com/common-tools-haonan/docker/stack"
+	"github.com/common-tools-haonan/docker/system"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"text/tabwriter"
+	"time"
 )
 
 func main() {
@@ -16,29 +28,67 @@ func main() {
 	//
 	network.Init()
 
+	// 以ghndockerd(软链接)启动时等价于 ghndocker daemon
+	args := os.Args
+	if filepath.Base(args[0]) == "ghndockerd" {
+		args = append([]string{args[0], "daemon"}, args[1:]...)
+	}
+
 	app := cli.NewApp()
 	app.Name = "ghndocker"
 	app.Usage = "ghndocker is a simple docker cmdline tool for guohaonan.Aatrox use"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "host, H",
+			Usage:  "daemon socket to connect to, for example unix:///home/guohaonan/ghndocker/ghndocker.sock, commands run locally when empty",
+			EnvVar: api.HostEnv,
+		},
+	}
 	app.Commands = []cli.Command{
 		initCommand,
+		monitorCommand,
+		daemonCommand,
+		metricsCommand,
 		runCommand,
+		createCommand,
+		startCommand,
 		listCommand,
 		logCommand,
 		stopCommand,
+		renameCommand,
+		pauseCommand,
+		unpauseCommand,
+		updateCommand,
 		removeCommand,
 		execCommand,
 		commitCommand,
+		inspectCommand,
+		topCommand,
+		portCommand,
+		cpCommand,
+		diffCommand,
+		exportCommand,
+		importCommand,
+		imagesCommand,
 		networkCommand,
+		upCommand,
+		downCommand,
+		psCommand,
+		systemCommand,
+		doctorCommand,
+		eventsCommand,
+		secretCommand,
+		snapshotCommand,
 	}
 
 	app.Before = func(context *cli.Context) error {
-		// log
+		// log, 输出到stderr，保证stdout只包含命令的输出，便于脚本解析
 		logrus.SetFormatter(&logrus.JSONFormatter{})
 
-		logrus.SetOutput(os.Stdout)
+		logrus.SetOutput(os.Stderr)
 		return nil
 	}
-	if err := app.Run(os.Args); err != nil {
+	if err := app.Run(args); err != nil {
 		logrus.Fatal(err)
 	}
 }
@@ -46,119 +96,468 @@ func main() {
 var initCommand = cli.Command{
 	Name:  "init",
 	Usage: "Init cgroup process run user's process in cgroup. Don't call it outside",
-	Action: func(context *cli.Context) error {
-		logrus.Infof("init start")
-		return container.RunContainerInitProcess()
-	},
-}
-
-var runCommand = cli.Command{
-	Name: "run",
-	Usage: "Create a cgroup with namespace and cgroups limit " +
-		"ghndocker run -it [command] ",
 	Flags: []cli.Flag{
 		cli.BoolFlag{
-			Name:  "it",
-			Usage: "enable docker to run",
+			Name:  "init",
+			Usage: "keep init as pid 1 to reap zombies and forward signals to user's process",
 		},
 		cli.BoolFlag{
-			Name:  "detach",
-			Usage: "run container on background",
-		},
-		cli.StringFlag{
-			Name:  "memory",
-			Usage: "memory limit",
-		},
-		cli.StringFlag{
-			Name:  "cpushre",
-			Usage: "cpushare limit",
-		},
-		cli.StringFlag{
-			Name:  "cpuset",
-			Usage: "cpuset limit",
-		},
-		cli.StringFlag{
-			Name:  "image",
-			Usage: "image type and name",
+			Name:  "read-only",
+			Usage: "remount the container rootfs read-only",
 		},
 		cli.StringFlag{
 			Name:  "volume",
-			Usage: "mount volume between host and container",
-		},
-		cli.StringFlag{
-			Name:  "name",
-			Usage: "container name",
+			Usage: "volume of the container, used to set its mount propagation",
 		},
 		cli.StringSliceFlag{
-			Name:  "env",
-			Usage: "environment from stdin",
+			Name:  "ulimit",
+			Usage: "resource limit set before executing user's process",
 		},
-		cli.StringFlag{
-			Name:  "net",
-			Usage: "connect into the specific network",
+		cli.StringSliceFlag{
+			Name:  "sysctl",
+			Usage: "namespaced kernel parameter written after namespace setup",
 		},
-		cli.StringFlag{
-			Name:  "port",
-			Usage: "host port mapping with container port",
+		cli.BoolFlag{
+			Name:  "secrets",
+			Usage: "read secrets from fd 4 and mount them on /run/secrets",
 		},
 	},
+	Action: func(context *cli.Context) error {
+		logrus.Infof("init start")
+		ulimits, err := container.ParseUlimits(context.StringSlice("ulimit"))
+		if err != nil {
+			return err
+		}
+		sysctls, err := container.ParseSysctls(context.StringSlice("sysctl"))
+		if err != nil {
+			return err
+		}
+		return container.RunContainerInitProcess(&container.InitOptions{
+			TinyInit: context.Bool("init"),
+			ReadOnly: context.Bool("read-only"),
+			Volume:   context.String("volume"),
+			Ulimits:  ulimits,
+			Sysctls:  sysctls,
+			Secrets:  context.Bool("secrets"),
+		})
+	},
+}
+
+var monitorCommand = cli.Command{
+	Name:   "monitor",
+	Usage:  "Monitor container's process and cgroup events. Don't call it outside",
+	Hidden: true,
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 1 {
-			return fmt.Errorf("missing Container command")
+			return fmt.Errorf("missing container id")
 		}
-		cmds := make([]string, 0)
+		return ghndocker.Monitor(context.Args().Get(0))
+	},
+}
+
+var metricsCommand = cli.Command{
+	Name:  "metrics",
+	Usage: "serve container and ghndocker metrics in Prometheus text format on /metrics",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "address to listen on",
+			Value: ghndocker.DefaultMetricsAddress,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return ghndocker.ServeMetrics(ctx.String("listen"))
+	},
+}
 
-		for _, cmd := range context.Args() {
-			cmds = append(cmds, cmd)
+var daemonCommand = cli.Command{
+	Name:  "daemon",
+	Usage: "run ghndockerd: supervise containers and serve the api on a unix socket, --host sets the socket",
+	Action: func(ctx *cli.Context) error {
+		socketPath, err := api.ParseHost(ctx.GlobalString("host"))
+		if err != nil {
+			return err
 		}
+		return ghndocker.RunDaemon(socketPath)
+	},
+}
 
+var runCommand = cli.Command{
+	Name: "run",
+	Usage: "Create a cgroup with namespace and cgroups limit " +
+		"ghndocker run -it [command] ",
+	Flags: append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "it",
+			Usage: "enable docker to run",
+		},
+		cli.BoolFlag{
+			Name:  "detach",
+			Usage: "run container on background",
+		},
+	}, containerFlags...),
+	Action: func(context *cli.Context) error {
 		itFlag := context.Bool("it")
 		detachFlag := context.Bool("detach")
 
 		if itFlag && detachFlag {
-			logrus.Fatalf("itFlag and detachFlag cannot exist at the same time")
+			return fmt.Errorf("itFlag and detachFlag cannot exist at the same time")
 		}
 
-		resConf := &subsystem.SubSystemConfig{
-			MemoryLimits: context.String("memory"),
-			CpuSet:       context.String("cpuset"),
-			CpuShare:     context.String("cpushare"),
+		config, err := parseContainerConfig(context)
+		if err != nil {
+			return err
 		}
 
-		image := context.String("image")
-		volume := context.String("volume")
-		name := context.String("name")
-		env := context.StringSlice("env")
-		net := context.String("net")
-		portMapping := context.String("port")
+		client, err := newClient(context)
+		if err != nil {
+			return err
+		}
+		if itFlag {
+			_, err = client.RunAttached(config)
+			return err
+		}
 
-		Run(itFlag, cmds, resConf, image, volume, name, env, net, portMapping)
+		containerId, err := client.Run(config)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, containerId)
 		return nil
 	},
 }
 
+var createCommand = cli.Command{
+	Name:      "create",
+	Usage:     "create a container without starting it, start it with ghndocker start",
+	ArgsUsage: "[command]",
+	Flags:     containerFlags,
+	Action: func(context *cli.Context) error {
+		config, err := parseContainerConfig(context)
+		if err != nil {
+			return err
+		}
+
+		client, err := newClient(context)
+		if err != nil {
+			return err
+		}
+		containerId, err := client.Create(config)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, containerId)
+		return nil
+	},
+}
+
+var startCommand = cli.Command{
+	Name:      "start",
+	Usage:     "start a created container on background",
+	ArgsUsage: "<container_id|name>",
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Start(containerRef(ctx))
+	},
+}
+
+// containerFlags run以及create共用的容器配置参数
+var containerFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "memory",
+		Usage: "memory limit",
+	},
+	cli.StringFlag{
+		Name:  "cpushare",
+		Usage: "cpushare limit",
+	},
+	cli.StringFlag{
+		Name:  "cpuset",
+		Usage: "cpuset limit",
+	},
+	cli.StringFlag{
+		Name:  "cpus",
+		Usage: "number of cpus, for example 1.5",
+	},
+	cli.StringFlag{
+		Name:  "pids-limit",
+		Usage: "max number of processes in container",
+	},
+	cli.StringFlag{
+		Name:  "memory-swap",
+		Usage: "total limit of memory and swap, -1 means unlimited swap",
+	},
+	cli.StringFlag{
+		Name:  "memory-reservation",
+		Usage: "memory soft limit",
+	},
+	cli.BoolFlag{
+		Name:  "oom-kill-disable",
+		Usage: "disable oom killer, only supported by cgroup v1",
+	},
+	cli.StringFlag{
+		Name:  "image",
+		Usage: "image type and name",
+	},
+	cli.StringFlag{
+		Name:  "volume",
+		Usage: "mount volume between host and container",
+	},
+	cli.StringFlag{
+		Name:  "name",
+		Usage: "container name",
+	},
+	cli.StringSliceFlag{
+		Name:  "env",
+		Usage: "environment from stdin",
+	},
+	cli.StringSliceFlag{
+		Name:  "net",
+		Usage: "connect into the specific network, repeat to join multiple networks as eth0, eth1...",
+	},
+	cli.StringSliceFlag{
+		Name:  "network-alias",
+		Usage: "alias of the container in every network it joins, resolvable from other containers in the network",
+	},
+	cli.StringFlag{
+		Name:  "port",
+		Usage: "host port mapping with container port, applied to the first network",
+	},
+	cli.BoolFlag{
+		Name:  "init",
+		Usage: "run a tiny init inside the container that reaps zombies and forwards signals",
+	},
+	cli.StringSliceFlag{
+		Name:  "label",
+		Usage: "set metadata on the container, k=v",
+	},
+	cli.StringFlag{
+		Name:  "health-cmd",
+		Usage: "command to run inside the container to check health",
+	},
+	cli.DurationFlag{
+		Name:  "health-interval",
+		Usage: "time between running the health check",
+		Value: 30 * time.Second,
+	},
+	cli.DurationFlag{
+		Name:  "health-timeout",
+		Usage: "maximum time to allow one health check to run",
+		Value: 30 * time.Second,
+	},
+	cli.IntFlag{
+		Name:  "health-retries",
+		Usage: "consecutive failures needed to report unhealthy",
+		Value: 3,
+	},
+	cli.DurationFlag{
+		Name:  "health-start-period",
+		Usage: "start period for the container to initialize before counting retries",
+	},
+	cli.BoolFlag{
+		Name:  "health-restart",
+		Usage: "restart the container when it becomes unhealthy",
+	},
+	cli.StringFlag{
+		Name:  "restart",
+		Usage: "restart policy when the container exits: no, always, on-failure[:max-retries]",
+	},
+	cli.BoolFlag{
+		Name:  "read-only",
+		Usage: "mount the container rootfs read-only, tmpfs and volumes stay writable",
+	},
+	cli.StringSliceFlag{
+		Name:  "ulimit",
+		Usage: "resource limit of the container processes, e.g. --ulimit nofile=65535:65535",
+	},
+	cli.StringSliceFlag{
+		Name:  "sysctl",
+		Usage: "namespaced kernel parameter of the container, e.g. --sysctl net.core.somaxconn=1024",
+	},
+	cli.StringSliceFlag{
+		Name:  "secret",
+		Usage: "mount a secret under /run/secrets in the container, e.g. --secret db_pass,target=/run/secrets/db,mode=0400",
+	},
+	cli.StringFlag{
+		Name:  "storage-driver",
+		Usage: "storage driver of the container rootfs: overlay or vfs, detected from the host by default",
+	},
+	cli.StringSliceFlag{
+		Name:  "storage-opt",
+		Usage: "storage driver options, e.g. --storage-opt size=2G",
+	},
+}
+
+// parseContainerConfig 从run/create的参数中解析容器配置
+func parseContainerConfig(context *cli.Context) (*ghndocker.RunOptions, error) {
+	if len(context.Args()) < 1 {
+		return nil, fmt.Errorf("missing Container command")
+	}
+	cmds := make([]string, 0)
+
+	for _, cmd := range context.Args() {
+		cmds = append(cmds, cmd)
+	}
+
+	resConf := &subsystem.SubSystemConfig{
+		MemoryLimits: context.String("memory"),
+		CpuSet:       context.String("cpuset"),
+		CpuShare:     context.String("cpushare"),
+		Cpus:         context.String("cpus"),
+		PidsLimit:    context.String("pids-limit"),
+
+		MemorySwap:        context.String("memory-swap"),
+		MemoryReservation: context.String("memory-reservation"),
+		OomKillDisable:    context.Bool("oom-kill-disable"),
+	}
+	if err := resConf.Validate(); err != nil {
+		return nil, err
+	}
+
+	labels, err := container.ParseLabels(context.StringSlice("label"))
+	if err != nil {
+		return nil, err
+	}
+	restartPolicy, err := container.ParseRestartPolicy(context.String("restart"))
+	if err != nil {
+		return nil, err
+	}
+	storage, err := container.ParseStorageConfig(context.String("storage-driver"), context.StringSlice("storage-opt"))
+	if err != nil {
+		return nil, err
+	}
+	ulimits, err := container.ParseUlimits(context.StringSlice("ulimit"))
+	if err != nil {
+		return nil, err
+	}
+	sysctls, err := container.ParseSysctls(context.StringSlice("sysctl"))
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*container.SecretReference, 0)
+	for _, value := range context.StringSlice("secret") {
+		secret, err := container.ParseSecretReference(value)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+
+	config := &ghndocker.RunOptions{
+		Name:           context.String("name"),
+		Image:          context.String("image"),
+		Cmd:            cmds,
+		Env:            context.StringSlice("env"),
+		Volume:         context.String("volume"),
+		Networks:       context.StringSlice("net"),
+		NetworkAliases: context.StringSlice("network-alias"),
+		PortMapping:    context.String("port"),
+		TinyInit:       context.Bool("init"),
+		Resources:      resConf,
+		Labels:         labels,
+
+		RestartPolicy: restartPolicy,
+		Storage:       storage,
+		ReadOnly:      context.Bool("read-only"),
+		Ulimits:       ulimits,
+		Sysctls:       sysctls,
+		Secrets:       secrets,
+	}
+
+	if healthCmd := context.String("health-cmd"); healthCmd != "" {
+		config.HealthConfig = &container.HealthConfig{
+			Cmd:                healthCmd,
+			Interval:           context.Duration("health-interval"),
+			Timeout:            context.Duration("health-timeout"),
+			Retries:            context.Int("health-retries"),
+			StartPeriod:        context.Duration("health-start-period"),
+			RestartOnUnhealthy: context.Bool("health-restart"),
+		}
+		if config.HealthConfig.Interval <= 0 || config.HealthConfig.Timeout <= 0 || config.HealthConfig.Retries <= 0 {
+			return nil, fmt.Errorf("health interval, timeout and retries should be positive")
+		}
+	}
+	return config, nil
+}
+
 var listCommand = cli.Command{
 	Name:  "show",
-	Usage: "show all containers in this host",
+	Usage: "show containers in this host, only running containers by default",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "a",
+			Usage: "show all containers",
+		},
+		cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "filter containers, status=running, name=web, label=k=v, network=net, ancestor=image",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "json, or go template to render each container, for example '{{.Id}} {{.ContainerName}}'",
+		},
+		cli.BoolFlag{
+			Name:  "q",
+			Usage: "only show container ids",
+		},
+		cli.BoolFlag{
+			Name:  "no-trunc",
+			Usage: "do not truncate output",
+		},
+	},
 	Action: func(context *cli.Context) error {
-		container.ListAllContainers()
-		return nil
+		filters, err := container.ParseListFilters(context.StringSlice("filter"))
+		if err != nil {
+			return err
+		}
+
+		options := &container.ListOptions{
+			All:     context.Bool("a"),
+			Filters: filters,
+			Format:  context.String("format"),
+			Quiet:   context.Bool("q"),
+			NoTrunc: context.Bool("no-trunc"),
+		}
+
+		client, err := newClient(context)
+		if err != nil {
+			return err
+		}
+		containers, err := client.List(options)
+		if err != nil {
+			return err
+		}
+		return container.RenderContainers(containers, options, os.Stdout)
 	},
 }
 
 var logCommand = cli.Command{
-	Name:  "logs",
-	Usage: "show exec logs in container",
-	Flags: []cli.Flag{
+	Name:      "logs",
+	Usage:     "show exec logs in container, or logs of all services in a stack with -f",
+	ArgsUsage: "<container_id|name> | -f stack.yaml [service...]",
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "container_id",
-			Usage: "find log by container_id",
+			Usage: "find log by container id, id prefix or name",
 		},
-	},
-	Action: func(ctx *cli.Context) {
-		id := ctx.String("container_id")
-		container.FindContainerLog(id)
-		return
+	}, stackFlags...),
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		if !ctx.IsSet("file") {
+			return client.Logs(containerRef(ctx), os.Stdout)
+		}
+
+		stackFile, err := loadStack(ctx)
+		if err != nil {
+			return err
+		}
+		return stack.Logs(client, stackFile.Name, ctx.Args(), os.Stdout)
 	},
 }
 
@@ -168,12 +567,105 @@ var stopCommand = cli.Command{
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "container_id",
-			Usage: "stop container by container_id",
+			Usage: "stop container by container id, id prefix or name",
 		},
 	},
 	Action: func(ctx *cli.Context) error {
-		id := ctx.String("container_id")
-		return container.StopContainer(id)
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Stop(containerRef(ctx))
+	},
+}
+
+var renameCommand = cli.Command{
+	Name:      "rename",
+	Usage:     "rename a container",
+	ArgsUsage: "<container_id|name> <new_name>",
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 2 {
+			return fmt.Errorf("missing container or new name")
+		}
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Rename(ctx.Args().Get(0), ctx.Args().Get(1))
+	},
+}
+
+var pauseCommand = cli.Command{
+	Name:  "pause",
+	Usage: "freeze all processes in container",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "container_id",
+			Usage: "pause container by container id, id prefix or name",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Pause(containerRef(ctx))
+	},
+}
+
+var unpauseCommand = cli.Command{
+	Name:  "unpause",
+	Usage: "thaw all processes in a paused container",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "container_id",
+			Usage: "unpause container by container id, id prefix or name",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Unpause(containerRef(ctx))
+	},
+}
+
+var updateCommand = cli.Command{
+	Name:      "update",
+	Usage:     "update resource limits of a running container",
+	ArgsUsage: "<container_id|name>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "memory",
+			Usage: "memory limit, for example 100m",
+		},
+		cli.StringFlag{
+			Name:  "cpus",
+			Usage: "number of cpus, for example 1.5",
+		},
+		cli.StringFlag{
+			Name:  "cpuset",
+			Usage: "cpuset limit, for example 0-2",
+		},
+		cli.StringFlag{
+			Name:  "pids-limit",
+			Usage: "max number of processes in container",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+
+		update := &subsystem.SubSystemConfig{
+			MemoryLimits: ctx.String("memory"),
+			Cpus:         ctx.String("cpus"),
+			CpuSet:       ctx.String("cpuset"),
+			PidsLimit:    ctx.String("pids-limit"),
+		}
+		return client.Update(containerRef(ctx), update)
 	},
 }
 
@@ -183,7 +675,7 @@ var removeCommand = cli.Command{
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "container_id",
-			Usage: "remove container by container_id",
+			Usage: "remove container by container id, id prefix or name",
 		},
 		cli.BoolFlag{
 			Name:  "f",
@@ -192,7 +684,11 @@ var removeCommand = cli.Command{
 	},
 	Action: func(ctx *cli.Context) error {
 		force := ctx.Bool("f")
-		return container.RemoveContainer(ctx.String("container_id"), force)
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Remove(containerRef(ctx), force)
 	},
 }
 
@@ -202,19 +698,29 @@ var execCommand = cli.Command{
 	Action: func(context *cli.Context) error {
 		//This is for callback
 		if os.Getenv(container.ENV_EXEC_PID) != "" {
-			logrus.Infof("pid callback pid %s", os.Getgid())
+			logrus.Infof("pid callback pid %d", os.Getpid())
 			return nil
 		}
 
 		if len(context.Args()) < 2 {
 			return fmt.Errorf("Missing container name or command")
 		}
-		containerName := context.Args().Get(0)
 		var commandArray []string
 		for _, arg := range context.Args().Tail() {
 			commandArray = append(commandArray, arg)
 		}
-		container.ExecContainer(containerName, commandArray)
+
+		client, err := newClient(context)
+		if err != nil {
+			return err
+		}
+		exitCode, err := client.Exec(context.Args().Get(0), commandArray, os.Stdin, os.Stdout, os.Stderr)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return cli.NewExitError("", exitCode)
+		}
 		return nil
 	},
 }
@@ -225,7 +731,7 @@ var commitCommand = cli.Command{
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "container_id",
-			Usage: "container filesystem based on",
+			Usage: "container filesystem based on, container id, id prefix or name",
 		},
 		cli.StringFlag{
 			Name:  "image",
@@ -233,11 +739,324 @@ var commitCommand = cli.Command{
 		},
 	},
 	Action: func(context *cli.Context) error {
-		containerId, image := context.String("container_id"), context.String("image")
-		return container.CommitToMakeAImage(containerId, image)
+		client, err := newClient(context)
+		if err != nil {
+			return err
+		}
+		return client.ImageCommit(containerRef(context), context.String("image"))
+	},
+}
+
+var inspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     "show the full record of a container merged with its live state",
+	ArgsUsage: "<container_id|name>",
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		inspect, err := client.Inspect(containerRef(ctx))
+		if err != nil {
+			return err
+		}
+
+		bytes, err := sonic.ConfigStd.MarshalIndent(inspect, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(bytes))
+		return nil
 	},
 }
 
+var topCommand = cli.Command{
+	Name:      "top",
+	Usage:     "list processes running in a container",
+	ArgsUsage: "<container_id|name>",
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+
+		processes, err := client.Top(containerRef(ctx))
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprintf(w, "UID\tPID\tPPID\tSTAT\tCMD\n")
+		for _, process := range processes {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", process.Uid, process.Pid, process.PPid, process.State, process.Cmd)
+		}
+		return w.Flush()
+	},
+}
+
+var portCommand = cli.Command{
+	Name:      "port",
+	Usage:     "list active port mappings of a container",
+	ArgsUsage: "<container_id|name>",
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		inspect, err := client.Inspect(ctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		for _, binding := range inspect.Ports {
+			if !binding.Active {
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "%s/tcp -> 0.0.0.0:%s\n", binding.ContainerPort, binding.HostPort)
+		}
+		return nil
+	},
+}
+
+var cpCommand = cli.Command{
+	Name:      "cp",
+	Usage:     "copy files between container and host, preserving modes",
+	ArgsUsage: "<container:path> <host_path> | <host_path> <container:path>",
+	Before:    localOnly,
+	Action: func(ctx *cli.Context) error {
+		if len(ctx.Args()) < 2 {
+			return fmt.Errorf("missing source or destination")
+		}
+		src, dst := ctx.Args().Get(0), ctx.Args().Get(1)
+
+		srcContainer, srcPath, srcInContainer := splitContainerPath(src)
+		dstContainer, dstPath, dstInContainer := splitContainerPath(dst)
+
+		switch {
+		case srcInContainer && !dstInContainer:
+			containerInfo, err := container.ResolveContainer(srcContainer)
+			if err != nil {
+				return err
+			}
+			return container.CopyFromContainer(containerInfo.Id, srcPath, dst)
+		case !srcInContainer && dstInContainer:
+			containerInfo, err := container.ResolveContainer(dstContainer)
+			if err != nil {
+				return err
+			}
+			return container.CopyToContainer(containerInfo.Id, src, dstPath)
+		default:
+			return fmt.Errorf("exactly one of source and destination should be container:path")
+		}
+	},
+}
+
+// splitContainerPath 解析 container:path，以/或.开头的参数视为宿主机路径
+func splitContainerPath(arg string) (string, string, bool) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg, false
+	}
+	containerRef, path, found := strings.Cut(arg, ":")
+	if !found || containerRef == "" {
+		return "", arg, false
+	}
+	return containerRef, path, true
+}
+
+var diffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "list added(A), changed(C) and deleted(D) files in container's writable layer",
+	ArgsUsage: "<container_id|name>",
+	Before:    localOnly,
+	Action: func(ctx *cli.Context) error {
+		id, err := resolveContainerId(ctx)
+		if err != nil {
+			return err
+		}
+
+		changes, err := container.DiffContainer(id)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			fmt.Fprintf(os.Stdout, "%s %s\n", change.Kind, change.Path)
+		}
+		return nil
+	},
+}
+
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export container's merged rootfs as a tar archive to stdout",
+	ArgsUsage: "<container_id|name>",
+	Before:    localOnly,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "o",
+			Usage: "write to a file instead of stdout",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		id, err := resolveContainerId(ctx)
+		if err != nil {
+			return err
+		}
+
+		output := os.Stdout
+		if path := ctx.String("o"); path != "" {
+			if output, err = os.Create(path); err != nil {
+				return err
+			}
+			defer output.Close()
+		}
+		return container.ExportContainer(id, output)
+	},
+}
+
+var snapshotCommand = cli.Command{
+	Name:   "snapshot",
+	Usage:  "snapshot container's writable layer and roll it back later",
+	Before: localOnly,
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "copy container's writable layer as an immutable snapshot, a running container is paused during the copy",
+			ArgsUsage: "<container_id|name> <tag>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 2 {
+					return fmt.Errorf("missing container or snapshot tag")
+				}
+				id, err := resolveContainerId(ctx)
+				if err != nil {
+					return err
+				}
+				return container.CreateSnapshot(id, ctx.Args().Get(1))
+			},
+		},
+		{
+			Name:      "ls",
+			Usage:     "list snapshots of a container, or of all containers",
+			ArgsUsage: "[container_id|name]",
+			Action: func(ctx *cli.Context) error {
+				id := ""
+				if len(ctx.Args()) > 0 {
+					var err error
+					if id, err = resolveContainerId(ctx); err != nil {
+						return err
+					}
+				}
+				snapshots, err := container.ListSnapshots(id)
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+				fmt.Fprintf(w, "CONTAINER\tTAG\tIMAGE\tSIZE\tCREATED\n")
+				for _, snapshot := range snapshots {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", snapshot.ContainerId, snapshot.Tag, snapshot.Image, snapshot.Size, snapshot.CreateTime)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "roll a stopped container's writable layer back to a snapshot, changes after the snapshot are discarded",
+			ArgsUsage: "<container_id|name> <tag>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 2 {
+					return fmt.Errorf("missing container or snapshot tag")
+				}
+				id, err := resolveContainerId(ctx)
+				if err != nil {
+					return err
+				}
+				return container.RestoreSnapshot(id, ctx.Args().Get(1))
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "remove a snapshot",
+			ArgsUsage: "<container_id|name> <tag>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 2 {
+					return fmt.Errorf("missing container or snapshot tag")
+				}
+				id, err := resolveContainerId(ctx)
+				if err != nil {
+					return err
+				}
+				return container.RemoveSnapshot(id, ctx.Args().Get(1))
+			},
+		},
+	},
+}
+
+var importCommand = cli.Command{
+	Name:      "import",
+	Usage:     "create an image from a tar archive read from stdin",
+	ArgsUsage: "<image>",
+	Action: func(ctx *cli.Context) error {
+		image := ctx.Args().First()
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.ImageImport(image, os.Stdin)
+	},
+}
+
+var imagesCommand = cli.Command{
+	Name:  "images",
+	Usage: "list local images",
+	Action: func(ctx *cli.Context) error {
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		images, err := client.ImageList()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprintf(w, "IMAGE\tSIZE\tEXTRACTED\tCREATED\n")
+		for _, image := range images {
+			fmt.Fprintf(w, "%s\t%d\t%t\t%s\n", image.Name, image.Size, image.Extracted, image.CreateTime)
+		}
+		return w.Flush()
+	},
+}
+
+// containerRef 优先使用--container_id，否则使用第一个位置参数
+func containerRef(ctx *cli.Context) string {
+	if ref := ctx.String("container_id"); ref != "" {
+		return ref
+	}
+	return ctx.Args().First()
+}
+
+// newClient 指定了--host时通过daemon执行，否则在本地执行
+func newClient(ctx *cli.Context) (*ghndocker.Client, error) {
+	return ghndocker.NewClient(ghndocker.ClientOptions{Host: ctx.GlobalString("host")})
+}
+
+// localOnly 直接读写本地状态目录的命令不经过daemon，指定--host时报错，避免在错误的host上执行
+func localOnly(ctx *cli.Context) error {
+	if ctx.GlobalString("host") != "" {
+		return fmt.Errorf("command does not support --host, run it on the daemon host")
+	}
+	return nil
+}
+
+// resolveContainerId 优先使用--container_id，否则使用第一个位置参数，支持完整id、唯一id前缀以及容器名称
+func resolveContainerId(ctx *cli.Context) (string, error) {
+	containerInfo, err := container.ResolveContainer(containerRef(ctx))
+	if err != nil {
+		return "", err
+	}
+	return containerInfo.Id, nil
+}
+
 var networkCommand = cli.Command{
 	Name:  "network",
 	Usage: "tools about container network, for example, create network(LAN)",
@@ -264,14 +1083,22 @@ var networkCommand = cli.Command{
 			},
 			Action: func(ctx *cli.Context) error {
 				name, driver, subnet := ctx.String("name"), ctx.String("driver"), ctx.String("subnet")
-				return network.CreateNetwork(name, driver, subnet)
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				return client.NetworkCreate(&api.NetworkCreateRequest{Name: name, Driver: driver, Subnet: subnet})
 			},
 		},
 		{
 			Name:  "list",
 			Usage: "list all networks",
 			Action: func(ctx *cli.Context) error {
-				networks, err := network.ListAllNetwork()
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				networks, err := client.NetworkList()
 				if err != nil {
 					return err
 				}
@@ -281,7 +1108,7 @@ var networkCommand = cli.Command{
 
 				for i := range networks {
 					nw := networks[i]
-					fmt.Fprintf(w, "%s\t%s\t%s\n", nw.NetworkName, nw.IPRange.String(), nw.Driver)
+					fmt.Fprintf(w, "%s\t%s\t%s\n", nw.Name, nw.IPRange, nw.Driver)
 				}
 
 				return w.Flush()
@@ -297,8 +1124,348 @@ var networkCommand = cli.Command{
 			},
 			Action: func(ctx *cli.Context) error {
 				name := ctx.String("name")
-				return network.DeleteNetwork(name)
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				return client.NetworkRemove(name)
+			},
+		},
+		{
+			Name:      "connect",
+			Usage:     "connect a container to a network, a running container gets a new interface immediately",
+			ArgsUsage: "<network> <container_id|name>",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "alias",
+					Usage: "alias of the container in the network, resolvable from other containers in the network",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 2 {
+					return fmt.Errorf("missing network or container")
+				}
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				return client.NetworkConnect(ctx.Args().Get(0), ctx.Args().Get(1), ctx.StringSlice("alias"))
+			},
+		},
+		{
+			Name:      "disconnect",
+			Usage:     "disconnect a container from a network",
+			ArgsUsage: "<network> <container_id|name>",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 2 {
+					return fmt.Errorf("missing network or container")
+				}
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				return client.NetworkDisconnect(ctx.Args().Get(0), ctx.Args().Get(1))
 			},
 		},
 	},
 }
+
+var secretCommand = cli.Command{
+	Name:  "secret",
+	Usage: "manage secrets encrypted at rest, mounted into containers by run --secret",
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "create a secret from a file, or from stdin when the file is omitted or -",
+			ArgsUsage: "NAME [FILE|-]",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing secret name")
+				}
+				var source io.Reader = os.Stdin
+				if file := ctx.Args().Get(1); file != "" && file != "-" {
+					f, err := os.Open(file)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					source = f
+				}
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				if err = client.SecretCreate(ctx.Args().First(), source); err != nil {
+					return err
+				}
+				fmt.Println(ctx.Args().First())
+				return nil
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list secrets, contents are never shown",
+			Action: func(ctx *cli.Context) error {
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				secrets, err := client.SecretList()
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+				fmt.Fprintf(w, "NAME\tSIZE\tCREATED\n")
+				for _, secret := range secrets {
+					fmt.Fprintf(w, "%s\t%d\t%s\n", secret.Name, secret.Size, secret.CreateTime)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "remove secrets that are not used by any container",
+			ArgsUsage: "NAME [NAME...]",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.Args()) < 1 {
+					return fmt.Errorf("missing secret name")
+				}
+				client, err := newClient(ctx)
+				if err != nil {
+					return err
+				}
+				for _, name := range ctx.Args() {
+					if err = client.SecretRemove(name); err != nil {
+						return err
+					}
+					fmt.Println(name)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// stackFlags up/down/ps/logs共用的stack文件参数
+var stackFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "f, file",
+		Usage: "stack file",
+		Value: "stack.yaml",
+	},
+	cli.StringFlag{
+		Name:  "p, project-name",
+		Usage: "project name, defaults to name in the stack file or the directory name of the stack file",
+	},
+}
+
+func loadStack(ctx *cli.Context) (*stack.Stack, error) {
+	return stack.Load(ctx.String("file"), ctx.String("project-name"))
+}
+
+var upCommand = cli.Command{
+	Name:  "up",
+	Usage: "create networks and start services of a stack in dependency order, for example, ghndocker up -f stack.yaml",
+	Flags: append([]cli.Flag{
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "maximum time to wait for a dependency to become healthy",
+			Value: 2 * time.Minute,
+		},
+	}, stackFlags...),
+	Action: func(ctx *cli.Context) error {
+		stackFile, err := loadStack(ctx)
+		if err != nil {
+			return err
+		}
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return stack.Up(client, stackFile, ctx.Duration("timeout"), os.Stdout)
+	},
+}
+
+var downCommand = cli.Command{
+	Name:  "down",
+	Usage: "stop and remove containers and networks of a stack",
+	Flags: stackFlags,
+	Action: func(ctx *cli.Context) error {
+		stackFile, err := loadStack(ctx)
+		if err != nil {
+			return err
+		}
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return stack.Down(client, stackFile, os.Stdout)
+	},
+}
+
+var psCommand = cli.Command{
+	Name:  "ps",
+	Usage: "show containers of a stack",
+	Flags: stackFlags,
+	Action: func(ctx *cli.Context) error {
+		stackFile, err := loadStack(ctx)
+		if err != nil {
+			return err
+		}
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		return stack.Ps(client, stackFile.Name, os.Stdout)
+	},
+}
+
+var systemCommand = cli.Command{
+	Name:   "system",
+	Usage:  "manage ghndocker, for example, prune unused resources",
+	Before: localOnly,
+	Subcommands: []cli.Command{
+		{
+			Name:  "prune",
+			Usage: "remove stopped containers, leftover volume mounts, unused networks and unused image layers",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "f, force",
+					Usage: "do not prompt for confirmation",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				if !ctx.Bool("force") {
+					fmt.Fprint(os.Stdout, "WARNING! This will remove all stopped containers, unused networks and unused image layers.\nAre you sure you want to continue? [y/N] ")
+					answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+					if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+						return nil
+					}
+				}
+
+				report, err := system.Prune()
+				if err != nil {
+					return err
+				}
+
+				sections := []struct {
+					title string
+					items []string
+				}{
+					{"Deleted containers", report.Containers},
+					{"Unmounted volumes", report.Volumes},
+					{"Deleted networks", report.Networks},
+					{"Deleted images", report.Images},
+				}
+				for _, section := range sections {
+					if len(section.items) == 0 {
+						continue
+					}
+					fmt.Fprintf(os.Stdout, "%s:\n", section.title)
+					for _, item := range section.items {
+						fmt.Fprintln(os.Stdout, item)
+					}
+					fmt.Fprintln(os.Stdout)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+var doctorCommand = cli.Command{
+	Name:   "doctor",
+	Usage:  "cross-check container records with processes, mounts, cgroups, links, iptables and ipam",
+	Before: localOnly,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "fix",
+			Usage: "repair the issues that can be fixed automatically",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		issues, err := system.Doctor(ctx.Bool("fix"))
+		if err == nil && len(issues) == 0 {
+			fmt.Fprintln(os.Stdout, "no issues found")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "KIND\tTARGET\tDETAIL\tSTATUS\n")
+		for _, issue := range issues {
+			status := "-"
+			switch {
+			case issue.Fixed:
+				status = "fixed"
+			case issue.FixError != "":
+				status = "fix failed: " + issue.FixError
+			case issue.Fixable:
+				status = "fixable"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", issue.Kind, issue.Target, issue.Detail, status)
+		}
+		w.Flush()
+		return err
+	},
+}
+
+var eventsCommand = cli.Command{
+	Name:   "events",
+	Usage:  "print lifecycle events of containers, networks and images, for example, ghndocker events --since 10m -f",
+	Before: localOnly,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "since",
+			Usage: "show events created since the time, RFC3339, unix timestamp or duration such as 10m",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "show events created until the time, RFC3339, unix timestamp or duration such as 10m",
+		},
+		cli.StringSliceFlag{
+			Name:  "filter",
+			Usage: "filter events, key=value, supported keys: type, event, container, image, network",
+		},
+		cli.BoolFlag{
+			Name:  "f, follow",
+			Usage: "keep waiting for new events",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "json: print raw json lines",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		now := time.Now()
+		since, err := container.ParseEventTime(ctx.String("since"), now)
+		if err != nil {
+			return err
+		}
+		until, err := container.ParseEventTime(ctx.String("until"), now)
+		if err != nil {
+			return err
+		}
+		filters, err := container.ParseEventFilters(ctx.StringSlice("filter"))
+		if err != nil {
+			return err
+		}
+
+		// follow模式下收到中断信号时正常退出
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stop)
+		}()
+
+		return container.StreamEvents(&container.EventOptions{
+			Since:   since,
+			Until:   until,
+			Filters: filters,
+			Follow:  ctx.Bool("follow"),
+			Format:  ctx.String("format"),
+		}, os.Stdout, stop)
+	},
+}
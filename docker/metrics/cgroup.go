@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"bufio"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// v1 cpuacct.stat的单位为USER_HZ，Linux上固定为100
+	userHz = 100
+
+	// v1 memory.limit_in_bytes未限制时为按页对齐的int64最大值
+	unlimitedMemoryV1 = 1 << 62
+)
+
+// cgroupReader 读取容器cgroup中的资源使用统计，v1下按照子系统分别读取
+type cgroupReader struct {
+	root string
+	v2   bool
+}
+
+// dir 子系统下容器cgroup的目录，v2下所有子系统共用一个目录
+func (reader *cgroupReader) dir(subsystem string, cgroupPath string) string {
+	if reader.v2 {
+		return path.Join(reader.root, cgroupPath)
+	}
+	return path.Join(reader.root, subsystem, cgroupPath)
+}
+
+func (reader *cgroupReader) collect(registry *registry, cgroupPath string, labels []string) {
+	if reader.v2 {
+		reader.collectV2(registry, reader.dir("", cgroupPath), labels)
+		return
+	}
+	reader.collectV1(registry, cgroupPath, labels)
+}
+
+func (reader *cgroupReader) collectV2(registry *registry, dir string, labels []string) {
+	if stat, ok := readKeyValues(path.Join(dir, "cpu.stat")); ok {
+		addCpu(registry, float64(stat["usage_usec"])/1e6, float64(stat["user_usec"])/1e6, float64(stat["system_usec"])/1e6, labels)
+		addThrottling(registry, stat["nr_periods"], stat["nr_throttled"], float64(stat["throttled_usec"])/1e6, labels)
+	}
+
+	if usage, ok := readUint(path.Join(dir, "memory.current")); ok {
+		registry.add("container_memory_usage_bytes", metricType_Gauge, "Memory usage of the container, including page cache.", float64(usage), labels...)
+	}
+	if limit, ok := readUint(path.Join(dir, "memory.max")); ok {
+		registry.add("container_memory_limit_bytes", metricType_Gauge, "Memory limit of the container, absent when unlimited.", float64(limit), labels...)
+	}
+	if stat, ok := readKeyValues(path.Join(dir, "memory.stat")); ok {
+		addMemoryStat(registry, stat["anon"], stat["file"], labels)
+	}
+	if events, ok := readKeyValues(path.Join(dir, "memory.events")); ok {
+		registry.add("container_memory_oom_kills_total", metricType_Counter, "Processes killed by the OOM killer in the container cgroup.", float64(events["oom_kill"]), labels...)
+	}
+
+	reader.collectPids(registry, dir, labels)
+
+	// io.stat每行为 major:minor rbytes=.. wbytes=.. rios=.. wios=.. ...
+	for _, line := range readLines(path.Join(dir, "io.stat")) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		stat := make(map[string]uint64)
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			stat[key], _ = strconv.ParseUint(value, 10, 64)
+		}
+		addBlkio(registry, fields[0], stat["rbytes"], stat["wbytes"], stat["rios"], stat["wios"], labels)
+	}
+}
+
+func (reader *cgroupReader) collectV1(registry *registry, cgroupPath string, labels []string) {
+	cpuacct := reader.dir("cpuacct", cgroupPath)
+	if usage, ok := readUint(path.Join(cpuacct, "cpuacct.usage")); ok {
+		stat, _ := readKeyValues(path.Join(cpuacct, "cpuacct.stat"))
+		addCpu(registry, float64(usage)/1e9, float64(stat["user"])/userHz, float64(stat["system"])/userHz, labels)
+	}
+	if stat, ok := readKeyValues(path.Join(reader.dir("cpu", cgroupPath), "cpu.stat")); ok {
+		addThrottling(registry, stat["nr_periods"], stat["nr_throttled"], float64(stat["throttled_time"])/1e9, labels)
+	}
+
+	memory := reader.dir("memory", cgroupPath)
+	if usage, ok := readUint(path.Join(memory, "memory.usage_in_bytes")); ok {
+		registry.add("container_memory_usage_bytes", metricType_Gauge, "Memory usage of the container, including page cache.", float64(usage), labels...)
+	}
+	if limit, ok := readUint(path.Join(memory, "memory.limit_in_bytes")); ok && limit < unlimitedMemoryV1 {
+		registry.add("container_memory_limit_bytes", metricType_Gauge, "Memory limit of the container, absent when unlimited.", float64(limit), labels...)
+	}
+	if stat, ok := readKeyValues(path.Join(memory, "memory.stat")); ok {
+		addMemoryStat(registry, stat["rss"], stat["cache"], labels)
+	}
+	// 较新的内核在memory.oom_control中提供oom_kill计数
+	if control, ok := readKeyValues(path.Join(memory, "memory.oom_control")); ok {
+		if kills, ok := control["oom_kill"]; ok {
+			registry.add("container_memory_oom_kills_total", metricType_Counter, "Processes killed by the OOM killer in the container cgroup.", float64(kills), labels...)
+		}
+	}
+
+	reader.collectPids(registry, reader.dir("pids", cgroupPath), labels)
+
+	// 每行为 major:minor Read|Write|Sync|Async|Discard|Total value，最后一行为 Total value。
+	// 容器进程只有在加入blkio子系统时才有统计
+	blkio := reader.dir("blkio", cgroupPath)
+	bytes := readBlkioV1(path.Join(blkio, "blkio.throttle.io_service_bytes"))
+	ops := readBlkioV1(path.Join(blkio, "blkio.throttle.io_serviced"))
+	for device, stat := range bytes {
+		addBlkio(registry, device, stat["Read"], stat["Write"], ops[device]["Read"], ops[device]["Write"], labels)
+	}
+}
+
+func (reader *cgroupReader) collectPids(registry *registry, dir string, labels []string) {
+	if current, ok := readUint(path.Join(dir, "pids.current")); ok {
+		registry.add("container_pids_current", metricType_Gauge, "Number of processes in the container.", float64(current), labels...)
+	}
+	if limit, ok := readUint(path.Join(dir, "pids.max")); ok {
+		registry.add("container_pids_limit", metricType_Gauge, "Maximum number of processes in the container, absent when unlimited.", float64(limit), labels...)
+	}
+}
+
+func addCpu(registry *registry, usage float64, user float64, system float64, labels []string) {
+	registry.add("container_cpu_usage_seconds_total", metricType_Counter, "Total CPU time consumed by the container.", usage, labels...)
+	registry.add("container_cpu_seconds_total", metricType_Counter, "CPU time consumed by the container in user and system mode.", user, withLabels(labels, "mode", "user")...)
+	registry.add("container_cpu_seconds_total", metricType_Counter, "CPU time consumed by the container in user and system mode.", system, withLabels(labels, "mode", "system")...)
+}
+
+func addThrottling(registry *registry, periods uint64, throttled uint64, throttledSeconds float64, labels []string) {
+	registry.add("container_cpu_periods_total", metricType_Counter, "Enforcement periods of the container CPU quota.", float64(periods), labels...)
+	registry.add("container_cpu_throttled_periods_total", metricType_Counter, "Periods in which the container was throttled by its CPU quota.", float64(throttled), labels...)
+	registry.add("container_cpu_throttled_seconds_total", metricType_Counter, "Time the container was throttled by its CPU quota.", throttledSeconds, labels...)
+}
+
+func addMemoryStat(registry *registry, rss uint64, cache uint64, labels []string) {
+	registry.add("container_memory_rss_bytes", metricType_Gauge, "Anonymous memory of the container.", float64(rss), labels...)
+	registry.add("container_memory_cache_bytes", metricType_Gauge, "Page cache of the container.", float64(cache), labels...)
+}
+
+func addBlkio(registry *registry, device string, readBytes uint64, writeBytes uint64, reads uint64, writes uint64, labels []string) {
+	labels = withLabels(labels, "device", device)
+	registry.add("container_blkio_read_bytes_total", metricType_Counter, "Bytes read from the block device by the container.", float64(readBytes), labels...)
+	registry.add("container_blkio_write_bytes_total", metricType_Counter, "Bytes written to the block device by the container.", float64(writeBytes), labels...)
+	registry.add("container_blkio_reads_total", metricType_Counter, "Read operations on the block device by the container.", float64(reads), labels...)
+	registry.add("container_blkio_writes_total", metricType_Counter, "Write operations on the block device by the container.", float64(writes), labels...)
+}
+
+// readBlkioV1 解析blkio统计文件，返回 设备 -> 操作类型 -> 值
+func readBlkioV1(file string) map[string]map[string]uint64 {
+	stats := make(map[string]map[string]uint64)
+	for _, line := range readLines(file) {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		if stats[fields[0]] == nil {
+			stats[fields[0]] = make(map[string]uint64)
+		}
+		stats[fields[0]][fields[1]] = value
+	}
+	return stats
+}
+
+// readUint 读取只包含一个整数的cgroup文件，文件不存在或者值为max时返回false
+func readUint(file string) (uint64, bool) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		logMissing(file, err)
+		return 0, false
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	return value, err == nil
+}
+
+// readKeyValues 读取每行为 key value 的cgroup文件
+func readKeyValues(file string) (map[string]uint64, bool) {
+	lines := readLines(file)
+	if lines == nil {
+		return nil, false
+	}
+	values := make(map[string]uint64, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, true
+}
+
+func readLines(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		logMissing(file, err)
+		return nil
+	}
+	defer f.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// logMissing 未启用的子系统或者已经删除的cgroup没有对应的文件，属于正常情况
+func logMissing(file string, err error) {
+	if !os.IsNotExist(err) {
+		logrus.Warnf("[Collector] read %s failed, err:%s", file, err)
+	}
+}
@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ContentType Prometheus文本格式
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	metricPrefix = "ghndocker_"
+
+	metricType_Gauge   = "gauge"
+	metricType_Counter = "counter"
+)
+
+// Container 需要采集指标的容器，由Source提供
+type Container struct {
+	Id    string
+	Name  string
+	Image string
+	State string
+	// CgroupPath 容器cgroup相对于各个子系统挂载点的路径，为空时不采集cgroup指标
+	CgroupPath string
+	// Networks 容器network namespace内各个网络设备的统计，由Source通过netlink读取
+	Networks []*NetworkStats
+}
+
+// NetworkStats 网络设备的收发统计
+type NetworkStats struct {
+	Interface string
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+// Counters ghndocker自身的生命周期计数
+type Counters struct {
+	Runs     int64
+	Failures int64
+	Restarts int64
+	Ooms     int64
+}
+
+// Source 指标的数据来源: 容器列表以及生命周期计数，测试时可以替换为固定的数据
+type Source interface {
+	Containers() ([]*Container, error)
+	Counters() (*Counters, error)
+}
+
+// Collector 采集容器的cgroup以及网络指标，以Prometheus文本格式输出
+type Collector struct {
+	source Source
+	cgroup *cgroupReader
+}
+
+// NewCollector cgroupRoot为cgroup的挂载点，v2为统一层级，v1下各个子系统挂载在cgroupRoot/<子系统>
+func NewCollector(source Source, cgroupRoot string, cgroupV2 bool) *Collector {
+	return &Collector{
+		source: source,
+		cgroup: &cgroupReader{root: cgroupRoot, v2: cgroupV2},
+	}
+}
+
+func (collector *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := collector.Collect(buf); err != nil {
+		logrus.Errorf("[Collector] collect metrics failed, err:%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(buf.Bytes())
+}
+
+// Collect 采集一次所有指标写入w，单个容器的cgroup文件读取失败时跳过对应的指标
+func (collector *Collector) Collect(w io.Writer) error {
+	containers, err := collector.source.Containers()
+	if err != nil {
+		return fmt.Errorf("list containers failed, err:%s", err)
+	}
+	counters, err := collector.source.Counters()
+	if err != nil {
+		return fmt.Errorf("read counters failed, err:%s", err)
+	}
+
+	registry := newRegistry()
+
+	states := make(map[string]int)
+	for _, container := range containers {
+		states[container.State]++
+	}
+	for state, count := range states {
+		registry.add("containers", metricType_Gauge, "Number of containers by state.", float64(count), "state", state)
+	}
+	registry.add("container_runs_total", metricType_Counter, "Number of container process starts, including restarts.", float64(counters.Runs))
+	registry.add("container_failures_total", metricType_Counter, "Number of container processes that exited with a non-zero code.", float64(counters.Failures))
+	registry.add("container_restarts_total", metricType_Counter, "Number of container restarts by restart policy or health check.", float64(counters.Restarts))
+	registry.add("container_ooms_total", metricType_Counter, "Number of OOM events in containers.", float64(counters.Ooms))
+
+	for _, container := range containers {
+		labels := []string{"id", container.Id, "name", container.Name, "image", container.Image}
+		if container.CgroupPath != "" {
+			collector.cgroup.collect(registry, container.CgroupPath, labels)
+		}
+		collectNetworks(registry, container.Networks, labels)
+	}
+
+	return registry.write(w)
+}
+
+func collectNetworks(registry *registry, networks []*NetworkStats, labels []string) {
+	for _, stats := range networks {
+		labels := withLabels(labels, "interface", stats.Interface)
+		registry.add("container_network_receive_bytes_total", metricType_Counter, "Bytes received by the container network interface.", float64(stats.RxBytes), labels...)
+		registry.add("container_network_transmit_bytes_total", metricType_Counter, "Bytes transmitted by the container network interface.", float64(stats.TxBytes), labels...)
+		registry.add("container_network_receive_packets_total", metricType_Counter, "Packets received by the container network interface.", float64(stats.RxPackets), labels...)
+		registry.add("container_network_transmit_packets_total", metricType_Counter, "Packets transmitted by the container network interface.", float64(stats.TxPackets), labels...)
+		registry.add("container_network_receive_errors_total", metricType_Counter, "Receive errors of the container network interface.", float64(stats.RxErrors), labels...)
+		registry.add("container_network_transmit_errors_total", metricType_Counter, "Transmit errors of the container network interface.", float64(stats.TxErrors), labels...)
+		registry.add("container_network_receive_dropped_total", metricType_Counter, "Received packets dropped by the container network interface.", float64(stats.RxDropped), labels...)
+		registry.add("container_network_transmit_dropped_total", metricType_Counter, "Transmitted packets dropped by the container network interface.", float64(stats.TxDropped), labels...)
+	}
+}
+
+// family 同名指标的HELP、TYPE以及所有样本
+type family struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+// registry 按照指标名称聚合样本，输出时同名样本连续出现
+type registry struct {
+	families map[string]*family
+}
+
+func newRegistry() *registry {
+	return &registry{families: make(map[string]*family)}
+}
+
+// add 添加一个样本，labels为 key1, value1, key2, value2...
+func (registry *registry) add(name string, kind string, help string, value float64, labels ...string) {
+	name = metricPrefix + name
+	f, ok := registry.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind}
+		registry.families[name] = f
+	}
+
+	sample := &strings.Builder{}
+	sample.WriteString(name)
+	if len(labels) > 0 {
+		sample.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sample.WriteByte(',')
+			}
+			fmt.Fprintf(sample, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		sample.WriteByte('}')
+	}
+	sample.WriteByte(' ')
+	sample.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, sample.String())
+}
+
+func (registry *registry) write(w io.Writer) error {
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer := bufio.NewWriter(w)
+	for _, name := range names {
+		f := registry.families[name]
+		sort.Strings(f.samples)
+		fmt.Fprintf(writer, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(writer, "# TYPE %s %s\n", f.name, f.kind)
+		for _, sample := range f.samples {
+			writer.WriteString(sample)
+			writer.WriteByte('\n')
+		}
+	}
+	return writer.Flush()
+}
+
+// withLabels 在公共标签之后追加标签，不修改公共标签
+func withLabels(labels []string, extra ...string) []string {
+	return append(append(make([]string, 0, len(labels)+len(extra)), labels...), extra...)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeSource struct {
+	containers []*Container
+	counters   *Counters
+}
+
+func (source *fakeSource) Containers() ([]*Container, error) {
+	return source.containers, nil
+}
+
+func (source *fakeSource) Counters() (*Counters, error) {
+	return source.counters, nil
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.Nil(t, os.WriteFile(file, []byte(content), 0644))
+	}
+}
+
+func scrape(t *testing.T, collector *Collector) string {
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+const webLabels = `id="123",name="web",image="busybox"`
+
+func TestCollector_CgroupV2(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"ghndocker/123/cpu.stat":       "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\nnr_periods 10\nnr_throttled 3\nthrottled_usec 1500000\n",
+		"ghndocker/123/memory.current": "1048576\n",
+		"ghndocker/123/memory.max":     "max\n",
+		"ghndocker/123/memory.stat":    "anon 4096\nfile 8192\n",
+		"ghndocker/123/memory.events":  "low 0\nhigh 0\nmax 2\noom 1\noom_kill 1\n",
+		"ghndocker/123/pids.current":   "3\n",
+		"ghndocker/123/pids.max":       "100\n",
+		"ghndocker/123/io.stat":        "8:0 rbytes=1024 wbytes=2048 rios=1 wios=2 dbytes=0 dios=0\n",
+	})
+
+	source := &fakeSource{
+		containers: []*Container{
+			{
+				Id: "123", Name: "web", Image: "busybox", State: "running", CgroupPath: "ghndocker/123",
+				Networks: []*NetworkStats{{Interface: "cif-123", RxBytes: 100, TxBytes: 200, RxPackets: 1, TxPackets: 2}},
+			},
+			{Id: "456", Name: "db", Image: "busybox", State: "exit", CgroupPath: "ghndocker/456"},
+		},
+		counters: &Counters{Runs: 5, Failures: 1, Restarts: 2, Ooms: 1},
+	}
+	body := scrape(t, NewCollector(source, root, true))
+
+	for _, line := range []string{
+		"# TYPE ghndocker_container_cpu_usage_seconds_total counter",
+		"ghndocker_container_cpu_usage_seconds_total{" + webLabels + "} 2.5",
+		"ghndocker_container_cpu_seconds_total{" + webLabels + `,mode="user"} 2`,
+		"ghndocker_container_cpu_seconds_total{" + webLabels + `,mode="system"} 0.5`,
+		"ghndocker_container_cpu_throttled_periods_total{" + webLabels + "} 3",
+		"ghndocker_container_cpu_throttled_seconds_total{" + webLabels + "} 1.5",
+		"# TYPE ghndocker_container_memory_usage_bytes gauge",
+		"ghndocker_container_memory_usage_bytes{" + webLabels + "} 1.048576e+06",
+		"ghndocker_container_memory_cache_bytes{" + webLabels + "} 8192",
+		"ghndocker_container_memory_oom_kills_total{" + webLabels + "} 1",
+		"ghndocker_container_pids_current{" + webLabels + "} 3",
+		"ghndocker_container_pids_limit{" + webLabels + "} 100",
+		"ghndocker_container_blkio_read_bytes_total{" + webLabels + `,device="8:0"} 1024`,
+		"ghndocker_container_blkio_writes_total{" + webLabels + `,device="8:0"} 2`,
+		"ghndocker_container_network_receive_bytes_total{" + webLabels + `,interface="cif-123"} 100`,
+		"ghndocker_container_network_transmit_packets_total{" + webLabels + `,interface="cif-123"} 2`,
+		`ghndocker_containers{state="running"} 1`,
+		`ghndocker_containers{state="exit"} 1`,
+		"ghndocker_container_runs_total 5",
+		"ghndocker_container_failures_total 1",
+		"ghndocker_container_restarts_total 2",
+		"ghndocker_container_ooms_total 1",
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+
+	// 未限制的内存以及已经删除cgroup的容器不输出
+	assert.NotContains(t, body, "ghndocker_container_memory_limit_bytes")
+	assert.NotContains(t, body, `id="456"`)
+	// 每个指标只有一组HELP/TYPE
+	assert.Equal(t, 1, strings.Count(body, "# TYPE ghndocker_container_cpu_seconds_total counter\n"))
+}
+
+func TestCollector_CgroupV1(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"cpuacct/ghndocker/123/cpuacct.usage":                 "3000000000\n",
+		"cpuacct/ghndocker/123/cpuacct.stat":                  "user 250\nsystem 50\n",
+		"cpu/ghndocker/123/cpu.stat":                          "nr_periods 10\nnr_throttled 4\nthrottled_time 2000000000\n",
+		"memory/ghndocker/123/memory.usage_in_bytes":          "2048\n",
+		"memory/ghndocker/123/memory.limit_in_bytes":          "536870912\n",
+		"memory/ghndocker/123/memory.stat":                    "cache 1024\nrss 512\n",
+		"pids/ghndocker/123/pids.current":                     "2\n",
+		"pids/ghndocker/123/pids.max":                         "max\n",
+		"blkio/ghndocker/123/blkio.throttle.io_service_bytes": "8:0 Read 4096\n8:0 Write 8192\n8:0 Total 12288\nTotal 12288\n",
+		"blkio/ghndocker/123/blkio.throttle.io_serviced":      "8:0 Read 4\n8:0 Write 8\n8:0 Total 12\nTotal 12\n",
+	})
+
+	source := &fakeSource{
+		containers: []*Container{{Id: "123", Name: "web", Image: "busybox", State: "running", CgroupPath: "ghndocker/123"}},
+		counters:   &Counters{},
+	}
+	body := scrape(t, NewCollector(source, root, false))
+
+	for _, line := range []string{
+		"ghndocker_container_cpu_usage_seconds_total{" + webLabels + "} 3",
+		"ghndocker_container_cpu_seconds_total{" + webLabels + `,mode="user"} 2.5`,
+		"ghndocker_container_cpu_throttled_seconds_total{" + webLabels + "} 2",
+		"ghndocker_container_memory_usage_bytes{" + webLabels + "} 2048",
+		"ghndocker_container_memory_limit_bytes{" + webLabels + "} 5.36870912e+08",
+		"ghndocker_container_memory_rss_bytes{" + webLabels + "} 512",
+		"ghndocker_container_pids_current{" + webLabels + "} 2",
+		"ghndocker_container_blkio_read_bytes_total{" + webLabels + `,device="8:0"} 4096`,
+		"ghndocker_container_blkio_reads_total{" + webLabels + `,device="8:0"} 4`,
+		"ghndocker_container_runs_total 0",
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.NotContains(t, body, "ghndocker_container_pids_limit")
+	assert.NotContains(t, body, "ghndocker_container_network_")
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabelValue("a\"b\\c\nd"))
+}
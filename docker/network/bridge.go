@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"hash/fnv"
 	"net"
-	"os/exec"
 	"strings"
 )
 
@@ -23,115 +23,76 @@ func (bridge *BridgeDriver) CreateNetwork(subnet *net.IPNet, networkName string)
 		Driver:      bridge.Name(),
 	}
 
-	// 1. 创建网桥实例
-	// 1.1 先通过name判断网络接口是否存在，若没有
-	_, err := net.InterfaceByName(networkName)
-	if err != nil && !strings.Contains(err.Error(), "no such network interface") {
-		return nil, err
-	}
-
-	// 1.2 设置link属性，并创建网桥
-	la := netlink.NewLinkAttrs()
-	la.Name = networkName
-
-	bridgeIns := &netlink.Bridge{
-		LinkAttrs: la,
-	}
-
-	err = netlink.LinkAdd(bridgeIns)
-	if err != nil {
+	// 1. 创建网桥实例，设置网桥网段并打开
+	if err := DefaultLinkManager.AddBridge(networkName, subnet); err != nil {
 		logrus.Errorf("[Bridge Driver] Create Network, Create Bridge failed, err:%s", err)
 		return nil, err
 	}
 
-	// 2. 设置网桥网段， 即宿主机将子网网段的请求路由到创建的该网桥上
-	link, err := netlink.LinkByName(networkName)
-	if err != nil {
-		return nil, err
-	}
-
-	err = netlink.AddrAdd(link, &netlink.Addr{
-		IPNet: subnet,
-		Label: "",
-		Flags: 0,
-		Scope: 0,
-	})
-
-	if err != nil {
-		logrus.Errorf("[Bridge Driver] Create Network, Add Route failed, err:%s", err)
-		return nil, err
-	}
-
-	// 3. 打开网桥， ip link set bro0 up
-	link, err = netlink.LinkByName(networkName)
-	if err != nil {
-		return nil, err
-	}
-
-	err = netlink.LinkSetUp(link)
-	if err != nil {
-		logrus.Errorf("[Bridge Driver] Create Network, Set Bridge From Down to Up failed, err:%s", err)
-		return nil, err
-	}
-	// 4. SNAT规则
+	// 2. SNAT规则
 	// iptables -t nat -A POSTROUTING -s subnet ! -o name -j "MASQUERADE"
-	cmds := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subnet.String(), networkName)
-	output, err := exec.Command("iptables", strings.Split(cmds, " ")...).CombinedOutput()
-	if err != nil {
-		logrus.Errorf("[Bridge Driver] Create Network, exec iptables failed, err:%s, output:%s", err, string(output))
+	if err := DefaultFirewall.Append("nat", "POSTROUTING", masqueradeRule(n)...); err != nil {
+		logrus.Errorf("[Bridge Driver] Create Network, add masquerade rule failed, err:%s", err)
+		if delErr := DefaultLinkManager.DeleteLink(networkName); delErr != nil {
+			logrus.Errorf("[Bridge Driver] Create Network, delete bridge failed, err:%s", delErr)
+		}
 		return nil, err
 	}
 
 	return n, nil
 }
 
-// DeleteNetwork 删除网络
+// DeleteNetwork 删除网络出口的SNAT规则以及网桥，规则已经不存在时跳过
 func (bridge *BridgeDriver) DeleteNetwork(network *Network) error {
-	name := network.NetworkName
-	br, err := netlink.LinkByName(name)
-	if err != nil {
-		return err
+	if rule := masqueradeRule(network); DefaultFirewall.Exists("nat", "POSTROUTING", rule...) {
+		if err := DefaultFirewall.Delete("nat", "POSTROUTING", rule...); err != nil {
+			logrus.Errorf("[Bridge Driver] Delete Network, remove masquerade rule failed, err:%s", err)
+			return err
+		}
 	}
-	return netlink.LinkDel(br)
+	return DefaultLinkManager.DeleteLink(network.NetworkName)
 }
 
 // Connect 容器连接, 创建容器网路通信组件veth 并设置为up
 func (bridge *BridgeDriver) Connect(network *Network, endPoint *EndPoint) error {
-
-	// 获取具体驱动网络信息 通过网络的唯一标识
-	networkName := network.NetworkName
-	br, err := netlink.LinkByName(networkName)
-	if err != nil {
-		return err
-	}
-
 	// 容器veth的信息
 	la := netlink.NewLinkAttrs()
-	la.Name = endPoint.ID[:5]
-	la.MasterIndex = br.Attrs().Index
+	la.Name = endPoint.VethName
 
-	// 创捷veth
+	// 创捷veth，peer移入容器之后重命名为endpoint的Interface
 	endPoint.Device = &netlink.Veth{
 		LinkAttrs: la,
-		PeerName:  "cif-" + endPoint.ID[:5],
+		PeerName:  peerName(endPoint),
 	}
 
-	// 创建接口
-	if err = netlink.LinkAdd(endPoint.Device); err != nil {
+	// 创建接口并接入网桥，网桥由网络的唯一标识确定
+	if err := DefaultLinkManager.AddVeth(la.Name, endPoint.Device.PeerName, network.NetworkName); err != nil {
 		logrus.Errorf("[bridge] connect network failed, err:%s", err)
 		return err
 	}
 
-	// 打开
-	if err = netlink.LinkSetUp(endPoint.Device); err != nil {
-		logrus.Errorf("[bridge] veth set up failed, err:%s", err)
-		return err
-	}
-
 	return nil
 }
 
-// Disconnect 容器断连
+// Disconnect 容器断连，删除宿主机一端的veth，容器内的另一端随之删除
 func (bridge *BridgeDriver) Disconnect(network *Network, endPoint *EndPoint) error {
-	return nil
+	return DefaultLinkManager.DeleteLink(endPoint.VethName)
+}
+
+// masqueradeRule 网络出口的SNAT规则(不包括 -t nat -A POSTROUTING)
+func masqueradeRule(network *Network) []string {
+	return []string{"-s", network.IPRange.String(), "!", "-o", network.NetworkName, "-j", "MASQUERADE"}
+}
+
+// vethName 宿主机一端的veth名称，由endpoint id(容器id+网络名称)的哈希得到，同一个容器接入多个网络时不会冲突
+// 网络设备名称最长15个字符
+func vethName(endPoint *EndPoint) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(endPoint.ID))
+	return fmt.Sprintf("veth%08x", hash.Sum32())
+}
+
+// peerName 容器一端的veth在移入容器之前的临时名称
+func peerName(endPoint *EndPoint) string {
+	return "cif" + strings.TrimPrefix(endPoint.VethName, "veth")
 }
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"fmt"
+	"github.com/bytedance/sonic"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// NatRule ghndocker在nat表中创建的iptables规则
+type NatRule struct {
+	Chain string
+	// Args 规则内容，不包括 -A <chain>
+	Args []string
+}
+
+func (rule *NatRule) String() string {
+	return fmt.Sprintf("-t nat -A %s %s", rule.Chain, strings.Join(rule.Args, " "))
+}
+
+// Option 读取规则中的选项值，例如 --to-destination、-s、-o，不存在时返回空
+func (rule *NatRule) Option(name string) string {
+	for i := 0; i < len(rule.Args)-1; i++ {
+		if rule.Args[i] == name {
+			return rule.Args[i+1]
+		}
+	}
+	return ""
+}
+
+// ListNatRules 列出nat表中端口映射(PREROUTING DNAT)以及网络出口(POSTROUTING MASQUERADE)规则
+func ListNatRules() ([]*NatRule, error) {
+	lines, err := DefaultFirewall.Rules("nat")
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*NatRule, 0)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "-A" {
+			continue
+		}
+
+		rule := &NatRule{Chain: fields[1], Args: fields[2:]}
+		switch {
+		case rule.Chain == "PREROUTING" && rule.Option("-j") == "DNAT":
+		case rule.Chain == "POSTROUTING" && rule.Option("-j") == "MASQUERADE":
+		default:
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// DeleteNatRule 删除nat表中的规则
+func DeleteNatRule(rule *NatRule) error {
+	if err := DefaultFirewall.Delete("nat", rule.Chain, rule.Args...); err != nil {
+		return fmt.Errorf("delete iptables rule:%s failed, err:%s", rule, err)
+	}
+	return nil
+}
+
+// ListEndpointLinks 列出挂在ghndocker网桥上的veth设备名称
+func ListEndpointLinks() ([]string, error) {
+	links, err := DefaultLinkManager.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	bridges := make(map[int]bool)
+	for _, link := range links {
+		if _, ok := networkMapping[link.Attrs().Name]; ok && link.Type() == "bridge" {
+			bridges[link.Attrs().Index] = true
+		}
+	}
+
+	names := make([]string, 0)
+	for _, link := range links {
+		if link.Type() == "veth" && bridges[link.Attrs().MasterIndex] {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LinkExists 判断网络设备是否存在
+func LinkExists(name string) bool {
+	return DefaultLinkManager.LinkExists(name)
+}
+
+// DeleteLink 删除网络设备，veth的一端被删除时另一端同时被删除
+func DeleteLink(name string) error {
+	return DefaultLinkManager.DeleteLink(name)
+}
+
+// IPAllocation ipam中记录为已分配的ip
+type IPAllocation struct {
+	// Subnet ipam中的地址池，即分配时传入的网段
+	Subnet string
+	IP     net.IP
+}
+
+// ListIPAllocations 读取ipam文件，列出所有地址池中已分配的ip
+func ListIPAllocations() ([]*IPAllocation, error) {
+	content, err := os.ReadFile(ipAddressManager.IpamDefaultStoragePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	manager := &LocalIPManager{}
+	if err = sonic.Unmarshal(content, manager); err != nil {
+		return nil, fmt.Errorf("parse ipam file failed, err:%s", err)
+	}
+
+	allocations := make([]*IPAllocation, 0)
+	for subnet, pool := range manager.IpamStorage {
+		base, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipam subnet:%s, err:%s", subnet, err)
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		available := 1 << (bits - ones)
+		for i := range pool {
+			for j := 0; j < 8; j++ {
+				// 与Allocate一致，第index个bit对应 base+index，超出网段大小的bit为占位
+				index := i*8 + j + 1
+				if pool[i]&(0x80>>j) == 0 || index > available {
+					continue
+				}
+				allocations = append(allocations, &IPAllocation{Subnet: subnet, IP: addIP(base.To4(), index)})
+			}
+		}
+	}
+
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Subnet != allocations[j].Subnet {
+			return allocations[i].Subnet < allocations[j].Subnet
+		}
+		return allocations[i].IP.String() < allocations[j].IP.String()
+	})
+	return allocations, nil
+}
+
+// ReleaseIPAllocation 释放ipam中的一个已分配ip
+func ReleaseIPAllocation(allocation *IPAllocation) error {
+	base, ipNet, err := net.ParseCIDR(allocation.Subnet)
+	if err != nil {
+		return err
+	}
+	return ipAddressManager.Release(&net.IPNet{IP: base.To4(), Mask: ipNet.Mask}, &allocation.IP)
+}
+
+func addIP(ip net.IP, offset int) net.IP {
+	value := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	value += uint32(offset)
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value)).To4()
+}
@@ -1,16 +1,121 @@
 package network
 
 import (
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
 )
 
+// endpointDirName 网络目录下保存endpoint记录的子目录，每个网络一个目录: endpoints/<network>/<endpoint id>
+const endpointDirName = "endpoints"
+
 // EndPoint ghndocker server 针对容器网络通信的统一抽象
 type EndPoint struct {
-	ID          string
-	Device      *netlink.Veth
-	IPAddress   *net.IP
-	MacAddress  *net.HardwareAddr
-	PortMapping []string
-	Network     *Network
+	ID          string `json:"id"`
+	ContainerId string `json:"container_id"`
+	NetworkName string `json:"network_name"`
+	VethName    string `json:"veth_name"`
+	// Interface 容器内的网卡名称
+	Interface   string            `json:"interface"`
+	Device      *netlink.Veth     `json:"-"`
+	IPAddress   *net.IP           `json:"ip_address"`
+	MacAddress  *net.HardwareAddr `json:"-"`
+	PortMapping []string          `json:"port_mapping"`
+	Network     *Network          `json:"-"`
+}
+
+// endpointDir 网络的endpoint记录目录
+func endpointDir(networkName string) string {
+	return path.Join(defaultNetworkPath, endpointDirName, networkName)
+}
+
+// Dump 持久化endpoint记录，断开连接或者容器删除时据此释放ip、veth以及端口映射
+func (endPoint *EndPoint) Dump() error {
+	dir := endpointDir(endPoint.NetworkName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.Errorf("[EndPoint Dump] mk dir:%s failed, err:%s", dir, err)
+		return err
+	}
+
+	bytes, err := sonic.Marshal(endPoint)
+	if err != nil {
+		logrus.Errorf("[EndPoint Dump] marshal failed, err:%s", err)
+		return err
+	}
+
+	if err = os.WriteFile(path.Join(dir, endPoint.ID), bytes, 0644); err != nil {
+		logrus.Errorf("[EndPoint Dump] write failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+// Remove 删除endpoint记录，记录不存在时跳过
+func (endPoint *EndPoint) Remove() error {
+	if err := os.Remove(path.Join(endpointDir(endPoint.NetworkName), endPoint.ID)); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("[EndPoint Remove] remove endpoint:%s failed, err:%s", endPoint.ID, err)
+		return err
+	}
+	return nil
+}
+
+// loadEndpoint 读取网络中指定id的endpoint记录，记录不存在时返回nil
+func loadEndpoint(networkName string, id string) (*EndPoint, error) {
+	bytes, err := os.ReadFile(path.Join(endpointDir(networkName), id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	endPoint := &EndPoint{}
+	if err = sonic.Unmarshal(bytes, endPoint); err != nil {
+		return nil, fmt.Errorf("parse endpoint:%s failed, err:%s", id, err)
+	}
+	return endPoint, nil
+}
+
+// ListEndpoints 列出接入网络的所有endpoint，按照id排序
+func ListEndpoints(networkName string) ([]*EndPoint, error) {
+	entries, err := os.ReadDir(endpointDir(networkName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	endPoints := make([]*EndPoint, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		endPoint, err := loadEndpoint(networkName, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if endPoint != nil {
+			endPoints = append(endPoints, endPoint)
+		}
+	}
+	sort.Slice(endPoints, func(i, j int) bool {
+		return endPoints[i].ID < endPoints[j].ID
+	})
+	return endPoints, nil
+}
+
+// endpointIds endpoint所属的容器id，用于错误提示
+func endpointIds(endPoints []*EndPoint) string {
+	ids := make([]string, 0, len(endPoints))
+	for _, endPoint := range endPoints {
+		ids = append(ids, endPoint.ContainerId)
+	}
+	return strings.Join(ids, ",")
 }
@@ -0,0 +1,220 @@
+package network
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeLinkManager 内存中的网络设备，veth的peer移入容器之后记录在peers中
+type fakeLinkManager struct {
+	links map[string]netlink.Link
+	addrs map[string]*net.IPNet
+	// peers 已经移入容器network namespace的veth peer -> 容器进程pid
+	peers map[string]string
+	// interfaces veth peer -> 容器内的网卡名称
+	interfaces map[string]string
+	// routes veth peer -> 经由该网卡的默认路由网关
+	routes map[string]net.IP
+	// failOn 方法名 -> 该方法返回的错误
+	failOn map[string]error
+	index  int
+}
+
+func newFakeLinkManager() *fakeLinkManager {
+	return &fakeLinkManager{
+		links:      make(map[string]netlink.Link),
+		addrs:      make(map[string]*net.IPNet),
+		peers:      make(map[string]string),
+		interfaces: make(map[string]string),
+		routes:     make(map[string]net.IP),
+		failOn:     make(map[string]error),
+	}
+}
+
+func (manager *fakeLinkManager) newAttrs(name string) netlink.LinkAttrs {
+	manager.index++
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.Index = manager.index
+	return la
+}
+
+func (manager *fakeLinkManager) AddBridge(name string, gateway *net.IPNet) error {
+	if err := manager.failOn["AddBridge"]; err != nil {
+		return err
+	}
+	if _, ok := manager.links[name]; ok {
+		return fmt.Errorf("link:%s already exists", name)
+	}
+	manager.links[name] = &netlink.Bridge{LinkAttrs: manager.newAttrs(name)}
+	manager.addrs[name] = gateway
+	return nil
+}
+
+func (manager *fakeLinkManager) AddVeth(name string, peerName string, master string) error {
+	if err := manager.failOn["AddVeth"]; err != nil {
+		return err
+	}
+	br, ok := manager.links[master]
+	if !ok {
+		return fmt.Errorf("bridge:%s not found", master)
+	}
+	if _, ok = manager.links[name]; ok {
+		return fmt.Errorf("link:%s already exists", name)
+	}
+
+	la := manager.newAttrs(name)
+	la.MasterIndex = br.Attrs().Index
+	manager.links[name] = &netlink.Veth{LinkAttrs: la, PeerName: peerName}
+	manager.links[peerName] = &netlink.Veth{LinkAttrs: manager.newAttrs(peerName), PeerName: name}
+	return nil
+}
+
+func (manager *fakeLinkManager) SetupPeer(peerName string, pid string, ifName string, address *net.IPNet, gateway net.IP) (net.HardwareAddr, error) {
+	if err := manager.failOn["SetupPeer"]; err != nil {
+		return nil, err
+	}
+	if _, ok := manager.links[peerName]; !ok {
+		return nil, fmt.Errorf("link:%s not found", peerName)
+	}
+	for peer, name := range manager.interfaces {
+		if name == ifName && manager.peers[peer] == pid {
+			return nil, fmt.Errorf("interface:%s already exists in container", ifName)
+		}
+	}
+	manager.peers[peerName] = pid
+	manager.interfaces[peerName] = ifName
+	manager.addrs[peerName] = address
+	if gateway != nil {
+		manager.routes[peerName] = gateway
+	}
+	return net.ParseMAC("02:42:ac:11:00:02")
+}
+
+func (manager *fakeLinkManager) LinkExists(name string) bool {
+	_, ok := manager.links[name]
+	return ok
+}
+
+func (manager *fakeLinkManager) LinkList() ([]netlink.Link, error) {
+	links := make([]netlink.Link, 0, len(manager.links))
+	for name, link := range manager.links {
+		if _, moved := manager.peers[name]; !moved {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Attrs().Index < links[j].Attrs().Index
+	})
+	return links, nil
+}
+
+func (manager *fakeLinkManager) DeleteLink(name string) error {
+	link, ok := manager.links[name]
+	if !ok {
+		return nil
+	}
+	if veth, isVeth := link.(*netlink.Veth); isVeth {
+		delete(manager.links, veth.PeerName)
+		delete(manager.peers, veth.PeerName)
+		delete(manager.interfaces, veth.PeerName)
+		delete(manager.routes, veth.PeerName)
+		delete(manager.addrs, veth.PeerName)
+	}
+	delete(manager.links, name)
+	delete(manager.addrs, name)
+	return nil
+}
+
+func (manager *fakeLinkManager) ContainerLinks(pid int) ([]netlink.Link, error) {
+	links := make([]netlink.Link, 0)
+	for name, owner := range manager.peers {
+		if owner == strconv.Itoa(pid) {
+			links = append(links, manager.links[name])
+		}
+	}
+	return links, nil
+}
+
+// fakeFirewall 内存中的iptables规则，每条规则记录为 -A <chain> <rule>
+type fakeFirewall struct {
+	rules  map[string][]string
+	failOn map[string]error
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{rules: make(map[string][]string), failOn: make(map[string]error)}
+}
+
+func ruleLine(chain string, rule []string) string {
+	return strings.Join(append([]string{"-A", chain}, rule...), " ")
+}
+
+func (firewall *fakeFirewall) Append(table string, chain string, rule ...string) error {
+	if err := firewall.failOn["Append"]; err != nil {
+		return err
+	}
+	firewall.rules[table] = append(firewall.rules[table], ruleLine(chain, rule))
+	return nil
+}
+
+func (firewall *fakeFirewall) Delete(table string, chain string, rule ...string) error {
+	line := ruleLine(chain, rule)
+	for i, existing := range firewall.rules[table] {
+		if existing == line {
+			firewall.rules[table] = append(firewall.rules[table][:i], firewall.rules[table][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("rule:%s does not exist", line)
+}
+
+func (firewall *fakeFirewall) Exists(table string, chain string, rule ...string) bool {
+	line := ruleLine(chain, rule)
+	for _, existing := range firewall.rules[table] {
+		if existing == line {
+			return true
+		}
+	}
+	return false
+}
+
+func (firewall *fakeFirewall) Rules(table string) ([]string, error) {
+	return append([]string{}, firewall.rules[table]...), nil
+}
+
+// useFakeNetwork 将网络设备、iptables、网络记录以及容器记录替换为内存实现以及临时目录，测试结束后恢复
+func useFakeNetwork(t *testing.T) (*fakeLinkManager, *fakeFirewall) {
+	root := t.TempDir()
+	links, firewall := newFakeLinkManager(), newFakeFirewall()
+
+	originLinks, originFirewall, originPath, originManager, originMapping := DefaultLinkManager, DefaultFirewall, defaultNetworkPath, ipAddressManager, networkMapping
+	originMountPoint := container.GhnDockerMountPoint
+	t.Cleanup(func() {
+		DefaultLinkManager, DefaultFirewall, defaultNetworkPath, ipAddressManager, networkMapping = originLinks, originFirewall, originPath, originManager, originMapping
+		container.GhnDockerMountPoint = originMountPoint
+		container.SetRootDir(container.DefaultRootDir)
+	})
+
+	container.SetRootDir(root)
+	container.GhnDockerMountPoint = path.Join(root, "mnt") + "/%s"
+	DefaultLinkManager, DefaultFirewall = links, firewall
+	defaultNetworkPath = path.Join(root, "network")
+	assert.Nil(t, os.MkdirAll(defaultNetworkPath, 0755))
+	ipAddressManager = &LocalIPManager{
+		IpamDefaultStoragePath: path.Join(defaultNetworkPath, "ipam_config.json"),
+		IpamStorage:            make(map[string][]byte),
+	}
+	networkMapping = make(map[string]*Network)
+	NetworkDrivers["bridge"] = &BridgeDriver{}
+	return links, firewall
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Firewall iptables规则的操作，默认执行iptables命令，测试时可以替换为内存中的实现
+type Firewall interface {
+	// Append 在table的chain末尾追加规则
+	Append(table string, chain string, rule ...string) error
+	// Delete 删除table的chain中的规则
+	Delete(table string, chain string, rule ...string) error
+	// Exists 规则是否存在
+	Exists(table string, chain string, rule ...string) bool
+	// Rules 按照 iptables -S 的格式列出table中的所有规则，每行为 -A <chain> <rule>
+	Rules(table string) ([]string, error)
+}
+
+// DefaultFirewall 网络驱动以及清理逻辑使用的Firewall
+var DefaultFirewall Firewall = &iptables{}
+
+type iptables struct{}
+
+func (firewall *iptables) Append(table string, chain string, rule ...string) error {
+	return firewall.run(table, "-A", chain, rule)
+}
+
+func (firewall *iptables) Delete(table string, chain string, rule ...string) error {
+	return firewall.run(table, "-D", chain, rule)
+}
+
+// Exists iptables -C 规则存在时返回0
+func (firewall *iptables) Exists(table string, chain string, rule ...string) bool {
+	args := append([]string{"-t", table, "-C", chain}, rule...)
+	return exec.Command("iptables", args...).Run() == nil
+}
+
+func (firewall *iptables) Rules(table string) ([]string, error) {
+	output, err := exec.Command("iptables", "-t", table, "-S").Output()
+	if err != nil {
+		return nil, fmt.Errorf("list iptables %s rules failed, err:%s", table, err)
+	}
+	return strings.Split(string(output), "\n"), nil
+}
+
+func (firewall *iptables) run(table string, action string, chain string, rule []string) error {
+	args := append([]string{"-t", table, action, chain}, rule...)
+	if output, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s failed, err:%s, output:%s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
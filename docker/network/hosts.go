@@ -0,0 +1,78 @@
+package network
+
+import (
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/sirupsen/logrus"
+)
+
+// refreshHosts 容器接入或者断开网络之后，重写网络中所有容器以及current的/etc/hosts，
+// 同一网络中的容器可以通过容器名称以及在该网络中的别名互相访问。写入失败只影响名称解析，记录日志之后继续
+func refreshHosts(networkName string, current *container.ContainerInfo) {
+	endPoints, err := ListEndpoints(networkName)
+	if err != nil {
+		logrus.Warnf("[refreshHosts] list endpoints of network:%s failed, err:%s", networkName, err)
+		return
+	}
+
+	containers := map[string]*container.ContainerInfo{current.Id: current}
+	refresh := []*container.ContainerInfo{current}
+	for _, endPoint := range endPoints {
+		if _, ok := containers[endPoint.ContainerId]; ok {
+			continue
+		}
+		peer, err := container.GetSpecificContainers(endPoint.ContainerId)
+		if err != nil {
+			logrus.Warnf("[refreshHosts] load container:%s failed, err:%s", endPoint.ContainerId, err)
+			continue
+		}
+		containers[peer.Id] = peer
+		refresh = append(refresh, peer)
+	}
+
+	for _, containerInfo := range refresh {
+		if err = container.WriteHostsFile(containerInfo, hostsEntries(containerInfo, containers)); err != nil {
+			logrus.Warnf("[refreshHosts] %s", err)
+		}
+	}
+}
+
+// hostsEntries 容器已经接入的每个网络中各个容器(包括自身)的ip、名称以及别名，known为已经读取的容器记录
+func hostsEntries(containerInfo *container.ContainerInfo, known map[string]*container.ContainerInfo) []*container.HostsEntry {
+	entries := make([]*container.HostsEntry, 0)
+	for _, networkName := range connectedNetworks(containerInfo) {
+		endPoints, err := ListEndpoints(networkName)
+		if err != nil {
+			logrus.Warnf("[hostsEntries] list endpoints of network:%s failed, err:%s", networkName, err)
+			continue
+		}
+
+		for _, endPoint := range endPoints {
+			peer, ok := known[endPoint.ContainerId]
+			if !ok {
+				if peer, err = container.GetSpecificContainers(endPoint.ContainerId); err != nil {
+					continue
+				}
+				known[peer.Id] = peer
+			}
+			settings := peer.NetworkSettings(networkName)
+			if settings == nil || !settings.Connected() {
+				continue
+			}
+
+			names := make([]string, 0, len(settings.Aliases)+1)
+			if peer.ContainerName != "" {
+				names = append(names, peer.ContainerName)
+			}
+			for _, alias := range settings.Aliases {
+				if alias != peer.ContainerName {
+					names = append(names, alias)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			entries = append(entries, &container.HostsEntry{IP: settings.IPAddress, Names: names})
+		}
+	}
+	return entries
+}
@@ -2,6 +2,7 @@ package network
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/bytedance/sonic"
 	"net"
 	"os"
@@ -12,7 +13,9 @@ type LocalIPManager struct {
 	IpamStorage            map[string][]byte `json:"ipam_storage"`
 }
 
+// Allocate 从subnet所在网段的地址池中分配一个ip，subnet.IP可以是网段内的任意地址(例如网关)
 func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
+	subnet = networkAddress(subnet)
 
 	var (
 		contentBytes = make([]byte, 0)
@@ -28,13 +31,17 @@ func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
 			}
 			bytes, err := sonic.Marshal(manager)
 			if err != nil {
+				ipamFile.Close()
 				return nil, err
 			}
 			_, err = ipamFile.Write(bytes)
 			if err != nil {
+				ipamFile.Close()
+				return nil, err
+			}
+			if err = ipamFile.Close(); err != nil {
 				return nil, err
 			}
-			ipamFile.Close()
 
 		} else {
 			return nil, err
@@ -69,6 +76,8 @@ func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
 
 	// 分配
 	subnetIpPool := ipPool[subnet.String()]
+	// 第k个bit对应 网段地址+k+1，可分配的地址不包括网段地址以及广播地址
+	hostNum := 1<<(total-subnetNum) - 2
 
 	for i := range subnetIpPool {
 		bit, base := subnetIpPool[i], byte(0x80)
@@ -79,6 +88,10 @@ func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
 				// 该位已经被使用
 				continue
 			}
+			if i*8+j+1 > hostNum {
+				// 广播地址以及之后的位不参与分配
+				break
+			}
 			isUnusedExisted = true
 			bitNum = j
 			// 修改为已占用
@@ -92,7 +105,9 @@ func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
 
 		// 具体位数
 		index := i*8 + bitNum + 1
-		ip = subnet.IP
+		// 复制一份，避免修改传入网段的ip；json反序列化得到的ipv4为16字节，统一转为4字节
+		ip = make(net.IP, net.IPv4len)
+		copy(ip, subnet.IP.To4())
 
 		for t := uint(4); t > 0; t -= 1 {
 			[]byte(ip)[4-t] += uint8(index >> ((t - 1) * 8))
@@ -101,6 +116,10 @@ func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
 		break
 	}
 
+	if ip == nil {
+		return nil, fmt.Errorf("no available ip in subnet:%s", subnet.String())
+	}
+
 	ipPool[subnet.String()] = subnetIpPool
 
 	manager.IpamStorage = ipPool
@@ -112,24 +131,29 @@ func (manager *LocalIPManager) Allocate(subnet *net.IPNet) (net.IP, error) {
 		}
 	}
 
-	newfile, err := os.OpenFile(manager.IpamDefaultStoragePath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
-	}
-
 	var content []byte
 	if content, err = sonic.Marshal(manager); err != nil {
 		return nil, err
 	}
 
+	newfile, err := os.OpenFile(manager.IpamDefaultStoragePath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
 	if _, err = newfile.Write(content); err != nil {
+		newfile.Close()
+		return nil, err
+	}
+	if err = newfile.Close(); err != nil {
 		return nil, err
 	}
 
 	return ip, nil
 }
 
+// Release 将ip归还到subnet所在网段的地址池
 func (manager *LocalIPManager) Release(subnet *net.IPNet, ip *net.IP) error {
+	subnet = networkAddress(subnet)
 	var (
 		err error
 	)
@@ -150,15 +174,18 @@ func (manager *LocalIPManager) Release(subnet *net.IPNet, ip *net.IP) error {
 
 	ipPool := manager.IpamStorage
 
-	c := 1
+	// 与Allocate一致，第c-1个bit对应 网段地址+c
+	c := 0
 	ipFor4, gwFor4 := ip.To4(), subnet.IP.To4()
-	//ipFor4[3] -= 1
 	for t := uint(4); t > 0; t -= 1 {
 		c += int(ipFor4[t-1]-gwFor4[t-1]) << ((4 - t) * 8)
 	}
 
 	// 计算bit位数
 	bytesNum, bitNum := (c-1)/8, (c-1)%8
+	if c <= 0 || bytesNum >= len(ipPool[subnet.String()]) {
+		return fmt.Errorf("ip:%s is not allocated from subnet:%s", ip.String(), subnet.String())
+	}
 	tmpByte := ipPool[subnet.String()][bytesNum]
 	tmpByte &= ^(0x80 >> bitNum)
 	ipPool[subnet.String()][bytesNum] = tmpByte
@@ -172,19 +199,27 @@ func (manager *LocalIPManager) Release(subnet *net.IPNet, ip *net.IP) error {
 		}
 	}
 
-	newfile, err := os.OpenFile(manager.IpamDefaultStoragePath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return err
-	}
-
 	var content []byte
 	if content, err = sonic.Marshal(manager); err != nil {
 		return err
 	}
 
+	newfile, err := os.OpenFile(manager.IpamDefaultStoragePath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
 	if _, err = newfile.Write(content); err != nil {
+		newfile.Close()
+		return err
+	}
+	if err = newfile.Close(); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// networkAddress 地址池以网段地址为key，网络记录中的IPRange.IP为网关地址，需要先取网段地址
+func networkAddress(subnet *net.IPNet) *net.IPNet {
+	return &net.IPNet{IP: subnet.IP.Mask(subnet.Mask).To4(), Mask: subnet.Mask}
+}
@@ -1,69 +1,80 @@
 package network
 
 import (
-	"github.com/bytedance/sonic"
+	"github.com/stretchr/testify/assert"
 	"net"
-	"os"
+	"path"
 	"testing"
 )
 
-func TestLocalIPManager_Allocate(t *testing.T) {
-	manager := &LocalIPManager{
-		IpamDefaultStoragePath: "/home/guohaonan/code/src/common-tools-haonan/docker/network/ipam.json",
+func newTestIPManager(t *testing.T) *LocalIPManager {
+	return &LocalIPManager{
+		IpamDefaultStoragePath: path.Join(t.TempDir(), "ipam.json"),
 		IpamStorage:            map[string][]byte{},
 	}
+}
 
-	var (
-		ipamFile *os.File
-	)
+func TestLocalIPManager_Allocate(t *testing.T) {
+	cases := []struct {
+		name   string
+		subnet string
+		count  int
+		want   []string
+		// full 分配count个之后网段内没有可用地址
+		full bool
+	}{
+		{name: "large subnet", subnet: "100.0.0.0/12", count: 3, want: []string{"100.0.0.1", "100.0.0.2", "100.0.0.3"}},
+		{name: "cross byte", subnet: "10.0.0.0/24", count: 10, want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8", "10.0.0.9", "10.0.0.10"}},
+		{name: "small subnet", subnet: "10.0.0.0/30", count: 2, want: []string{"10.0.0.1", "10.0.0.2"}, full: true},
+		{name: "one byte subnet", subnet: "10.0.0.0/29", count: 6, want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}, full: true},
+	}
 
-	_, err := os.Stat(manager.IpamDefaultStoragePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			ipamFile, err = os.OpenFile(manager.IpamDefaultStoragePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-			if err != nil {
-				t.Fatal(err)
-			}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			manager := newTestIPManager(t)
+			_, ipRange, err := net.ParseCIDR(c.subnet)
+			assert.Nil(t, err)
 
-			bytes, err := sonic.Marshal(manager)
-			if err != nil {
-				t.Fatal(err)
-			}
-			_, err = ipamFile.Write(bytes)
-			if err != nil {
-				t.Fatal(err)
+			got := make([]string, 0, c.count)
+			for i := 0; i < c.count; i++ {
+				ip, err := manager.Allocate(ipRange)
+				assert.Nil(t, err)
+				got = append(got, ip.String())
 			}
-			ipamFile.Close()
-		} else {
-			t.Fatalf("dir stat failed, err:%s", err)
-		}
-	}
-
-	_, ipRange, err := net.ParseCIDR("100.0.0.0/12")
-	if err != nil {
-		t.Error(err)
-	}
+			assert.Equal(t, c.want, got)
 
-	ip, err := manager.Allocate(ipRange)
-	if err != nil {
-		t.Fatal(err)
+			// 分配记录持久化，新的manager从文件中继续分配
+			reloaded := &LocalIPManager{IpamDefaultStoragePath: manager.IpamDefaultStoragePath, IpamStorage: map[string][]byte{}}
+			allocations, err := reloaded.Allocate(ipRange)
+			if c.full {
+				// 不会分配广播地址以及网段之外的地址
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.NotContains(t, c.want, allocations.String())
+		})
 	}
-	t.Log(ip)
 }
 
 func TestLocalIPManager_Release(t *testing.T) {
-	manager := &LocalIPManager{
-		IpamDefaultStoragePath: "/home/guohaonan/code/src/common-tools-haonan/docker/network/ipam.json",
-		IpamStorage:            map[string][]byte{},
-	}
+	manager := newTestIPManager(t)
 	_, ipRange, err := net.ParseCIDR("100.0.0.0/12")
-	if err != nil {
-		t.Fatal(err)
-	}
+	assert.Nil(t, err)
 
-	ip := net.IPv4(100, 0, 0, 1)
-	err = manager.Release(ipRange, &ip)
-	if err != nil {
-		t.Fatal(err)
+	for i := 0; i < 3; i++ {
+		_, err = manager.Allocate(ipRange)
+		assert.Nil(t, err)
 	}
+
+	// 释放之后的ip被优先分配
+	ip := net.IPv4(100, 0, 0, 2)
+	assert.Nil(t, manager.Release(ipRange, &ip))
+	reused, err := manager.Allocate(ipRange)
+	assert.Nil(t, err)
+	assert.Equal(t, "100.0.0.2", reused.String())
+
+	next, err := manager.Allocate(ipRange)
+	assert.Nil(t, err)
+	assert.Equal(t, "100.0.0.4", next.String())
 }
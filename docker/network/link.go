@@ -0,0 +1,267 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"net"
+	"os"
+	"runtime"
+)
+
+// LinkManager 网络设备的操作，默认通过netlink实现，测试时可以替换为内存中的实现
+type LinkManager interface {
+	// AddBridge 创建网桥，配置网关地址之后打开
+	AddBridge(name string, gateway *net.IPNet) error
+	// AddVeth 创建一对veth，name一端接入网桥master并打开
+	AddVeth(name string, peerName string, master string) error
+	// SetupPeer 将veth的peerName一端移入进程pid的network namespace并重命名为ifName，配置地址并打开，返回其mac地址
+	// gateway不为空时添加经由gateway的默认路由
+	SetupPeer(peerName string, pid string, ifName string, address *net.IPNet, gateway net.IP) (net.HardwareAddr, error)
+	// LinkExists 宿主机上的网络设备是否存在
+	LinkExists(name string) bool
+	// LinkList 列出宿主机上的所有网络设备
+	LinkList() ([]netlink.Link, error)
+	// DeleteLink 删除宿主机上的网络设备，设备不存在时视为已经删除，veth的一端被删除时另一端同时被删除
+	DeleteLink(name string) error
+	// ContainerLinks 列出进程pid的network namespace内除lo之外的网络设备，包含收发统计
+	ContainerLinks(pid int) ([]netlink.Link, error)
+}
+
+// DefaultLinkManager 网络驱动以及清理逻辑使用的LinkManager
+var DefaultLinkManager LinkManager = &netlinkManager{}
+
+type netlinkManager struct{}
+
+func (manager *netlinkManager) AddBridge(name string, gateway *net.IPNet) error {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	bridgeIns := &netlink.Bridge{LinkAttrs: la}
+	if err := netlink.LinkAdd(bridgeIns); err != nil {
+		logrus.Errorf("[netlinkManager] create bridge failed, err:%s", err)
+		return err
+	}
+
+	// 设置网桥网段， 即宿主机将子网网段的请求路由到创建的该网桥上
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err = netlink.AddrAdd(link, &netlink.Addr{IPNet: gateway}); err != nil {
+		logrus.Errorf("[netlinkManager] add bridge address failed, err:%s", err)
+		return err
+	}
+
+	// ip link set <name> up
+	if err = netlink.LinkSetUp(link); err != nil {
+		logrus.Errorf("[netlinkManager] set bridge up failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (manager *netlinkManager) AddVeth(name string, peerName string, master string) error {
+	br, err := netlink.LinkByName(master)
+	if err != nil {
+		return err
+	}
+
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.MasterIndex = br.Attrs().Index
+	veth := &netlink.Veth{LinkAttrs: la, PeerName: peerName}
+	if err = netlink.LinkAdd(veth); err != nil {
+		logrus.Errorf("[netlinkManager] create veth failed, err:%s", err)
+		return err
+	}
+	if err = netlink.LinkSetUp(veth); err != nil {
+		logrus.Errorf("[netlinkManager] veth set up failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func (manager *netlinkManager) SetupPeer(peerName string, pid string, ifName string, address *net.IPNet, gateway net.IP) (net.HardwareAddr, error) {
+	peerLink, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return nil, fmt.Errorf("fail config endpoint: %v", err)
+	}
+
+	exit, err := enterContainerNetns(peerLink, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer exit()
+
+	// 移入容器之后的设备处于down状态，可以直接重命名
+	if err = setInterfaceName(peerName, ifName); err != nil {
+		return nil, err
+	}
+	if err = setInterfaceIp(ifName, address); err != nil {
+		return nil, err
+	}
+	if err = setInterfaceUp(ifName); err != nil {
+		return nil, err
+	}
+	if err = setInterfaceUp("lo"); err != nil {
+		return nil, err
+	}
+
+	interfaceDev, err := netlink.LinkByName(ifName)
+	if err != nil {
+		logrus.Errorf("[SetupPeer] interface:%s find failed, err:%s", ifName, err)
+		return nil, err
+	}
+	// 接入多个网络时只有第一个网络添加默认路由
+	if gateway == nil {
+		return interfaceDev.Attrs().HardwareAddr, nil
+	}
+
+	_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
+	defaultRoute := &netlink.Route{
+		LinkIndex: interfaceDev.Attrs().Index,
+		Gw:        gateway,
+		Dst:       cidr,
+	}
+	if err = netlink.RouteAdd(defaultRoute); err != nil {
+		logrus.Errorf("[SetupPeer] route add failed, err:%s", err)
+		return nil, err
+	}
+	return interfaceDev.Attrs().HardwareAddr, nil
+}
+
+func (manager *netlinkManager) LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+func (manager *netlinkManager) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (manager *netlinkManager) DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		// 容器进程退出时网络namespace被销毁，veth已经随之删除
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+// ContainerLinks 通过指定namespace的netlink句柄读取，不需要切换当前线程的namespace
+func (manager *netlinkManager) ContainerLinks(pid int) ([]netlink.Link, error) {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, fmt.Errorf("get net namespace of pid:%d failed, err:%s", pid, err)
+	}
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Delete()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]netlink.Link, 0, len(links))
+	for _, link := range links {
+		if link.Attrs().Flags&net.FlagLoopback == 0 {
+			result = append(result, link)
+		}
+	}
+	return result, nil
+}
+
+// enterContainerNetns 将link移入容器进程的network namespace，并将当前线程切换到该namespace，返回切换回原namespace的函数
+func enterContainerNetns(link netlink.Link, pid string) (func(), error) {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%s/ns/net", pid), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("get container net namespace failed, err:%s", err)
+	}
+
+	nsFD := f.Fd()
+	runtime.LockOSThread()
+
+	// 获取当前的网络namespace
+	origns, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		f.Close()
+		return nil, fmt.Errorf("get current netns failed, err:%s", err)
+	}
+	exit := func() {
+		netns.Set(origns)
+		origns.Close()
+		runtime.UnlockOSThread()
+		f.Close()
+	}
+
+	// 修改veth peer 另外一端移到容器的namespace中
+	if err = netlink.LinkSetNsFd(link, int(nsFD)); err != nil {
+		exit()
+		return nil, fmt.Errorf("set link netns failed, err:%s", err)
+	}
+
+	// 设置当前进程到新的网络namespace，并在函数执行完成之后再恢复到之前的namespace
+	if err = netns.Set(netns.NsHandle(nsFD)); err != nil {
+		exit()
+		return nil, fmt.Errorf("set netns failed, err:%s", err)
+	}
+	return exit, nil
+}
+
+func setInterfaceName(name string, newName string) error {
+	interfaceDev, err := netlink.LinkByName(name)
+	if err != nil {
+		logrus.Errorf("[setInterfaceName] interface:%s find failed, err:%s", name, err)
+		return err
+	}
+
+	if err = netlink.LinkSetName(interfaceDev, newName); err != nil {
+		logrus.Errorf("[setInterfaceName] rename interface:%s to %s failed, err:%s", name, newName, err)
+		return err
+	}
+	return nil
+}
+
+func setInterfaceIp(name string, subnet *net.IPNet) error {
+	interfaceDev, err := netlink.LinkByName(name)
+	if err != nil {
+		logrus.Errorf("[setInterfaceIp] interface:%s find failed, err:%s", name, err)
+		return err
+	}
+
+	addr := &netlink.Addr{IPNet: subnet, Peer: subnet, Label: "", Flags: 0, Scope: 0, Broadcast: nil}
+
+	if err = netlink.AddrAdd(interfaceDev, addr); err != nil {
+		logrus.Errorf("[setInterfance] addr add failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+func setInterfaceUp(name string) error {
+	interfaceDev, err := netlink.LinkByName(name)
+	if err != nil {
+		logrus.Errorf("[setInterfaceUp] interface:%s find failed, err:%s", name, err)
+		return err
+	}
+
+	if err = netlink.LinkSetUp(interfaceDev); err != nil {
+		logrus.Errorf("[setInterfaceUp] Link set up failed, err:%s", err)
+		return err
+	}
+	return nil
+}
+
+// ContainerLinks 列出容器network namespace内除lo之外的网络设备，包含收发统计
+func ContainerLinks(pid int) ([]netlink.Link, error) {
+	return DefaultLinkManager.ContainerLinks(pid)
+}
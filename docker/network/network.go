@@ -6,21 +6,16 @@ import (
 	"github.com/bytedance/sonic"
 	"github.com/common-tools-haonan/docker/container"
 	"github.com/sirupsen/logrus"
-	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
 	"net"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
-	"runtime"
 	"strings"
 )
 
-const (
-	defaultNetworkPath = "/home/guohaonan/ghndocker/network"
-)
+// defaultNetworkPath 网络记录以及ipam文件所在的目录，测试时指向临时目录
+var defaultNetworkPath = "/home/guohaonan/ghndocker/network"
 
 type Network struct {
 	NetworkName string     `json:"network_name"`
@@ -91,48 +86,88 @@ func (network *Network) Remove() error {
 	return os.RemoveAll(networkPath)
 }
 
-func CreateNetwork(networkName, driverName string, subnet string) error {
+// CreateNetwork 分配网关地址并通过驱动创建网络，任意一步失败时撤销已经完成的步骤
+func CreateNetwork(networkName, driverName string, subnet string) (err error) {
+	// 网络记录与ipam文件、endpoint目录在同一个目录下
+	if networkName == endpointDirName || networkName == path.Base(ipAddressManager.IpamDefaultStoragePath) {
+		return fmt.Errorf("network name:%s is reserved", networkName)
+	}
+
 	_, ipRange, err := net.ParseCIDR(subnet)
 	if err != nil {
 		logrus.Errorf("[CreateNetwork] create local network failed, err:%s", err)
 		return err
 	}
 
+	driverInterface, isExist := NetworkDrivers[driverName]
+	if !isExist {
+		logrus.Errorf("[CreateWork] driver:%s doesn't implement", driverName)
+		return errors.New(fmt.Sprintf("driver:%s doesn't implement", driverName))
+	}
+
+	rollback := &container.Rollback{}
+	defer func() {
+		if err != nil {
+			rollback.Undo()
+		}
+	}()
+
 	// 网关地址
 	gatewayIP, err := ipAddressManager.Allocate(ipRange)
 	if err != nil {
 		return err
 	}
+	rollback.Push("gateway lease", func() error {
+		return ipAddressManager.Release(ipRange, &gatewayIP)
+	})
 	ipRange.IP = gatewayIP
 
-	var (
-		driverInterface Driver
-		isExist         bool
-	)
-
-	driverInterface, isExist = NetworkDrivers[driverName]
-	if !isExist {
-		logrus.Errorf("[CreateWork] driver:%s doesn't implement", driverName)
-		return errors.New(fmt.Sprintf("driver:%s doesn't implement", driverName))
-	}
-
 	network, err := driverInterface.CreateNetwork(ipRange, networkName)
 	if err != nil {
 		logrus.Errorf("[CreateNetwork] driver:%v create failed, err:%s", reflect.ValueOf(driverInterface).Interface(), err)
 		return err
 	}
+	rollback.Push("network", func() error {
+		return driverInterface.DeleteNetwork(network)
+	})
 
-	return network.Dump(defaultNetworkPath)
+	if err = network.Dump(defaultNetworkPath); err != nil {
+		return err
+	}
+	networkMapping[networkName] = network
+	return nil
 }
 
 func DeleteNetwork(networkName string) error {
-	network, ok := networkMapping[networkName]
+	network, ok := lookupNetwork(networkName)
 	if !ok {
 		return errors.New(fmt.Sprintf("network:%s not existed", networkName))
 	}
 
+	// 仍有运行中的容器接入时不允许删除
+	attached, err := container.ListContainers(&container.ListOptions{Filters: map[string][]string{"network": {networkName}}})
+	if err != nil {
+		return err
+	}
+	if len(attached) > 0 {
+		ids := make([]string, 0, len(attached))
+		for _, containerInfo := range attached {
+			ids = append(ids, containerInfo.Id)
+		}
+		return fmt.Errorf("network:%s has active containers:%s", networkName, strings.Join(ids, ","))
+	}
+
+	// 已经退出但没有断开的容器仍然占用ip以及端口映射，删除容器之后才能删除网络
+	endPoints, err := ListEndpoints(networkName)
+	if err != nil {
+		return err
+	}
+	if len(endPoints) > 0 {
+		return fmt.Errorf("network:%s has endpoints of containers:%s", networkName, endpointIds(endPoints))
+	}
+
 	ipRange := network.IPRange
-	err := ipAddressManager.Release(ipRange, &ipRange.IP)
+	err = ipAddressManager.Release(ipRange, &ipRange.IP)
 	if err != nil {
 		return err
 	}
@@ -151,9 +186,38 @@ func DeleteNetwork(networkName string) error {
 		return err
 	}
 
+	delete(networkMapping, networkName)
 	return network.Remove()
 }
 
+// NetworkExists 网络记录是否存在
+func NetworkExists(networkName string) bool {
+	_, ok := lookupNetwork(networkName)
+	return ok
+}
+
+// lookupNetwork 查找网络记录，启动之后由其他进程创建的网络从磁盘加载(daemon长期运行时需要)
+func lookupNetwork(networkName string) (*Network, bool) {
+	if network, ok := networkMapping[networkName]; ok {
+		return network, true
+	}
+
+	networkPath := path.Join(defaultNetworkPath, "/", networkName)
+	if networkName == "" || networkName == endpointDirName || networkName == path.Base(ipAddressManager.IpamDefaultStoragePath) {
+		return nil, false
+	}
+	if isExist, _ := container.PathExist(networkPath); !isExist {
+		return nil, false
+	}
+
+	network := &Network{NetworkName: networkName}
+	if err := network.Load(networkPath); err != nil {
+		return nil, false
+	}
+	networkMapping[networkName] = network
+	return network, true
+}
+
 func ListAllNetwork() ([]*Network, error) {
 	// 读取默认目录
 	if _, err := os.Stat(defaultNetworkPath); err != nil {
@@ -169,6 +233,10 @@ func ListAllNetwork() ([]*Network, error) {
 	err := filepath.Walk(defaultNetworkPath, func(networkPath string, file os.FileInfo, err error) error {
 		// 底层默认执行一次walkfc, 避免报错，这步过滤
 		if file.IsDir() {
+			if networkPath != defaultNetworkPath {
+				// endpoint记录目录
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -196,174 +264,358 @@ func ListAllNetwork() ([]*Network, error) {
 	return networks, nil
 }
 
-func Connect(networkName string, portMapping string, containerInfo *container.ContainerInfo) error {
-	network, ok := networkMapping[networkName]
+// Connect 将容器接入网络: 分配ip、创建veth、配置容器内网卡ip和路由、添加端口映射，任意一步失败时撤销已经完成的步骤，
+// 接入之后更新网络中各个容器的/etc/hosts
+// 容器记录中没有该网络时追加到Networks末尾，容器内网卡名称为第一个未被使用的ethN，只有第一个接入的网络添加默认路由
+func Connect(networkName string, portMapping string, containerInfo *container.ContainerInfo) (err error) {
+	network, ok := lookupNetwork(networkName)
 	if !ok {
 		return errors.New(fmt.Sprintf("network:%s not existed", networkName))
 	}
 
+	driver, isDriverExist := NetworkDrivers[network.Driver]
+	if !isDriverExist {
+		return errors.New(fmt.Sprintf("driver:%s not init", network.Driver))
+	}
+
+	settings := containerInfo.NetworkSettings(networkName)
+	if settings != nil && settings.Connected() {
+		return fmt.Errorf("container:%s is already connected to network:%s", containerInfo.Id, networkName)
+	}
+
+	rollback := &container.Rollback{}
+	defer func() {
+		if err != nil {
+			rollback.Undo()
+		}
+	}()
+
+	if settings == nil {
+		settings = &container.EndpointSettings{NetworkName: networkName}
+		containerInfo.Networks = append(containerInfo.Networks, settings)
+		rollback.Push("network settings", func() error {
+			containerInfo.Networks = containerInfo.Networks[:len(containerInfo.Networks)-1]
+			return nil
+		})
+	}
+
+	// 第一个接入的网络作为默认路由
+	var gateway net.IP
+	if len(connectedNetworks(containerInfo)) == 0 {
+		gateway = network.IPRange.IP
+	}
+
 	// 接入容器的网络ip分配
 	ipRange := network.IPRange
 	ip, err := ipAddressManager.Allocate(ipRange)
 	if err != nil {
 		return err
 	}
+	rollback.Push("ip lease", func() error {
+		return ipAddressManager.Release(ipRange, &ip)
+	})
 
 	endpoint := &EndPoint{
 		ID:          fmt.Sprintf("%s-%s", containerInfo.Id, networkName),
+		ContainerId: containerInfo.Id,
+		NetworkName: networkName,
+		Interface:   nextInterface(containerInfo),
 		IPAddress:   &ip,
 		Network:     network,
-		PortMapping: strings.Split(portMapping, ":"),
-	}
-
-	var (
-		driver        Driver
-		isDriverExist bool
-	)
-
-	driver, isDriverExist = NetworkDrivers[network.Driver]
-	if !isDriverExist {
-		return errors.New(fmt.Sprintf("driver:%s not init", network.Driver))
+		PortMapping: splitPortMapping(portMapping),
 	}
+	endpoint.VethName = vethName(endpoint)
 
 	// 容器网络设备veth创建
+	rollback.Push("veth", func() error {
+		return driver.Disconnect(network, endpoint)
+	})
 	if err = driver.Connect(network, endpoint); err != nil {
 		return err
 	}
 
 	// 配置ip, route
-	if err = configInterfaceIpAndRoute(endpoint, containerInfo); err != nil {
+	if err = configInterfaceIpAndRoute(endpoint, containerInfo, gateway); err != nil {
 		return err
 	}
 
 	// port
+	rollback.Push("port mapping", func() error {
+		return removePortMapping(endpoint)
+	})
 	if err = configPortMapping(endpoint); err != nil {
 		return err
 	}
+
+	// 持久化endpoint，断开以及删除网络时使用
+	if err = endpoint.Dump(); err != nil {
+		return err
+	}
+	rollback.Push("endpoint record", func() error {
+		return endpoint.Remove()
+	})
+
+	// 记录容器在该网络中的接入信息
+	settings.EndpointId = endpoint.ID
+	settings.Interface = endpoint.Interface
+	settings.IPAddress = ip.String()
+	if endpoint.MacAddress != nil {
+		settings.MacAddress = endpoint.MacAddress.String()
+	}
+	rollback.Push("endpoint settings", func() error {
+		resetEndpointSettings(settings)
+		return nil
+	})
+	if err = container.UpdateContainerNetworks(containerInfo); err != nil {
+		return err
+	}
+	container.RecordEvent(container.EventType_Network, container.EventAction_Connect, networkName, map[string]string{"container": containerInfo.Id, "ip": ip.String()})
+	refreshHosts(networkName, containerInfo)
 	return nil
 }
 
-func configInterfaceIpAndRoute(endpoint *EndPoint, containerInfo *container.ContainerInfo) (err error) {
-
-	interfaceIP := endpoint.Network.IPRange
-	interfaceIP.IP = endpoint.IPAddress.To4()
+// Disconnect 将容器从网络断开: 删除端口映射规则、veth设备、释放ip并删除endpoint记录，并从网络中其他容器的/etc/hosts中移除
+// 容器记录中保留该网络以及别名，重启时重新接入，调用方负责持久化容器记录
+func Disconnect(networkName string, containerInfo *container.ContainerInfo) error {
+	settings := containerInfo.NetworkSettings(networkName)
+	if settings == nil || !settings.Connected() {
+		return fmt.Errorf("container:%s is not connected to network:%s", containerInfo.Id, networkName)
+	}
 
-	peerLink, err := netlink.LinkByName(endpoint.Device.PeerName)
-	if err != nil {
-		return fmt.Errorf("fail config endpoint: %v", err)
+	network, ok := lookupNetwork(networkName)
+	if !ok {
+		return errors.New(fmt.Sprintf("network:%s not existed", networkName))
 	}
 
-	defer enterContainerNetns(&peerLink, containerInfo)()
-	if err = setInterfaceIp(endpoint.Device.PeerName, interfaceIP); err != nil {
-		return err
+	driver, isDriverExist := NetworkDrivers[network.Driver]
+	if !isDriverExist {
+		return errors.New(fmt.Sprintf("driver:%s not init", network.Driver))
 	}
 
-	if err = setInterfaceUp(endpoint.Device.PeerName); err != nil {
+	endpoint, err := loadEndpoint(network.NetworkName, settings.EndpointId)
+	if err != nil {
 		return err
 	}
+	// 没有endpoint记录(接入时还没有持久化endpoint)时根据容器记录断开，当时的veth名称为容器id的前5位
+	if endpoint == nil {
+		ip := net.ParseIP(settings.IPAddress)
+		endpoint = &EndPoint{
+			ID:          settings.EndpointId,
+			ContainerId: containerInfo.Id,
+			NetworkName: network.NetworkName,
+			VethName:    containerInfo.Id[:5],
+			IPAddress:   &ip,
+			PortMapping: splitPortMapping(containerInfo.PortMapping),
+		}
+	}
+	endpoint.Network = network
 
-	if err = setInterfaceUp("lo"); err != nil {
-		return err
+	var ip net.IP
+	if endpoint.IPAddress != nil {
+		ip = *endpoint.IPAddress
+	}
+	if ip != nil {
+		if err := removePortMapping(endpoint); err != nil {
+			return err
+		}
 	}
 
-	interfaceDev, err := netlink.LinkByName(endpoint.Device.PeerName)
-	if err != nil {
-		logrus.Errorf("[configInterfaceIpAndRoute] interface:%s find failed, err:%s", endpoint.Device.PeerName, err)
+	if err := driver.Disconnect(network, endpoint); err != nil {
 		return err
 	}
-	_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
-	defaultRoute := &netlink.Route{
-		LinkIndex: interfaceDev.Attrs().Index,
-		Gw:        endpoint.Network.IPRange.IP,
-		Dst:       cidr,
+
+	if ip != nil {
+		if err := ipAddressManager.Release(network.IPRange, &ip); err != nil {
+			return err
+		}
 	}
 
-	if err = netlink.RouteAdd(defaultRoute); err != nil {
-		logrus.Errorf("[configInterfaceIpAndRoute] route add failed, err:%s", err)
+	if err = endpoint.Remove(); err != nil {
 		return err
 	}
 
+	resetEndpointSettings(settings)
+	container.RecordEvent(container.EventType_Network, container.EventAction_Disconnect, network.NetworkName, map[string]string{"container": containerInfo.Id})
+	refreshHosts(network.NetworkName, containerInfo)
 	return nil
 }
 
-func setInterfaceIp(name string, subnet *net.IPNet) error {
-	interfaceDev, err := netlink.LinkByName(name)
-	if err != nil {
-		logrus.Errorf("[setInterfaceIp] interface:%s find failed, err:%s", name, err)
-		return err
-	}
+// ConnectAll 按照容器记录中的顺序接入所有网络，端口映射只作用于第一个网络，失败时断开已经接入的网络
+func ConnectAll(containerInfo *container.ContainerInfo) (err error) {
+	rollback := &container.Rollback{}
+	defer func() {
+		if err != nil {
+			rollback.Undo()
+		}
+	}()
 
-	addr := &netlink.Addr{IPNet: subnet, Peer: subnet, Label: "", Flags: 0, Scope: 0, Broadcast: nil}
+	for i, networkName := range containerInfo.NetworkNames() {
+		portMapping := ""
+		if i == 0 {
+			portMapping = containerInfo.PortMapping
+		}
+		if err = Connect(networkName, portMapping, containerInfo); err != nil {
+			return fmt.Errorf("connect network:%s failed, err:%s", networkName, err)
+		}
 
-	if err = netlink.AddrAdd(interfaceDev, addr); err != nil {
-		logrus.Errorf("[setInterfance] addr add failed, err:%s", err)
-		return err
+		networkName := networkName
+		rollback.Push("network "+networkName, func() error {
+			return Disconnect(networkName, containerInfo)
+		})
 	}
 	return nil
 }
 
-func setInterfaceUp(name string) error {
-	interfaceDev, err := netlink.LinkByName(name)
-	if err != nil {
-		logrus.Errorf("[setInterfaceUp] interface:%s find failed, err:%s", name, err)
-		return err
+// DisconnectAll 断开容器已经接入的所有网络，调用方负责持久化容器记录
+func DisconnectAll(containerInfo *container.ContainerInfo) error {
+	for _, networkName := range connectedNetworks(containerInfo) {
+		if err := Disconnect(networkName, containerInfo); err != nil {
+			return fmt.Errorf("disconnect container:%s from network:%s failed, err:%s", containerInfo.Id, networkName, err)
+		}
 	}
+	return nil
+}
 
-	if err = netlink.LinkSetUp(interfaceDev); err != nil {
-		logrus.Errorf("[setInterfaceUp] Link set up failed, err:%s", err)
+// ReleaseContainer 容器停止、退出或者删除时断开所有网络并持久化容器记录，没有接入网络时跳过
+func ReleaseContainer(containerInfo *container.ContainerInfo) error {
+	if len(connectedNetworks(containerInfo)) == 0 {
+		return nil
+	}
+	if err := DisconnectAll(containerInfo); err != nil {
 		return err
 	}
-	return nil
+	return container.UpdateContainerNetworks(containerInfo)
 }
 
-func enterContainerNetns(enLink *netlink.Link, cinfo *container.ContainerInfo) func() {
-	f, err := os.OpenFile(fmt.Sprintf("/proc/%s/ns/net", cinfo.Pid), os.O_RDONLY, 0)
-	if err != nil {
-		logrus.Errorf("error get container net namespace, %v", err)
+// connectedNetworks 容器已经接入的网络名称
+func connectedNetworks(containerInfo *container.ContainerInfo) []string {
+	names := make([]string, 0, len(containerInfo.Networks))
+	for _, settings := range containerInfo.Networks {
+		if settings.Connected() {
+			names = append(names, settings.NetworkName)
+		}
 	}
+	return names
+}
 
-	nsFD := f.Fd()
-	runtime.LockOSThread()
+// nextInterface 容器内第一个未被已接入网络使用的网卡名称，依次为eth0、eth1...
+func nextInterface(containerInfo *container.ContainerInfo) string {
+	used := make(map[string]bool)
+	for _, settings := range containerInfo.Networks {
+		if settings.Connected() {
+			used[settings.Interface] = true
+		}
+	}
+	for i := 0; ; i++ {
+		if name := fmt.Sprintf("eth%d", i); !used[name] {
+			return name
+		}
+	}
+}
+
+// resetEndpointSettings 清除断开之后失效的接入信息，保留网络名称以及别名
+func resetEndpointSettings(settings *container.EndpointSettings) {
+	settings.EndpointId = ""
+	settings.Interface = ""
+	settings.IPAddress = ""
+	settings.MacAddress = ""
+}
 
-	// 修改veth peer 另外一端移到容器的namespace中
-	if err = netlink.LinkSetNsFd(*enLink, int(nsFD)); err != nil {
-		logrus.Errorf("error set link netns , %v", err)
+// splitPortMapping 多个端口映射以逗号分隔，例如 8080:80,8443:443
+func splitPortMapping(portMapping string) []string {
+	mappings := make([]string, 0)
+	for _, pm := range strings.Split(portMapping, ",") {
+		if pm = strings.TrimSpace(pm); pm != "" {
+			mappings = append(mappings, pm)
+		}
 	}
+	return mappings
+}
 
-	// 获取当前的网络namespace
-	origns, err := netns.Get()
-	if err != nil {
-		logrus.Errorf("error get current netns, %v", err)
+// ListPortBindings 列出容器的端口映射，并检查对应的DNAT规则当前是否存在
+func ListPortBindings(containerInfo *container.ContainerInfo) []*container.PortBinding {
+	// 端口映射只作用于第一个网络
+	containerIP := ""
+	if len(containerInfo.Networks) > 0 {
+		containerIP = containerInfo.Networks[0].IPAddress
+	}
+
+	bindings := make([]*container.PortBinding, 0)
+	for _, pm := range splitPortMapping(containerInfo.PortMapping) {
+		portMapping := strings.Split(pm, ":")
+		if len(portMapping) != 2 {
+			continue
+		}
+
+		binding := &container.PortBinding{
+			HostPort:      portMapping[0],
+			ContainerIP:   containerIP,
+			ContainerPort: portMapping[1],
+		}
+		if containerIP != "" {
+			ip := net.ParseIP(containerIP)
+			if rule, err := portMappingRule(&EndPoint{IPAddress: &ip}, pm); err == nil {
+				binding.Active = DefaultFirewall.Exists("nat", "PREROUTING", rule...)
+			}
+		}
+		bindings = append(bindings, binding)
 	}
+	return bindings
+}
 
-	// 设置当前进程到新的网络namespace，并在函数执行完成之后再恢复到之前的namespace
-	if err = netns.Set(netns.NsHandle(nsFD)); err != nil {
-		logrus.Errorf("error set netns, %v", err)
+// configInterfaceIpAndRoute 配置容器内的网卡，gateway为空时不添加默认路由
+func configInterfaceIpAndRoute(endpoint *EndPoint, containerInfo *container.ContainerInfo, gateway net.IP) error {
+	// 复制一份网段信息，避免修改网络本身记录的网关地址
+	interfaceIP := &net.IPNet{
+		IP:   endpoint.IPAddress.To4(),
+		Mask: endpoint.Network.IPRange.Mask,
 	}
-	return func() {
-		netns.Set(origns)
-		origns.Close()
-		runtime.UnlockOSThread()
-		f.Close()
+
+	mac, err := DefaultLinkManager.SetupPeer(endpoint.Device.PeerName, containerInfo.Pid, endpoint.Interface, interfaceIP, gateway)
+	if err != nil {
+		logrus.Errorf("[configInterfaceIpAndRoute] setup interface:%s failed, err:%s", endpoint.Device.PeerName, err)
+		return err
 	}
+	endpoint.MacAddress = &mac
+	return nil
 }
 
 func configPortMapping(ep *EndPoint) error {
 	for _, pm := range ep.PortMapping {
-		portMapping := strings.Split(pm, ":")
-		if len(portMapping) != 2 {
-			logrus.Errorf("port mapping format error, %v", pm)
-			continue
+		rule, err := portMappingRule(ep, pm)
+		if err != nil {
+			return err
 		}
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
-			portMapping[0], ep.IPAddress.String(), portMapping[1])
-		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-		//err := cmd.Run()
-		output, err := cmd.Output()
+		if err = DefaultFirewall.Append("nat", "PREROUTING", rule...); err != nil {
+			return fmt.Errorf("add port mapping:%s failed, err:%s", pm, err)
+		}
+	}
+	return nil
+}
+
+// removePortMapping 删除endpoint的所有端口映射规则，规则不存在时跳过
+func removePortMapping(ep *EndPoint) error {
+	for _, pm := range ep.PortMapping {
+		rule, err := portMappingRule(ep, pm)
 		if err != nil {
-			logrus.Errorf("iptables Output, %v", output)
 			continue
 		}
+		if !DefaultFirewall.Exists("nat", "PREROUTING", rule...) {
+			continue
+		}
+		if err = DefaultFirewall.Delete("nat", "PREROUTING", rule...); err != nil {
+			return fmt.Errorf("remove port mapping:%s failed, err:%s", pm, err)
+		}
 	}
 	return nil
 }
+
+// portMappingRule 端口映射 宿主机端口:容器端口 对应的DNAT规则(不包括 -t nat -A PREROUTING)
+func portMappingRule(ep *EndPoint, pm string) ([]string, error) {
+	portMapping := strings.Split(pm, ":")
+	if len(portMapping) != 2 {
+		return nil, fmt.Errorf("port mapping format error:%s, example: 8080:80", pm)
+	}
+	return []string{"-p", "tcp", "-m", "tcp", "--dport", portMapping[0],
+		"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%s", ep.IPAddress.String(), portMapping[1])}, nil
+}
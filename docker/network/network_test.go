@@ -0,0 +1,379 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+const (
+	testNetwork = "br-test"
+	testSubnet  = "192.168.10.0/24"
+)
+
+// newContainerRecord 创建运行中的容器记录，Connect成功时会覆盖写入
+func newContainerRecord(t *testing.T, id string, networks ...string) *container.ContainerInfo {
+	containerInfo := &container.ContainerInfo{Id: id, Pid: "4242", Status: container.ContainerStatus_Running}
+	for _, networkName := range networks {
+		containerInfo.Networks = append(containerInfo.Networks, &container.EndpointSettings{NetworkName: networkName})
+	}
+	assert.Nil(t, os.MkdirAll(fmt.Sprintf(container.GhnDockerRunningContainerDir, id), 0755))
+	writeContainerRecord(t, containerInfo)
+	return containerInfo
+}
+
+// writeContainerRecord 覆盖写入容器记录，模拟容器在网络操作之外发生的状态变化
+func writeContainerRecord(t *testing.T, containerInfo *container.ContainerInfo) {
+	content, err := sonic.Marshal(containerInfo)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path.Join(fmt.Sprintf(container.GhnDockerRunningContainerDir, containerInfo.Id), container.ConfFileName), content, 0644))
+}
+
+func TestCreateNetwork(t *testing.T) {
+	cases := []struct {
+		name    string
+		driver  string
+		subnet  string
+		prepare func(links *fakeLinkManager, firewall *fakeFirewall)
+		wantErr bool
+	}{
+		{name: "bridge", driver: "bridge", subnet: testSubnet},
+		{name: "unknown driver", driver: "overlay", subnet: testSubnet, wantErr: true},
+		{name: "invalid subnet", driver: "bridge", subnet: "192.168.10.0", wantErr: true},
+		{
+			name: "bridge exists", driver: "bridge", subnet: testSubnet, wantErr: true,
+			prepare: func(links *fakeLinkManager, firewall *fakeFirewall) {
+				links.AddBridge(testNetwork, nil)
+			},
+		},
+		{
+			name: "masquerade failed", driver: "bridge", subnet: testSubnet, wantErr: true,
+			prepare: func(links *fakeLinkManager, firewall *fakeFirewall) {
+				firewall.failOn["Append"] = errors.New("iptables: permission denied")
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			links, firewall := useFakeNetwork(t)
+			if c.prepare != nil {
+				c.prepare(links, firewall)
+			}
+
+			err := CreateNetwork(testNetwork, c.driver, c.subnet)
+			_, recorded := lookupNetwork(testNetwork)
+			allocations, listErr := ListIPAllocations()
+			assert.Nil(t, listErr)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				assert.False(t, recorded)
+				// 失败时网关地址被释放
+				assert.Empty(t, allocations)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.True(t, recorded)
+			assert.True(t, links.LinkExists(testNetwork))
+			assert.Equal(t, "192.168.10.1/24", links.addrs[testNetwork].String())
+			assert.True(t, firewall.Exists("nat", "POSTROUTING", "-s", "192.168.10.1/24", "!", "-o", testNetwork, "-j", "MASQUERADE"))
+			assert.Len(t, allocations, 1)
+			assert.Equal(t, "192.168.10.1", allocations[0].IP.String())
+
+			// 网络记录持久化之后可以被其他进程加载
+			networkMapping = make(map[string]*Network)
+			network, ok := lookupNetwork(testNetwork)
+			assert.True(t, ok)
+			assert.Equal(t, "bridge", network.Driver)
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	cases := []struct {
+		name        string
+		network     string
+		portMapping string
+		prepare     func(links *fakeLinkManager, firewall *fakeFirewall)
+		wantErr     bool
+	}{
+		{name: "with port mapping", network: testNetwork, portMapping: "8080:80,8443:443"},
+		{name: "without port mapping", network: testNetwork},
+		{name: "unknown network", network: "br-missing", wantErr: true},
+		{
+			name: "veth failed", network: testNetwork, wantErr: true,
+			prepare: func(links *fakeLinkManager, firewall *fakeFirewall) {
+				links.failOn["AddVeth"] = errors.New("file exists")
+			},
+		},
+		{
+			name: "setup peer failed", network: testNetwork, wantErr: true,
+			prepare: func(links *fakeLinkManager, firewall *fakeFirewall) {
+				links.failOn["SetupPeer"] = errors.New("no such process")
+			},
+		},
+		{name: "invalid port mapping", network: testNetwork, portMapping: "8080:80,8443", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			links, firewall := useFakeNetwork(t)
+			assert.Nil(t, CreateNetwork(testNetwork, "bridge", testSubnet))
+			if c.prepare != nil {
+				c.prepare(links, firewall)
+			}
+			containerInfo := newContainerRecord(t, "abcdef123456")
+			containerInfo.PortMapping = c.portMapping
+
+			err := Connect(c.network, c.portMapping, containerInfo)
+			endpoint := &EndPoint{ID: containerInfo.Id + "-" + c.network}
+			endpoint.VethName = vethName(endpoint)
+			veth, peer := endpoint.VethName, peerName(endpoint)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				// 已经完成的步骤全部撤销: veth、端口映射、ip以及容器记录中的网络
+				assert.False(t, links.LinkExists(veth))
+				assert.Empty(t, containerInfo.Networks)
+				assert.Len(t, firewall.rules["nat"], 1)
+				allocations, _ := ListIPAllocations()
+				for _, allocation := range allocations {
+					assert.NotEqual(t, "192.168.10.2", allocation.IP.String())
+				}
+				endPoints, _ := ListEndpoints(testNetwork)
+				assert.Empty(t, endPoints)
+				return
+			}
+
+			assert.Nil(t, err)
+			settings := containerInfo.NetworkSettings(testNetwork)
+			assert.Equal(t, "192.168.10.2", settings.IPAddress)
+			assert.Equal(t, "02:42:ac:11:00:02", settings.MacAddress)
+			assert.Equal(t, "eth0", settings.Interface)
+			assert.True(t, links.LinkExists(veth))
+			assert.Equal(t, "4242", links.peers[peer])
+			assert.Equal(t, "eth0", links.interfaces[peer])
+			assert.Equal(t, "192.168.10.2/24", links.addrs[peer].String())
+			assert.Equal(t, "192.168.10.1", links.routes[peer].String())
+
+			bindings := ListPortBindings(containerInfo)
+			assert.Len(t, bindings, len(splitPortMapping(c.portMapping)))
+			for _, binding := range bindings {
+				assert.True(t, binding.Active)
+			}
+
+			record, err := container.GetSpecificContainers(containerInfo.Id)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"192.168.10.2"}, record.IPAddresses())
+
+			// endpoint记录持久化，不影响网络列表
+			endPoints, err := ListEndpoints(testNetwork)
+			assert.Nil(t, err)
+			assert.Len(t, endPoints, 1)
+			assert.Equal(t, containerInfo.Id, endPoints[0].ContainerId)
+			assert.Equal(t, veth, endPoints[0].VethName)
+			assert.Equal(t, "192.168.10.2", endPoints[0].IPAddress.String())
+			assert.Equal(t, splitPortMapping(c.portMapping), endPoints[0].PortMapping)
+			networks, err := ListAllNetwork()
+			assert.Nil(t, err)
+			assert.Len(t, networks, 1)
+
+			// 断开之后veth、端口映射以及ip全部释放，再次接入时复用同一个ip
+			assert.Nil(t, Disconnect(testNetwork, containerInfo))
+			assert.False(t, links.LinkExists(veth))
+			assert.Len(t, firewall.rules["nat"], 1)
+			assert.False(t, settings.Connected())
+			assert.Equal(t, "", settings.IPAddress)
+			endPoints, _ = ListEndpoints(testNetwork)
+			assert.Empty(t, endPoints)
+			assert.Nil(t, Connect(c.network, c.portMapping, containerInfo))
+			assert.Len(t, containerInfo.Networks, 1)
+			assert.Equal(t, "192.168.10.2", settings.IPAddress)
+		})
+	}
+}
+
+func TestConnectAll(t *testing.T) {
+	cases := []struct {
+		name     string
+		networks []string
+		prepare  func(links *fakeLinkManager)
+		wantErr  bool
+	}{
+		{name: "single network", networks: []string{testNetwork}},
+		{name: "multiple networks", networks: []string{testNetwork, "br-backend"}},
+		{
+			name: "second network failed", networks: []string{testNetwork, "br-backend"}, wantErr: true,
+			prepare: func(links *fakeLinkManager) {
+				// 第二个网络的网桥不存在
+				links.DeleteLink("br-backend")
+			},
+		},
+		{name: "unknown network", networks: []string{testNetwork, "br-missing"}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			links, firewall := useFakeNetwork(t)
+			assert.Nil(t, CreateNetwork(testNetwork, "bridge", testSubnet))
+			assert.Nil(t, CreateNetwork("br-backend", "bridge", "192.168.20.0/24"))
+			if c.prepare != nil {
+				c.prepare(links)
+			}
+			containerInfo := newContainerRecord(t, "abcdef123456", c.networks...)
+			containerInfo.PortMapping = "8080:80"
+
+			err := ConnectAll(containerInfo)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				// 已经接入的网络全部断开，容器记录中的网络保留
+				assert.Len(t, containerInfo.Networks, len(c.networks))
+				assert.Empty(t, connectedNetworks(containerInfo))
+				assert.Empty(t, links.peers)
+				assert.Len(t, firewall.rules["nat"], 2)
+				return
+			}
+
+			assert.Nil(t, err)
+			for i, networkName := range c.networks {
+				settings := containerInfo.NetworkSettings(networkName)
+				assert.Equal(t, fmt.Sprintf("eth%d", i), settings.Interface)
+				endpoint, _ := loadEndpoint(networkName, settings.EndpointId)
+				assert.Equal(t, settings.IPAddress, endpoint.IPAddress.String())
+
+				// 只有第一个网络添加默认路由以及端口映射
+				_, hasRoute := links.routes[peerName(endpoint)]
+				assert.Equal(t, i == 0, hasRoute)
+				assert.Equal(t, i == 0, len(endpoint.PortMapping) > 0)
+			}
+			assert.Equal(t, "192.168.10.2", ListPortBindings(containerInfo)[0].ContainerIP)
+
+			// 运行中接入新的网络使用下一个网卡名称，断开之后网卡名称可以复用
+			assert.Nil(t, CreateNetwork("br-extra", "bridge", "192.168.30.0/24"))
+			assert.Nil(t, Connect("br-extra", "", containerInfo))
+			assert.Equal(t, fmt.Sprintf("eth%d", len(c.networks)), containerInfo.NetworkSettings("br-extra").Interface)
+			assert.NotNil(t, Connect("br-extra", "", containerInfo))
+			assert.Nil(t, Disconnect(testNetwork, containerInfo))
+			assert.Nil(t, Disconnect("br-extra", containerInfo))
+			assert.Nil(t, Connect("br-extra", "", containerInfo))
+			assert.Equal(t, "eth0", containerInfo.NetworkSettings("br-extra").Interface)
+
+			assert.Nil(t, ReleaseContainer(containerInfo))
+			assert.Empty(t, links.peers)
+			assert.Len(t, firewall.rules["nat"], 3)
+			record, _ := container.GetSpecificContainers(containerInfo.Id)
+			assert.Empty(t, record.IPAddresses())
+			assert.Len(t, record.Networks, len(c.networks)+1)
+		})
+	}
+}
+
+func TestConnect_Hosts(t *testing.T) {
+	useFakeNetwork(t)
+	assert.Nil(t, CreateNetwork(testNetwork, "bridge", testSubnet))
+
+	newContainer := func(id string, pid string, name string, aliases ...string) *container.ContainerInfo {
+		containerInfo := newContainerRecord(t, id)
+		containerInfo.Pid, containerInfo.ContainerName = pid, name
+		containerInfo.Networks = []*container.EndpointSettings{{NetworkName: testNetwork, Aliases: aliases}}
+		writeContainerRecord(t, containerInfo)
+		assert.Nil(t, os.MkdirAll(path.Join(fmt.Sprintf(container.GhnDockerMountPoint, id), "etc"), 0755))
+		return containerInfo
+	}
+	readHosts := func(id string) string {
+		content, err := os.ReadFile(path.Join(fmt.Sprintf(container.GhnDockerMountPoint, id), "etc/hosts"))
+		assert.Nil(t, err)
+		return string(content)
+	}
+	const localhost = "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"
+
+	db := newContainer("aaaaaaaaaaaa", "4242", "demo_db_1", "db")
+	web := newContainer("bbbbbbbbbbbb", "4243", "demo_web_1", "web", "www")
+	assert.Nil(t, Connect(testNetwork, "", db))
+	assert.Nil(t, Connect(testNetwork, "", web))
+
+	// 后接入的容器同样会写入先接入的容器的/etc/hosts
+	want := localhost + "192.168.10.2\tdemo_db_1 db\n192.168.10.3\tdemo_web_1 web www\n"
+	assert.Equal(t, want, readHosts(db.Id))
+	assert.Equal(t, want, readHosts(web.Id))
+
+	assert.Nil(t, Disconnect(testNetwork, db))
+	assert.Equal(t, localhost+"192.168.10.3\tdemo_web_1 web www\n", readHosts(web.Id))
+	assert.Equal(t, localhost, readHosts(db.Id))
+}
+
+func TestDeleteNetwork(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    container.ContainerStatus
+		connected bool
+		released  bool
+		wantErr   bool
+	}{
+		{name: "no containers"},
+		{name: "running container", status: container.ContainerStatus_Running, wantErr: true},
+		{name: "stopped container", status: container.ContainerStatus_Stop},
+		{name: "exited container with endpoint", status: container.ContainerStatus_Exit, connected: true, wantErr: true},
+		{name: "exited container released", status: container.ContainerStatus_Exit, connected: true, released: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			links, firewall := useFakeNetwork(t)
+			assert.Nil(t, CreateNetwork(testNetwork, "bridge", testSubnet))
+			if c.status != "" {
+				containerInfo := newContainerRecord(t, "abcdef123456", testNetwork)
+				if c.connected {
+					assert.Nil(t, Connect(testNetwork, "", containerInfo))
+				}
+				containerInfo.Status = c.status
+				writeContainerRecord(t, containerInfo)
+				if c.released {
+					assert.Nil(t, ReleaseContainer(containerInfo))
+					record, _ := container.GetSpecificContainers(containerInfo.Id)
+					assert.False(t, record.NetworkSettings(testNetwork).Connected())
+				}
+			}
+
+			err := DeleteNetwork(testNetwork)
+			_, statErr := os.Stat(path.Join(defaultNetworkPath, testNetwork))
+			if c.wantErr {
+				assert.NotNil(t, err)
+				assert.True(t, links.LinkExists(testNetwork))
+				assert.Nil(t, statErr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.False(t, links.LinkExists(testNetwork))
+			assert.Empty(t, firewall.rules["nat"])
+			assert.True(t, os.IsNotExist(statErr))
+			_, ok := lookupNetwork(testNetwork)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestListNatRules(t *testing.T) {
+	_, firewall := useFakeNetwork(t)
+	_, subnet, _ := net.ParseCIDR(testSubnet)
+	ip := net.ParseIP("192.168.10.2")
+	firewall.Append("nat", "POSTROUTING", masqueradeRule(&Network{NetworkName: testNetwork, IPRange: subnet})...)
+	firewall.Append("nat", "POSTROUTING", "-s", "172.17.0.0/16", "-j", "ACCEPT")
+	rule, _ := portMappingRule(&EndPoint{IPAddress: &ip}, "8080:80")
+	firewall.Append("nat", "PREROUTING", rule...)
+
+	rules, err := ListNatRules()
+	assert.Nil(t, err)
+	assert.Len(t, rules, 2)
+	assert.Equal(t, testNetwork, rules[0].Option("-o"))
+	assert.Equal(t, "192.168.10.2:80", rules[1].Option("--to-destination"))
+
+	assert.Nil(t, DeleteNatRule(rules[1]))
+	assert.Len(t, firewall.rules["nat"], 2)
+}
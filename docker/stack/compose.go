@@ -0,0 +1,284 @@
+package stack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/common-tools-haonan/docker/api"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/ghndocker"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// healthPollInterval 等待依赖服务健康时的轮询周期
+const healthPollInterval = 500 * time.Millisecond
+
+// Up 创建stack的网络，按照依赖顺序启动服务，启动服务之前等待其依赖的服务健康(未配置健康检查时为运行中)
+// 已经运行的容器保持不变，已经退出的容器删除后重建，超出scale的副本被删除
+func Up(client *ghndocker.Client, stack *Stack, timeout time.Duration, w io.Writer) error {
+	if err := createNetworks(client, stack, w); err != nil {
+		return err
+	}
+
+	existing, err := projectContainers(client, stack.Name)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*container.ContainerInfo, len(existing))
+	for _, containerInfo := range existing {
+		byName[containerInfo.ContainerName] = containerInfo
+	}
+
+	order, err := stack.ServiceOrder()
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		service := stack.Services[name]
+		for _, dependency := range service.DependsOn {
+			fmt.Fprintf(w, "Waiting for service %s\n", dependency)
+			if err = waitService(client, stack, dependency, timeout); err != nil {
+				return fmt.Errorf("service:%s depends on %s, err:%s", name, dependency, err)
+			}
+		}
+
+		for n := 1; n <= service.replicas(); n++ {
+			containerName := stack.ContainerName(name, n)
+			if containerInfo, ok := byName[containerName]; ok {
+				if containerInfo.Status == container.ContainerStatus_Running || containerInfo.Status == container.ContainerStatus_Paused {
+					fmt.Fprintf(w, "Container %s is up-to-date\n", containerName)
+					continue
+				}
+				fmt.Fprintf(w, "Recreating %s\n", containerName)
+				if err = client.Remove(containerInfo.Id, true); err != nil {
+					return err
+				}
+			}
+
+			options, err := stack.runOptions(name, n)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "Starting %s\n", containerName)
+			if _, err = client.Run(options); err != nil {
+				return fmt.Errorf("start %s failed, err:%s", containerName, err)
+			}
+		}
+	}
+
+	// 缩容以及已经从stack文件中删除的服务
+	for _, containerInfo := range existing {
+		service, ok := stack.Services[containerInfo.Labels[Label_Service]]
+		n, _ := strconv.Atoi(containerInfo.Labels[Label_Number])
+		if ok && n <= service.replicas() {
+			continue
+		}
+		fmt.Fprintf(w, "Removing %s\n", containerInfo.ContainerName)
+		if err = client.Remove(containerInfo.Id, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createNetworks(client *ghndocker.Client, stack *Stack, w io.Writer) error {
+	networks, err := client.NetworkList()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(networks))
+	for _, nw := range networks {
+		existing[nw.Name] = true
+	}
+
+	names := make([]string, 0, len(stack.Networks))
+	for name := range stack.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fullName := stack.NetworkName(name)
+		if existing[fullName] {
+			continue
+		}
+		driver := stack.Networks[name].Driver
+		if driver == "" {
+			driver = "bridge"
+		}
+		fmt.Fprintf(w, "Creating network %s\n", fullName)
+		if err = client.NetworkCreate(&api.NetworkCreateRequest{Name: fullName, Driver: driver, Subnet: stack.Networks[name].Subnet}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitService 等待服务的所有副本健康，配置了健康检查时需要healthy，否则只需要运行中
+func waitService(client *ghndocker.Client, stack *Stack, service string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for n := 1; n <= stack.Services[service].replicas(); n++ {
+		containerName := stack.ContainerName(service, n)
+		for {
+			inspect, err := client.Inspect(containerName)
+			if err != nil {
+				return err
+			}
+
+			if inspect.Status != container.ContainerStatus_Running {
+				return fmt.Errorf("container:%s is %s", containerName, inspect.Status)
+			}
+			if inspect.HealthConfig == nil || (inspect.Health != nil && inspect.Health.Status == container.HealthStatus_Healthy) {
+				break
+			}
+			if inspect.Health != nil && inspect.Health.Status == container.HealthStatus_Unhealthy {
+				return fmt.Errorf("container:%s is unhealthy", containerName)
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timeout waiting for container:%s to become healthy", containerName)
+			}
+			time.Sleep(healthPollInterval)
+		}
+	}
+	return nil
+}
+
+// Down 停止并删除stack的所有容器，然后删除stack的网络
+func Down(client *ghndocker.Client, stack *Stack, w io.Writer) error {
+	containers, err := projectContainers(client, stack.Name)
+	if err != nil {
+		return err
+	}
+
+	// 按照启动顺序的逆序停止，依赖方先于被依赖方停止
+	order, err := stack.ServiceOrder()
+	if err != nil {
+		return err
+	}
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		rank[name] = i
+	}
+	sort.SliceStable(containers, func(i, j int) bool {
+		return rank[containers[i].Labels[Label_Service]] > rank[containers[j].Labels[Label_Service]]
+	})
+
+	for _, containerInfo := range containers {
+		if containerInfo.Status == container.ContainerStatus_Running || containerInfo.Status == container.ContainerStatus_Paused {
+			fmt.Fprintf(w, "Stopping %s\n", containerInfo.ContainerName)
+			if err = client.Stop(containerInfo.Id); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "Removing %s\n", containerInfo.ContainerName)
+		if err = client.Remove(containerInfo.Id, true); err != nil {
+			return err
+		}
+	}
+
+	networks, err := client.NetworkList()
+	if err != nil {
+		return err
+	}
+	for _, nw := range networks {
+		name := nw.Name
+		for stackNetwork := range stack.Networks {
+			if name != stack.NetworkName(stackNetwork) {
+				continue
+			}
+			fmt.Fprintf(w, "Removing network %s\n", name)
+			if err = client.NetworkRemove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Ps 输出stack所有容器的状态
+func Ps(client *ghndocker.Client, project string, w io.Writer) error {
+	containers, err := projectContainers(client, project)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 12, 1, 3, ' ', 0)
+	fmt.Fprint(tw, "NAME\tSERVICE\tSTATUS\tHEALTH\tIP\tPORTS\n")
+	for _, containerInfo := range containers {
+		health := "-"
+		if containerInfo.Health != nil {
+			health = string(containerInfo.Health.Status)
+		}
+		ip, ports := strings.Join(containerInfo.IPAddresses(), ","), containerInfo.PortMapping
+		if ip == "" {
+			ip = "-"
+		}
+		if ports == "" {
+			ports = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", containerInfo.ContainerName, containerInfo.Labels[Label_Service],
+			containerInfo.Status, health, ip, ports)
+	}
+	return tw.Flush()
+}
+
+// Logs 合并输出stack内容器的日志，每行以容器名称为前缀，services为空时输出所有服务
+func Logs(client *ghndocker.Client, project string, services []string, w io.Writer) error {
+	containers, err := projectContainers(client, project)
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool, len(services))
+	for _, service := range services {
+		selected[service] = true
+	}
+
+	width := 0
+	for _, containerInfo := range containers {
+		if len(containerInfo.ContainerName) > width {
+			width = len(containerInfo.ContainerName)
+		}
+	}
+
+	for _, containerInfo := range containers {
+		if len(selected) > 0 && !selected[containerInfo.Labels[Label_Service]] {
+			continue
+		}
+
+		var logs bytes.Buffer
+		if err = client.Logs(containerInfo.Id, &logs); err != nil {
+			return fmt.Errorf("read logs of %s failed, err:%s", containerInfo.ContainerName, err)
+		}
+		scanner := bufio.NewScanner(&logs)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			fmt.Fprintf(w, "%-*s | %s\n", width, containerInfo.ContainerName, scanner.Text())
+		}
+		if err = scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// projectContainers stack创建的所有容器，按照名称排序
+func projectContainers(client *ghndocker.Client, project string) ([]*container.ContainerInfo, error) {
+	containers, err := client.List(&container.ListOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {Label_Project + "=" + project}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].ContainerName < containers[j].ContainerName
+	})
+	return containers, nil
+}
@@ -0,0 +1,485 @@
+package stack
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup/subsystem"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/ghndocker"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// 容器标签，用于查找stack创建的容器
+	Label_Project = "ghndocker.stack.project"
+	Label_Service = "ghndocker.stack.service"
+	Label_Number  = "ghndocker.stack.number"
+
+	// maxBridgeNameLen 网桥名称即网络名称，受网络接口名称长度(IFNAMSIZ-1)限制
+	maxBridgeNameLen = 15
+)
+
+var projectNameFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Stack stack文件，格式参考docker compose:
+//
+//	name: demo
+//	services:
+//	  db:
+//	    image: redis
+//	    command: redis-server
+//	    healthcheck:
+//	      test: ["CMD-SHELL", "redis-cli ping"]
+//	      interval: 5s
+//	  web:
+//	    image: busybox
+//	    command: ["httpd", "-f"]
+//	    environment: {MODE: dev}
+//	    ports: ["8080:80"]
+//	    depends_on: [db]
+//	    restart: on-failure:3
+//	    networks: [front]
+//	networks:
+//	  front:
+//	    subnet: 10.20.0.0/24
+type Stack struct {
+	Name     string              `yaml:"name"`
+	Services map[string]*Service `yaml:"services"`
+	Networks map[string]*Network `yaml:"networks"`
+
+	// dir stack文件所在目录，相对路径的数据卷以此为基准
+	dir string
+}
+
+type Service struct {
+	Image       string            `yaml:"image"`
+	Command     stringOrList      `yaml:"command"`
+	Environment mappingOrList     `yaml:"environment"`
+	Volumes     []string          `yaml:"volumes"`
+	Ports       []string          `yaml:"ports"`
+	Labels      map[string]string `yaml:"labels"`
+	// Init 容器内运行tiny init
+	Init bool `yaml:"init"`
+	// ReadOnly 以只读方式挂载容器根文件系统
+	ReadOnly bool                   `yaml:"read_only"`
+	Ulimits  map[string]ulimitValue `yaml:"ulimits"`
+	Sysctls  mappingOrList          `yaml:"sysctls"`
+	// Secrets 与run --secret格式相同，secret需要事先通过secret create创建
+	Secrets []string `yaml:"secrets"`
+	// Scale 副本数量，默认为1
+	Scale     int          `yaml:"scale"`
+	Restart   string       `yaml:"restart"`
+	DependsOn dependsOn    `yaml:"depends_on"`
+	Networks  []string     `yaml:"networks"`
+	Health    *HealthCheck `yaml:"healthcheck"`
+	Resources `yaml:",inline"`
+}
+
+// Resources 资源限制，字段名称与compose一致
+type Resources struct {
+	MemLimit       string `yaml:"mem_limit"`
+	MemswapLimit   string `yaml:"memswap_limit"`
+	MemReservation string `yaml:"mem_reservation"`
+	Cpus           string `yaml:"cpus"`
+	CpuShares      string `yaml:"cpu_shares"`
+	Cpuset         string `yaml:"cpuset"`
+	PidsLimit      string `yaml:"pids_limit"`
+	OomKillDisable bool   `yaml:"oom_kill_disable"`
+}
+
+type HealthCheck struct {
+	// Test ["CMD-SHELL", "cmd"]、["CMD", "arg"...]、["NONE"] 或者直接写命令
+	Test        stringOrList `yaml:"test"`
+	Interval    string       `yaml:"interval"`
+	Timeout     string       `yaml:"timeout"`
+	Retries     int          `yaml:"retries"`
+	StartPeriod string       `yaml:"start_period"`
+	Disable     bool         `yaml:"disable"`
+}
+
+type Network struct {
+	// Driver 默认为bridge
+	Driver string `yaml:"driver"`
+	Subnet string `yaml:"subnet"`
+}
+
+// stringOrList 可以写成字符串或者字符串列表
+type stringOrList []string
+
+func (value *stringOrList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*value = strings.Fields(node.Value)
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*value = list
+	return nil
+}
+
+// mappingOrList 可以写成 KEY=VALUE 列表或者映射
+type mappingOrList []string
+
+func (value *mappingOrList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*value = list
+		return nil
+	}
+
+	var mapping map[string]string
+	if err := node.Decode(&mapping); err != nil {
+		return err
+	}
+	list := make([]string, 0, len(mapping))
+	for k, v := range mapping {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	*value = list
+	return nil
+}
+
+// ulimitValue 可以写成单个数值(soft与hard相同)，或者 {soft: 1024, hard: 2048}
+type ulimitValue struct {
+	Soft string `yaml:"soft"`
+	Hard string `yaml:"hard"`
+}
+
+func (value *ulimitValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		value.Soft, value.Hard = node.Value, node.Value
+		return nil
+	}
+	type plain ulimitValue
+	return node.Decode((*plain)(value))
+}
+
+// dependsOn 可以写成服务列表，或者compose长格式 {db: {condition: service_healthy}}，启动时都会等待依赖健康
+type dependsOn []string
+
+func (value *dependsOn) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*value = list
+		return nil
+	}
+
+	list := make([]string, 0, len(node.Content)/2)
+	for i := 0; i < len(node.Content); i += 2 {
+		list = append(list, node.Content[i].Value)
+	}
+	sort.Strings(list)
+	*value = list
+	return nil
+}
+
+// Load 读取并校验stack文件，project为空时依次使用文件中的name以及文件所在目录名
+func Load(path string, project string) (*Stack, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read stack file failed, err:%s", err)
+	}
+
+	stack := &Stack{}
+	if err = yaml.Unmarshal(content, stack); err != nil {
+		return nil, fmt.Errorf("parse stack file:%s failed, err:%s", path, err)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	stack.dir = filepath.Dir(absPath)
+
+	switch {
+	case project != "":
+		stack.Name = project
+	case stack.Name == "":
+		stack.Name = filepath.Base(stack.dir)
+	}
+	stack.Name = strings.ToLower(stack.Name)
+
+	if err = stack.validate(); err != nil {
+		return nil, err
+	}
+	return stack, nil
+}
+
+func (stack *Stack) validate() error {
+	if !projectNameFormat.MatchString(stack.Name) {
+		return fmt.Errorf("invalid project name:%s, only [a-z0-9][a-z0-9_-] are allowed", stack.Name)
+	}
+	if len(stack.Services) == 0 {
+		return fmt.Errorf("no service defined in stack")
+	}
+
+	for name, nw := range stack.Networks {
+		if nw == nil || nw.Subnet == "" {
+			return fmt.Errorf("network:%s missing subnet", name)
+		}
+		if fullName := stack.NetworkName(name); len(fullName) > maxBridgeNameLen {
+			return fmt.Errorf("network name:%s is longer than %d characters, use a shorter project or network name", fullName, maxBridgeNameLen)
+		}
+	}
+
+	for name, service := range stack.Services {
+		if service == nil || service.Image == "" {
+			return fmt.Errorf("service:%s missing image", name)
+		}
+		if len(service.Command) == 0 {
+			return fmt.Errorf("service:%s missing command", name)
+		}
+		if service.Scale < 0 {
+			return fmt.Errorf("service:%s scale should not be negative", name)
+		}
+		if service.Scale > 1 && len(service.Ports) > 0 {
+			return fmt.Errorf("service:%s publishes ports and cannot be scaled", name)
+		}
+		// 容器只支持一个数据卷
+		if len(service.Volumes) > 1 {
+			return fmt.Errorf("service:%s declares %d volumes, only one is supported", name, len(service.Volumes))
+		}
+		joined := make(map[string]bool, len(service.Networks))
+		for _, nw := range service.Networks {
+			if _, ok := stack.Networks[nw]; !ok {
+				return fmt.Errorf("service:%s refers to undefined network:%s", name, nw)
+			}
+			if joined[nw] {
+				return fmt.Errorf("service:%s joins network:%s more than once", name, nw)
+			}
+			joined[nw] = true
+		}
+		for _, dependency := range service.DependsOn {
+			if _, ok := stack.Services[dependency]; !ok {
+				return fmt.Errorf("service:%s depends on undefined service:%s", name, dependency)
+			}
+		}
+		if _, err := container.ParseRestartPolicy(service.Restart); err != nil {
+			return fmt.Errorf("service:%s %s", name, err)
+		}
+		if _, err := service.healthConfig(); err != nil {
+			return fmt.Errorf("service:%s %s", name, err)
+		}
+	}
+
+	_, err := stack.ServiceOrder()
+	return err
+}
+
+// ServiceOrder 按照depends_on排序，被依赖的服务在前，同一层按照名称排序
+func (stack *Stack) ServiceOrder() ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	names := make([]string, 0, len(stack.Services))
+	for name := range stack.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	state := make(map[string]int)
+	order := make([]string, 0, len(names))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular dependency between services: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		dependencies := append([]string(nil), stack.Services[name].DependsOn...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// NetworkName stack内网络的实际名称
+func (stack *Stack) NetworkName(network string) string {
+	return stack.Name + "_" + network
+}
+
+// ContainerName 服务第n个副本的容器名称
+func (stack *Stack) ContainerName(service string, n int) string {
+	return fmt.Sprintf("%s_%s_%d", stack.Name, service, n)
+}
+
+func (service *Service) replicas() int {
+	if service.Scale == 0 {
+		return 1
+	}
+	return service.Scale
+}
+
+// runOptions 服务第n个副本的容器配置
+func (stack *Stack) runOptions(name string, n int) (*ghndocker.RunOptions, error) {
+	service := stack.Services[name]
+
+	labels := map[string]string{
+		Label_Project: stack.Name,
+		Label_Service: name,
+		Label_Number:  fmt.Sprint(n),
+	}
+	for k, v := range service.Labels {
+		labels[k] = v
+	}
+
+	options := &ghndocker.RunOptions{
+		Name:        stack.ContainerName(name, n),
+		Image:       service.Image,
+		Cmd:         service.Command,
+		Env:         service.Environment,
+		PortMapping: strings.Join(service.Ports, ","),
+		TinyInit:    service.Init,
+		ReadOnly:    service.ReadOnly,
+		Labels:      labels,
+		Resources: &subsystem.SubSystemConfig{
+			MemoryLimits:      service.MemLimit,
+			MemorySwap:        service.MemswapLimit,
+			MemoryReservation: service.MemReservation,
+			Cpus:              service.Cpus,
+			CpuShare:          service.CpuShares,
+			CpuSet:            service.Cpuset,
+			PidsLimit:         service.PidsLimit,
+			OomKillDisable:    service.OomKillDisable,
+		},
+	}
+
+	if len(service.Volumes) > 0 {
+		options.Volume = stack.volume(service.Volumes[0])
+	}
+	// 服务名称作为容器在每个网络中的别名
+	for _, serviceNetwork := range service.Networks {
+		options.Networks = append(options.Networks, stack.NetworkName(serviceNetwork))
+	}
+	if len(options.Networks) > 0 {
+		options.NetworkAliases = []string{name}
+	}
+
+	var err error
+	if options.RestartPolicy, err = container.ParseRestartPolicy(service.Restart); err != nil {
+		return nil, err
+	}
+	if options.HealthConfig, err = service.healthConfig(); err != nil {
+		return nil, err
+	}
+
+	ulimits := make([]string, 0, len(service.Ulimits))
+	for ulimitName, value := range service.Ulimits {
+		ulimits = append(ulimits, fmt.Sprintf("%s=%s:%s", ulimitName, value.Soft, value.Hard))
+	}
+	if options.Ulimits, err = container.ParseUlimits(ulimits); err != nil {
+		return nil, fmt.Errorf("service:%s, err:%s", name, err)
+	}
+	if options.Sysctls, err = container.ParseSysctls(service.Sysctls); err != nil {
+		return nil, fmt.Errorf("service:%s, err:%s", name, err)
+	}
+	for _, value := range service.Secrets {
+		secret, err := container.ParseSecretReference(value)
+		if err != nil {
+			return nil, fmt.Errorf("service:%s, err:%s", name, err)
+		}
+		options.Secrets = append(options.Secrets, secret)
+	}
+	return options, nil
+}
+
+// volume 宿主机路径为相对路径时相对于stack文件所在目录
+func (stack *Stack) volume(volume string) string {
+	hostPath, containerPath, found := strings.Cut(volume, ":")
+	if !found || filepath.IsAbs(hostPath) {
+		return volume
+	}
+	return filepath.Join(stack.dir, hostPath) + ":" + containerPath
+}
+
+// healthConfig 将compose的healthcheck转换为容器的健康检查配置，默认值与run命令一致
+func (service *Service) healthConfig() (*container.HealthConfig, error) {
+	health := service.Health
+	if health == nil || health.Disable || len(health.Test) == 0 {
+		return nil, nil
+	}
+
+	var cmd string
+	switch health.Test[0] {
+	case "NONE":
+		return nil, nil
+	case "CMD":
+		// 探测命令以一个字符串交给容器内的sh执行，包含空白的参数会被拆开，需要改用CMD-SHELL自行加引号
+		for _, arg := range health.Test[1:] {
+			if strings.IndexFunc(arg, unicode.IsSpace) >= 0 {
+				return nil, fmt.Errorf("healthcheck CMD argument:%q contains whitespace, use CMD-SHELL with quoting instead", arg)
+			}
+		}
+		cmd = strings.Join(health.Test[1:], " ")
+	case "CMD-SHELL":
+		cmd = strings.Join(health.Test[1:], " ")
+	default:
+		cmd = strings.Join(health.Test, " ")
+	}
+	if cmd == "" {
+		return nil, fmt.Errorf("healthcheck missing test command")
+	}
+
+	config := &container.HealthConfig{
+		Cmd:      cmd,
+		Interval: 30 * time.Second,
+		Timeout:  30 * time.Second,
+		Retries:  3,
+	}
+	durations := []struct {
+		value  string
+		target *time.Duration
+	}{
+		{health.Interval, &config.Interval},
+		{health.Timeout, &config.Timeout},
+		{health.StartPeriod, &config.StartPeriod},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid healthcheck duration:%s", duration.value)
+		}
+		*duration.target = parsed
+	}
+	if health.Retries > 0 {
+		config.Retries = health.Retries
+	}
+	return config, nil
+}
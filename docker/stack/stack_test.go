@@ -0,0 +1,155 @@
+package stack
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testStackFile = `
+name: Demo
+services:
+  db:
+    image: redis
+    command: redis-server
+    healthcheck:
+      test: ["CMD", "redis-cli", "ping"]
+  web:
+    image: busybox
+    command: ["httpd", "-f"]
+    volumes: ["./html:/www"]
+    depends_on:
+      db:
+        condition: service_healthy
+    networks: [front]
+networks:
+  front:
+    subnet: 10.20.0.0/24
+`
+
+func TestLoad(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		project  string
+		wantName string
+		wantErr  bool
+	}{
+		{name: "name from file", content: testStackFile, wantName: "demo"},
+		{name: "project overrides name", content: testStackFile, project: "Shop", wantName: "shop"},
+		{name: "name from dir", content: "services: {app: {image: busybox, command: top}}", wantName: "stack"},
+		{name: "invalid yaml", content: "services: [", wantErr: true},
+		{name: "invalid project", content: testStackFile, project: "-demo", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "stack")
+			assert.Nil(t, os.MkdirAll(dir, 0755))
+			path := filepath.Join(dir, "stack.yaml")
+			assert.Nil(t, os.WriteFile(path, []byte(c.content), 0644))
+
+			stack, err := Load(path, c.project)
+			if c.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.wantName, stack.Name)
+			assert.Equal(t, dir, stack.dir)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := Load(filepath.Join(t.TempDir(), "stack.yaml"), "")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestStack_Validate(t *testing.T) {
+	newStack := func(modify func(stack *Stack)) *Stack {
+		stack := &Stack{
+			Name: "demo",
+			Services: map[string]*Service{
+				"db":  {Image: "redis", Command: stringOrList{"redis-server"}},
+				"web": {Image: "busybox", Command: stringOrList{"httpd"}, DependsOn: dependsOn{"db"}, Networks: []string{"front"}},
+			},
+			Networks: map[string]*Network{"front": {Subnet: "10.20.0.0/24"}},
+		}
+		if modify != nil {
+			modify(stack)
+		}
+		return stack
+	}
+
+	cases := []struct {
+		name  string
+		stack *Stack
+		valid bool
+	}{
+		{name: "valid", stack: newStack(nil), valid: true},
+		{name: "no service", stack: newStack(func(stack *Stack) { stack.Services = nil })},
+		{name: "missing image", stack: newStack(func(stack *Stack) { stack.Services["db"].Image = "" })},
+		{name: "missing command", stack: newStack(func(stack *Stack) { stack.Services["db"].Command = nil })},
+		{name: "missing subnet", stack: newStack(func(stack *Stack) { stack.Networks["front"].Subnet = "" })},
+		{name: "network name too long", stack: newStack(func(stack *Stack) { stack.Name = "averylongproject" })},
+		{name: "undefined network", stack: newStack(func(stack *Stack) { stack.Services["db"].Networks = []string{"back"} })},
+		{name: "duplicate network", stack: newStack(func(stack *Stack) { stack.Services["web"].Networks = []string{"front", "front"} })},
+		{name: "undefined dependency", stack: newStack(func(stack *Stack) { stack.Services["web"].DependsOn = dependsOn{"cache"} })},
+		{name: "scaled with ports", stack: newStack(func(stack *Stack) {
+			stack.Services["web"].Scale, stack.Services["web"].Ports = 2, []string{"8080:80"}
+		})},
+		{name: "multiple volumes", stack: newStack(func(stack *Stack) { stack.Services["web"].Volumes = []string{"/a:/a", "/b:/b"} })},
+		{name: "invalid restart", stack: newStack(func(stack *Stack) { stack.Services["web"].Restart = "sometimes" })},
+		{name: "unsupported restart", stack: newStack(func(stack *Stack) { stack.Services["web"].Restart = "unless-stopped" })},
+		{name: "healthcheck CMD", stack: newStack(func(stack *Stack) {
+			stack.Services["db"].Health = &HealthCheck{Test: stringOrList{"CMD", "redis-cli", "ping"}}
+		}), valid: true},
+		{name: "healthcheck CMD with whitespace", stack: newStack(func(stack *Stack) {
+			stack.Services["db"].Health = &HealthCheck{Test: stringOrList{"CMD", "sh", "-c", "redis-cli ping"}}
+		})},
+		{name: "healthcheck CMD-SHELL", stack: newStack(func(stack *Stack) {
+			stack.Services["db"].Health = &HealthCheck{Test: stringOrList{"CMD-SHELL", "redis-cli ping || exit 1"}}
+		}), valid: true},
+		{name: "dependency cycle", stack: newStack(func(stack *Stack) { stack.Services["db"].DependsOn = dependsOn{"web"} })},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.valid, c.stack.validate() == nil)
+		})
+	}
+}
+
+func TestStack_ServiceOrder(t *testing.T) {
+	cases := []struct {
+		name     string
+		services map[string]dependsOn
+		want     []string
+		wantErr  bool
+	}{
+		{name: "no dependency", services: map[string]dependsOn{"b": nil, "a": nil, "c": nil}, want: []string{"a", "b", "c"}},
+		{name: "chain", services: map[string]dependsOn{"web": {"api"}, "api": {"db"}, "db": nil}, want: []string{"db", "api", "web"}},
+		{name: "diamond", services: map[string]dependsOn{"web": {"cache", "db"}, "cache": {"db"}, "db": nil, "admin": nil}, want: []string{"admin", "db", "cache", "web"}},
+		{name: "cycle", services: map[string]dependsOn{"a": {"b"}, "b": {"c"}, "c": {"a"}}, wantErr: true},
+		{name: "self", services: map[string]dependsOn{"a": {"a"}}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stack := &Stack{Services: make(map[string]*Service)}
+			for name, dependencies := range c.services {
+				stack.Services[name] = &Service{DependsOn: dependencies}
+			}
+
+			order, err := stack.ServiceOrder()
+			if c.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.want, order)
+		})
+	}
+}
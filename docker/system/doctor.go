@@ -0,0 +1,371 @@
+package system
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/cgroup"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/network"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	IssueKind_Record   = "record"
+	IssueKind_Mount    = "mount"
+	IssueKind_Dir      = "dir"
+	IssueKind_Cgroup   = "cgroup"
+	IssueKind_Link     = "link"
+	IssueKind_Iptable  = "iptables"
+	IssueKind_Ipam     = "ipam"
+	IssueKind_Network  = "network"
+	IssueKind_Endpoint = "endpoint"
+)
+
+// Issue doctor检查出的一项状态不一致
+type Issue struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Detail string `json:"detail"`
+	// Fixable 是否可以通过 --fix 自动修复
+	Fixable bool `json:"fixable"`
+	Fixed   bool `json:"fixed"`
+	// FixError 修复失败的原因
+	FixError string `json:"fix_error,omitempty"`
+
+	fix func() error
+}
+
+// doctorState 检查过程中共享的宿主机状态快照
+type doctorState struct {
+	containers map[string]*container.ContainerInfo
+	// activeIps 运行中(包括暂停)的容器、仍有endpoint记录的容器以及网关使用的ip
+	activeIps map[string]bool
+	// alive 进程仍然存在的容器id
+	alive map[string]bool
+	// ownedLinks 进程仍然存在的容器在宿主机一端的veth设备
+	ownedLinks map[string]bool
+	networks   []*network.Network
+	issues     []*Issue
+}
+
+func (state *doctorState) report(kind string, target string, detail string, fix func() error) {
+	state.issues = append(state.issues, &Issue{
+		Kind:    kind,
+		Target:  target,
+		Detail:  detail,
+		Fixable: fix != nil,
+		fix:     fix,
+	})
+}
+
+// Doctor 将容器记录与宿主机上的进程、挂载点、cgroup、网络设备、iptables规则以及ipam记录进行交叉检查，
+// fix为true时修复可以自动修复的问题。检查期间不应当有其他ghndocker命令在创建或删除资源
+func Doctor(fix bool) ([]*Issue, error) {
+	containers, err := container.ListContainers(&container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	networks, err := network.ListAllNetwork()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &doctorState{
+		containers: make(map[string]*container.ContainerInfo),
+		activeIps:  make(map[string]bool),
+		alive:      make(map[string]bool),
+		ownedLinks: make(map[string]bool),
+		networks:   networks,
+		issues:     make([]*Issue, 0),
+	}
+	for _, containerInfo := range containers {
+		state.containers[containerInfo.Id] = containerInfo
+	}
+
+	checks := []func(state *doctorState) error{
+		checkProcesses,
+		checkMounts,
+		checkDirs,
+		checkCgroups,
+		checkEndpoints,
+		checkLinks,
+		checkNatRules,
+		checkIpam,
+	}
+	for _, check := range checks {
+		if err = check(state); err != nil {
+			return state.issues, err
+		}
+	}
+
+	if fix {
+		for _, issue := range state.issues {
+			if issue.fix == nil {
+				continue
+			}
+			if err := issue.fix(); err != nil {
+				issue.FixError = err.Error()
+				continue
+			}
+			issue.Fixed = true
+		}
+	}
+	return state.issues, nil
+}
+
+// checkProcesses 记录为运行中的容器进程已经不存在时，将容器标记为EXIT
+func checkProcesses(state *doctorState) error {
+	for _, containerInfo := range state.containers {
+		if containerInfo.Status != container.ContainerStatus_Running && containerInfo.Status != container.ContainerStatus_Paused {
+			continue
+		}
+
+		pid, _ := strconv.Atoi(strings.TrimSpace(containerInfo.Pid))
+		if container.IsProcessAlive(pid) {
+			state.alive[containerInfo.Id] = true
+			for _, ip := range containerInfo.IPAddresses() {
+				state.activeIps[ip] = true
+			}
+			// 没有endpoint记录的旧版本容器，veth名称为容器id的前5位
+			if len(containerInfo.Id) >= 5 {
+				state.ownedLinks[containerInfo.Id[:5]] = true
+			}
+			continue
+		}
+
+		containerInfo := containerInfo
+		state.report(IssueKind_Record, containerInfo.Id, fmt.Sprintf("status is %s but pid:%d is not alive", containerInfo.Status, pid), func() error {
+			// 退出码已经无法获取，与容器正常退出一样释放ip、veth以及端口映射
+			if err := container.MarkContainerExited(containerInfo.Id, -1); err != nil {
+				return err
+			}
+			exited, err := container.GetSpecificContainers(containerInfo.Id)
+			if err != nil {
+				return err
+			}
+			return network.ReleaseContainer(exited)
+		})
+	}
+
+	for _, nw := range state.networks {
+		state.activeIps[nw.IPRange.IP.String()] = true
+	}
+	return nil
+}
+
+// checkMounts 没有容器记录的挂载点需要卸载；运行中容器的根文件系统未挂载只报告
+func checkMounts(state *doctorState) error {
+	mountPoints, err := containerMountPoints()
+	if err != nil {
+		return err
+	}
+
+	mounted := make(map[string]bool)
+	for _, mountPoint := range mountPoints {
+		mounted[mountPoint] = true
+		containerId := containerMountFormat.FindStringSubmatch(mountPoint)[1]
+		if _, ok := state.containers[containerId]; ok {
+			continue
+		}
+
+		mountPoint := mountPoint
+		state.report(IssueKind_Mount, mountPoint, "mounted but no container record", func() error {
+			return unmount(mountPoint)
+		})
+	}
+
+	for _, containerInfo := range state.containers {
+		rootfs := fmt.Sprintf(container.GhnDockerMountPoint, containerInfo.Id)
+		if containerInfo.Status == container.ContainerStatus_Running && !mounted[rootfs] {
+			state.report(IssueKind_Mount, rootfs, "rootfs of running container is not mounted", nil)
+		}
+	}
+	return nil
+}
+
+// checkDirs 没有容器记录的容器可写层、work目录、快照以及可写层的容量镜像
+func checkDirs(state *doctorState) error {
+	images, err := ioutil.ReadDir(container.GhnDockerQuotaRootDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, image := range images {
+		containerId := strings.TrimSuffix(image.Name(), ".img")
+		if _, ok := state.containers[containerId]; ok || image.IsDir() || containerId == image.Name() {
+			continue
+		}
+
+		// 先于可写层目录修复: 可写层目录上挂载着容量镜像时无法删除
+		state.report(IssueKind_Dir, container.GhnDockerQuotaRootDir+image.Name(), "no container record", func() error {
+			return container.RemoveQuota(containerId, fmt.Sprintf(container.GhnDockerContainerDir, containerId))
+		})
+	}
+
+	for _, root := range []string{container.GhnDockerContainerRootDir, container.GhnDockerWorkRootDir, container.GhnDockerSnapshotRootDir} {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			if _, ok := state.containers[entry.Name()]; ok || !entry.IsDir() {
+				continue
+			}
+
+			dir := root + entry.Name()
+			state.report(IssueKind_Dir, dir, "no container record", func() error {
+				return os.RemoveAll(dir)
+			})
+		}
+	}
+	return nil
+}
+
+// checkCgroups 没有容器记录的容器cgroup
+func checkCgroups(state *doctorState) error {
+	for _, containerId := range cgroup.ListChildren(container.CGroupRootPath) {
+		if _, ok := state.containers[containerId]; ok {
+			continue
+		}
+
+		namespace := container.CGroupRootPath + "/" + containerId
+		state.report(IssueKind_Cgroup, namespace, "no container record", func() error {
+			return cgroup.RemoveTree(namespace)
+		})
+	}
+	return nil
+}
+
+// checkEndpoints 没有容器记录的endpoint记录，容器记录仍然存在的endpoint保留其ip以及端口映射，删除容器时释放
+func checkEndpoints(state *doctorState) error {
+	for _, nw := range state.networks {
+		endPoints, err := network.ListEndpoints(nw.NetworkName)
+		if err != nil {
+			return err
+		}
+
+		for _, endPoint := range endPoints {
+			if _, ok := state.containers[endPoint.ContainerId]; ok {
+				if state.alive[endPoint.ContainerId] {
+					state.ownedLinks[endPoint.VethName] = true
+				}
+				if endPoint.IPAddress != nil {
+					state.activeIps[endPoint.IPAddress.String()] = true
+				}
+				continue
+			}
+
+			endPoint := endPoint
+			state.report(IssueKind_Endpoint, endPoint.ID, fmt.Sprintf("endpoint in network:%s has no container record", nw.NetworkName), func() error {
+				return endPoint.Remove()
+			})
+		}
+	}
+	return nil
+}
+
+// checkLinks 网络记录对应的网桥，以及网桥上不属于运行中容器的veth设备
+func checkLinks(state *doctorState) error {
+	for _, nw := range state.networks {
+		if !network.LinkExists(nw.NetworkName) {
+			state.report(IssueKind_Network, nw.NetworkName, "bridge of network does not exist", nil)
+		}
+	}
+
+	links, err := network.ListEndpointLinks()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if state.ownedLinks[link] {
+			continue
+		}
+
+		link := link
+		state.report(IssueKind_Link, link, "veth does not belong to any running container", func() error {
+			// 已经在修复容器记录时随网络一起释放
+			if !network.LinkExists(link) {
+				return nil
+			}
+			return network.DeleteLink(link)
+		})
+	}
+	return nil
+}
+
+// checkNatRules 指向已经不存在的容器ip的端口映射，以及网络已经删除的MASQUERADE规则
+func checkNatRules(state *doctorState) error {
+	rules, err := network.ListNatRules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		rule := rule
+		switch rule.Chain {
+		case "PREROUTING":
+			destination, _, _ := strings.Cut(rule.Option("--to-destination"), ":")
+			if state.activeIps[destination] || !state.inNetworks(destination) {
+				continue
+			}
+			state.report(IssueKind_Iptable, rule.String(), "destination is not a running container", func() error {
+				return network.DeleteNatRule(rule)
+			})
+		case "POSTROUTING":
+			bridge := rule.Option("-o")
+			if bridge == "" || state.hasNetwork(bridge) || network.LinkExists(bridge) {
+				continue
+			}
+			state.report(IssueKind_Iptable, rule.String(), fmt.Sprintf("network:%s does not exist", bridge), func() error {
+				return network.DeleteNatRule(rule)
+			})
+		}
+	}
+	return nil
+}
+
+// checkIpam ipam中已分配但没有被网关或者运行中的容器使用的ip
+func checkIpam(state *doctorState) error {
+	allocations, err := network.ListIPAllocations()
+	if err != nil {
+		return err
+	}
+
+	for _, allocation := range allocations {
+		if state.activeIps[allocation.IP.String()] {
+			continue
+		}
+
+		allocation := allocation
+		state.report(IssueKind_Ipam, allocation.IP.String(), fmt.Sprintf("allocated in %s but not in use", allocation.Subnet), func() error {
+			return network.ReleaseIPAllocation(allocation)
+		})
+	}
+	return nil
+}
+
+func (state *doctorState) inNetworks(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, nw := range state.networks {
+		if parsed != nil && nw.IPRange.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *doctorState) hasNetwork(name string) bool {
+	for _, nw := range state.networks {
+		if nw.NetworkName == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package system
+
+import (
+	"fmt"
+	"github.com/common-tools-haonan/docker/container"
+	"github.com/common-tools-haonan/docker/network"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+var (
+	// containerMountFormat ghndocker创建的挂载点: /mnt/<容器id>[/数据卷路径]
+	containerMountFormat = regexp.MustCompile(`^/mnt/([0-9]{10})(/.*)?$`)
+)
+
+// PruneReport system prune 删除的资源
+type PruneReport struct {
+	Containers []string `json:"containers"`
+	// Volumes 已删除容器遗留的数据卷挂载点
+	Volumes  []string `json:"volumes"`
+	Networks []string `json:"networks"`
+	// Images 没有被任何容器使用、并且可以由镜像tar包重新解压的镜像目录
+	Images []string `json:"images"`
+}
+
+// Prune 删除已停止的容器、遗留的数据卷挂载、没有容器接入的网络以及没有被使用的镜像目录
+func Prune() (*PruneReport, error) {
+	report := &PruneReport{
+		Containers: make([]string, 0),
+		Volumes:    make([]string, 0),
+		Networks:   make([]string, 0),
+		Images:     make([]string, 0),
+	}
+
+	containers, err := container.ListContainers(&container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make([]*container.ContainerInfo, 0, len(containers))
+	for _, containerInfo := range containers {
+		if containerInfo.Status != container.ContainerStatus_Stop && containerInfo.Status != container.ContainerStatus_Exit {
+			remaining = append(remaining, containerInfo)
+			continue
+		}
+		// 已经退出的容器可能仍然占用ip以及端口映射
+		if err = network.ReleaseContainer(containerInfo); err != nil {
+			logrus.Errorf("[Prune] %s", err)
+			remaining = append(remaining, containerInfo)
+			continue
+		}
+		if err = container.RemoveContainer(containerInfo.Id, false); err != nil {
+			logrus.Errorf("[Prune] remove container:%s failed, err:%s", containerInfo.Id, err)
+			remaining = append(remaining, containerInfo)
+			continue
+		}
+		report.Containers = append(report.Containers, containerInfo.Id)
+	}
+
+	if report.Volumes, err = pruneVolumes(remaining); err != nil {
+		return nil, err
+	}
+	if report.Networks, err = pruneNetworks(remaining); err != nil {
+		return nil, err
+	}
+	if report.Images, err = pruneImages(remaining); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// pruneVolumes 卸载不属于任何容器的数据卷挂载点，容器根文件系统的挂载由doctor处理
+func pruneVolumes(containers []*container.ContainerInfo) ([]string, error) {
+	known := make(map[string]bool)
+	for _, containerInfo := range containers {
+		known[containerInfo.Id] = true
+	}
+
+	mountPoints, err := containerMountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := make([]string, 0)
+	for _, mountPoint := range mountPoints {
+		matched := containerMountFormat.FindStringSubmatch(mountPoint)
+		if matched[2] == "" || known[matched[1]] {
+			continue
+		}
+		if err = unmount(mountPoint); err != nil {
+			logrus.Errorf("[Prune] umount volume:%s failed, err:%s", mountPoint, err)
+			continue
+		}
+		pruned = append(pruned, mountPoint)
+	}
+	return pruned, nil
+}
+
+// pruneNetworks 删除没有任何容器记录引用的网络
+func pruneNetworks(containers []*container.ContainerInfo) ([]string, error) {
+	used := make(map[string]bool)
+	for _, containerInfo := range containers {
+		for _, networkName := range containerInfo.NetworkNames() {
+			used[networkName] = true
+		}
+	}
+
+	networks, err := network.ListAllNetwork()
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := make([]string, 0)
+	for _, nw := range networks {
+		if used[nw.NetworkName] {
+			continue
+		}
+		if err = network.DeleteNetwork(nw.NetworkName); err != nil {
+			logrus.Errorf("[Prune] delete network:%s failed, err:%s", nw.NetworkName, err)
+			continue
+		}
+		pruned = append(pruned, nw.NetworkName)
+	}
+	return pruned, nil
+}
+
+// pruneImages 删除没有被容器使用的镜像目录；只有镜像tar包仍然存在时才删除，下次使用时重新解压
+func pruneImages(containers []*container.ContainerInfo) ([]string, error) {
+	used := make(map[string]bool)
+	for _, containerInfo := range containers {
+		used[containerInfo.Image] = true
+	}
+
+	entries, err := ioutil.ReadDir(container.GhnDockerImageRootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]string, 0), nil
+		}
+		return nil, err
+	}
+
+	pruned := make([]string, 0)
+	for _, entry := range entries {
+		image := entry.Name()
+		if !entry.IsDir() || used[image] {
+			continue
+		}
+		if isExist, _ := container.PathExist(fmt.Sprintf(container.GhnDockerImageDir, image) + ".tar"); !isExist {
+			continue
+		}
+		if err = os.RemoveAll(fmt.Sprintf(container.GhnDockerImageDir, image)); err != nil {
+			logrus.Errorf("[Prune] remove image:%s failed, err:%s", image, err)
+			continue
+		}
+		pruned = append(pruned, image)
+	}
+	return pruned, nil
+}
+
+// containerMountPoints 宿主机上所有ghndocker创建的挂载点，按照路径由深到浅排序，便于依次卸载
+func containerMountPoints() ([]string, error) {
+	mounted, err := container.HostMountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoints := make([]string, 0)
+	for mountPoint := range mounted {
+		if containerMountFormat.MatchString(mountPoint) {
+			mountPoints = append(mountPoints, mountPoint)
+		}
+	}
+	sort.Slice(mountPoints, func(i, j int) bool {
+		if depth := strings.Count(mountPoints[i], "/") - strings.Count(mountPoints[j], "/"); depth != 0 {
+			return depth > 0
+		}
+		return mountPoints[i] < mountPoints[j]
+	})
+	return mountPoints, nil
+}
+
+// unmount lazy卸载挂载点并删除对应的目录
+func unmount(mountPoint string) error {
+	if err := syscall.Unmount(mountPoint, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// 容器根目录被卸载之后，挂载点所在的空目录一并删除
+	if parent := filepath.Dir(mountPoint); containerMountFormat.MatchString(parent) {
+		os.Remove(parent)
+	}
+	return nil
+}